@@ -16,10 +16,12 @@ package agent
 
 import (
 	"os"
+	"time"
 
 	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
 	"github.com/AdRoll/hologram/transport/local"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 type cliHandler struct {
@@ -67,24 +69,32 @@ func (h *cliHandler) HandleConnection(c protocol.MessageReadWriteCloser) {
 
 			SSHSetAgentSock(sshAgentSock, sshKeyBytes)
 
-			if dr.GetAssumeRole() != nil {
-				log.Debug("Handling AssumeRole request.")
+			if dr.GetReturnCredentials() && (dr.GetAssumeRole() != nil || dr.GetGetUserCredentials() != nil) {
+				log.Debug("Handling request for credentials to return.")
 				assumeRole := dr.GetAssumeRole()
 
-				err := h.client.AssumeRole(assumeRole.GetRole())
+				duration := time.Duration(assumeRole.GetDurationSeconds()) * time.Second
+				creds, err := h.client.FetchCredentials(assumeRole.GetRole(), duration)
 
-				var agentResponse protocol.AgentResponse
+				msg = &protocol.Message{
+					AgentResponse: h.respond(err),
+				}
 				if err == nil {
-					agentResponse.Success = &protocol.Success{}
-				} else {
-					log.Errorf(err.Error())
-					e := err.Error()
-					agentResponse.Failure = &protocol.Failure{
-						ErrorMessage: &e,
-					}
+					msg.AgentResponse.Success.Credentials = stsCredentials(creds)
+				}
+				err = c.Write(msg)
+				if err != nil {
+					return
 				}
+			} else if dr.GetAssumeRole() != nil {
+				log.Debug("Handling AssumeRole request.")
+				assumeRole := dr.GetAssumeRole()
+
+				duration := time.Duration(assumeRole.GetDurationSeconds()) * time.Second
+				err := h.client.AssumeRole(assumeRole.GetRole(), duration)
+
 				msg = &protocol.Message{
-					AgentResponse: &agentResponse,
+					AgentResponse: h.respond(err),
 				}
 				err = c.Write(msg)
 				if err != nil {
@@ -94,18 +104,26 @@ func (h *cliHandler) HandleConnection(c protocol.MessageReadWriteCloser) {
 				log.Debug("Handling GetSessionToken request.")
 				err := h.client.GetUserCredentials()
 
-				var agentResponse protocol.AgentResponse
-				if err == nil {
-					agentResponse.Success = &protocol.Success{}
-				} else {
-					log.Errorf(err.Error())
-					e := err.Error()
-					agentResponse.Failure = &protocol.Failure{
-						ErrorMessage: &e,
+				msg = &protocol.Message{
+					AgentResponse: h.respond(err),
+				}
+				err = c.Write(msg)
+				if err != nil {
+					return
+				}
+			} else if dr.GetListRoles() != nil {
+				log.Debug("Handling ListRoles request.")
+				roles, defaultRole, err := h.client.ListRoles()
+
+				agentResponse := h.respond(err)
+				if agentResponse.GetSuccess() != nil {
+					agentResponse.Success.Roles = &protocol.RoleList{
+						Roles:       roles,
+						DefaultRole: &defaultRole,
 					}
 				}
 				msg = &protocol.Message{
-					AgentResponse: &agentResponse,
+					AgentResponse: agentResponse,
 				}
 				err = c.Write(msg)
 				if err != nil {
@@ -123,3 +141,29 @@ func (h *cliHandler) HandleConnection(c protocol.MessageReadWriteCloser) {
 		}
 	}
 }
+
+/*
+respond reports the outcome of a request.
+*/
+func (h *cliHandler) respond(err error) *protocol.AgentResponse {
+	if err != nil {
+		log.Errorf(err.Error())
+		e := err.Error()
+		return &protocol.AgentResponse{
+			Failure: &protocol.Failure{
+				ErrorMessage: &e,
+			},
+		}
+	}
+	return &protocol.AgentResponse{Success: &protocol.Success{}}
+}
+
+func stsCredentials(creds *sts.Credentials) *protocol.STSCredentials {
+	expiration := creds.Expiration.Unix()
+	return &protocol.STSCredentials{
+		AccessKeyId:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		AccessToken:     creds.SessionToken,
+		Expiration:      &expiration,
+	}
+}
@@ -17,17 +17,23 @@ package agent
 import (
 	"io"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/hologram/protocol"
+	"github.com/aws/aws-sdk-go/service/sts"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 type dummyClient struct {
-	callCount int
+	callCount   int
+	assumed     bool
+	creds       *sts.Credentials
+	fetchedRole string
 }
 
-func (c *dummyClient) AssumeRole(role string) error {
+func (c *dummyClient) AssumeRole(role string, duration time.Duration) error {
 	c.callCount++
+	c.assumed = true
 	return nil
 }
 
@@ -36,6 +42,17 @@ func (c *dummyClient) GetUserCredentials() error {
 	return nil
 }
 
+func (c *dummyClient) FetchCredentials(role string, duration time.Duration) (*sts.Credentials, error) {
+	c.callCount++
+	c.fetchedRole = role
+	return c.creds, nil
+}
+
+func (c *dummyClient) ListRoles() ([]string, string, error) {
+	c.callCount++
+	return []string{"arn:aws:iam::123456789012:role/dev", "arn:aws:iam::123456789012:role/prod"}, "arn:aws:iam::123456789012:role/dev", nil
+}
+
 func TestCliHandler(t *testing.T) {
 	Convey("AssumeRole", t, func() {
 		ra := &dummyClient{}
@@ -61,6 +78,96 @@ func TestCliHandler(t *testing.T) {
 
 		So(ra.callCount, ShouldEqual, 1)
 	})
+
+	Convey("ListRoles", t, func() {
+		ra := &dummyClient{}
+		ch := NewCliHandler("", ra)
+
+		conn := testConnection(ch.HandleConnection)
+
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				ListRoles: &protocol.ListRoles{},
+			},
+		})
+
+		response, err := conn.Read()
+		So(err, ShouldBeNil)
+
+		roles := response.GetAgentResponse().GetSuccess().GetRoles()
+		So(roles, ShouldNotBeNil)
+		So(roles.GetRoles(), ShouldResemble, []string{"arn:aws:iam::123456789012:role/dev", "arn:aws:iam::123456789012:role/prod"})
+		So(roles.GetDefaultRole(), ShouldEqual, "arn:aws:iam::123456789012:role/dev")
+		So(ra.callCount, ShouldEqual, 1)
+	})
+
+	Convey("GetUserCredentials returning credentials", t, func() {
+		accessKey := "access_key"
+		secretKey := "secret"
+		token := "token"
+		expiration := time.Date(2014, 10, 22, 12, 21, 17, 00, time.UTC)
+		ra := &dummyClient{creds: &sts.Credentials{
+			AccessKeyId:     &accessKey,
+			SecretAccessKey: &secretKey,
+			SessionToken:    &token,
+			Expiration:      &expiration,
+		}}
+		ch := NewCliHandler("", ra)
+
+		conn := testConnection(ch.HandleConnection)
+
+		returnCredentials := true
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				GetUserCredentials: &protocol.GetUserCredentials{},
+				ReturnCredentials:  &returnCredentials,
+			},
+		})
+
+		response, err := conn.Read()
+		So(err, ShouldBeNil)
+
+		returned := response.GetAgentResponse().GetSuccess().GetCredentials()
+		So(returned, ShouldNotBeNil)
+		So(returned.GetAccessKeyId(), ShouldEqual, "access_key")
+		So(returned.GetSecretAccessKey(), ShouldEqual, "secret")
+		So(returned.GetAccessToken(), ShouldEqual, "token")
+		So(returned.GetExpiration(), ShouldEqual, expiration.Unix())
+	})
+
+	Convey("AssumeRole returning credentials", t, func() {
+		accessKey := "access_key"
+		secretKey := "secret"
+		token := "token"
+		expiration := time.Date(2014, 10, 22, 12, 21, 17, 00, time.UTC)
+		ra := &dummyClient{creds: &sts.Credentials{
+			AccessKeyId:     &accessKey,
+			SecretAccessKey: &secretKey,
+			SessionToken:    &token,
+			Expiration:      &expiration,
+		}}
+		ch := NewCliHandler("", ra)
+
+		conn := testConnection(ch.HandleConnection)
+
+		role := "prod"
+		returnCredentials := true
+		conn.Write(&protocol.Message{
+			AgentRequest: &protocol.AgentRequest{
+				AssumeRole:        &protocol.AssumeRole{Role: &role},
+				ReturnCredentials: &returnCredentials,
+			},
+		})
+
+		response, err := conn.Read()
+		So(err, ShouldBeNil)
+		So(response.GetAgentResponse().GetSuccess().GetCredentials().GetAccessKeyId(), ShouldEqual, "access_key")
+
+		Convey("It should not switch the agent's own credentials", func() {
+			So(ra.fetchedRole, ShouldEqual, "prod")
+			So(ra.assumed, ShouldBeFalse)
+		})
+	})
 }
 
 func testConnection(handler protocol.ConnectionHandlerFunc) protocol.MessageReadWriteCloser {
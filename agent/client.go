@@ -16,6 +16,7 @@
 package agent
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"strings"
@@ -31,23 +32,37 @@ import (
 	"github.com/aws/aws-sdk-go/service/sts"
 )
 
+/*
+CredentialsReceiver implementers hold the credentials a Client got, along
+with the role and session duration asked for, so they can be refreshed
+the same way.
+*/
 type CredentialsReceiver interface {
-	SetCredentials(*sts.Credentials, string)
+	SetCredentials(creds *sts.Credentials, role string, duration time.Duration)
 	SetClient(Client)
 }
 
+/*
+Client implementers get credentials for the workstation. A zero duration
+asks for the server's default session length. FetchCredentials gets
+credentials for role, or for the user if role is empty, and returns them
+without making them the workstation's credentials.
+*/
 type Client interface {
-	AssumeRole(role string) error
+	AssumeRole(role string, duration time.Duration) error
 	GetUserCredentials() error
+	ListRoles() (roles []string, defaultRole string, err error)
+	FetchCredentials(role string, duration time.Duration) (*sts.Credentials, error)
 }
 
 type client struct {
 	connectionString string
 	cr               CredentialsReceiver
+	tlsConfig        *tls.Config
 }
 
 type accessKeyClient struct {
-	credentialService server.CredentialService
+	credentialService server.DurationCredentialService
 	iamUsername       string
 	cr                CredentialsReceiver
 }
@@ -78,16 +93,13 @@ func AccessKeyClient(cr CredentialsReceiver, accountAliases *map[string]string)
 	return c
 }
 
-func (c *accessKeyClient) AssumeRole(role string) error {
-	user := server.User{
-		Username: c.iamUsername,
-	}
-	response, err := c.credentialService.AssumeRole(&user, role, false)
+func (c *accessKeyClient) AssumeRole(role string, duration time.Duration) error {
+	response, err := c.assumeRole(role, duration)
 
 	if err != nil {
 		return err
 	}
-	c.cr.SetCredentials(response, role)
+	c.cr.SetCredentials(response, role, duration)
 	return nil
 }
 
@@ -97,10 +109,32 @@ func (c *accessKeyClient) GetUserCredentials() error {
 	if err != nil {
 		return err
 	}
-	c.cr.SetCredentials(response, "")
+	c.cr.SetCredentials(response, "", 0)
 	return nil
 }
 
+func (c *accessKeyClient) FetchCredentials(role string, duration time.Duration) (*sts.Credentials, error) {
+	if role == "" {
+		return c.credentialService.GetSessionToken()
+	}
+	return c.assumeRole(role, duration)
+}
+
+func (c *accessKeyClient) assumeRole(role string, duration time.Duration) (*sts.Credentials, error) {
+	user := server.User{
+		Username: c.iamUsername,
+	}
+	return c.credentialService.AssumeRoleFor(&user, role, false, duration)
+}
+
+/*
+ListRoles is not possible without a Hologram server, which is what knows
+the roles users have been given.
+*/
+func (c *accessKeyClient) ListRoles() ([]string, string, error) {
+	return nil, "", errors.New("roles can only be listed by a hologram server")
+}
+
 func NewClient(connectionString string, cr CredentialsReceiver) *client {
 	c := &client{
 		connectionString: connectionString,
@@ -112,54 +146,170 @@ func NewClient(connectionString string, cr CredentialsReceiver) *client {
 	return c
 }
 
-func (c *client) AssumeRole(role string) error {
+/*
+UseTLS makes the client dial the server with tlsConfig, such as a mutual
+TLS configuration from remote.ClientTLSConfig, instead of the built-in
+certificate.
+*/
+func (c *client) UseTLS(tlsConfig *tls.Config) {
+	c.tlsConfig = tlsConfig
+}
+
+func assumeRoleRequest(role string, duration time.Duration) *protocol.ServerRequest {
 	req := &protocol.ServerRequest{
 		AssumeRole: &protocol.AssumeRole{
 			Role: &role,
 		},
 	}
+	if duration > 0 {
+		seconds := uint32(duration / time.Second)
+		req.AssumeRole.DurationSeconds = &seconds
+	}
+	return req
+}
+
+func getUserCredentialsRequest() *protocol.ServerRequest {
+	return &protocol.ServerRequest{
+		GetUserCredentials: &protocol.GetUserCredentials{},
+	}
+}
 
-	return c.requestCredentials(req, role)
+func (c *client) AssumeRole(role string, duration time.Duration) error {
+	return c.requestCredentials(assumeRoleRequest(role, duration), role, duration)
 }
 
 func (c *client) GetUserCredentials() error {
-	req := &protocol.ServerRequest{
-		GetUserCredentials: &protocol.GetUserCredentials{},
+	return c.requestCredentials(getUserCredentialsRequest(), "", 0)
+}
+
+func (c *client) FetchCredentials(role string, duration time.Duration) (*sts.Credentials, error) {
+	if role == "" {
+		return c.fetchCredentials(getUserCredentialsRequest())
+	}
+	return c.fetchCredentials(assumeRoleRequest(role, duration))
+}
+
+func (c *client) fetchCredentials(req *protocol.ServerRequest) (*sts.Credentials, error) {
+	response, err := c.authenticatedRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	credsResponse := response.GetCredentials()
+	if credsResponse == nil {
+		return nil, fmt.Errorf("unexpected message from server: %v", response)
 	}
 
-	return c.requestCredentials(req, "")
+	accessKeyId := credsResponse.GetAccessKeyId()
+	sessionToken := credsResponse.GetAccessToken()
+	secretAccessKey := credsResponse.GetSecretAccessKey()
+	expiration := time.Unix(credsResponse.GetExpiration(), 0)
+
+	return &sts.Credentials{
+		AccessKeyId:     &accessKeyId,
+		SessionToken:    &sessionToken,
+		SecretAccessKey: &secretAccessKey,
+		Expiration:      &expiration,
+	}, nil
+}
+
+/*
+ListRoles asks the server which roles the user may assume.
+*/
+func (c *client) ListRoles() ([]string, string, error) {
+	response, err := c.authenticatedRequest(&protocol.ServerRequest{
+		ListRoles: &protocol.ListRoles{},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if response.GetRoles() == nil {
+		return nil, "", fmt.Errorf("unexpected message from server: %v", response)
+	}
+	return response.GetRoles().GetRoles(), response.GetRoles().GetDefaultRole(), nil
 }
 
-func (c *client) requestCredentials(req *protocol.ServerRequest, role string) error {
-	conn, err := remote.NewClient(c.connectionString)
+func (c *client) requestCredentials(req *protocol.ServerRequest, role string, duration time.Duration) error {
+	creds, err := c.fetchCredentials(req)
 	if err != nil {
 		return err
 	}
+	c.cr.SetCredentials(creds, role, duration)
+	return nil
+}
+
+/*
+negotiate sends our Hello with a Ping and works out what the server speaks
+from its answer. Servers that predate negotiation answer without a Hello.
+*/
+func negotiate(conn protocol.MessageReadWriteCloser) (protocol.Negotiated, error) {
+	pingType := protocol.Ping_REQUEST
+	err := conn.Write(&protocol.Message{
+		Hello: protocol.NewHello(),
+		Ping:  &protocol.Ping{Type: &pingType},
+	})
+	if err != nil {
+		return protocol.Negotiated{}, err
+	}
+
+	msg, err := conn.Read()
+	if err != nil {
+		return protocol.Negotiated{}, err
+	}
+	if msg.GetPing() == nil {
+		return protocol.Negotiated{}, fmt.Errorf("unexpected message from server: %v", msg)
+	}
+	negotiated := protocol.Negotiate(msg.GetHello())
+	log.Info("Negotiated protocol version %d with the server.", negotiated.Version)
+	protocol.EnableCompression(conn, negotiated)
+	return negotiated, nil
+}
+
+/*
+authenticatedRequest sends req to the server, answers its SSH challenges
+with each of the user's keys in turn, and returns the response that
+follows.
+*/
+func (c *client) authenticatedRequest(req *protocol.ServerRequest) (*protocol.ServerResponse, error) {
+	conn, err := remote.NewClientWithTLS(c.connectionString, c.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	negotiated, err := negotiate(conn)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetListRoles() != nil && !negotiated.Supports(protocol.CapabilityListRoles) {
+		return nil, errors.New("the hologram server cannot list roles; it needs upgrading")
+	}
+	if req.GetAssumeRole().GetDurationSeconds() > 0 && !negotiated.Supports(protocol.CapabilitySessionDuration) {
+		log.Warning("The hologram server does not support session durations; using its default.")
+	}
 
 	msg := &protocol.Message{ServerRequest: req}
 
 	err = conn.Write(msg)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for skip := 0; ; {
 		msg, err = conn.Read()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if msg.GetServerResponse() != nil {
 			serverResponse := msg.GetServerResponse()
 			if serverResponse.GetChallenge() != nil {
 				challenge := serverResponse.GetChallenge().GetChallenge()
 
-				signature, err := SSHSign([]byte(challenge), skip)
+				signature, publicKey, err := SSHSignWithKey([]byte(challenge), skip)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				if signature == nil {
-					return errors.New("No keys worked")
+					return nil, errors.New("No keys worked")
 				}
 
 				msg = &protocol.Message{
@@ -167,39 +317,25 @@ func (c *client) requestCredentials(req *protocol.ServerRequest, role string) er
 						ChallengeResponse: &protocol.SSHChallengeResponse{
 							Signature: signature.Blob,
 							Format:    &signature.Format,
+							PublicKey: publicKey.Marshal(),
 						},
 					},
 				}
 
 				err = conn.Write(msg)
 				if err != nil {
-					return err
-				}
-			} else if serverResponse.GetCredentials() != nil {
-				credsResponse := serverResponse.GetCredentials()
-				accessKeyId := credsResponse.GetAccessKeyId()
-				sessionToken := credsResponse.GetAccessToken()
-				secretAccessKey := credsResponse.GetSecretAccessKey()
-				expiration := time.Unix(credsResponse.GetExpiration(), 0)
-
-				creds := &sts.Credentials{
-					AccessKeyId:     &accessKeyId,
-					SessionToken:    &sessionToken,
-					SecretAccessKey: &secretAccessKey,
-					Expiration:      &expiration,
+					return nil, err
 				}
-				c.cr.SetCredentials(creds, role)
-				return nil
 			} else if serverResponse.GetVerificationFailure() != nil {
 				// try the next key
 				skip++
 			} else {
-				return fmt.Errorf("unexpected message from server: %v", msg)
+				return serverResponse, nil
 			}
 		} else if msg.GetError() != "" {
-			return errors.New(msg.GetError())
+			return nil, errors.New(msg.GetError())
 		} else {
-			return fmt.Errorf("unexpected message from server: %v", msg)
+			return nil, fmt.Errorf("unexpected message from server: %v", msg)
 		}
 	}
 }
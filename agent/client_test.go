@@ -17,6 +17,7 @@ package agent
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/hologram/protocol"
 	"github.com/AdRoll/hologram/transport/remote"
@@ -34,7 +35,7 @@ type dummyCredentialsReceiver struct {
 	creds *sts.Credentials
 }
 
-func (r *dummyCredentialsReceiver) SetCredentials(creds *sts.Credentials, role string) {
+func (r *dummyCredentialsReceiver) SetCredentials(creds *sts.Credentials, role string, duration time.Duration) {
 	r.creds = creds
 }
 
@@ -59,7 +60,7 @@ func TestAssumeRole(t *testing.T) {
 			server.Close()
 		})
 
-		err = c.AssumeRole("test_role")
+		err = c.AssumeRole("test_role", 0)
 
 		So(err, ShouldBeNil)
 		So(credentialsReceiver.creds, ShouldNotBeNil)
@@ -73,7 +74,11 @@ func DummyServer(c protocol.MessageReadWriteCloser) {
 			return
 		}
 
-		if msg.GetServerRequest() != nil {
+		// Answer pings the way servers that predate negotiation do.
+		if msg.GetPing() != nil {
+			pingType := protocol.Ping_RESPONSE
+			err = c.Write(&protocol.Message{Ping: &protocol.Ping{Type: &pingType}})
+		} else if msg.GetServerRequest() != nil {
 			serverRequest := msg.GetServerRequest()
 
 			accessKey := "access"
@@ -0,0 +1,163 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultContainerCredentialsPath is where container credentials are served when no path is configured.
+const DefaultContainerCredentialsPath = "/credentials"
+
+/*
+ContainerCredentialsService serves credentials in the format of the ECS
+container credential provider, for SDKs configured through
+AWS_CONTAINER_CREDENTIALS_FULL_URI and AWS_CONTAINER_AUTHORIZATION_TOKEN.
+*/
+type ContainerCredentialsService interface {
+	Service
+	Port() int
+	URI() string
+	AuthorizationToken() string
+}
+
+type containerCredentialsService struct {
+	listener net.Listener
+	creds    CredentialsSource
+	path     string
+	token    string
+}
+
+func (ccs *containerCredentialsService) Start() error {
+	go ccs.listen()
+	return nil
+}
+
+func (ccs *containerCredentialsService) listen() {
+	handler := http.NewServeMux()
+	handler.HandleFunc(ccs.path, ccs.getCredentials)
+
+	err := http.Serve(ccs.listener, handler)
+
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "use of closed network connection") {
+			return
+		}
+		panic(err)
+	}
+}
+
+func (ccs *containerCredentialsService) Stop() error {
+	return ccs.listener.Close()
+}
+
+func (ccs *containerCredentialsService) Port() int {
+	return ccs.listener.Addr().(*net.TCPAddr).Port
+}
+
+/*
+URI is the value to export as AWS_CONTAINER_CREDENTIALS_FULL_URI. A
+listener bound to every address, which Go reports as [::] even for
+0.0.0.0, is reached through 127.0.0.1.
+*/
+func (ccs *containerCredentialsService) URI() string {
+	addr := ccs.listener.Addr().(*net.TCPAddr)
+	ip := addr.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)), ccs.path)
+}
+
+/*
+AuthorizationToken is the value to export as
+AWS_CONTAINER_AUTHORIZATION_TOKEN. Requests without it are refused.
+*/
+func (ccs *containerCredentialsService) AuthorizationToken() string {
+	return ccs.token
+}
+
+/*
+Returns credentials in the shape the ECS credential provider expects.
+*/
+func (ccs *containerCredentialsService) getCredentials(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(ccs.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	creds, err := ccs.creds.GetCredentials()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	resp := &containerCredentialsResponse{
+		AccessKeyId:     *creds.AccessKeyId,
+		SecretAccessKey: *creds.SecretAccessKey,
+		Token:           *creds.SessionToken,
+		Expiration:      creds.Expiration.UTC().Format(time.RFC3339),
+	}
+	respBody, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respBody)
+}
+
+/*
+NewContainerCredentialsService serves the credentials from creds at path
+on listener. An empty path uses DefaultContainerCredentialsPath. Clients
+must send a random token, generated here, in their Authorization header.
+*/
+func NewContainerCredentialsService(listener net.Listener, creds CredentialsSource, path string) (ContainerCredentialsService, error) {
+	if path == "" {
+		path = DefaultContainerCredentialsPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	return &containerCredentialsService{
+		listener: listener,
+		creds:    creds,
+		path:     path,
+		token:    base64.RawURLEncoding.EncodeToString(raw),
+	}, nil
+}
+
+/*
+Structure encoded as JSON for container credential clients.
+*/
+type containerCredentialsResponse struct {
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
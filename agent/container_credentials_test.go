@@ -0,0 +1,111 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContainerCredentialsService(t *testing.T) {
+	Convey("Given a container credentials server", t, func() {
+		testListener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		accessKey := "access_key"
+		secretKey := "secret"
+		token := "token"
+		expiration := time.Date(2014, 10, 22, 12, 21, 17, 00, time.UTC)
+		dummyCreds := &dummyCredentialsSource{creds: &sts.Credentials{
+			AccessKeyId:     &accessKey,
+			SecretAccessKey: &secretKey,
+			SessionToken:    &token,
+			Expiration:      &expiration,
+		}}
+
+		service, err := NewContainerCredentialsService(testListener, dummyCreds, "")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			service.Stop()
+		})
+
+		service.Start()
+
+		Convey("It should describe itself with a full URI", func() {
+			So(service.URI(), ShouldEqual, "http://"+testListener.Addr().String()+"/credentials")
+		})
+
+		get := func(token string) *http.Response {
+			request, err := http.NewRequest("GET", service.URI(), nil)
+			So(err, ShouldBeNil)
+			if token != "" {
+				request.Header.Set("Authorization", token)
+			}
+			response, err := http.DefaultClient.Do(request)
+			So(err, ShouldBeNil)
+			return response
+		}
+
+		Convey("It should refuse requests without its authorization token", func() {
+			So(service.AuthorizationToken(), ShouldNotBeEmpty)
+			So(get("").StatusCode, ShouldEqual, 401)
+			So(get("wrong").StatusCode, ShouldEqual, 401)
+		})
+
+		Convey("It should return credentials in the ECS format", func() {
+			response := get(service.AuthorizationToken())
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, 200)
+			body, _ := ioutil.ReadAll(response.Body)
+
+			var creds map[string]string
+			So(json.Unmarshal(body, &creds), ShouldBeNil)
+			So(creds, ShouldResemble, map[string]string{
+				"AccessKeyId":     "access_key",
+				"SecretAccessKey": "secret",
+				"Token":           "token",
+				"Expiration":      "2014-10-22T12:21:17Z",
+			})
+		})
+
+		Convey("It should return a 500 error if there are no credentials", func() {
+			dummyCreds.creds = nil
+			dummyCreds.err = errors.New("testing")
+			So(get(service.AuthorizationToken()).StatusCode, ShouldEqual, 500)
+		})
+	})
+
+	Convey("Given a container credentials server listening on every address", t, func() {
+		testListener, err := net.Listen("tcp", "0.0.0.0:0")
+		So(err, ShouldBeNil)
+		service, err := NewContainerCredentialsService(testListener, &dummyCredentialsSource{}, "/creds")
+		So(err, ShouldBeNil)
+		defer testListener.Close()
+
+		Convey("Its URI should point at loopback", func() {
+			So(service.URI(), ShouldEqual, fmt.Sprintf("http://127.0.0.1:%d/creds", service.Port()))
+		})
+	})
+}
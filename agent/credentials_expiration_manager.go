@@ -22,19 +22,21 @@ import (
 )
 
 type credentialsExpirationManager struct {
-	creds  *sts.Credentials
-	user   string
-	role   string
-	client Client
+	creds    *sts.Credentials
+	user     string
+	role     string
+	duration time.Duration
+	client   Client
 }
 
 func NewCredentialsExpirationManager() *credentialsExpirationManager {
 	return &credentialsExpirationManager{}
 }
 
-func (m *credentialsExpirationManager) SetCredentials(newCreds *sts.Credentials, role string) {
+func (m *credentialsExpirationManager) SetCredentials(newCreds *sts.Credentials, role string, duration time.Duration) {
 	m.creds = newCreds
 	m.role = role
+	m.duration = duration
 }
 
 func (m *credentialsExpirationManager) SetClient(client Client) {
@@ -61,7 +63,7 @@ func (m *credentialsExpirationManager) maybeRefreshCredentials() error {
 		if m.role != "" {
 			// and we used AssumeRole to generate the current creds
 			// then use AssumeRole to refresh 'em
-			return m.client.AssumeRole(m.role)
+			return m.client.AssumeRole(m.role, m.duration)
 		}
 		// go ahead and refresh our creds, just to be safe
 		return m.client.GetUserCredentials()
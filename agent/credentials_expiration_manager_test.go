@@ -27,7 +27,7 @@ type dummyClient2 struct {
 	getUserCredentialsCount int
 }
 
-func (d *dummyClient2) AssumeRole(role string) error {
+func (d *dummyClient2) AssumeRole(role string, duration time.Duration) error {
 	d.assumeRoleCount++
 	return nil
 }
@@ -37,6 +37,14 @@ func (d *dummyClient2) GetUserCredentials() error {
 	return nil
 }
 
+func (d *dummyClient2) FetchCredentials(role string, duration time.Duration) (*sts.Credentials, error) {
+	return nil, nil
+}
+
+func (d *dummyClient2) ListRoles() ([]string, string, error) {
+	return nil, "", nil
+}
+
 func TestCredentialsExpirationManager(t *testing.T) {
 	Convey("TestCredentialsExpirationManager", t, func() {
 		c := &dummyClient2{}
@@ -51,7 +59,7 @@ func TestCredentialsExpirationManager(t *testing.T) {
 				AccessKeyId: &key,
 				Expiration:  &currentExpiration,
 			}
-			credsManager.SetCredentials(&creds, "")
+			credsManager.SetCredentials(&creds, "", 0)
 
 			retrievedCreds, err := credsManager.GetCredentials()
 			So(err, ShouldBeNil)
@@ -63,7 +71,7 @@ func TestCredentialsExpirationManager(t *testing.T) {
 				AccessKeyId: &key,
 				Expiration:  &expiredExpiration,
 			}
-			credsManager.SetCredentials(&creds, "")
+			credsManager.SetCredentials(&creds, "", 0)
 
 			_, err := credsManager.GetCredentials()
 			So(err, ShouldBeNil)
@@ -75,7 +83,7 @@ func TestCredentialsExpirationManager(t *testing.T) {
 				AccessKeyId: &key,
 				Expiration:  &expiredExpiration,
 			}
-			credsManager.SetCredentials(&creds, "role")
+			credsManager.SetCredentials(&creds, "role", 0)
 
 			_, err := credsManager.GetCredentials()
 			So(err, ShouldBeNil)
@@ -32,6 +32,7 @@ port numbers for testing purposes.
 type MetadataService interface {
 	Service
 	Port() int
+	RequireTokens(required bool)
 }
 
 type CredentialsSource interface {
@@ -43,8 +44,10 @@ metadataService is the internal implementation of the public interface.
 It serves as a reference implementation of the EC2 HTTP API for workstations.
 */
 type metadataService struct {
-	listener net.Listener
-	creds    CredentialsSource
+	listener       net.Listener
+	creds          CredentialsSource
+	tokens         *metadataTokens
+	tokensRequired bool
 }
 
 func (mds *metadataService) Start() error {
@@ -58,6 +61,7 @@ Spawned in the background.
 */
 func (mds *metadataService) listen() {
 	handler := http.NewServeMux()
+	handler.HandleFunc(metadataTokenPath, mds.issueToken)
 	handler.HandleFunc("/latest", mds.getServices)
 	handler.HandleFunc("/latest/meta-data/iam/security-credentials/", mds.enumerateRoles)
 	handler.HandleFunc("/latest/meta-data/iam/security-credentials/hologram-access", mds.getCredentials)
@@ -65,7 +69,7 @@ func (mds *metadataService) listen() {
 	handler.HandleFunc("/latest/meta-data/placement/availability-zone", mds.getAvailabilityZone)
 	handler.HandleFunc("/latest/meta-data/public-hostname", mds.getPublicDNS)
 
-	err := http.Serve(mds.listener, handler)
+	err := http.Serve(mds.listener, mds.requireToken(handler))
 
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "use of closed network connection") {
@@ -91,6 +95,15 @@ func (mds *metadataService) Port() int {
 	return mds.listener.Addr().(*net.TCPAddr).Port
 }
 
+/*
+RequireTokens makes the service refuse requests without an IMDSv2 session
+token, as EC2 does when an instance's tokens are required. It must be
+called before Start.
+*/
+func (mds *metadataService) RequireTokens(required bool) {
+	mds.tokensRequired = required
+}
+
 /*
 Enumerates the available instance profiles on this fake instance.
 Seems like Amazon only supports one.
@@ -156,6 +169,7 @@ func NewMetadataService(listener net.Listener, creds CredentialsSource) (Metadat
 	return &metadataService{
 		listener: listener,
 		creds:    creds,
+		tokens:   newMetadataTokens(),
 	}, nil
 }
 
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"testing"
@@ -112,6 +113,67 @@ func TestMetadataService(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(response.StatusCode, ShouldEqual, 500)
 		})
+
+		Convey("It should issue IMDSv2 tokens honoring the requested TTL", func() {
+			response := tokenRequest(service.Port(), "60")
+			So(response.StatusCode, ShouldEqual, 200)
+			So(response.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"), ShouldEqual, "60")
+			token, _ := ioutil.ReadAll(response.Body)
+			So(token, ShouldNotBeEmpty)
+
+			response = tokenGet(service.Port(), "/latest/meta-data/instance-id", string(token))
+			So(response.StatusCode, ShouldEqual, 200)
+
+			Convey("And refuse the token once it has expired", func() {
+				service.(*metadataService).tokens.now = func() time.Time {
+					return time.Now().Add(time.Minute)
+				}
+				response := tokenGet(service.Port(), "/latest/meta-data/instance-id", string(token))
+				So(response.StatusCode, ShouldEqual, 401)
+			})
+		})
+
+		Convey("It should refuse token requests with a missing or excessive TTL", func() {
+			So(tokenRequest(service.Port(), "").StatusCode, ShouldEqual, 400)
+			So(tokenRequest(service.Port(), "21601").StatusCode, ShouldEqual, 400)
+		})
+
+		Convey("It should refuse requests carrying an unknown token", func() {
+			response := tokenGet(service.Port(), "/latest/meta-data/instance-id", "bogus")
+			So(response.StatusCode, ShouldEqual, 401)
+		})
+	})
+
+	Convey("Given a test server requiring IMDSv2 tokens", t, func() {
+		testListener, err := net.ListenTCP("tcp", &net.TCPAddr{
+			IP:   net.ParseIP("0.0.0.0"),
+			Port: 0,
+		})
+		So(err, ShouldBeNil)
+
+		service, err := NewMetadataService(testListener, &dummyCredentialsSource{})
+		So(err, ShouldBeNil)
+		service.RequireTokens(true)
+
+		Reset(func() {
+			service.Stop()
+		})
+
+		service.Start()
+
+		Convey("It should refuse requests without a token", func() {
+			response := tokenGet(service.Port(), "/latest/meta-data/instance-id", "")
+			So(response.StatusCode, ShouldEqual, 401)
+		})
+
+		Convey("It should serve requests with a token", func() {
+			response := tokenRequest(service.Port(), "21600")
+			So(response.StatusCode, ShouldEqual, 200)
+			token, _ := ioutil.ReadAll(response.Body)
+
+			response = tokenGet(service.Port(), "/latest/meta-data/instance-id", string(token))
+			So(response.StatusCode, ShouldEqual, 200)
+		})
 	})
 }
 
@@ -124,3 +186,27 @@ func request(port int, path string) []byte {
 	response.Body.Read(respBodyBytes)
 	return respBodyBytes
 }
+
+func tokenRequest(port int, ttl string) *http.Response {
+	url := fmt.Sprintf("http://localhost:%v/latest/api/token", port)
+	req, err := http.NewRequest("PUT", url, nil)
+	So(err, ShouldBeNil)
+	if ttl != "" {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", ttl)
+	}
+	response, err := http.DefaultClient.Do(req)
+	So(err, ShouldBeNil)
+	return response
+}
+
+func tokenGet(port int, path string, token string) *http.Response {
+	url := fmt.Sprintf("http://localhost:%v%v", port, path)
+	req, err := http.NewRequest("GET", url, nil)
+	So(err, ShouldBeNil)
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	response, err := http.DefaultClient.Do(req)
+	So(err, ShouldBeNil)
+	return response
+}
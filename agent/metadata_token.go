@@ -0,0 +1,150 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers and limits of the IMDSv2 session token protocol.
+const (
+	metadataTokenPath      = "/latest/api/token"
+	metadataTokenHeader    = "X-aws-ec2-metadata-token"
+	metadataTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	maxMetadataTokenTTL    = 6 * time.Hour
+)
+
+var errMetadataTokenTTL = errors.New("token TTL must be between 1 and 21600 seconds")
+
+/*
+metadataTokens remembers the IMDSv2 session tokens handed out by the
+metadata service until they expire.
+*/
+type metadataTokens struct {
+	sync.Mutex
+	expiries map[string]time.Time
+	now      func() time.Time
+}
+
+func newMetadataTokens() *metadataTokens {
+	return &metadataTokens{
+		expiries: map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+/*
+issue returns a new opaque token that stays valid for ttl.
+*/
+func (mt *metadataTokens) issue(ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	mt.Lock()
+	defer mt.Unlock()
+	now := mt.now()
+	for issued, expiry := range mt.expiries {
+		if !now.Before(expiry) {
+			delete(mt.expiries, issued)
+		}
+	}
+	mt.expiries[token] = now.Add(ttl)
+	return token, nil
+}
+
+/*
+valid reports whether token was issued by us and has not expired.
+*/
+func (mt *metadataTokens) valid(token string) bool {
+	mt.Lock()
+	defer mt.Unlock()
+	expiry, ok := mt.expiries[token]
+	return ok && mt.now().Before(expiry)
+}
+
+/*
+parseMetadataTokenTTL reads the TTL a client asks for, which EC2 requires
+and bounds at six hours.
+*/
+func parseMetadataTokenTTL(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errMetadataTokenTTL
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl < time.Second || ttl > maxMetadataTokenTTL {
+		return 0, errMetadataTokenTTL
+	}
+	return ttl, nil
+}
+
+/*
+issueToken serves PUT /latest/api/token. Like EC2, it refuses requests
+that went through a proxy, so that a misconfigured proxy on the
+workstation cannot be used to fetch tokens.
+*/
+func (mds *metadataService) issueToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		w.Header().Set("Allow", "PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("X-Forwarded-For") != "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	ttl, err := parseMetadataTokenTTL(r.Header.Get(metadataTokenTTLHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := mds.tokens.issue(ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(metadataTokenTTLHeader, strconv.Itoa(int(ttl/time.Second)))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+}
+
+/*
+requireToken checks the session token on a metadata request. A token that
+is present must be valid; a missing one is only refused when tokens are
+required, so IMDSv1 clients keep working by default.
+*/
+func (mds *metadataService) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != metadataTokenPath {
+			token := r.Header.Get(metadataTokenHeader)
+			if (token == "" && mds.tokensRequired) || (token != "" && !mds.tokens.valid(token)) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -49,48 +49,58 @@ func SSHSetAgentSock(socketAddressFromCli string, sshKeyFromCli []byte) {
 // SSHSign signs the provided challenge using a key from the ssh-agent keyring. The key is chosen by enumerating all
 // keys, then skipping the requested number of keys.
 func SSHSign(challenge []byte, skip int) (*ssh.Signature, error) {
+	sig, _, err := SSHSignWithKey(challenge, skip)
+	return sig, err
+}
+
+// SSHSignWithKey signs like SSHSign and also returns the public key it signed with, so that the server can go
+// straight to it.
+func SSHSignWithKey(challenge []byte, skip int) (*ssh.Signature, ssh.PublicKey, error) {
 	var signer ssh.Signer
 
 	if socketAddress == "" {
 		// Do not infinitely loop trying to use our provided SSH key.
 		if skip > 0 {
-			return nil, errSSHKey
+			return nil, nil, errSSHKey
 		}
 
 		log.Debug("Falling back on provided SSH key.")
 		if providedSSHKey == nil {
-			return nil, errSSHKey
+			return nil, nil, errSSHKey
 		}
 		signer = providedSSHKey
 	} else {
 		c, err := net.Dial("unix", socketAddress)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		agent := agent.NewClient(c)
 
 		keys, err := agent.List()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if len(keys) == 0 {
-			return nil, errNoKeys
+			return nil, nil, errNoKeys
 		}
 
 		if skip >= len(keys) {
 			// indicate that we've tried everything and exhausted the keyring
-			return nil, nil
+			return nil, nil, nil
 		}
 
 		signers, getSignersErr := agent.Signers()
 		if getSignersErr != nil {
-			return nil, getSignersErr
+			return nil, nil, getSignersErr
 		}
 
 		signer = signers[skip]
 	}
 
 	sig, err := signer.Sign(rand.Reader, challenge)
-	return sig, err
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, signer.PublicKey(), nil
 }
@@ -20,4 +20,18 @@ Config represents the top-level configuration values required by the application
 type Config struct {
 	Host           string            `json:"host"`
 	AccountAliases map[string]string `json:"accountAliases"`
+	// RequireIMDSv2 refuses metadata requests without a session token.
+	RequireIMDSv2 bool `json:"requireimdsv2"`
+	// ContainerListen, if set, is a loopback address to also serve
+	// credentials on in the ECS container format, at ContainerPath. The
+	// variables containers need are printed to stdout at startup.
+	ContainerListen string `json:"containerlisten"`
+	ContainerPath   string `json:"containerpath"`
+	// TLS, if Cert is set, connects to the server with mutual TLS.
+	TLS struct {
+		CA         string `json:"ca"`
+		Cert       string `json:"cert"`
+		Key        string `json:"key"`
+		ServerName string `json:"servername"`
+	} `json:"tls"`
 }
@@ -18,6 +18,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -26,6 +27,7 @@ import (
 
 	"github.com/AdRoll/hologram/agent"
 	"github.com/AdRoll/hologram/log"
+	"github.com/AdRoll/hologram/transport/remote"
 )
 
 var (
@@ -85,12 +87,40 @@ func main() {
 		log.Errorf("Could not create metadata service: %s", err.Error())
 		os.Exit(1)
 	}
+	mds.RequireTokens(config.RequireIMDSv2)
 	mds.Start()
 
+	if config.ContainerListen != "" {
+		containerListener, err := net.Listen("tcp", config.ContainerListen)
+		if err != nil {
+			log.Errorf("Could not start up the container credentials interface: %s", err.Error())
+			os.Exit(1)
+		}
+		containerCreds, err := agent.NewContainerCredentialsService(containerListener, credsManager, config.ContainerPath)
+		if err != nil {
+			log.Errorf("Could not create container credentials service: %s", err.Error())
+			os.Exit(1)
+		}
+		containerCreds.Start()
+		log.Info("Serving container credentials at %s.", containerCreds.URI())
+		// The token guards the credentials, so it goes to stdout only, never to the logs.
+		fmt.Printf("export AWS_CONTAINER_CREDENTIALS_FULL_URI=%s AWS_CONTAINER_AUTHORIZATION_TOKEN=%s\n",
+			containerCreds.URI(), containerCreds.AuthorizationToken())
+	}
+
 	// Create a hologram client that can be used by other services to talk to the server
 	var client (agent.Client)
 	if config.Host != "" {
-		client = agent.NewClient(config.Host, credsManager)
+		remoteClient := agent.NewClient(config.Host, credsManager)
+		if config.TLS.Cert != "" {
+			tlsConfig, err := remote.ClientTLSConfig(config.TLS.CA, config.TLS.Cert, config.TLS.Key, config.TLS.ServerName)
+			if err != nil {
+				log.Errorf("Could not load the TLS configuration: %s", err.Error())
+				os.Exit(1)
+			}
+			remoteClient.UseTLS(tlsConfig)
+		}
+		client = remoteClient
 	} else {
 		client = agent.AccessKeyClient(credsManager, &config.AccountAliases)
 	}
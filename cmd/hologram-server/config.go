@@ -20,23 +20,159 @@ type LDAP struct {
 		Password string `json:"password"`
 	} `json:"bind"`
 	UserAttr     string `json:"userattr"`
+	// UserAttrs, if set, are tried in order instead of UserAttr.
+	UserAttrs []string `json:"userattrs"`
 	sshAttr      string `json:"sshattr"`
 	BaseDN       string `json:"basedn"`
 	Host         string `json:"host"`
 	InsecureLDAP bool   `json:"insecureldap"`
+	// StartTLS upgrades a plaintext connection to Host before binding,
+	// checking the server's certificate against CAFile (or the system
+	// roots) and ServerName (or Host). CertFile and KeyFile are an
+	// optional client certificate.
+	StartTLS   bool   `json:"starttls"`
+	CAFile     string `json:"cafile"`
+	CertFile   string `json:"certfile"`
+	KeyFile    string `json:"keyfile"`
+	ServerName string `json:"servername"`
 	EnableLDAPRoles bool   `json:"enableldaproles"`
 	RoleAttribute   string `json:"roleattr"`
+	MemberUidGroups bool   `json:"memberuidgroups"`
 	DefaultRoleAttr string `json:"defaultroleattr"`
+	// DefaultRoleFrom orders the sources of default roles: "user", "group", "global".
+	DefaultRoleFrom   []string `json:"defaultrolefrom"`
+	DefaultRoleGroups []string `json:"defaultrolegroups"`
+	ApprovedCurves  []string `json:"approvedcurves"`
+	KeyTypes        []string `json:"keytypes"`
+	MinRSABits      int      `json:"minrsabits"`
+	KeyCreatedAttr  string   `json:"keycreatedattr"`
+	ReportRoleOnly  bool     `json:"reportroleonly"`
+	MaxCertLifetime int      `json:"maxcertlifetime"`
+	// TrustedCAs are authorized_keys lines of SSH CAs whose user certificates
+	// authenticate the users named by their principals.
+	TrustedCAs []string `json:"trustedcas"`
+	StrictEd25519   bool     `json:"stricted25519"`
+	FoldAttributes  bool     `json:"foldattributes"`
+	DecodeBinary    bool     `json:"decodebinary"`
+	ExclusiveRoles  []string `json:"exclusiveroles"`
+	BreakerFailures int      `json:"breakerfailures"`
+	BreakerCooldown int      `json:"breakercooldown"`
+	RealmSuffixes   []string `json:"realmsuffixes"`
+	RoleUsageLimit  int      `json:"roleusagelimit"`
+	KeyConflict     string   `json:"keyconflict"`
+	// Fingerprint is "sha256" (the default) or "md5" for legacy fingerprints.
+	Fingerprint       string `json:"fingerprint"`
+	StrictFingerprint bool   `json:"strictfingerprint"`
+	Canaries          []string `json:"canaries"`
+	DuplicateUsers    string   `json:"duplicateusers"`
+	PageSize          uint32   `json:"pagesize"`
+	DropKeyless       bool     `json:"dropkeyless"`
+	RemovedKeyGrace int      `json:"removedkeygrace"`
+	HoursAttr       string   `json:"hoursattr"`
+	SelfTest        bool     `json:"selftest"`
+	RecentEvents    int      `json:"recentevents"`
+	RefreshHistory  int      `json:"refreshhistory"`
+	GroupRefresh    int      `json:"grouprefresh"`
+	GroupNesting    int      `json:"groupnesting"`
+	MaxAge          int      `json:"maxage"`
+	MinRefresh      int      `json:"minrefresh"`
+	UpdateTimeout   int      `json:"updatetimeout"`
+	// MissRefreshRate, per second, and MissRefreshBurst bound the refreshes
+	// started by cache misses across all clients.
+	MissRefreshRate  float64 `json:"missrefreshrate"`
+	MissRefreshBurst int     `json:"missrefreshburst"`
+	FoldRoleNames   bool     `json:"foldrolenames"`
+	DedupeARNs      bool     `json:"dedupearns"`
+	TimezoneAttr    string   `json:"timezoneattr"`
+	AllowedAccounts []string `json:"allowedaccounts"`
+	StrictAccounts  bool     `json:"strictaccounts"`
+	// MaxSearches bounds concurrent searches against the directory; 0 means unbounded.
+	MaxSearches int `json:"maxsearches"`
+	SessionTagAttrs []string `json:"sessiontagattrs"`
+}
+
+// SQL configures loading users from a database instead of LDAP. No
+// database/sql driver is built in; Driver must name one linked into the
+// server by a custom build.
+type SQL struct {
+	Driver  string `json:"driver"`
+	DSN     string `json:"dsn"`
+	Query   string `json:"query"`
+	Timeout int    `json:"timeout"`
+	// WithLDAP keeps LDAP as the first user source and adds the database's
+	// users alongside it, instead of replacing it.
+	WithLDAP bool `json:"withldap"`
+}
+
+// Chaos injects faults into LDAP operations for resilience testing. Never enable it in production.
+type Chaos struct {
+	Enabled     bool    `json:"enabled"`
+	ErrorRate   float64 `json:"errorrate"`
+	Latency     int     `json:"latencyms"`
+	LatencyRate float64 `json:"latencyrate"`
+	Seed        int64   `json:"seed"`
 }
 
 type Config struct {
 	LDAP LDAP `json:"ldap"`
+	SQL  SQL  `json:"sql"`
+	// UsernameCase is "lower" or "upper" to normalize usernames in both
+	// LDAP and SQL caches; by default they are used as they are.
+	UsernameCase string `json:"usernamecase"`
+	Chaos Chaos `json:"chaos"`
 	AWS struct {
 		Account     string `json:"account"`
 		DefaultRole string `json:"defaultrole"`
+		// Partition qualifies bare role names, e.g. "aws-us-gov"; it defaults to "aws".
+		Partition string `json:"partition"`
+		// TrustPrincipal enables checking that granted roles trust this principal.
+		TrustPrincipal string `json:"trustprincipal"`
+		// MaxSessionDuration, in seconds, caps the role sessions agents may
+		// ask for; it should not exceed the roles' own MaxSessionDuration
+		// unless LookupDurations is set.
+		MaxSessionDuration int `json:"maxsessionduration"`
+		// LookupDurations reads each role's own MaxSessionDuration with
+		// iam:GetRole, so that MaxSessionDuration is only an upper bound.
+		LookupDurations bool `json:"lookupdurations"`
+		// ExternalIDs maps roles to the external IDs their trust policies require.
+		ExternalIDs map[string]string `json:"externalids"`
+		// RoleChain lists roles assumed in turn before the one users ask for.
+		RoleChain []string `json:"rolechain"`
 	} `json:"aws"`
 	Stats        string `json:"stats"`
+	// StatsFlush, in milliseconds, batches counters before sending them; 0 sends each at once.
+	StatsFlush   int    `json:"statsflush"`
+	// Prometheus, if set, is an address to serve metrics on at /metrics
+	// instead of sending them to statsd.
+	Prometheus string `json:"prometheus"`
+	// Health, if set, is an address to serve /healthz and /readyz on.
+	Health string `json:"health"`
 	Listen       string `json:"listen"`
+	// TLS, if Cert is set, replaces the built-in certificate and requires
+	// agents to present certificates signed by CA.
+	TLS struct {
+		CA   string `json:"ca"`
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+	} `json:"tls"`
 	CacheTimeout int    `json:"cachetimeout"`
+	// CredentialLimit caps credential requests per user per CredentialWindow seconds.
+	CredentialLimit  int `json:"credentiallimit"`
+	CredentialWindow int `json:"credentialwindow"`
+	// CredentialCache reuses AssumeRole credentials until they are within
+	// CredentialRefresh seconds (default 300) of expiring.
+	CredentialCache   bool `json:"credentialcache"`
+	CredentialRefresh int  `json:"credentialrefresh"`
+	// ChallengeSkew, in seconds, is how long SSH challenges stay valid (default 120).
+	ChallengeSkew int `json:"challengeskew"`
+	// AuthRate, per second, and AuthBurst limit authentication attempts
+	// from each client address; 0 leaves them unlimited.
+	AuthRate  float64 `json:"authrate"`
+	AuthBurst int     `json:"authburst"`
+	// ShutdownTimeout, in seconds, is how long requests in flight are given
+	// to finish when the server is stopped (default 30).
+	ShutdownTimeout int `json:"shutdowntimeout"`
+	// AuditLog, if set, is a file to append JSON audit records to.
+	AuditLog string `json:"auditlog"`
 	AccountAliases   map[string]string `json:"accountAliases`
 }
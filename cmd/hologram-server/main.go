@@ -16,11 +16,14 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -31,9 +34,11 @@ import (
 	"github.com/AdRoll/hologram/transport/remote"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/nmcclain/ldap"
 	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
 )
 
 func ConnectLDAP(conf LDAP) (*ldap.Conn, error) {
@@ -63,6 +68,165 @@ func ConnectLDAP(conf LDAP) (*ldap.Conn, error) {
 	return ldapServer, nil
 }
 
+/*
+connectStartTLS connects to LDAP in plaintext, upgrades the connection
+with StartTLS and binds. It never falls back to plaintext.
+*/
+func connectStartTLS(conf LDAP) (server.LDAPImplementation, error) {
+	tlsConfig, err := server.LDAPTLSConfig(conf.CAFile, conf.CertFile, conf.KeyFile, conf.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load LDAP TLS settings! %v", err)
+	}
+
+	log.Debug("Connecting to LDAP at server %s (using StartTLS).", conf.Host)
+	ldapServer, err := server.DialStartTLS(conf.Host, tlsConfig, conf.Bind.DN, conf.Bind.Password)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to LDAP with StartTLS! %v", err)
+	}
+	return ldapServer, nil
+}
+
+/*
+newLDAPCache connects to LDAP and loads the user cache from it.
+*/
+func newLDAPCache(config Config, stats g2s.Statter) (server.LDAPImplementation, server.UserCache, error) {
+	server.SetMaxConcurrentSearches(config.LDAP.MaxSearches)
+	open := func() (server.LDAPImplementation, error) {
+		if config.LDAP.StartTLS {
+			return connectStartTLS(config.LDAP)
+		}
+		return ConnectLDAP(config.LDAP)
+	}
+	ldapServer, err := server.NewReconnectingLDAP(open)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Chaos.Enabled {
+		ldapServer = server.NewChaosLDAP(ldapServer, server.ChaosConfig{
+			ErrorRate:   config.Chaos.ErrorRate,
+			Latency:     time.Duration(config.Chaos.Latency) * time.Millisecond,
+			LatencyRate: config.Chaos.LatencyRate,
+			Seed:        config.Chaos.Seed,
+		})
+	}
+
+	ldapOptions := server.Options{
+		UserAttr:        config.LDAP.UserAttr,
+		UserAttrs:       config.LDAP.UserAttrs,
+		SSHAttr:         config.LDAP.sshAttr,
+		BaseDN:          config.LDAP.BaseDN,
+		EnableLDAPRoles: config.LDAP.EnableLDAPRoles,
+		MemberUidGroups: config.LDAP.MemberUidGroups,
+		RoleAttribute:   config.LDAP.RoleAttribute,
+		DefaultRole:     config.AWS.DefaultRole,
+		DefaultRoleAttr: config.LDAP.DefaultRoleAttr,
+		ApprovedCurves:  config.LDAP.ApprovedCurves,
+		AllowedKeyTypes: config.LDAP.KeyTypes,
+		MinRSABits:      config.LDAP.MinRSABits,
+		KeyCreatedAttr:  config.LDAP.KeyCreatedAttr,
+
+		ReportRoleOnlyMembers:  config.LDAP.ReportRoleOnly,
+		MaxCertLifetime:        time.Duration(config.LDAP.MaxCertLifetime) * time.Second,
+		StrictEd25519:          config.LDAP.StrictEd25519,
+		FoldAttributeNames:     config.LDAP.FoldAttributes,
+		DecodeBinaryAttributes: config.LDAP.DecodeBinary,
+		ExclusiveRoles:         config.LDAP.ExclusiveRoles,
+
+		RefreshBreakerThreshold: config.LDAP.BreakerFailures,
+		RefreshBreakerCooldown:  time.Duration(config.LDAP.BreakerCooldown) * time.Second,
+		RealmSuffixes:           config.LDAP.RealmSuffixes,
+		UsernameCase:            config.UsernameCase,
+		RoleUsageLimit:          config.LDAP.RoleUsageLimit,
+		RemovedKeyGrace:         time.Duration(config.LDAP.RemovedKeyGrace) * time.Second,
+		AllowedHoursAttr:        config.LDAP.HoursAttr,
+		TimezoneAttr:            config.LDAP.TimezoneAttr,
+		SelfTest:                config.LDAP.SelfTest,
+		RecentEventsSize:        config.LDAP.RecentEvents,
+		RefreshHistorySize:      config.LDAP.RefreshHistory,
+		GroupRefreshInterval:    time.Duration(config.LDAP.GroupRefresh) * time.Second,
+		GroupNestingDepth:       config.LDAP.GroupNesting,
+		MaxAge:                  time.Duration(config.LDAP.MaxAge) * time.Second,
+		MinRefreshInterval:      time.Duration(config.LDAP.MinRefresh) * time.Second,
+		UpdateTimeout:           time.Duration(config.LDAP.UpdateTimeout) * time.Second,
+		MissRefreshRate:         config.LDAP.MissRefreshRate,
+		MissRefreshBurst:        config.LDAP.MissRefreshBurst,
+		DefaultRolePrecedence:   config.LDAP.DefaultRoleFrom,
+		DefaultRoleGroups:       config.LDAP.DefaultRoleGroups,
+		AllowedAccounts:         config.LDAP.AllowedAccounts,
+		StrictAccounts:          config.LDAP.StrictAccounts,
+		SessionTagAttrs:         config.LDAP.SessionTagAttrs,
+
+		CaseInsensitiveRoleNames: config.LDAP.FoldRoleNames,
+		DedupeARNsIgnoringCase:   config.LDAP.DedupeARNs,
+
+		FingerprintConflictPolicy:   config.LDAP.KeyConflict,
+		StrictFingerprintCollisions: config.LDAP.StrictFingerprint,
+		CanaryFingerprints:          config.LDAP.Canaries,
+		DuplicateUserPolicy:         config.LDAP.DuplicateUsers,
+		PageSize:                    config.LDAP.PageSize,
+		DropKeylessUsers:            config.LDAP.DropKeyless,
+	}
+	if config.LDAP.Fingerprint == "md5" {
+		ldapOptions.Fingerprint = server.FingerprintLegacyMD5
+	}
+	for _, line := range config.LDAP.TrustedCAs {
+		ca, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not parse trusted CA %q: %s", line, err.Error())
+		}
+		ldapOptions.TrustedUserCAs = append(ldapOptions.TrustedUserCAs, ca)
+	}
+	if config.AWS.TrustPrincipal != "" {
+		ldapOptions.TrustIAM = iam.New(session.New(&aws.Config{}))
+		ldapOptions.TrustAccount = config.AWS.Account
+		ldapOptions.TrustPrincipal = config.AWS.TrustPrincipal
+	}
+
+	ldapCache, err := server.NewLDAPUserCacheWithOptions(ldapServer, stats, ldapOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Top-level error in LDAPUserCache layer: %s", err.Error())
+	}
+	return ldapServer, ldapCache, nil
+}
+
+/*
+checkSQLDriver refuses an sql.driver that is not linked into this binary.
+None is linked by default, so the SQL backend needs a build that imports
+a database/sql driver.
+*/
+func checkSQLDriver(conf SQL) error {
+	if conf.Driver == "" {
+		return nil
+	}
+	for _, driver := range sql.Drivers() {
+		if driver == conf.Driver {
+			return nil
+		}
+	}
+	return fmt.Errorf("sql.driver %q is not built into this server (available: %q); rebuild it importing that database/sql driver, or remove the sql section to use LDAP", conf.Driver, sql.Drivers())
+}
+
+/*
+newSQLCache loads the user cache from a database. The driver must be
+linked into this binary.
+*/
+func newSQLCache(conf SQL, usernameCase string, stats g2s.Statter) (server.UserCache, error) {
+	db, err := sql.Open(conf.Driver, conf.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the user database: %v", err)
+	}
+	sqlCache, err := server.NewSQLUserCache(db, conf.Query, time.Duration(conf.Timeout)*time.Second, stats)
+	if err != nil {
+		return nil, fmt.Errorf("Top-level error in SQLUserCache layer: %s", err.Error())
+	}
+	if usernameCase != server.UsernameAsIs {
+		if err := sqlCache.NormalizeUsernames(usernameCase); err != nil {
+			return nil, fmt.Errorf("Top-level error in SQLUserCache layer: %s", err.Error())
+		}
+	}
+	return sqlCache, nil
+}
+
 func main() {
 	// Parse command-line flags for this system.
 	var (
@@ -104,6 +268,10 @@ func main() {
 		log.Errorf("Error in parsing config file: %s", configParseErr.Error())
 		os.Exit(1)
 	}
+	if err := checkSQLDriver(config.SQL); err != nil {
+		log.Errorf("Error in config file: %s", err.Error())
+		os.Exit(1)
+	}
 
 	// Merge in command flag options.
 	if *ldapAddress != "" {
@@ -165,7 +333,16 @@ func main() {
 		config.LDAP.sshAttr = "sshPublicKey"
 	}
 
-	if config.Stats == "" {
+	if config.Prometheus != "" {
+		prometheus := server.NewPrometheusStatter("hologram", nil)
+		metrics := http.NewServeMux()
+		metrics.Handle("/metrics", prometheus)
+		go func() {
+			log.Errorf("Prometheus metrics endpoint stopped: %s", http.ListenAndServe(config.Prometheus, metrics).Error())
+		}()
+		log.Debug("This program will serve metrics at http://%s/metrics", config.Prometheus)
+		stats = prometheus
+	} else if config.Stats == "" {
 		log.Debug("No statsd server specified; no metrics will be emitted by this program.")
 		stats = g2s.Noop()
 	} else {
@@ -177,28 +354,130 @@ func main() {
 			log.Debug("This program will emit metrics to %s", config.Stats)
 		}
 	}
+	if config.StatsFlush > 0 {
+		aggregated := server.NewAggregatingStatter(stats, time.Duration(config.StatsFlush)*time.Millisecond)
+		defer aggregated.Close()
+		stats = aggregated
+	}
 
 	// Setup the server state machine that responds to requests.
 	stsConnection := sts.New(session.New(&aws.Config{}))
 	credentialsService := server.NewDirectSessionTokenService(config.AWS.Account, stsConnection, &config.AccountAliases)
+	if config.AWS.Partition != "" {
+		credentialsService.UsePartition(config.AWS.Partition)
+	}
+	if len(config.AWS.RoleChain) > 0 {
+		if err := credentialsService.ChainThrough(config.AWS.RoleChain, nil, stats); err != nil {
+			log.Errorf("Fatal error, exiting: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if len(config.AWS.ExternalIDs) > 0 {
+		credentialsService.UseExternalIDs(config.AWS.ExternalIDs)
+	}
+	if config.AWS.MaxSessionDuration > 0 {
+		credentialsService.LimitSessionDuration(time.Duration(config.AWS.MaxSessionDuration) * time.Second)
+	}
+	if config.AWS.LookupDurations {
+		credentialsService.LookupRoleDurations(server.NewIAMRoleDurations(iam.New(session.New(&aws.Config{}))), 0, nil)
+	}
+	if config.CredentialCache {
+		refreshWindow := time.Duration(config.CredentialRefresh) * time.Second
+		credentialsService.CacheCredentials(refreshWindow, nil, stats)
+	}
 
-	open := func() (server.LDAPImplementation, error) { return ConnectLDAP(config.LDAP) }
-	ldapServer, err := server.NewPersistentLDAP(open)
+	var userCache server.UserCache
+	var ldapServer server.LDAPImplementation
+	var err error
+	if config.SQL.Driver != "" && config.SQL.WithLDAP {
+		var ldapCache, sqlCache server.UserCache
+		ldapServer, ldapCache, err = newLDAPCache(config, stats)
+		if err == nil {
+			sqlCache, err = newSQLCache(config.SQL, config.UsernameCase, stats)
+		}
+		userCache = server.NewMultiUserCache(stats,
+			server.UserSource{Name: "ldap", Cache: ldapCache},
+			server.UserSource{Name: "sql", Cache: sqlCache},
+		)
+	} else if config.SQL.Driver != "" {
+		userCache, err = newSQLCache(config.SQL, config.UsernameCase, stats)
+	} else {
+		ldapServer, userCache, err = newLDAPCache(config, stats)
+	}
 	if err != nil {
 		log.Errorf("Fatal error, exiting: %s", err.Error())
 		os.Exit(1)
 	}
+	if authorizer, ok := userCache.(server.RoleAuthorizer); ok {
+		credentialsService.AuthorizeRolesWith(authorizer)
+	}
 
-	ldapCache, err := server.NewLDAPUserCache(ldapServer, stats, config.LDAP.UserAttr, config.LDAP.sshAttr, config.LDAP.BaseDN,
-		config.LDAP.EnableLDAPRoles, config.LDAP.RoleAttribute, config.AWS.DefaultRole, config.LDAP.DefaultRoleAttr)
-	if err != nil {
-		log.Errorf("Top-level error in LDAPUserCache layer: %s", err.Error())
-		os.Exit(1)
+	// Reloads requested by signal or timer are bounded so that a wedged
+	// directory cannot wedge the signal handling goroutine.
+	updateTimeout := server.DefaultUpdateTimeout
+	if config.LDAP.UpdateTimeout > 0 {
+		updateTimeout = time.Duration(config.LDAP.UpdateTimeout) * time.Second
+	}
+	reloadUserCache := func() {
+		if err := server.UpdateWithTimeout(userCache, updateTimeout); err != nil {
+			log.Warning("Could not reload the user cache: %s", err.Error())
+		}
 	}
 
-	serverHandler := server.New(ldapCache, credentialsService, config.AWS.DefaultRole, stats, ldapServer,
+	// Reload the cache based on time set in configuration. Caches that can
+	// refresh themselves do so off the signal handling goroutine.
+	var cacheTimeoutTick <-chan time.Time
+	cacheInterval := time.Duration(config.CacheTimeout) * time.Second
+	if refresher, ok := userCache.(server.BackgroundRefresher); ok {
+		defer refresher.StartBackgroundRefresh(cacheInterval)()
+	} else {
+		cacheTimeoutTick = time.NewTicker(cacheInterval).C
+	}
+
+	serverHandler := server.New(userCache, credentialsService, config.AWS.DefaultRole, stats, ldapServer,
 		config.LDAP.UserAttr, config.LDAP.sshAttr, config.LDAP.BaseDN, config.LDAP.EnableLDAPRoles, config.LDAP.DefaultRoleAttr)
-	server, err := remote.NewServer(config.Listen, serverHandler.HandleConnection)
+	if config.CredentialLimit > 0 {
+		window := time.Duration(config.CredentialWindow) * time.Second
+		serverHandler.LimitCredentialRequests(server.NewCredentialRateLimiter(config.CredentialLimit, window, nil))
+	}
+	if config.AuditLog != "" {
+		auditLog, err := server.OpenAuditLog(config.AuditLog)
+		if err != nil {
+			log.Errorf("Could not open the audit log: %s", err.Error())
+			os.Exit(1)
+		}
+		serverHandler.AuditTo(auditLog)
+	}
+	if config.ChallengeSkew > 0 {
+		skew := time.Duration(config.ChallengeSkew) * time.Second
+		serverHandler.GuardChallenges(server.NewChallengeGuard(skew, 0, nil))
+	}
+	if config.AuthRate > 0 {
+		burst := config.AuthBurst
+		if burst < 1 {
+			burst = 1
+		}
+		serverHandler.LimitAuthentications(server.NewTokenBucketLimiter(config.AuthRate, burst, nil))
+	}
+	if config.Health != "" {
+		go func() {
+			log.Errorf("Health endpoint stopped: %s", http.ListenAndServe(config.Health, serverHandler.HealthHandler()).Error())
+		}()
+		log.Debug("This program will serve health checks at http://%s/healthz and /readyz", config.Health)
+	}
+	var tlsConfig *tls.Config
+	if config.TLS.Cert != "" {
+		tlsConfig, err = remote.ServerTLSConfig(config.TLS.CA, config.TLS.Cert, config.TLS.Key)
+		if err != nil {
+			log.Errorf("Could not load the TLS configuration: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	shutdownTimeout := server.DefaultShutdownTimeout
+	if config.ShutdownTimeout > 0 {
+		shutdownTimeout = time.Duration(config.ShutdownTimeout) * time.Second
+	}
+	server, err := remote.NewServerWithTLS(config.Listen, serverHandler.HandleConnection, tlsConfig)
 
 	// Wait for a signal from the OS to shutdown.
 	terminate := make(chan os.Signal, 1)
@@ -215,9 +494,6 @@ func main() {
 	reloadCacheSigHup := make(chan os.Signal, 1)
 	signal.Notify(reloadCacheSigHup, syscall.SIGHUP)
 
-	// Reload the cache based on time set in configuration
-	cacheTimeoutTicker := time.NewTicker(time.Duration(config.CacheTimeout) * time.Second)
-
 	log.Info("Hologram server is online, waiting for termination.")
 
 	// Handle termination
@@ -239,15 +515,19 @@ func main() {
 				log.DebugMode(false)
 			case <-reloadCacheSigHup:
 				log.Info("Force-reloading user cache.")
-				ldapCache.Update()
-			case <-cacheTimeoutTicker.C:
+				reloadUserCache()
+			case <-cacheTimeoutTick:
 				log.Info("Cache timeout. Reloading user cache.")
-				ldapCache.Update()
+				reloadUserCache()
 			}
 		}
 	}()
 
 	<-done
 	log.Info("Caught signal; shutting down now.")
+	// Stop taking connections, then let the requests in flight finish.
 	server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	serverHandler.Shutdown(ctx)
 }
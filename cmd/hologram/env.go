@@ -0,0 +1,79 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+/*
+env prints shell commands that export credentials, for eval $(hologram env).
+It takes an optional role and flags choosing the shell.
+*/
+func env(args []string) error {
+	flags := flag.NewFlagSet("env", flag.ExitOnError)
+	fish := flags.Bool("fish", false, "Print commands for the fish shell.")
+	powershell := flags.Bool("powershell", false, "Print commands for PowerShell.")
+	force := flags.Bool("force", false, "Print credentials even when writing to a terminal.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: hologram env [-fish|-powershell] [-force] [role]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *fish && *powershell {
+		return errors.New("choose at most one of -fish and -powershell")
+	}
+	if !*force && terminal.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("refusing to print credentials to a terminal; use eval $(hologram env), or -force")
+	}
+
+	creds, err := fetchCredentials(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	export := exportSh
+	if *fish {
+		export = exportFish
+	} else if *powershell {
+		export = exportPowerShell
+	}
+	fmt.Println(export("AWS_ACCESS_KEY_ID", creds.GetAccessKeyId()))
+	fmt.Println(export("AWS_SECRET_ACCESS_KEY", creds.GetSecretAccessKey()))
+	fmt.Println(export("AWS_SESSION_TOKEN", creds.GetAccessToken()))
+	fmt.Println(export("AWS_EXPIRATION", time.Unix(creds.GetExpiration(), 0).UTC().Format(time.RFC3339)))
+	return nil
+}
+
+func exportSh(name, value string) string {
+	return fmt.Sprintf("export %s='%s'", name, strings.Replace(value, "'", `'\''`, -1))
+}
+
+func exportFish(name, value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	return fmt.Sprintf("set -gx %s '%s';", name, strings.Replace(value, "'", `\'`, -1))
+}
+
+func exportPowerShell(name, value string) string {
+	return fmt.Sprintf("$Env:%s = '%s'", name, strings.Replace(value, "'", "''", -1))
+}
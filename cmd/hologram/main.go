@@ -16,10 +16,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
@@ -27,6 +29,8 @@ import (
 	"github.com/mitchellh/go-homedir"
 )
 
+var sessionDuration = flag.Duration("duration", 0, "How long role credentials should last, up to what the server allows (default: the server's default)")
+
 func main() {
 	flag.Parse()
 
@@ -40,16 +44,36 @@ func main() {
 	}
 
 	switch args[0] {
-	case "use":
+	case "use", "switch":
 		if len(args) < 2 {
-			fmt.Println("Usage: hologram use <role>")
+			fmt.Printf("Usage: hologram %s <role>\n", args[0])
 			os.Exit(1)
 		}
 		err = use(args[1])
 		break
+	case "roles":
+		err = roles()
+		break
 	case "me":
 		err = me()
 		break
+	case "credential-process":
+		role := ""
+		if len(args) > 1 {
+			role = args[1]
+		}
+		// stdout belongs to the AWS SDK here, so errors must not be logged to it.
+		if err := credentialProcess(role); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	case "env":
+		if err := env(args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
 	default:
 		fmt.Println("Usage: hologram use <role>")
 		os.Exit(1)
@@ -62,10 +86,15 @@ func main() {
 }
 
 func use(role string) error {
+	assumeRole := &protocol.AssumeRole{
+		Role: &role,
+	}
+	if *sessionDuration > 0 {
+		seconds := uint32(*sessionDuration / time.Second)
+		assumeRole.DurationSeconds = &seconds
+	}
 	response, err := request(&protocol.AgentRequest{
-		AssumeRole: &protocol.AssumeRole{
-			Role: &role,
-		},
+		AssumeRole: assumeRole,
 	})
 	if err != nil {
 		return err
@@ -105,6 +134,104 @@ func me() error {
 	return fmt.Errorf("Unexpected response type: %v", response)
 }
 
+/*
+credentialProcessOutput is the JSON an AWS credential_process prints.
+*/
+type credentialProcessOutput struct {
+	Version         int    `json:"Version"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+/*
+credentialProcess prints credentials for role, or for the user if role is
+empty, for use as a credential_process in ~/.aws/config. Unlike use, it
+leaves the agent's own credentials alone.
+*/
+func credentialProcess(role string) error {
+	creds, err := fetchCredentials(role)
+	if err != nil {
+		return err
+	}
+	output, err := json.Marshal(&credentialProcessOutput{
+		Version:         1,
+		AccessKeyId:     creds.GetAccessKeyId(),
+		SecretAccessKey: creds.GetSecretAccessKey(),
+		SessionToken:    creds.GetAccessToken(),
+		Expiration:      time.Unix(creds.GetExpiration(), 0).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+/*
+fetchCredentials has the agent get credentials for role, or for the user
+if role is empty, and hand them back without switching to them.
+*/
+func fetchCredentials(role string) (*protocol.STSCredentials, error) {
+	returnCredentials := true
+	req := &protocol.AgentRequest{ReturnCredentials: &returnCredentials}
+	if role != "" {
+		req.AssumeRole = &protocol.AssumeRole{Role: &role}
+		if *sessionDuration > 0 {
+			seconds := uint32(*sessionDuration / time.Second)
+			req.AssumeRole.DurationSeconds = &seconds
+		}
+	} else {
+		req.GetUserCredentials = &protocol.GetUserCredentials{}
+	}
+
+	response, err := request(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.GetFailure() != nil {
+		return nil, fmt.Errorf("Error from hologram: %s", response.GetFailure().GetErrorMessage())
+	}
+
+	creds := response.GetSuccess().GetCredentials()
+	if creds == nil {
+		return nil, fmt.Errorf("hologram-agent did not return credentials; it may need upgrading")
+	}
+	return creds, nil
+}
+
+/*
+roles prints the roles the user may switch to, marking their default.
+*/
+func roles() error {
+	response, err := request(&protocol.AgentRequest{
+		ListRoles: &protocol.ListRoles{},
+	})
+	if err != nil {
+		return err
+	}
+
+	if response.GetFailure() != nil {
+		return fmt.Errorf("Error from server: %s", response.GetFailure().GetErrorMessage())
+	}
+
+	roleList := response.GetSuccess().GetRoles()
+	if roleList == nil {
+		return fmt.Errorf("Unexpected response type: %v", response)
+	}
+	defaultRole := roleList.GetDefaultRole()
+	if defaultRole != "" {
+		fmt.Printf("* %s (default)\n", defaultRole)
+	}
+	for _, role := range roleList.GetRoles() {
+		if role != defaultRole {
+			fmt.Printf("  %s\n", role)
+		}
+	}
+	return nil
+}
+
 func request(req *protocol.AgentRequest) (*protocol.AgentResponse, error) {
 	client, err := local.NewClient("/var/run/hologram.sock")
 	if err != nil {
@@ -23,6 +23,7 @@
 // 	* Info:		White
 // 	* Warning:	Yellow
 // 	* Error:	Red
+// 	* Critical:	Magenta
 // 	* Debug:	Cyan
 //
 // The log format is as follows:
@@ -59,6 +60,7 @@ type Sink interface {
 	Info(message string)
 	Warning(message string)
 	Error(message string)
+	Critical(message string)
 	Debug(message string)
 }
 
@@ -103,6 +105,22 @@ func Errorf(message string, v ...interface{}) {
 	internalLog.Error(fileMessage, v...)
 }
 
+/*
+Critical reports a condition that needs someone's attention right away,
+above and beyond an ordinary error.
+*/
+func Critical(message string, v ...interface{}) {
+	// Prepend the log message with information about the calling function.
+	var fileMessage string
+	if debugMode {
+		_, f, l, _ := runtime.Caller(1)
+		fileMessage = fmt.Sprintf("(%s:%d) %s", f, l, message)
+	} else {
+		fileMessage = message
+	}
+	internalLog.Critical(fileMessage, v...)
+}
+
 func Debug(message string, v ...interface{}) {
 	// Prepend the log message with information about the calling function.
 	var fileMessage string
@@ -70,6 +70,14 @@ func (m *logMux) Error(message string, v ...interface{}) {
 	}
 }
 
+func (m *logMux) Critical(message string, v ...interface{}) {
+	actualMessage := fmt.Sprintf(message, v...)
+
+	for _, sink := range m.sinks {
+		sink.Critical(actualMessage)
+	}
+}
+
 func (m *logMux) Warning(message string, v ...interface{}) {
 	actualMessage := fmt.Sprintf(message, v...)
 
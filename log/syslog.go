@@ -50,3 +50,7 @@ func (ss *syslogSink) Warning(message string) {
 func (ss *syslogSink) Error(message string) {
 	ss.writer.Err(message)
 }
+
+func (ss *syslogSink) Critical(message string) {
+	ss.writer.Crit(message)
+}
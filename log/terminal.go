@@ -59,3 +59,10 @@ func (ss *terminalSink) Error(message string) {
 	colouredMessage := rgbterm.FgString(leveledMessage, 220, 50, 47)
 	fmt.Println(colouredMessage)
 }
+
+func (ss *terminalSink) Critical(message string) {
+	messageTime := time.Now().Format(time.RFC3339)
+	leveledMessage := fmt.Sprintf("[CRIT   ] %s %s", messageTime, message)
+	colouredMessage := rgbterm.FgString(leveledMessage, 211, 54, 130)
+	fmt.Println(colouredMessage)
+}
@@ -16,7 +16,10 @@ package protocol
 
 //go:generate protoc --go_out=. hologram.proto
 
-import "io"
+import (
+	"io"
+	"net"
+)
 
 /*
 MessageReadWriteCloser implementers provide a wrapper around the Hologram
@@ -34,6 +37,7 @@ required for a connection handler to speak the Hologram protocol.
 */
 type messageConnection struct {
 	internalConn io.ReadWriteCloser
+	compress     bool
 }
 
 func (smc *messageConnection) Read() (*Message, error) {
@@ -41,13 +45,37 @@ func (smc *messageConnection) Read() (*Message, error) {
 }
 
 func (smc *messageConnection) Write(msg *Message) error {
+	if smc.compress {
+		return WriteCompressed(smc.internalConn, msg)
+	}
 	return Write(smc.internalConn, msg)
 }
 
+/*
+EnableCompression gzips large messages from now on. Call it only once the
+peer has negotiated CapabilityGzip.
+*/
+func (smc *messageConnection) EnableCompression() {
+	smc.compress = true
+}
+
 func (smc *messageConnection) Close() error {
 	return smc.internalConn.Close()
 }
 
+/*
+RemoteAddr returns the address of the other end of the connection, or an
+empty string if the underlying connection does not know it.
+*/
+func (smc *messageConnection) RemoteAddr() string {
+	if conn, ok := smc.internalConn.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
+
 /*
 NewmessageConnection is a convenience function to create a
 properly-initialized messageConnection.
@@ -24,10 +24,12 @@ It is generated from these files:
 
 It has these top-level messages:
 	Message
+	Hello
 	Ping
 	ServerRequest
 	AssumeRole
 	GetUserCredentials
+	ListRoles
 	AddSSHKey
 	SSHChallengeResponse
 	MFATokenResponse
@@ -36,6 +38,7 @@ It has these top-level messages:
 	SSHVerificationFailure
 	STSCredentials
 	MFATokenRequest
+	RoleList
 	AgentRequest
 	AgentResponse
 	Success
@@ -125,7 +128,9 @@ func (x *Ping_RequestResponse) UnmarshalJSON(data []byte) error {
 type Message struct {
 	Error *string `protobuf:"bytes,1,opt,name=error" json:"error,omitempty"`
 	// This is useful for statistics and debugging
-	Source           *Message_Source `protobuf:"varint,2,opt,name=source,enum=protocol.Message_Source,def=0" json:"source,omitempty"`
+	Source *Message_Source `protobuf:"varint,2,opt,name=source,enum=protocol.Message_Source,def=0" json:"source,omitempty"`
+	// Sent with a Ping to negotiate the protocol; see version.go
+	Hello            *Hello          `protobuf:"bytes,3,opt,name=hello" json:"hello,omitempty"`
 	Ping             *Ping           `protobuf:"bytes,5,opt,name=ping" json:"ping,omitempty"`
 	ServerRequest    *ServerRequest  `protobuf:"bytes,6,opt,name=serverRequest" json:"serverRequest,omitempty"`
 	ServerResponse   *ServerResponse `protobuf:"bytes,7,opt,name=serverResponse" json:"serverResponse,omitempty"`
@@ -156,6 +161,13 @@ func (m *Message) GetSource() Message_Source {
 	return Default_Message_Source
 }
 
+func (m *Message) GetHello() *Hello {
+	if m != nil {
+		return m.Hello
+	}
+	return nil
+}
+
 func (m *Message) GetPing() *Ping {
 	if m != nil {
 		return m.Ping
@@ -205,6 +217,31 @@ func (m *Message) GetFailure() *Failure {
 	return nil
 }
 
+// Hello announces the protocol version and optional features a peer speaks.
+type Hello struct {
+	Version          *uint32  `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+	Capabilities     []string `protobuf:"bytes,2,rep,name=capabilities" json:"capabilities,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Hello) Reset()         { *m = Hello{} }
+func (m *Hello) String() string { return proto.CompactTextString(m) }
+func (*Hello) ProtoMessage()    {}
+
+func (m *Hello) GetVersion() uint32 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *Hello) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
 type Ping struct {
 	Type             *Ping_RequestResponse `protobuf:"varint,1,opt,name=type,enum=protocol.Ping_RequestResponse,def=1" json:"type,omitempty"`
 	XXX_unrecognized []byte                `json:"-"`
@@ -229,6 +266,7 @@ type ServerRequest struct {
 	TokenResponse      *MFATokenResponse     `protobuf:"bytes,6,opt,name=tokenResponse" json:"tokenResponse,omitempty"`
 	GetUserCredentials *GetUserCredentials   `protobuf:"bytes,7,opt,name=getUserCredentials" json:"getUserCredentials,omitempty"`
 	AddSSHkey          *AddSSHKey            `protobuf:"bytes,8,opt,name=addSSHkey" json:"addSSHkey,omitempty"`
+	ListRoles          *ListRoles            `protobuf:"bytes,9,opt,name=listRoles" json:"listRoles,omitempty"`
 	XXX_unrecognized   []byte                `json:"-"`
 }
 
@@ -271,9 +309,17 @@ func (m *ServerRequest) GetAddSSHkey() *AddSSHKey {
 	return nil
 }
 
+func (m *ServerRequest) GetListRoles() *ListRoles {
+	if m != nil {
+		return m.ListRoles
+	}
+	return nil
+}
+
 type AssumeRole struct {
 	User             *string `protobuf:"bytes,1,opt,name=user" json:"user,omitempty"`
 	Role             *string `protobuf:"bytes,2,opt,name=role" json:"role,omitempty"`
+	DurationSeconds  *uint32 `protobuf:"varint,3,opt,name=durationSeconds" json:"durationSeconds,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -295,6 +341,13 @@ func (m *AssumeRole) GetRole() string {
 	return ""
 }
 
+func (m *AssumeRole) GetDurationSeconds() uint32 {
+	if m != nil && m.DurationSeconds != nil {
+		return *m.DurationSeconds
+	}
+	return 0
+}
+
 type GetUserCredentials struct {
 	XXX_unrecognized []byte `json:"-"`
 }
@@ -303,6 +356,14 @@ func (m *GetUserCredentials) Reset()         { *m = GetUserCredentials{} }
 func (m *GetUserCredentials) String() string { return proto.CompactTextString(m) }
 func (*GetUserCredentials) ProtoMessage()    {}
 
+type ListRoles struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *ListRoles) Reset()         { *m = ListRoles{} }
+func (m *ListRoles) String() string { return proto.CompactTextString(m) }
+func (*ListRoles) ProtoMessage()    {}
+
 type AddSSHKey struct {
 	Username         *string `protobuf:"bytes,1,req,name=username" json:"username,omitempty"`
 	Passwordhash     *string `protobuf:"bytes,2,req,name=passwordhash" json:"passwordhash,omitempty"`
@@ -338,6 +399,7 @@ func (m *AddSSHKey) GetSshkeybytes() string {
 type SSHChallengeResponse struct {
 	Signature        []byte  `protobuf:"bytes,1,req,name=signature" json:"signature,omitempty"`
 	Format           *string `protobuf:"bytes,2,req,name=format" json:"format,omitempty"`
+	PublicKey        []byte  `protobuf:"bytes,3,opt,name=publicKey" json:"publicKey,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -359,6 +421,13 @@ func (m *SSHChallengeResponse) GetFormat() string {
 	return ""
 }
 
+func (m *SSHChallengeResponse) GetPublicKey() []byte {
+	if m != nil {
+		return m.PublicKey
+	}
+	return nil
+}
+
 type MFATokenResponse struct {
 	TokenValue       *string `protobuf:"bytes,1,opt,name=tokenValue" json:"tokenValue,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -380,6 +449,7 @@ type ServerResponse struct {
 	VerificationFailure *SSHVerificationFailure `protobuf:"bytes,5,opt,name=verificationFailure" json:"verificationFailure,omitempty"`
 	Credentials         *STSCredentials         `protobuf:"bytes,6,opt,name=credentials" json:"credentials,omitempty"`
 	TokenRequest        *MFATokenRequest        `protobuf:"bytes,7,opt,name=tokenRequest" json:"tokenRequest,omitempty"`
+	Roles               *RoleList               `protobuf:"bytes,8,opt,name=roles" json:"roles,omitempty"`
 	XXX_unrecognized    []byte                  `json:"-"`
 }
 
@@ -415,6 +485,13 @@ func (m *ServerResponse) GetTokenRequest() *MFATokenRequest {
 	return nil
 }
 
+func (m *ServerResponse) GetRoles() *RoleList {
+	if m != nil {
+		return m.Roles
+	}
+	return nil
+}
+
 type SSHChallenge struct {
 	Challenge        []byte `protobuf:"bytes,1,req,name=challenge" json:"challenge,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
@@ -487,14 +564,43 @@ func (m *MFATokenRequest) Reset()         { *m = MFATokenRequest{} }
 func (m *MFATokenRequest) String() string { return proto.CompactTextString(m) }
 func (*MFATokenRequest) ProtoMessage()    {}
 
+// RoleList holds the roles a user may assume.
+type RoleList struct {
+	Roles            []string `protobuf:"bytes,1,rep,name=roles" json:"roles,omitempty"`
+	DefaultRole      *string  `protobuf:"bytes,2,opt,name=defaultRole" json:"defaultRole,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *RoleList) Reset()         { *m = RoleList{} }
+func (m *RoleList) String() string { return proto.CompactTextString(m) }
+func (*RoleList) ProtoMessage()    {}
+
+func (m *RoleList) GetRoles() []string {
+	if m != nil {
+		return m.Roles
+	}
+	return nil
+}
+
+func (m *RoleList) GetDefaultRole() string {
+	if m != nil && m.DefaultRole != nil {
+		return *m.DefaultRole
+	}
+	return ""
+}
+
 type AgentRequest struct {
 	SshAgentSock       *string             `protobuf:"bytes,2,opt,name=sshAgentSock" json:"sshAgentSock,omitempty"`
 	AssumeRole         *AssumeRole         `protobuf:"bytes,3,opt,name=assumeRole" json:"assumeRole,omitempty"`
 	GetUserCredentials *GetUserCredentials `protobuf:"bytes,4,opt,name=getUserCredentials" json:"getUserCredentials,omitempty"`
+	ListRoles          *ListRoles          `protobuf:"bytes,7,opt,name=listRoles" json:"listRoles,omitempty"`
 	// sshKeyFile should be sent along if the CLI cannot determine
 	// how to communicate with the user's SSH agent.
-	SshKeyFile       []byte `protobuf:"bytes,5,opt,name=sshKeyFile" json:"sshKeyFile,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	SshKeyFile []byte `protobuf:"bytes,5,opt,name=sshKeyFile" json:"sshKeyFile,omitempty"`
+	// returnCredentials asks the agent to include the credentials it
+	// obtained in its Success response.
+	ReturnCredentials *bool  `protobuf:"varint,6,opt,name=returnCredentials" json:"returnCredentials,omitempty"`
+	XXX_unrecognized  []byte `json:"-"`
 }
 
 func (m *AgentRequest) Reset()         { *m = AgentRequest{} }
@@ -529,6 +635,20 @@ func (m *AgentRequest) GetSshKeyFile() []byte {
 	return nil
 }
 
+func (m *AgentRequest) GetListRoles() *ListRoles {
+	if m != nil {
+		return m.ListRoles
+	}
+	return nil
+}
+
+func (m *AgentRequest) GetReturnCredentials() bool {
+	if m != nil && m.ReturnCredentials != nil {
+		return *m.ReturnCredentials
+	}
+	return false
+}
+
 type AgentResponse struct {
 	Success          *Success `protobuf:"bytes,2,opt,name=success" json:"success,omitempty"`
 	Failure          *Failure `protobuf:"bytes,3,opt,name=failure" json:"failure,omitempty"`
@@ -554,13 +674,29 @@ func (m *AgentResponse) GetFailure() *Failure {
 }
 
 type Success struct {
-	XXX_unrecognized []byte `json:"-"`
+	Credentials      *STSCredentials `protobuf:"bytes,1,opt,name=credentials" json:"credentials,omitempty"`
+	Roles            *RoleList       `protobuf:"bytes,2,opt,name=roles" json:"roles,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
 }
 
 func (m *Success) Reset()         { *m = Success{} }
 func (m *Success) String() string { return proto.CompactTextString(m) }
 func (*Success) ProtoMessage()    {}
 
+func (m *Success) GetCredentials() *STSCredentials {
+	if m != nil {
+		return m.Credentials
+	}
+	return nil
+}
+
+func (m *Success) GetRoles() *RoleList {
+	if m != nil {
+		return m.Roles
+	}
+	return nil
+}
+
 type Failure struct {
 	ErrorMessage     *string `protobuf:"bytes,1,opt,name=errorMessage" json:"errorMessage,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -0,0 +1,113 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+/*
+Peers negotiate the protocol by sending a Hello with a Ping request, to
+which a server that understands Hello answers with its own. Servers that
+predate it answer the Ping alone, and agents that predate it never send a
+Hello; either way, both sides fall back to LegacyVersion with no
+capabilities. A server only sends a Hello to a peer that sent one, and
+only uses optional features both sides listed.
+*/
+const (
+	// LegacyVersion is spoken by peers that do not negotiate.
+	LegacyVersion uint32 = 1
+	// Version is the protocol version this tree speaks.
+	Version uint32 = 2
+)
+
+// Optional features a peer may list in its Hello.
+const (
+	// CapabilitySessionDuration honors AssumeRole.durationSeconds.
+	CapabilitySessionDuration = "session-duration"
+	// CapabilityListRoles answers ServerRequest.listRoles.
+	CapabilityListRoles = "list-roles"
+	// CapabilityGzip reads gzipped message bodies; see WriteCompressed.
+	CapabilityGzip = "gzip"
+)
+
+// Capabilities lists the optional features this tree supports.
+var Capabilities = []string{
+	CapabilitySessionDuration,
+	CapabilityListRoles,
+	CapabilityGzip,
+}
+
+/*
+EnableCompression turns on compression for conn if the peer negotiated it
+and conn knows how.
+*/
+func EnableCompression(conn MessageReadWriteCloser, negotiated Negotiated) bool {
+	compressor, ok := conn.(interface {
+		EnableCompression()
+	})
+	if !ok || !negotiated.Supports(CapabilityGzip) {
+		return false
+	}
+	compressor.EnableCompression()
+	return true
+}
+
+/*
+NewHello describes this end of the connection.
+*/
+func NewHello() *Hello {
+	version := Version
+	return &Hello{
+		Version:      &version,
+		Capabilities: append([]string(nil), Capabilities...),
+	}
+}
+
+/*
+Negotiated is what both ends of a connection speak.
+*/
+type Negotiated struct {
+	Version      uint32
+	Capabilities map[string]bool
+}
+
+/*
+Supports reports whether both ends support capability.
+*/
+func (n Negotiated) Supports(capability string) bool {
+	return n.Capabilities[capability]
+}
+
+/*
+Negotiate settles on the lower of the two versions and the capabilities
+both ends list, given the peer's Hello. A nil Hello means a peer that does
+not negotiate.
+*/
+func Negotiate(peer *Hello) Negotiated {
+	negotiated := Negotiated{Version: LegacyVersion, Capabilities: map[string]bool{}}
+	if peer == nil || peer.GetVersion() < LegacyVersion {
+		return negotiated
+	}
+
+	negotiated.Version = peer.GetVersion()
+	if negotiated.Version > Version {
+		negotiated.Version = Version
+	}
+	for _, capability := range peer.GetCapabilities() {
+		for _, ours := range Capabilities {
+			if capability == ours {
+				negotiated.Capabilities[capability] = true
+			}
+		}
+	}
+	return negotiated
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNegotiate(t *testing.T) {
+	Convey("Negotiating with a peer that sends no Hello should fall back to the legacy protocol", t, func() {
+		negotiated := Negotiate(nil)
+		So(negotiated.Version, ShouldEqual, LegacyVersion)
+		So(negotiated.Supports(CapabilityListRoles), ShouldBeFalse)
+	})
+
+	Convey("Negotiating with a newer peer should settle on our version and shared capabilities", t, func() {
+		version := Version + 1
+		negotiated := Negotiate(&Hello{
+			Version:      &version,
+			Capabilities: []string{CapabilityListRoles, "something-new"},
+		})
+		So(negotiated.Version, ShouldEqual, Version)
+		So(negotiated.Supports(CapabilityListRoles), ShouldBeTrue)
+		So(negotiated.Supports(CapabilitySessionDuration), ShouldBeFalse)
+		So(negotiated.Supports("something-new"), ShouldBeFalse)
+	})
+
+	Convey("Negotiating with ourselves should keep everything", t, func() {
+		negotiated := Negotiate(NewHello())
+		So(negotiated.Version, ShouldEqual, Version)
+		for _, capability := range Capabilities {
+			So(negotiated.Supports(capability), ShouldBeTrue)
+		}
+	})
+}
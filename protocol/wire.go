@@ -17,11 +17,14 @@
 package protocol
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 
 	"github.com/golang/protobuf/proto"
 )
@@ -35,6 +38,16 @@ var (
 // message just filling up all available memory on the server.
 const MaximumMessageSize uint32 = 1024 * 1024
 
+// Messages smaller than this are not worth compressing.
+const CompressionThreshold = 1024
+
+// Bits of header.Reserved.
+const (
+	// flagGzip marks a gzipped body; ContentLength and Checksum are of
+	// the compressed bytes.
+	flagGzip uint64 = 1 << iota
+)
+
 // header comprises a structured dataset for all parties involved
 // in message-passing to verify received data.
 type header struct {
@@ -113,6 +126,14 @@ func Read(r io.Reader) (*Message, error) {
 		return nil, ErrCorruptedMessage
 	}
 
+	if incomingHeader.Reserved&flagGzip != 0 {
+		data, err = gunzip(data)
+		if err != nil {
+			return nil, err
+		}
+		incomingHeader.ContentLength = uint32(len(data))
+	}
+
 	err = proto.Unmarshal(data[0:incomingHeader.ContentLength], msg)
 	return msg, err
 }
@@ -120,16 +141,38 @@ func Read(r io.Reader) (*Message, error) {
 // Write marshals a Message into the proper on-wire format and sends it
 // to the remote system.
 func Write(w io.Writer, msg *Message) error {
+	return write(w, msg, false)
+}
+
+// WriteCompressed is like Write, but gzips messages larger than
+// CompressionThreshold. Only peers that negotiated CapabilityGzip can
+// read them.
+func WriteCompressed(w io.Writer, msg *Message) error {
+	return write(w, msg, true)
+}
+
+func write(w io.Writer, msg *Message, compress bool) error {
 	buf, err := proto.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	// For now we just compute the length as we don't have tests.
+	var flags uint64
+	if compress && len(buf) > CompressionThreshold {
+		compressed, err := gzipBytes(buf)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(buf) {
+			buf = compressed
+			flags |= flagGzip
+		}
+	}
+
 	bufHeader := &header{
 		ContentLength: uint32(len(buf)),
 		Checksum:      crc32.ChecksumIEEE(buf),
-		Reserved:      0,
+		Reserved:      flags,
 	}
 
 	err = binary.Write(w, binary.LittleEndian, bufHeader)
@@ -146,3 +189,34 @@ func Write(w io.Writer, msg *Message) error {
 	}
 	return nil
 }
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// gunzip decompresses a message body, holding it to MaximumMessageSize
+// so that a small body cannot expand to fill memory.
+func gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	decompressed, err := ioutil.ReadAll(io.LimitReader(gz, int64(MaximumMessageSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(decompressed)) > MaximumMessageSize {
+		return nil, fmt.Errorf("message too large: decompresses to more than %d bytes", MaximumMessageSize)
+	}
+	return decompressed, nil
+}
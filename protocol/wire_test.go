@@ -16,11 +16,15 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -138,6 +142,50 @@ func TestWire(t *testing.T) {
 			So(rMsg, ShouldBeNil)
 		})
 
+		Convey("A large compressed message should round-trip", func() {
+			keys := make([]string, 500)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("arn:aws:iam::123456789012:role/synthetic-role-%d", i)
+			}
+			msg := &Message{ServerResponse: &ServerResponse{Roles: &RoleList{Roles: keys}}}
+			plain, _ := proto.Marshal(msg)
+
+			So(WriteCompressed(buffer, msg), ShouldBeNil)
+			So(buffer.Len(), ShouldBeLessThan, len(plain))
+
+			var written header
+			So(binary.Read(bytes.NewReader(buffer.Bytes()), binary.LittleEndian, &written), ShouldBeNil)
+			So(written.Reserved&flagGzip, ShouldNotEqual, 0)
+			So(written.ContentLength, ShouldEqual, buffer.Len()-binary.Size(written))
+
+			readMsg, err := Read(buffer)
+			So(err, ShouldBeNil)
+			So(readMsg.GetServerResponse().GetRoles().GetRoles(), ShouldResemble, keys)
+		})
+
+		Convey("A small message should be sent uncompressed", func() {
+			msg := &Message{Ping: &Ping{}}
+			So(WriteCompressed(buffer, msg), ShouldBeNil)
+
+			var written header
+			So(binary.Read(bytes.NewReader(buffer.Bytes()), binary.LittleEndian, &written), ShouldBeNil)
+			So(written.Reserved&flagGzip, ShouldEqual, 0)
+		})
+
+		Convey("A compressed message expanding past the maximum size should be refused", func() {
+			body, _ := gzipBytes(make([]byte, MaximumMessageSize+1))
+			binary.Write(buffer, binary.LittleEndian, &header{
+				ContentLength: uint32(len(body)),
+				Checksum:      crc32.ChecksumIEEE(body),
+				Reserved:      flagGzip,
+			})
+			buffer.Write(body)
+
+			msg, err := Read(buffer)
+			So(err, ShouldNotBeNil)
+			So(msg, ShouldBeNil)
+		})
+
 		Convey("Massive messages should throw an error", func() {
 			source := Message_OTHER
 			pingType := Ping_REQUEST
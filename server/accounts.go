@@ -0,0 +1,66 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+/*
+arnAccount returns the account ID of an ARN, or "" if it has none.
+*/
+func arnAccount(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[4]
+}
+
+/*
+accountAllowed reports whether roles in arn's account may be handed out.
+*/
+func (luc *ldapUserCache) accountAllowed(arn string) bool {
+	return containsString(luc.opts.AllowedAccounts, arnAccount(arn))
+}
+
+/*
+allowedAccountARNs drops the ARNs outside Options.AllowedAccounts. Denials
+are kept, since they can only take access away. In strict mode a single
+foreign ARN rejects the user instead, which the second result reports.
+*/
+func (luc *ldapUserCache) allowedAccountARNs(username string, arns []string) ([]string, bool) {
+	if len(luc.opts.AllowedAccounts) == 0 {
+		return arns, true
+	}
+
+	allowed := make([]string, 0, len(arns))
+	for _, arn := range arns {
+		if strings.HasPrefix(arn, "!") || luc.accountAllowed(arn) {
+			allowed = append(allowed, arn)
+			continue
+		}
+
+		luc.stats.Counter(1.0, "foreignAccountARN", 1)
+		if luc.opts.StrictAccounts {
+			log.Errorf("User %s was granted %s, outside the allowed accounts; the user will not be loaded.", username, arn)
+			return nil, false
+		}
+		log.Warning("Dropping %s from user %s: its account is not allowed.", arn, username)
+	}
+	return allowed, true
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/g2s"
+)
+
+type counterKey struct {
+	bucket     string
+	sampleRate float32
+}
+
+/*
+AggregatingStatter is a g2s.Statter that sums counters in memory and sends
+each bucket's total once per flush interval, so that busy servers send
+statsd one packet per counter instead of one per event. Timings and gauges
+are passed straight through. Call Close on shutdown to send what is left.
+*/
+type AggregatingStatter struct {
+	sync.Mutex
+	inner    g2s.Statter
+	counters map[counterKey]int
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+/*
+NewAggregatingStatter wraps inner, flushing summed counters to it every
+interval. An interval of zero or less only flushes on Flush and Close.
+*/
+func NewAggregatingStatter(inner g2s.Statter, interval time.Duration) *AggregatingStatter {
+	as := &AggregatingStatter{
+		inner:    inner,
+		counters: map[counterKey]int{},
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go as.run(interval)
+	return as
+}
+
+func (as *AggregatingStatter) run(interval time.Duration) {
+	defer close(as.stopped)
+	if interval <= 0 {
+		<-as.stop
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			as.Flush()
+		case <-as.stop:
+			return
+		}
+	}
+}
+
+func (as *AggregatingStatter) Counter(sampleRate float32, bucket string, n ...int) {
+	as.Lock()
+	defer as.Unlock()
+	for _, count := range n {
+		as.counters[counterKey{bucket, sampleRate}] += count
+	}
+}
+
+func (as *AggregatingStatter) Timing(sampleRate float32, bucket string, d ...time.Duration) {
+	as.inner.Timing(sampleRate, bucket, d...)
+}
+
+func (as *AggregatingStatter) Gauge(sampleRate float32, bucket string, value ...string) {
+	as.inner.Gauge(sampleRate, bucket, value...)
+}
+
+/*
+Flush sends the counters summed since the last flush.
+*/
+func (as *AggregatingStatter) Flush() {
+	as.Lock()
+	counters := as.counters
+	as.counters = map[counterKey]int{}
+	as.Unlock()
+
+	for key, total := range counters {
+		as.inner.Counter(key.sampleRate, key.bucket, total)
+	}
+}
+
+/*
+Close stops the periodic flushes and sends whatever is still pending.
+*/
+func (as *AggregatingStatter) Close() {
+	close(as.stop)
+	<-as.stopped
+	as.Flush()
+}
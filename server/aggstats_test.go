@@ -0,0 +1,113 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// packetStatter counts the Counter calls it receives, one per packet.
+type packetStatter struct {
+	sync.Mutex
+	packets int
+	totals  map[string]int
+}
+
+func (ps *packetStatter) Counter(sampleRate float32, bucket string, n ...int) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.packets++
+	for _, count := range n {
+		ps.totals[bucket] += count
+	}
+}
+
+func (ps *packetStatter) Timing(sampleRate float32, bucket string, d ...time.Duration) {}
+
+func (ps *packetStatter) Gauge(sampleRate float32, bucket string, value ...string) {}
+
+func (ps *packetStatter) snapshot() (int, map[string]int) {
+	ps.Lock()
+	defer ps.Unlock()
+	totals := map[string]int{}
+	for bucket, total := range ps.totals {
+		totals[bucket] = total
+	}
+	return ps.packets, totals
+}
+
+func TestAggregatingStatter(t *testing.T) {
+	Convey("Given an aggregating statter that only flushes on demand", t, func() {
+		inner := &packetStatter{totals: map[string]int{}}
+		stats := server.NewAggregatingStatter(inner, 0)
+
+		for i := 0; i < 10; i++ {
+			stats.Counter(1.0, "authSuccess", 1)
+		}
+		stats.Counter(1.0, "authFailure", 2, 3)
+
+		Convey("Nothing should be sent before a flush", func() {
+			packets, _ := inner.snapshot()
+			So(packets, ShouldEqual, 0)
+		})
+
+		Convey("A flush should send one total per bucket", func() {
+			stats.Flush()
+			packets, totals := inner.snapshot()
+			So(packets, ShouldEqual, 2)
+			So(totals["authSuccess"], ShouldEqual, 10)
+			So(totals["authFailure"], ShouldEqual, 5)
+
+			Convey("And the next flush should start from zero", func() {
+				stats.Flush()
+				packets, _ := inner.snapshot()
+				So(packets, ShouldEqual, 2)
+			})
+		})
+
+		Convey("Closing should flush what is pending", func() {
+			stats.Close()
+			_, totals := inner.snapshot()
+			So(totals["authSuccess"], ShouldEqual, 10)
+		})
+	})
+
+	Convey("Given an aggregating statter with a short flush interval", t, func() {
+		inner := &packetStatter{totals: map[string]int{}}
+		stats := server.NewAggregatingStatter(inner, 10*time.Millisecond)
+		defer stats.Close()
+
+		stats.Counter(1.0, "authSuccess", 1)
+		stats.Counter(1.0, "authSuccess", 1)
+
+		Convey("Counters should be flushed without being asked", func() {
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) {
+				if _, totals := inner.snapshot(); totals["authSuccess"] == 2 {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			packets, totals := inner.snapshot()
+			So(packets, ShouldEqual, 1)
+			So(totals["authSuccess"], ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/nmcclain/ldap"
+)
+
+/*
+entryAttributes looks up an LDAP entry's attribute values by name. The ldap
+library matches attribute names exactly, so when folding is enabled the
+values are gathered into a map keyed by lower-cased name instead, rescuing
+directories that return names in an unexpected case. When binary decoding
+is enabled the same map also files values returned under an option such as
+cn;binary under the bare name, decoded to text.
+*/
+type entryAttributes struct {
+	entry      *ldap.Entry
+	fold       bool
+	normalized map[string][]string
+}
+
+func (luc *ldapUserCache) attributesOf(entry *ldap.Entry) entryAttributes {
+	attrs := entryAttributes{entry: entry, fold: luc.opts.FoldAttributeNames}
+	if !luc.opts.FoldAttributeNames && !luc.opts.DecodeBinaryAttributes {
+		return attrs
+	}
+
+	attrs.normalized = map[string][]string{}
+	for _, attribute := range entry.Attributes {
+		name := attribute.Name
+		values := attribute.Values
+		if luc.opts.DecodeBinaryAttributes {
+			if i := strings.Index(name, ";"); i >= 0 {
+				if strings.EqualFold(name[i+1:], "binary") {
+					values = decodeBinaryValues(values)
+				}
+				name = name[:i]
+			}
+		}
+		name = attrs.key(name)
+		attrs.normalized[name] = append(attrs.normalized[name], values...)
+	}
+	return attrs
+}
+
+func (ea entryAttributes) key(name string) string {
+	if ea.fold {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+func (ea entryAttributes) values(name string) []string {
+	if ea.normalized != nil {
+		return ea.normalized[ea.key(name)]
+	}
+	return ea.entry.GetAttributeValues(name)
+}
+
+func (ea entryAttributes) value(name string) string {
+	values := ea.values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func decodeBinaryValues(values []string) []string {
+	decoded := make([]string, 0, len(values))
+	for _, value := range values {
+		decoded = append(decoded, decodeBinaryValue(value))
+	}
+	return decoded
+}
+
+/*
+decodeBinaryValue turns a binary-tagged value into text where it holds
+text: UTF-16LE as written by Active Directory is converted and trailing
+NUL padding is dropped. Values that are not text, such as SSH keys in wire
+format, are returned unchanged.
+*/
+func decodeBinaryValue(value string) string {
+	text := value
+	if len(value) >= 2 && len(value)%2 == 0 {
+		utf16LE := true
+		for i := 1; i < len(value); i += 2 {
+			if value[i] != 0 {
+				utf16LE = false
+				break
+			}
+		}
+		if utf16LE {
+			units := make([]uint16, 0, len(value)/2)
+			for i := 0; i < len(value); i += 2 {
+				units = append(units, uint16(value[i]))
+			}
+			text = string(utf16.Decode(units))
+		}
+	}
+
+	text = strings.TrimRight(text, "\x00")
+	for _, r := range text {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return value
+		}
+	}
+	return text
+}
@@ -0,0 +1,179 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/AdRoll/hologram/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// Actions an AuditEvent can record.
+const (
+	AuditAuthenticate = "authenticate"
+	AuditCredentials  = "credentials"
+)
+
+/*
+AuditEvent is the audit record of one authentication or credential grant.
+RequestedRole is empty when the user asked for their default role, and
+GrantedRole is empty unless credentials were issued.
+*/
+type AuditEvent struct {
+	Time          time.Time `json:"time"`
+	Action        string    `json:"action"`
+	Username      string    `json:"username,omitempty"`
+	Fingerprint   string    `json:"fingerprint,omitempty"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	RequestedRole string    `json:"requested_role,omitempty"`
+	GrantedRole   string    `json:"granted_role,omitempty"`
+	Success       bool      `json:"success"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+/*
+AuditSink implementers receive the server's audit events, for example to
+forward them to a SIEM. Audit must be safe to call from several
+goroutines at once.
+*/
+type AuditSink interface {
+	Audit(event AuditEvent)
+}
+
+/*
+JSONLinesAuditSink writes each audit event as a line of JSON.
+*/
+type JSONLinesAuditSink struct {
+	sync.Mutex
+	w io.Writer
+}
+
+/*
+NewJSONLinesAuditSink writes audit events to w.
+*/
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{w: w}
+}
+
+/*
+OpenAuditLog appends audit events to the file at path, creating it
+readable by its owner only if need be.
+*/
+func OpenAuditLog(path string) (*JSONLinesAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesAuditSink(file), nil
+}
+
+func (sink *JSONLinesAuditSink) Audit(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Could not encode an audit event: %s", err.Error())
+		return
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+	if _, err := sink.w.Write(append(line, '\n')); err != nil {
+		log.Errorf("Could not write an audit event: %s", err.Error())
+	}
+}
+
+/*
+AuditTo makes the server send an audit event to sink for every
+authentication and credential request.
+*/
+func (sm *server) AuditTo(sink AuditSink) {
+	sm.audit = sink
+}
+
+func (sm *server) auditEvent(event AuditEvent) {
+	if sm.audit == nil {
+		return
+	}
+	event.Time = time.Now()
+	sm.audit.Audit(event)
+}
+
+/*
+auditAuthentication records the outcome of a challenge response signed
+with publicKey, if the client sent it.
+*/
+func (sm *server) auditAuthentication(m protocol.MessageReadWriteCloser, user *User, publicKey []byte, err error) {
+	if sm.audit == nil {
+		return
+	}
+
+	event := AuditEvent{
+		Action:     AuditAuthenticate,
+		RemoteAddr: remoteAddr(m),
+		Success:    user != nil && err == nil,
+	}
+	if key, parseErr := ssh.ParsePublicKey(publicKey); parseErr == nil {
+		event.Fingerprint = fingerprintSHA256(key)
+	}
+	switch {
+	case err != nil:
+		event.Reason = err.Error()
+	case user == nil:
+		event.Reason = "no matching key"
+	default:
+		event.Username = user.Username
+	}
+	sm.auditEvent(event)
+}
+
+/*
+auditCredentials records the outcome of a credential request by user for
+requested, granted being the role credentials were issued for, if any.
+*/
+func (sm *server) auditCredentials(m protocol.MessageReadWriteCloser, user *User, requested string, granted string, err error) {
+	if sm.audit == nil {
+		return
+	}
+
+	event := AuditEvent{
+		Action:        AuditCredentials,
+		Username:      user.Username,
+		RemoteAddr:    remoteAddr(m),
+		RequestedRole: requested,
+		GrantedRole:   granted,
+		Success:       granted != "",
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	sm.auditEvent(event)
+}
+
+/*
+remoteAddr returns the client's address, if the connection knows it.
+*/
+func remoteAddr(m protocol.MessageReadWriteCloser) string {
+	if conn, ok := m.(interface {
+		RemoteAddr() string
+	}); ok {
+		return conn.RemoteAddr()
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type recordingAuditSink struct {
+	sync.Mutex
+	events []server.AuditEvent
+}
+
+func (ras *recordingAuditSink) Audit(event server.AuditEvent) {
+	ras.Lock()
+	defer ras.Unlock()
+	ras.events = append(ras.events, event)
+}
+
+func (ras *recordingAuditSink) recorded() []server.AuditEvent {
+	ras.Lock()
+	defer ras.Unlock()
+	return append([]server.AuditEvent(nil), ras.events...)
+}
+
+func TestServerAudit(t *testing.T) {
+	Convey("Given a server sending audit events to a sink", t, func() {
+		authenticator := &DummyAuthenticator{&server.User{Username: "words"}}
+		testServer := server.New(authenticator, &dummyCredentials{}, "default", g2s.Noop(), nil, "cn", "sshPublicKey", "dc=testdn,dc=com", false, "")
+		sink := &recordingAuditSink{}
+		testServer.AuditTo(sink)
+
+		r, w := io.Pipe()
+		testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
+		go testServer.HandleConnection(testConnection)
+
+		role := "testrole"
+		testConnection.Write(&protocol.Message{
+			ServerRequest: &protocol.ServerRequest{AssumeRole: &protocol.AssumeRole{Role: &role}},
+		})
+		_, err := testConnection.Read()
+		So(err, ShouldBeNil)
+
+		format := "test"
+		testConnection.Write(&protocol.Message{
+			ServerRequest: &protocol.ServerRequest{
+				ChallengeResponse: &protocol.SSHChallengeResponse{Format: &format, Signature: []byte("ssss")},
+			},
+		})
+
+		Convey("A granted role should be audited with its authentication", func() {
+			credsMsg, err := testConnection.Read()
+			So(err, ShouldBeNil)
+			So(credsMsg.GetServerResponse().GetCredentials(), ShouldNotBeNil)
+
+			events := sink.recorded()
+			So(events, ShouldHaveLength, 2)
+			So(events[0].Action, ShouldEqual, server.AuditAuthenticate)
+			So(events[0].Username, ShouldEqual, "words")
+			So(events[0].Success, ShouldBeTrue)
+			So(events[1].Action, ShouldEqual, server.AuditCredentials)
+			So(events[1].RequestedRole, ShouldEqual, "testrole")
+			So(events[1].GrantedRole, ShouldEqual, "testrole")
+			So(events[1].Success, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a JSON lines audit sink", t, func() {
+		var buf bytes.Buffer
+		sink := server.NewJSONLinesAuditSink(&buf)
+
+		Convey("Each event should be written as one line of JSON", func() {
+			at := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+			sink.Audit(server.AuditEvent{Time: at, Action: server.AuditAuthenticate, Username: "alice", Success: true})
+			sink.Audit(server.AuditEvent{Time: at, Action: server.AuditCredentials, Username: "alice", Reason: "denied"})
+
+			lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+			So(lines, ShouldHaveLength, 2)
+			var event map[string]interface{}
+			So(json.Unmarshal(lines[1], &event), ShouldBeNil)
+			So(event["username"], ShouldEqual, "alice")
+			So(event["success"], ShouldEqual, false)
+			So(event["reason"], ShouldEqual, "denied")
+			So(event["time"], ShouldEqual, "2016-01-01T12:00:00Z")
+		})
+	})
+}
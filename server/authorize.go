@@ -0,0 +1,169 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+// ErrRoleNotAuthorized is returned when a user asks for a role they have not been granted.
+var ErrRoleNotAuthorized = errors.New("user is not authorized to assume the requested role")
+
+/*
+RoleAuthorizer decides whether a user may assume a role, given the role's
+full ARN and a user whose roles have been qualified to full ARNs.
+*/
+type RoleAuthorizer interface {
+	AuthorizeRole(user *User, requestedARN string) error
+}
+
+/*
+AuthorizeRole checks that user may assume requestedARN. The user's default
+role is always allowed. Entries in the user's ARNs may use * as a wildcard,
+and entries prefixed with ! deny the roles they match, taking precedence
+over any grant. Without LDAP roles every role is allowed, leaving the
+decision to IAM as before. Authorized roles are counted in RoleUsage().
+*/
+func (luc *ldapUserCache) AuthorizeRole(user *User, requestedARN string) error {
+	opts := luc.options()
+	if opts.EnableLDAPRoles && !roleAuthorized(user, requestedARN, opts.CaseInsensitiveRoleNames) {
+		log.Warning("User %s requested role %s, which they have not been granted.", user.Username, requestedARN)
+		luc.stats.Counter(1.0, "ldapRoleNotAuthorized", 1)
+		return ErrRoleNotAuthorized
+	}
+	luc.roleUsage.record(requestedARN)
+	return nil
+}
+
+/*
+RoleNotPermittedError is returned by the credential path when a user asks
+for a role that is neither among their ARNs nor their default role. It
+wraps ErrRoleNotAuthorized.
+*/
+type RoleNotPermittedError struct {
+	Username string
+	Role     string
+}
+
+func (e *RoleNotPermittedError) Error() string {
+	return fmt.Sprintf("User %s is not authorized to assume role %s!", e.Username, e.Role)
+}
+
+func (e *RoleNotPermittedError) Unwrap() error {
+	return ErrRoleNotAuthorized
+}
+
+func roleAuthorized(user *User, requestedARN string, foldCase bool) bool {
+	normalize := func(arn string) string { return arn }
+	if foldCase {
+		normalize = foldRoleName
+	}
+
+	requestedARN = normalize(requestedARN)
+	granted := requestedARN == normalize(user.DefaultRole)
+	for _, pattern := range user.ARNs {
+		if strings.HasPrefix(pattern, "!") {
+			if arnMatches(normalize(pattern[1:]), requestedARN) {
+				return false
+			}
+		} else if arnMatches(normalize(pattern), requestedARN) {
+			granted = true
+		}
+	}
+	return granted
+}
+
+/*
+foldRoleName lower-cases the path and name of a role ARN, leaving the
+partition and account as they are.
+*/
+func foldRoleName(arn string) string {
+	if i := strings.Index(arn, ":role/"); i >= 0 {
+		return arn[:i+len(":role/")] + strings.ToLower(arn[i+len(":role/"):])
+	}
+	return arn
+}
+
+/*
+rewriteARN passes an ARN through Options.ARNRewriter, keeping the "!" of a
+denial outside of it.
+*/
+func (luc *ldapUserCache) rewriteARN(arn string) string {
+	if luc.opts.ARNRewriter == nil || arn == "" {
+		return arn
+	}
+	if strings.HasPrefix(arn, "!") {
+		return "!" + luc.opts.ARNRewriter(arn[1:])
+	}
+	return luc.opts.ARNRewriter(arn)
+}
+
+func (luc *ldapUserCache) rewriteARNs(arns []string) []string {
+	if luc.opts.ARNRewriter == nil {
+		return arns
+	}
+
+	rewritten := make([]string, 0, len(arns))
+	for _, arn := range arns {
+		rewritten = append(rewritten, luc.rewriteARN(arn))
+	}
+	return rewritten
+}
+
+/*
+dedupeARNsIgnoringCase drops ARNs that differ from an earlier one only in
+case, keeping the first spelling seen.
+*/
+func dedupeARNsIgnoringCase(arns []string) []string {
+	seen := map[string]bool{}
+	deduped := make([]string, 0, len(arns))
+	for _, arn := range arns {
+		key := strings.ToLower(arn)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, arn)
+	}
+	return deduped
+}
+
+/*
+arnMatches matches an ARN against a pattern in which * stands for any
+run of characters, including the / separators of role paths.
+*/
+func arnMatches(pattern string, arn string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == arn
+	}
+
+	if !strings.HasPrefix(arn, parts[0]) {
+		return false
+	}
+	arn = arn[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(arn, part)
+		if i < 0 {
+			return false
+		}
+		arn = arn[i+len(part):]
+	}
+	return strings.HasSuffix(arn, parts[len(parts)-1])
+}
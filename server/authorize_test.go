@@ -0,0 +1,123 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuthorizeRole(t *testing.T) {
+	Convey("Given an LDAP cache with server roles enabled", t, func() {
+		lc, err := server.NewLDAPUserCacheWithOptions(&StubLDAPServer{}, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+		})
+		So(err, ShouldBeNil)
+
+		user := &server.User{
+			Username:    "testuser",
+			DefaultRole: "arn:aws:iam::123456789012:role/default",
+			ARNs: []string{
+				"arn:aws:iam::123456789012:role/developer",
+				"arn:aws:iam::210987654321:role/*",
+				"!arn:aws:iam::210987654321:role/admin",
+			},
+		}
+
+		Convey("An explicitly granted role should be authorized", func() {
+			So(lc.AuthorizeRole(user, "arn:aws:iam::123456789012:role/developer"), ShouldBeNil)
+		})
+
+		Convey("The default role should be authorized", func() {
+			So(lc.AuthorizeRole(user, "arn:aws:iam::123456789012:role/default"), ShouldBeNil)
+		})
+
+		Convey("A role matched by a wildcard should be authorized", func() {
+			So(lc.AuthorizeRole(user, "arn:aws:iam::210987654321:role/team/reader"), ShouldBeNil)
+		})
+
+		Convey("A role that was never granted should not be authorized", func() {
+			So(lc.AuthorizeRole(user, "arn:aws:iam::123456789012:role/admin"), ShouldEqual, server.ErrRoleNotAuthorized)
+		})
+
+		Convey("A denied role should not be authorized even if a wildcard matches it", func() {
+			So(lc.AuthorizeRole(user, "arn:aws:iam::210987654321:role/admin"), ShouldEqual, server.ErrRoleNotAuthorized)
+		})
+	})
+}
+
+func TestAuthorizeRoleCaseInsensitive(t *testing.T) {
+	Convey("Given a user granted roles whose names differ in case from the requests", t, func() {
+		user := &server.User{
+			Username:    "testuser",
+			DefaultRole: "arn:aws:iam::123456789012:role/Default",
+			ARNs: []string{
+				"arn:aws:iam::123456789012:role/Developer",
+				"arn:aws:iam::210987654321:role/Team/*",
+				"!arn:aws:iam::210987654321:role/team/Admin",
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+		}
+
+		Convey("By default case differences should be denied", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(&StubLDAPServer{}, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.AuthorizeRole(user, "arn:aws:iam::123456789012:role/developer"), ShouldEqual, server.ErrRoleNotAuthorized)
+		})
+
+		Convey("With case-insensitive role names", func() {
+			opts.CaseInsensitiveRoleNames = true
+			lc, err := server.NewLDAPUserCacheWithOptions(&StubLDAPServer{}, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+
+			Convey("Granted and default roles should match in any case", func() {
+				So(lc.AuthorizeRole(user, "arn:aws:iam::123456789012:role/developer"), ShouldBeNil)
+				So(lc.AuthorizeRole(user, "arn:aws:iam::123456789012:role/DEFAULT"), ShouldBeNil)
+				So(lc.AuthorizeRole(user, "arn:aws:iam::210987654321:role/team/reader"), ShouldBeNil)
+			})
+
+			Convey("Denials should match in any case too", func() {
+				So(lc.AuthorizeRole(user, "arn:aws:iam::210987654321:role/TEAM/admin"), ShouldEqual, server.ErrRoleNotAuthorized)
+			})
+
+			Convey("The rest of the ARN should still be compared exactly", func() {
+				So(lc.AuthorizeRole(user, "ARN:aws:iam::123456789012:role/developer"), ShouldEqual, server.ErrRoleNotAuthorized)
+			})
+
+			Convey("Credential requests should be authorized in any case too", func() {
+				service := server.NewDirectSessionTokenService("123456789012", &countingSTS{clock: &fakeClock{now: time.Now()}}, nil)
+				service.AuthorizeRolesWith(lc)
+				_, err := service.AssumeRole(user, "developer", true)
+				So(err, ShouldBeNil)
+				_, err = service.AssumeRole(user, "arn:aws:iam::210987654321:role/TEAM/admin", true)
+				So(err, ShouldHaveSameTypeAs, &server.RoleNotPermittedError{})
+			})
+
+			Convey("The stored ARNs should be left alone", func() {
+				So(user.ARNs[0], ShouldEqual, "arn:aws:iam::123456789012:role/Developer")
+			})
+		})
+	})
+}
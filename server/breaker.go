@@ -0,0 +1,116 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+)
+
+// States of a refreshBreaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "halfOpen"
+)
+
+/*
+refreshBreaker is a circuit breaker around the refresh that a cache miss
+triggers. After threshold consecutive failures it opens and refuses
+refreshes for cooldown, so that a dead directory is not hammered by every
+authentication. Once the cooldown has passed a single probe is let through
+(half-open); its outcome closes or re-opens the breaker.
+*/
+type refreshBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+	stats     g2s.Statter
+	failures  int
+	state     string
+	openedAt  time.Time
+}
+
+func newRefreshBreaker(threshold int, cooldown time.Duration, clock Clock, stats g2s.Statter) *refreshBreaker {
+	return &refreshBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     clock,
+		stats:     stats,
+		state:     BreakerClosed,
+	}
+}
+
+/*
+allow reports whether a refresh may be attempted now.
+*/
+func (rb *refreshBreaker) allow() bool {
+	rb.Lock()
+	defer rb.Unlock()
+
+	switch rb.state {
+	case BreakerOpen:
+		if rb.clock.Now().Sub(rb.openedAt) < rb.cooldown {
+			return false
+		}
+		rb.transition(BreakerHalfOpen)
+		return true
+	case BreakerHalfOpen:
+		// A probe is already in flight.
+		return false
+	}
+	return true
+}
+
+/*
+record feeds the outcome of an allowed refresh back into the breaker.
+*/
+func (rb *refreshBreaker) record(err error) {
+	rb.Lock()
+	defer rb.Unlock()
+
+	if err == nil {
+		rb.failures = 0
+		if rb.state != BreakerClosed {
+			rb.transition(BreakerClosed)
+		}
+		return
+	}
+
+	rb.failures++
+	if rb.state == BreakerHalfOpen || rb.failures >= rb.threshold {
+		rb.openedAt = rb.clock.Now()
+		rb.transition(BreakerOpen)
+	}
+}
+
+func (rb *refreshBreaker) transition(state string) {
+	if rb.state == state {
+		return
+	}
+	log.Warning("Cache refresh breaker moving from %s to %s.", rb.state, state)
+	rb.stats.Counter(1.0, "refreshBreaker."+state, 1)
+	rb.state = state
+}
+
+func (rb *refreshBreaker) currentState() string {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.state
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPUserCacheRefreshBreaker(t *testing.T) {
+	Convey("Given an LDAP cache with a refresh breaker", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		unknownSigner, _ := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		clock := &fakeClock{now: time.Now()}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:                "cn",
+			SSHAttr:                 "sshPublicKey",
+			RefreshBreakerThreshold: 2,
+			RefreshBreakerCooldown:  time.Minute,
+			Clock:                   clock,
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When the directory goes down", func() {
+			s.Err = errors.New("directory is down")
+			authenticatesWith(lc, unknownSigner)
+			authenticatesWith(lc, unknownSigner)
+
+			Convey("The breaker should open after two failed refreshes", func() {
+				So(lc.RefreshBreakerState(), ShouldEqual, server.BreakerOpen)
+
+				searches := s.Searches
+				authenticatesWith(lc, unknownSigner)
+				So(s.Searches, ShouldEqual, searches)
+			})
+
+			Convey("After the cooldown a failing probe should re-open it", func() {
+				clock.Advance(2 * time.Minute)
+				searches := s.Searches
+				authenticatesWith(lc, unknownSigner)
+				So(s.Searches, ShouldEqual, searches+1)
+				So(lc.RefreshBreakerState(), ShouldEqual, server.BreakerOpen)
+			})
+
+			Convey("After the cooldown a successful probe should close it", func() {
+				s.Err = nil
+				clock.Advance(2 * time.Minute)
+				authenticatesWith(lc, unknownSigner)
+				So(lc.RefreshBreakerState(), ShouldEqual, server.BreakerClosed)
+			})
+		})
+	})
+}
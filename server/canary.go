@@ -0,0 +1,36 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/AdRoll/hologram/log"
+)
+
+/*
+checkCanaries raises a critical alert for every fingerprint in
+Options.CanaryFingerprints that the freshly built index no longer holds.
+Canaries are the keys of people who must always be able to get in, such
+as the on-call responder, so losing one usually means the directory is in
+trouble.
+*/
+func (luc *ldapUserCache) checkCanaries(index *fingerprintIndex) {
+	for _, fingerprint := range luc.opts.CanaryFingerprints {
+		if _, ok := index.keys[fingerprint]; ok {
+			continue
+		}
+		log.Critical("Canary key %s is missing from the directory.", fingerprint)
+		luc.stats.Counter(1.0, "canaryMissing", 1)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+checkCertValidity enforces a certificate's validity window at the given
+time. When maxLifetime is non-zero the window is additionally capped to
+maxLifetime after ValidAfter, so that a certificate issued for an unusually
+long period stops being trusted once it is older than our policy allows,
+even if it has not expired yet.
+*/
+func checkCertValidity(cert *ssh.Certificate, now time.Time, maxLifetime time.Duration) error {
+	unixNow := now.Unix()
+	if after := int64(cert.ValidAfter); after < 0 || unixNow < after {
+		return fmt.Errorf("certificate %q is not yet valid", cert.KeyId)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		if before := int64(cert.ValidBefore); before < 0 || unixNow >= before {
+			return fmt.Errorf("certificate %q has expired", cert.KeyId)
+		}
+	}
+
+	if maxLifetime > 0 {
+		issued := time.Unix(int64(cert.ValidAfter), 0)
+		if now.Sub(issued) > maxLifetime {
+			return fmt.Errorf("certificate %q was issued more than %s ago", cert.KeyId, maxLifetime)
+		}
+	}
+	return nil
+}
+
+/*
+isTrustedUserCA reports whether key is one of Options.TrustedUserCAs.
+*/
+func (luc *ldapUserCache) isTrustedUserCA(key ssh.PublicKey) bool {
+	marshaled := string(key.Marshal())
+	for _, ca := range luc.opts.TrustedUserCAs {
+		if string(ca.Marshal()) == marshaled {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+verifyAuthorityCert authenticates a client presenting a user certificate
+signed by one of Options.TrustedUserCAs. The certificate must be valid
+now and name a cached user among its principals; that user is returned if
+the certificate's key made sshSig. Certificates restricted by a
+source-address are refused, as we cannot see where the agent connected
+from. luc.mu must be held.
+*/
+func (luc *ldapUserCache) verifyAuthorityCert(cert *ssh.Certificate, challenge []byte, sshSig *ssh.Signature, now time.Time) *User {
+	if cert.CertType != ssh.UserCert || !luc.isTrustedUserCA(cert.SignatureKey) {
+		return nil
+	}
+	if _, ok := cert.CriticalOptions["source-address"]; ok {
+		log.Warning("Refusing certificate %q: its source-address cannot be enforced.", cert.KeyId)
+		return nil
+	}
+
+	checker := &ssh.CertChecker{
+		IsAuthority: luc.isTrustedUserCA,
+		Clock:       func() time.Time { return now },
+	}
+	for _, principal := range cert.ValidPrincipals {
+		user, ok := luc.users[luc.normalizeUsername(principal)]
+		if !ok {
+			continue
+		}
+		if err := checker.CheckCert(principal, cert); err != nil {
+			log.Warning("Refusing certificate %q for %s: %s", cert.KeyId, principal, err.Error())
+			return nil
+		}
+		if err := checkCertValidity(cert, now, luc.opts.MaxCertLifetime); err != nil {
+			log.Warning("Refusing certificate for %s: %s", principal, err.Error())
+			return nil
+		}
+		if luc.opts.Verifier.Verify(cert, challenge, sshSig) != nil {
+			return nil
+		}
+		luc.stats.Counter(1.0, "authByUserCA", 1)
+		return user
+	}
+	log.Debug("Certificate %q names no known user among %v.", cert.KeyId, cert.ValidPrincipals)
+	return nil
+}
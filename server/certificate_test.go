@@ -0,0 +1,218 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	cryptrand "crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+newUserCert issues a user certificate for a fresh key, signed by ca and
+valid between the given times. It returns a signer that authenticates with
+the certificate and the certificate's base64 wire encoding.
+*/
+func newUserCert(ca ssh.Signer, validAfter time.Time, validBefore time.Time) (ssh.Signer, string) {
+	userSigner, _ := newECDSASigner(elliptic.P256())
+	cert := &ssh.Certificate{
+		Key:             userSigner.PublicKey(),
+		KeyId:           "testuser",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"testuser"},
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(cryptrand.Reader, ca); err != nil {
+		panic(err)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, userSigner)
+	if err != nil {
+		panic(err)
+	}
+	return certSigner, base64.StdEncoding.EncodeToString(cert.Marshal())
+}
+
+func authenticatesWith(lc server.UserCache, signer ssh.Signer) bool {
+	challenge := randomBytes(64)
+	sig, err := signer.Sign(cryptrand.Reader, challenge)
+	if err != nil {
+		panic(err)
+	}
+	user, _ := lc.Authenticate("testuser", challenge, sig)
+	return user != nil
+}
+
+func TestLDAPUserCacheCertificateLifetime(t *testing.T) {
+	Convey("Given an LDAP cache that trusts certificates for at most 12 hours", t, func() {
+		ca, _ := newECDSASigner(elliptic.P256())
+		now := time.Now()
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			MaxCertLifetime: 12 * time.Hour,
+		}
+
+		Convey("A certificate issued an hour ago should authenticate", func() {
+			signer, cert := newUserCert(ca, now.Add(-time.Hour), now.Add(48*time.Hour))
+			lc, err := server.NewLDAPUserCacheWithOptions(&StubLDAPServer{Keys: []string{cert}}, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+		})
+
+		Convey("A long-lived certificate issued 13 hours ago should not authenticate", func() {
+			signer, cert := newUserCert(ca, now.Add(-13*time.Hour), now.Add(24*time.Hour))
+			lc, err := server.NewLDAPUserCacheWithOptions(&StubLDAPServer{Keys: []string{cert}}, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, signer), ShouldBeFalse)
+		})
+
+		Convey("An expired certificate should not authenticate", func() {
+			signer, cert := newUserCert(ca, now.Add(-2*time.Hour), now.Add(-time.Hour))
+			lc, err := server.NewLDAPUserCacheWithOptions(&StubLDAPServer{Keys: []string{cert}}, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, signer), ShouldBeFalse)
+		})
+	})
+}
+
+/*
+issueCert signs a user certificate for a fresh key with ca, letting the
+caller adjust it first. It returns a signer that authenticates with it.
+*/
+func issueCert(ca ssh.Signer, adjust func(*ssh.Certificate)) ssh.Signer {
+	userSigner, _ := newECDSASigner(elliptic.P256())
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             userSigner.PublicKey(),
+		KeyId:           "jdoe@ca",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"jdoe"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if adjust != nil {
+		adjust(cert)
+	}
+	if err := cert.SignCert(cryptrand.Reader, ca); err != nil {
+		panic(err)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, userSigner)
+	if err != nil {
+		panic(err)
+	}
+	return certSigner
+}
+
+/*
+authenticateWithKey signs a challenge with signer and authenticates,
+passing along the signer's key as an agent does.
+*/
+func authenticateWithKey(lc server.KeyAuthenticator, signer ssh.Signer) *server.User {
+	challenge := randomBytes(64)
+	sig, err := signer.Sign(cryptrand.Reader, challenge)
+	if err != nil {
+		panic(err)
+	}
+	user, _ := lc.AuthenticateKey("derp", challenge, sig, signer.PublicKey())
+	return user
+}
+
+func TestLDAPUserCacheTrustedUserCAs(t *testing.T) {
+	Convey("Given an LDAP cache trusting an SSH CA and a user with no keys", t, func() {
+		ca, _ := newECDSASigner(elliptic.P256())
+		stranger, _ := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=jdoe", map[string][]string{"cn": {"jdoe"}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:       "cn",
+			SSHAttr:        "sshPublicKey",
+			TrustedUserCAs: []ssh.PublicKey{ca.PublicKey()},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("A certificate from the CA should authenticate its principal", func() {
+			user := authenticateWithKey(lc, issueCert(ca, nil))
+			So(user, ShouldNotBeNil)
+			So(user.Username, ShouldEqual, "jdoe")
+		})
+
+		Convey("Users should be found by any of several username attributes", func() {
+			s.Users = append(s.Users, fixtureEntry("uid=asmith", map[string][]string{"uid": {"asmith"}}))
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttrs:      []string{"uid", "cn"},
+				SSHAttr:        "sshPublicKey",
+				TrustedUserCAs: []ssh.PublicKey{ca.PublicKey()},
+			})
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "jdoe")
+			So(lc.Users(), ShouldContainKey, "asmith")
+		})
+
+		Convey("Without trusted CAs a user with no keys should not be loaded", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttr: "cn",
+				SSHAttr:  "sshPublicKey",
+			})
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "jdoe")
+		})
+
+		Convey("A certificate from another CA should not authenticate", func() {
+			So(authenticateWithKey(lc, issueCert(stranger, nil)), ShouldBeNil)
+		})
+
+		Convey("An expired certificate should not authenticate", func() {
+			signer := issueCert(ca, func(cert *ssh.Certificate) {
+				cert.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+			})
+			So(authenticateWithKey(lc, signer), ShouldBeNil)
+		})
+
+		Convey("A certificate naming no known user should not authenticate", func() {
+			signer := issueCert(ca, func(cert *ssh.Certificate) {
+				cert.ValidPrincipals = []string{"root"}
+			})
+			So(authenticateWithKey(lc, signer), ShouldBeNil)
+		})
+
+		Convey("A certificate bound to a source address should not authenticate", func() {
+			signer := issueCert(ca, func(cert *ssh.Certificate) {
+				cert.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"}
+			})
+			So(authenticateWithKey(lc, signer), ShouldBeNil)
+		})
+
+		Convey("A host certificate should not authenticate", func() {
+			signer := issueCert(ca, func(cert *ssh.Certificate) {
+				cert.CertType = ssh.HostCert
+			})
+			So(authenticateWithKey(lc, signer), ShouldBeNil)
+		})
+	})
+}
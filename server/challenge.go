@@ -0,0 +1,142 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors returned for challenges that must not be accepted.
+var (
+	ErrChallengeMalformed = errors.New("challenge was not issued by this server")
+	ErrChallengeExpired   = errors.New("challenge is too old or from the future")
+	ErrChallengeReplayed  = errors.New("challenge has already been used")
+)
+
+// Defaults for the challenges the server issues.
+const (
+	DefaultChallengeSkew     = 2 * time.Minute
+	DefaultChallengeCapacity = 10000
+)
+
+// Challenges are a big-endian Unix nanosecond timestamp and a random nonce.
+const (
+	challengeLength      = 64
+	challengeStampLength = 8
+)
+
+/*
+ChallengeGuard issues the SSH challenges users sign and makes sure each is
+only accepted once, and only while it is recent. It remembers the
+challenges consumed within the skew window, up to capacity of them; when
+full, the oldest are forgotten first.
+*/
+type ChallengeGuard struct {
+	sync.Mutex
+	skew     time.Duration
+	capacity int
+	clock    Clock
+	consumed map[string]*list.Element
+	order    *list.List
+}
+
+type consumedChallenge struct {
+	nonce string
+	at    time.Time
+}
+
+/*
+NewChallengeGuard accepts challenges issued within skew of now and
+remembers up to capacity consumed ones. Non-positive values use the
+defaults, and a nil clock the system clock.
+*/
+func NewChallengeGuard(skew time.Duration, capacity int, clock Clock) *ChallengeGuard {
+	if skew <= 0 {
+		skew = DefaultChallengeSkew
+	}
+	if capacity <= 0 {
+		capacity = DefaultChallengeCapacity
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &ChallengeGuard{
+		skew:     skew,
+		capacity: capacity,
+		clock:    clock,
+		consumed: map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+/*
+Issue returns a fresh challenge stamped with the current time.
+*/
+func (cg *ChallengeGuard) Issue() ([]byte, error) {
+	challenge := make([]byte, challengeLength)
+	binary.BigEndian.PutUint64(challenge, uint64(cg.clock.Now().UnixNano()))
+	if _, err := rand.Read(challenge[challengeStampLength:]); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+/*
+Consume accepts challenge once, if it is well formed and was issued
+within the skew window.
+*/
+func (cg *ChallengeGuard) Consume(challenge []byte) error {
+	if len(challenge) != challengeLength {
+		return ErrChallengeMalformed
+	}
+
+	now := cg.clock.Now()
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(challenge)))
+	if age := now.Sub(issued); age > cg.skew || age < -cg.skew {
+		return ErrChallengeExpired
+	}
+
+	cg.Lock()
+	defer cg.Unlock()
+
+	cg.forget(func(entry consumedChallenge) bool { return now.Sub(entry.at) > 2*cg.skew })
+	nonce := string(challenge)
+	if _, ok := cg.consumed[nonce]; ok {
+		return ErrChallengeReplayed
+	}
+	cg.forget(func(consumedChallenge) bool { return cg.order.Len() >= cg.capacity })
+	cg.consumed[nonce] = cg.order.PushBack(consumedChallenge{nonce: nonce, at: now})
+	return nil
+}
+
+/*
+forget drops consumed challenges, oldest first, for as long as drop says
+to. The lock must be held.
+*/
+func (cg *ChallengeGuard) forget(drop func(consumedChallenge) bool) {
+	for oldest := cg.order.Front(); oldest != nil; oldest = cg.order.Front() {
+		entry := oldest.Value.(consumedChallenge)
+		if !drop(entry) {
+			return
+		}
+		cg.order.Remove(oldest)
+		delete(cg.consumed, entry.nonce)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChallengeGuard(t *testing.T) {
+	Convey("Given a challenge guard with a one minute skew", t, func() {
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		guard := server.NewChallengeGuard(time.Minute, 3, clock)
+
+		Convey("Issued challenges should be distinct and accepted once", func() {
+			first, err := guard.Issue()
+			So(err, ShouldBeNil)
+			second, err := guard.Issue()
+			So(err, ShouldBeNil)
+			So(first, ShouldHaveLength, 64)
+			So(bytes.Equal(first, second), ShouldBeFalse)
+
+			So(guard.Consume(first), ShouldBeNil)
+			So(guard.Consume(second), ShouldBeNil)
+			So(guard.Consume(first), ShouldEqual, server.ErrChallengeReplayed)
+		})
+
+		Convey("Challenges older than the skew should be refused", func() {
+			challenge, _ := guard.Issue()
+			clock.Advance(61 * time.Second)
+			So(guard.Consume(challenge), ShouldEqual, server.ErrChallengeExpired)
+		})
+
+		Convey("Challenges from the future should be refused", func() {
+			clock.Advance(2 * time.Minute)
+			challenge, _ := guard.Issue()
+			clock.Advance(-2 * time.Minute)
+			So(guard.Consume(challenge), ShouldEqual, server.ErrChallengeExpired)
+		})
+
+		Convey("Challenges not issued by the guard should be refused", func() {
+			So(guard.Consume([]byte("short")), ShouldEqual, server.ErrChallengeMalformed)
+		})
+
+		Convey("A replay should be caught while the guard has room for it", func() {
+			replayed, _ := guard.Issue()
+			So(guard.Consume(replayed), ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				challenge, _ := guard.Issue()
+				So(guard.Consume(challenge), ShouldBeNil)
+			}
+			So(guard.Consume(replayed), ShouldEqual, server.ErrChallengeReplayed)
+		})
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/nmcclain/ldap"
+)
+
+/*
+ErrInjectedFault is the cause of the network errors that a chaos LDAP
+wrapper injects.
+*/
+var ErrInjectedFault = errors.New("fault injected by chaos testing")
+
+/*
+ChaosConfig describes the faults to inject into LDAP operations. Each
+operation fails with probability ErrorRate and, independently, is delayed
+by Latency with probability LatencyRate. Seed makes the sequence of faults
+repeatable.
+*/
+type ChaosConfig struct {
+	ErrorRate   float64
+	Latency     time.Duration
+	LatencyRate float64
+	Seed        int64
+}
+
+/*
+chaosLDAP wraps an LDAPImplementation and injects faults into it, so that
+the breaker, retries and stale-cache paths can be exercised on purpose. It
+must only ever be set up explicitly; nothing enables it by default.
+*/
+type chaosLDAP struct {
+	sync.Mutex
+	inner  LDAPImplementation
+	config ChaosConfig
+	random *rand.Rand
+}
+
+/*
+NewChaosLDAP returns inner wrapped in a fault injector. Injected failures
+are LDAP network errors wrapping ErrInjectedFault.
+*/
+func NewChaosLDAP(inner LDAPImplementation, config ChaosConfig) LDAPImplementation {
+	log.Warning("Chaos testing is enabled: LDAP operations will fail %.0f%% of the time and be delayed %s %.0f%% of the time.",
+		config.ErrorRate*100, config.Latency, config.LatencyRate*100)
+	return &chaosLDAP{
+		inner:  inner,
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+/*
+inject delays and returns an error as the dice decide.
+*/
+func (cl *chaosLDAP) inject() error {
+	cl.Lock()
+	delay := cl.random.Float64() < cl.config.LatencyRate
+	fail := cl.random.Float64() < cl.config.ErrorRate
+	cl.Unlock()
+
+	if delay {
+		time.Sleep(cl.config.Latency)
+	}
+	if fail {
+		return ldap.NewError(ldap.ErrorNetwork, ErrInjectedFault)
+	}
+	return nil
+}
+
+func (cl *chaosLDAP) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if err := cl.inject(); err != nil {
+		return nil, err
+	}
+	return cl.inner.Search(searchRequest)
+}
+
+func (cl *chaosLDAP) Modify(modifyRequest *ldap.ModifyRequest) error {
+	if err := cl.inject(); err != nil {
+		return err
+	}
+	return cl.inner.Modify(modifyRequest)
+}
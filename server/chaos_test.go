@@ -0,0 +1,80 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChaosLDAP(t *testing.T) {
+	Convey("Given a directory behind a fault injector", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+
+		Convey("Without faults configured it should pass operations through", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(server.NewChaosLDAP(s, server.ChaosConfig{}), g2s.Noop(), server.Options{
+				UserAttr: "cn",
+				SSHAttr:  "sshPublicKey",
+			})
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+		})
+
+		Convey("Injected failures should surface as LDAP network errors", func() {
+			chaos := server.NewChaosLDAP(s, server.ChaosConfig{ErrorRate: 1})
+			_, err := chaos.Search(&ldap.SearchRequest{})
+			So(err, ShouldNotBeNil)
+			So(err.(*ldap.Error).ResultCode, ShouldEqual, ldap.ErrorNetwork)
+			So(err.(*ldap.Error).Err, ShouldEqual, server.ErrInjectedFault)
+			So(s.Searches, ShouldEqual, 0)
+		})
+
+		Convey("Injected latency should delay operations", func() {
+			chaos := server.NewChaosLDAP(s, server.ChaosConfig{Latency: 20 * time.Millisecond, LatencyRate: 1})
+			start := time.Now()
+			_, err := chaos.Search(&ldap.SearchRequest{})
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+		})
+
+		Convey("Injected failures should trip the refresh breaker", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(server.NewChaosLDAP(s, server.ChaosConfig{ErrorRate: 1}), g2s.Noop(), server.Options{
+				UserAttr: "cn",
+				SSHAttr:  "sshPublicKey",
+
+				RefreshBreakerThreshold: 2,
+				RefreshBreakerCooldown:  time.Minute,
+			})
+			So(err, ShouldNotBeNil)
+
+			So(authenticatesWith(lc, signer), ShouldBeFalse)
+			So(lc.RefreshBreakerState(), ShouldEqual, server.BreakerClosed)
+			So(authenticatesWith(lc, signer), ShouldBeFalse)
+			So(lc.RefreshBreakerState(), ShouldEqual, server.BreakerOpen)
+			So(s.Searches, ShouldEqual, 0)
+		})
+	})
+}
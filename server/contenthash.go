@@ -0,0 +1,104 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+fingerprintSHA256 returns the OpenSSH-style SHA256 fingerprint of a key,
+e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+*/
+func fingerprintSHA256(key ssh.PublicKey) string {
+	return fingerprintBlob(key.Marshal())
+}
+
+func fingerprintBlob(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+/*
+keyFingerprints returns the SHA256 fingerprints of keys, in order.
+*/
+func keyFingerprints(keys []ssh.PublicKey) []string {
+	fingerprints := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fingerprints = append(fingerprints, fingerprintSHA256(key))
+	}
+	return fingerprints
+}
+
+/*
+rawKeyFingerprint identifies a key value that could not be parsed without
+putting the key itself in the logs: it is the SHA256 fingerprint of the
+longest base64 field in the value, the would-be key blob, or failing that
+of the whole value.
+*/
+func rawKeyFingerprint(value string) string {
+	var blob []byte
+	for _, field := range strings.Fields(value) {
+		if decoded, err := base64.StdEncoding.DecodeString(field); err == nil && len(decoded) > len(blob) {
+			blob = decoded
+		}
+	}
+	if blob == nil {
+		blob = []byte(value)
+	}
+	return fingerprintBlob(blob)
+}
+
+/*
+contentHash digests a set of users as sorted (username, key fingerprint,
+ARN) tuples, so that two caches holding the same users hash the same no
+matter the order they were loaded in.
+*/
+func contentHash(users map[string]*User) string {
+	tuples := []string{}
+	for username, user := range users {
+		fingerprints := []string{""}
+		if len(user.SSHKeys) > 0 {
+			fingerprints = fingerprints[:0]
+			for _, key := range user.SSHKeys {
+				fingerprints = append(fingerprints, fingerprintSHA256(key))
+			}
+		}
+		arns := user.ARNs
+		if len(arns) == 0 {
+			arns = []string{""}
+		}
+
+		for _, fingerprint := range fingerprints {
+			for _, arn := range arns {
+				tuples = append(tuples, strings.Join([]string{username, fingerprint, arn}, "\x00"))
+			}
+		}
+	}
+	sort.Strings(tuples)
+
+	hash := sha256.New()
+	for _, tuple := range tuples {
+		hash.Write([]byte(tuple))
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
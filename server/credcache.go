@@ -0,0 +1,128 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/peterbourgon/g2s"
+)
+
+/*
+DefaultCredentialRefreshWindow is how long before they expire cached
+credentials stop being handed out when no other window is configured.
+*/
+const DefaultCredentialRefreshWindow = 5 * time.Minute
+
+// What makes two AssumeRole calls interchangeable.
+type credentialKey struct {
+	roleARN     string
+	sessionName string
+	duration    int64
+}
+
+// An AssumeRole call that other requests for the same key are waiting on.
+type credentialCall struct {
+	done  chan struct{}
+	creds *sts.Credentials
+	err   error
+}
+
+/*
+credentialCache keeps the credentials returned by AssumeRole until they
+are within refreshWindow of expiring, so that bursts of requests for the
+same role do not each cost an STS call. Concurrent misses for the same key
+share a single call.
+*/
+type credentialCache struct {
+	sync.Mutex
+	refreshWindow time.Duration
+	clock         Clock
+	stats         g2s.Statter
+	entries       map[credentialKey]*sts.Credentials
+	inflight      map[credentialKey]*credentialCall
+}
+
+func newCredentialCache(refreshWindow time.Duration, clock Clock, stats g2s.Statter) *credentialCache {
+	if refreshWindow <= 0 {
+		refreshWindow = DefaultCredentialRefreshWindow
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &credentialCache{
+		refreshWindow: refreshWindow,
+		clock:         clock,
+		stats:         stats,
+		entries:       map[credentialKey]*sts.Credentials{},
+		inflight:      map[credentialKey]*credentialCall{},
+	}
+}
+
+/*
+get returns the cached credentials for key, calling assume to get fresh
+ones if there are none worth handing out. Errors are not cached.
+*/
+func (cc *credentialCache) get(key credentialKey, assume func() (*sts.Credentials, error)) (*sts.Credentials, error) {
+	cc.Lock()
+	if creds, ok := cc.entries[key]; ok && cc.usable(creds) {
+		cc.Unlock()
+		cc.stats.Counter(1.0, "credentialCacheHit", 1)
+		return creds, nil
+	}
+	cc.stats.Counter(1.0, "credentialCacheMiss", 1)
+	if call, ok := cc.inflight[key]; ok {
+		cc.Unlock()
+		<-call.done
+		return call.creds, call.err
+	}
+	call := &credentialCall{done: make(chan struct{})}
+	cc.inflight[key] = call
+	cc.Unlock()
+
+	call.creds, call.err = assume()
+
+	cc.Lock()
+	delete(cc.inflight, key)
+	cc.prune()
+	if call.err == nil && call.creds != nil && cc.usable(call.creds) {
+		cc.entries[key] = call.creds
+	}
+	cc.Unlock()
+	close(call.done)
+	return call.creds, call.err
+}
+
+/*
+usable reports whether creds have long enough left to be handed out
+again. The lock must be held.
+*/
+func (cc *credentialCache) usable(creds *sts.Credentials) bool {
+	return creds.Expiration != nil && cc.clock.Now().Add(cc.refreshWindow).Before(*creds.Expiration)
+}
+
+/*
+prune forgets credentials too close to expiry to be handed out. The lock
+must be held.
+*/
+func (cc *credentialCache) prune() {
+	for key, creds := range cc.entries {
+		if !cc.usable(creds) {
+			delete(cc.entries, key)
+		}
+	}
+}
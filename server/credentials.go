@@ -18,12 +18,14 @@ package server
 // It was a service before because it held state, which is now gone.
 
 import (
-	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/AdRoll/hologram/log"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/peterbourgon/g2s"
 )
 
 /*
@@ -36,6 +38,25 @@ type CredentialService interface {
 	GetSessionToken() (*sts.Credentials, error)
 }
 
+/*
+DurationCredentialService is a CredentialService that can also issue role
+credentials lasting a requested time. A zero duration asks for the
+default.
+*/
+type DurationCredentialService interface {
+	CredentialService
+	AssumeRoleFor(user *User, role string, enableLDAPRoles bool, duration time.Duration) (*sts.Credentials, error)
+}
+
+// Session durations STS accepts for AssumeRole.
+const (
+	MinSessionDuration = 15 * time.Minute
+	MaxSessionDuration = 12 * time.Hour
+)
+
+// The duration of role sessions when none is requested.
+const DefaultSessionDuration = time.Hour
+
 /*
 STSImplementation exists to enable dependency injection of an
 implementation of STS.
@@ -52,68 +73,183 @@ compiled into the application.
 */
 type directSessionTokenService struct {
 	iamAccount     string
-	sts            *sts.STS
+	partition      string
+	sts            STSImplementation
 	accountAliases *map[string]string
+	cache          *credentialCache
+	maxDuration    time.Duration
+	externalIDs    map[string]string
+	chain          *roleChain
+	authorizer     RoleAuthorizer
+	roleDurations  *roleDurations
 }
 
 /*
 NewDirectSessionTokenService returns a credential service that talks
 to Amazon directly.
 */
-func NewDirectSessionTokenService(iamAccount string, sts *sts.STS, accountAliases *map[string]string) *directSessionTokenService {
-	return &directSessionTokenService{iamAccount: iamAccount, sts: sts, accountAliases: accountAliases}
+func NewDirectSessionTokenService(iamAccount string, sts STSImplementation, accountAliases *map[string]string) *directSessionTokenService {
+	return &directSessionTokenService{iamAccount: iamAccount, partition: DefaultPartition, sts: sts, accountAliases: accountAliases}
+}
+
+/*
+UsePartition sets the AWS partition, such as "aws-us-gov", that role names
+are qualified in. Call it before the methods that take roles.
+*/
+func (s *directSessionTokenService) UsePartition(partition string) {
+	s.partition = partition
+}
+
+/*
+UseExternalIDs sets the external IDs to pass to STS when assuming roles
+whose trust policies require one, keyed by role in any form BuildARN
+accepts.
+*/
+func (s *directSessionTokenService) UseExternalIDs(externalIDs map[string]string) {
+	s.externalIDs = make(map[string]string, len(externalIDs))
+	for role, externalID := range externalIDs {
+		s.externalIDs[s.buildARN(role)] = externalID
+	}
+}
+
+/*
+LimitSessionDuration sets the longest session AssumeRoleFor will request,
+kept within what STS accepts. Without LookupRoleDurations it applies to
+every role and should not exceed the MaxSessionDuration of any role users
+assume; it defaults to an hour, the MaxSessionDuration roles are created
+with.
+*/
+func (s *directSessionTokenService) LimitSessionDuration(max time.Duration) {
+	s.maxDuration = clampDuration(max, MinSessionDuration, MaxSessionDuration)
+}
+
+/*
+LookupRoleDurations makes AssumeRoleFor limit sessions by each role's own
+MaxSessionDuration, read from source and cached for ttl. The limit set by
+LimitSessionDuration, if any, remains an upper bound. Roles whose
+duration cannot be looked up, including those in other accounts, are
+limited as they would be without it. A nil clock uses the system clock.
+*/
+func (s *directSessionTokenService) LookupRoleDurations(source RoleDurationSource, ttl time.Duration, clock Clock) {
+	s.roleDurations = newRoleDurations(source, s.iamAccount, ttl, clock)
+}
+
+/*
+AuthorizeRolesWith makes AssumeRole ask authorizer whether a user may
+assume a role, so that the check follows the user cache's options.
+Without one, roles are matched exactly when LDAP roles are enabled.
+*/
+func (s *directSessionTokenService) AuthorizeRolesWith(authorizer RoleAuthorizer) {
+	s.authorizer = authorizer
+}
+
+/*
+CacheCredentials makes AssumeRole reuse the credentials it got for the
+same role, session name and duration until they are within refreshWindow
+of expiring, counting hits and misses in stats. Users are still checked
+against the role every time. A nil clock uses the system clock.
+*/
+func (s *directSessionTokenService) CacheCredentials(refreshWindow time.Duration, clock Clock, stats g2s.Statter) {
+	s.cache = newCredentialCache(refreshWindow, clock, stats)
 }
 
 func (s *directSessionTokenService) Start() error {
 	return nil
 }
 
+// DefaultPartition is the commercial AWS partition roles are qualified in.
+const DefaultPartition = "aws"
+
 func BuildARN(role string, defaultAccount string, accountAliases *map[string]string) string {
+	return BuildPartitionARN(role, DefaultPartition, defaultAccount, accountAliases)
+}
+
+/*
+BuildPartitionARN is BuildARN for roles in partition. Roles that are
+already IAM ARNs, in any partition, are returned as they are.
+*/
+func BuildPartitionARN(role string, partition string, defaultAccount string, accountAliases *map[string]string) string {
 	var arn string
 
 	split := strings.Split(role, "/")
 	if len(split) == 2 && accountAliases != nil && (*accountAliases)[split[0]] != "" {
 		arn = fmt.Sprintf("%s:role/%s", (*accountAliases)[split[0]], split[1])
-	} else if strings.HasPrefix(role, "arn:aws:iam") {
+	} else if isIAMARN(role) {
 		arn = role
 	} else if strings.Contains(role, ":role/") {
-		arn = fmt.Sprintf("arn:aws:iam::%s", role)
+		arn = fmt.Sprintf("arn:%s:iam::%s", partition, role)
 	} else {
-		arn = fmt.Sprintf("arn:aws:iam::%s:role/%s", defaultAccount, role)
+		arn = fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, defaultAccount, role)
 	}
 	return arn
 }
 
-func (s *directSessionTokenService) AssumeRole(user *User, role string, enableLDAPRoles bool) (*sts.Credentials, error) {
-	var arn string = BuildARN(role, s.iamAccount, s.accountAliases)
+// isIAMARN reports whether role starts with "arn:<partition>:iam:".
+func isIAMARN(role string) bool {
+	parts := strings.SplitN(role, ":", 4)
+	return len(parts) == 4 && parts[0] == "arn" && parts[1] != "" && parts[2] == "iam"
+}
 
-	log.Debug("Checking ARN %s against user %s (with access %s)", arn, user.Username, enableLDAPRoles)
+func (s *directSessionTokenService) buildARN(role string) string {
+	return BuildPartitionARN(role, s.partition, s.iamAccount, s.accountAliases)
+}
 
-	if enableLDAPRoles {
-		found := false
-		for _, a := range user.ARNs {
-			a = BuildARN(a, s.iamAccount, s.accountAliases)
-			if arn == a {
-				found = true
-				break
-			}
-		}
+func (s *directSessionTokenService) AssumeRole(user *User, role string, enableLDAPRoles bool) (*sts.Credentials, error) {
+	return s.AssumeRoleFor(user, role, enableLDAPRoles, 0)
+}
 
-		log.Debug("Found %s", found)
+/*
+AssumeRoleFor is AssumeRole for a session of the requested duration,
+clamped to the limit set by LimitSessionDuration and to what STS accepts.
+*/
+func (s *directSessionTokenService) AssumeRoleFor(user *User, role string, enableLDAPRoles bool, requested time.Duration) (*sts.Credentials, error) {
+	var arn string = s.buildARN(role)
 
-		if !found {
-			return nil, errors.New(fmt.Sprintf("User %s is not authorized to assume role %s!", user.Username, arn))
-		}
+	log.Debug("Checking ARN %s against user %s (with access %s)", arn, user.Username, enableLDAPRoles)
+
+	if err := s.authorize(user, arn, enableLDAPRoles); err != nil {
+		return nil, &RoleNotPermittedError{Username: user.Username, Role: arn}
 	}
 	log.Debug("User: %s", user.Username)
-	duration := int64(3600)
+	sessionName := SessionName(user.Username)
+	duration := int64(s.sessionDuration(user.Username, arn, requested) / time.Second)
 	options := &sts.AssumeRoleInput{
 		DurationSeconds: &duration,
 		RoleArn:         &arn,
-		RoleSessionName: &user.Username,
+		RoleSessionName: &sessionName,
+	}
+	externalID, hasExternalID := s.externalIDs[arn]
+	if hasExternalID {
+		options.ExternalId = &externalID
+	}
+
+	assume := func() (*sts.Credentials, error) {
+		creds, err := s.assumeRole(options)
+		if err != nil && !hasExternalID && accessDenied(err) {
+			return nil, fmt.Errorf("STS refused to let Hologram assume %s. If the role's trust policy requires an external ID, configure one for it. (%s)", arn, err.Error())
+		}
+		return creds, err
+	}
+	if s.cache == nil {
+		return assume()
 	}
+	key := credentialKey{roleARN: arn, sessionName: sessionName, duration: duration}
+	return s.cache.get(key, assume)
+}
 
-	r, err := s.sts.AssumeRole(options)
+func accessDenied(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "AccessDenied"
+}
+
+func (s *directSessionTokenService) assumeRole(options *sts.AssumeRoleInput) (*sts.Credentials, error) {
+	var r *sts.AssumeRoleOutput
+	var err error
+	if s.chain != nil {
+		r, err = s.chain.assume(s.sts, options)
+	} else {
+		r, err = s.sts.AssumeRole(options)
+	}
 	if err != nil {
 		log.Debug("Error!! %s", err.Error())
 		return nil, err
@@ -121,6 +257,90 @@ func (s *directSessionTokenService) AssumeRole(user *User, role string, enableLD
 	return r.Credentials, nil
 }
 
+/*
+authorize checks that user may assume arn. An authorizer is asked about
+every role, so that it sees each one used and applies its own LDAP roles
+setting; without one, roles are only checked if enableLDAPRoles is set.
+*/
+func (s *directSessionTokenService) authorize(user *User, arn string, enableLDAPRoles bool) error {
+	if s.authorizer != nil {
+		return s.authorizer.AuthorizeRole(s.qualifyRoles(user), arn)
+	}
+	if enableLDAPRoles && !roleAuthorized(s.qualifyRoles(user), arn, false) {
+		return ErrRoleNotAuthorized
+	}
+	return nil
+}
+
+/*
+qualifyRoles returns a copy of user whose roles are full ARNs, so that
+they can be compared with a requested one.
+*/
+func (s *directSessionTokenService) qualifyRoles(user *User) *User {
+	qualified := *user
+	qualified.ARNs = make([]string, 0, len(user.ARNs))
+	for _, a := range user.ARNs {
+		if strings.HasPrefix(a, "!") {
+			qualified.ARNs = append(qualified.ARNs, "!"+s.buildARN(a[1:]))
+		} else {
+			qualified.ARNs = append(qualified.ARNs, s.buildARN(a))
+		}
+	}
+	if user.DefaultRole != "" {
+		qualified.DefaultRole = s.buildARN(user.DefaultRole)
+	}
+	return &qualified
+}
+
+/*
+sessionDuration decides how long a requested session for arn may last,
+logging when the request has to be clamped.
+*/
+func (s *directSessionTokenService) sessionDuration(username string, arn string, requested time.Duration) time.Duration {
+	max := s.durationLimit(arn)
+	if s.chain != nil && max > chainedSessionDuration {
+		max = chainedSessionDuration
+	}
+	if requested == 0 {
+		return clampDuration(DefaultSessionDuration, MinSessionDuration, max)
+	}
+	duration := clampDuration(requested, MinSessionDuration, max)
+	if duration != requested {
+		log.Info("Clamped the %s session %s requested for %s to %s.", requested, username, arn, duration)
+	}
+	return duration
+}
+
+/*
+durationLimit is the longest session arn may have: its own
+MaxSessionDuration within the configured limit if it can be looked up,
+or else the configured limit or an hour.
+*/
+func (s *directSessionTokenService) durationLimit(arn string) time.Duration {
+	if s.roleDurations != nil {
+		if roleMax, ok := s.roleDurations.lookup(arn); ok {
+			if s.maxDuration > 0 && s.maxDuration < roleMax {
+				return s.maxDuration
+			}
+			return roleMax
+		}
+	}
+	if s.maxDuration > 0 {
+		return s.maxDuration
+	}
+	return DefaultSessionDuration
+}
+
+func clampDuration(d time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
 func (s *directSessionTokenService) GetSessionToken() (*sts.Credentials, error) {
 	input := sts.GetSessionTokenInput{}
 	response, err := s.sts.GetSessionToken(&input)
@@ -1,12 +1,63 @@
 package server_test
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/hologram/server"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sts"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+/*
+countingSTS issues hour-long credentials as of clock's time, counting the
+AssumeRole calls and, if release is set, holding each until it is closed.
+*/
+type countingSTS struct {
+	sync.Mutex
+	clock      *fakeClock
+	calls      int
+	duration   int64
+	externalID *string
+	err        error
+	release    chan struct{}
+}
+
+func (cs *countingSTS) AssumeRole(options *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	cs.Lock()
+	cs.calls++
+	cs.duration = *options.DurationSeconds
+	cs.externalID = options.ExternalId
+	release, err := cs.release, cs.err
+	expiration := cs.clock.Now().Add(time.Hour)
+	cs.Unlock()
+
+	if release != nil {
+		<-release
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId: aws.String(*options.RoleArn + "/" + *options.RoleSessionName),
+		Expiration:  &expiration,
+	}}, nil
+}
+
+func (cs *countingSTS) GetSessionToken(*sts.GetSessionTokenInput) (*sts.GetSessionTokenOutput, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (cs *countingSTS) callCount() int {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.calls
+}
+
 func TestBuildARN(t *testing.T) {
 	aliases := map[string]string{
 		"a1": "arn:aws:iam::1234",
@@ -22,4 +73,223 @@ func TestBuildARN(t *testing.T) {
 		So(role, ShouldResemble, "arn:aws:iam::1234:role/rolename")
 	})
 
+	Convey("An ARN in another partition should be returned as it is", t, func() {
+		role := server.BuildARN("arn:aws-us-gov:iam::1234:role/rolename", "99999", &aliases)
+		So(role, ShouldEqual, "arn:aws-us-gov:iam::1234:role/rolename")
+	})
+
+	Convey("A role name should be qualified in the given partition", t, func() {
+		So(server.BuildPartitionARN("rolename", "aws-us-gov", "99999", nil), ShouldEqual, "arn:aws-us-gov:iam::99999:role/rolename")
+		So(server.BuildPartitionARN("1234:role/rolename", "aws-us-gov", "99999", nil), ShouldEqual, "arn:aws-us-gov:iam::1234:role/rolename")
+	})
+
+}
+
+func TestCredentialCache(t *testing.T) {
+	Convey("Given a credential service caching AssumeRole results", t, func() {
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		fake := &countingSTS{clock: clock}
+		stats := newRecordingStatter()
+		service := server.NewDirectSessionTokenService("123456789012", fake, nil)
+		service.CacheCredentials(5*time.Minute, clock, stats)
+
+		alice := &server.User{Username: "alice", ARNs: []string{"developer"}}
+		bob := &server.User{Username: "bob", ARNs: []string{"developer"}}
+
+		Convey("Repeated requests should share one AssumeRole call", func() {
+			first, err := service.AssumeRole(alice, "developer", true)
+			So(err, ShouldBeNil)
+			second, err := service.AssumeRole(alice, "developer", true)
+			So(err, ShouldBeNil)
+			So(second, ShouldEqual, first)
+			So(fake.callCount(), ShouldEqual, 1)
+			So(stats.Count("credentialCacheMiss"), ShouldEqual, 1)
+			So(stats.Count("credentialCacheHit"), ShouldEqual, 1)
+		})
+
+		Convey("Different session names should not share credentials", func() {
+			first, _ := service.AssumeRole(alice, "developer", true)
+			second, _ := service.AssumeRole(bob, "developer", true)
+			So(*second.AccessKeyId, ShouldNotEqual, *first.AccessKeyId)
+			So(fake.callCount(), ShouldEqual, 2)
+		})
+
+		Convey("Credentials within the refresh window should be replaced", func() {
+			service.AssumeRole(alice, "developer", true)
+			clock.Advance(54 * time.Minute)
+			service.AssumeRole(alice, "developer", true)
+			So(fake.callCount(), ShouldEqual, 1)
+			clock.Advance(2 * time.Minute)
+			service.AssumeRole(alice, "developer", true)
+			So(fake.callCount(), ShouldEqual, 2)
+		})
+
+		Convey("A user without the role should be refused even when it is cached", func() {
+			service.AssumeRole(alice, "developer", true)
+			_, err := service.AssumeRole(&server.User{Username: "alice"}, "developer", true)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Errors should not be cached", func() {
+			fake.err = errors.New("throttled")
+			_, err := service.AssumeRole(alice, "developer", true)
+			So(err, ShouldNotBeNil)
+			fake.err = nil
+			_, err = service.AssumeRole(alice, "developer", true)
+			So(err, ShouldBeNil)
+			So(fake.callCount(), ShouldEqual, 2)
+		})
+
+		Convey("Concurrent misses should collapse into one call", func() {
+			fake.release = make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					service.AssumeRole(alice, "developer", true)
+				}()
+			}
+			So(eventually(func() bool { return fake.callCount() == 1 }), ShouldBeTrue)
+			time.Sleep(10 * time.Millisecond)
+			close(fake.release)
+			wg.Wait()
+			So(fake.callCount(), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Without caching every request should call AssumeRole", t, func() {
+		fake := &countingSTS{clock: &fakeClock{now: time.Now()}}
+		service := server.NewDirectSessionTokenService("123456789012", fake, nil)
+		user := &server.User{Username: "alice"}
+		service.AssumeRole(user, "developer", false)
+		service.AssumeRole(user, "developer", false)
+		So(fake.callCount(), ShouldEqual, 2)
+	})
+}
+
+func TestSessionDuration(t *testing.T) {
+	Convey("Given a credential service allowing sessions of up to four hours", t, func() {
+		fake := &countingSTS{clock: &fakeClock{now: time.Now()}}
+		service := server.NewDirectSessionTokenService("123456789012", fake, nil)
+		service.LimitSessionDuration(4 * time.Hour)
+		user := &server.User{Username: "alice"}
+
+		Convey("No requested duration should keep the one hour default", func() {
+			_, err := service.AssumeRole(user, "developer", false)
+			So(err, ShouldBeNil)
+			So(fake.duration, ShouldEqual, 3600)
+		})
+
+		Convey("A duration within the limits should be used as is", func() {
+			_, err := service.AssumeRoleFor(user, "developer", false, 2*time.Hour)
+			So(err, ShouldBeNil)
+			So(fake.duration, ShouldEqual, 7200)
+		})
+
+		Convey("Durations outside the limits should be clamped", func() {
+			service.AssumeRoleFor(user, "developer", false, 12*time.Hour)
+			So(fake.duration, ShouldEqual, 4*3600)
+			service.AssumeRoleFor(user, "developer", false, time.Minute)
+			So(fake.duration, ShouldEqual, 900)
+		})
+
+		Convey("The limit itself should stay within what STS accepts", func() {
+			service.LimitSessionDuration(48 * time.Hour)
+			service.AssumeRoleFor(user, "developer", false, 24*time.Hour)
+			So(fake.duration, ShouldEqual, 12*3600)
+		})
+	})
+}
+
+func TestExternalIDs(t *testing.T) {
+	Convey("Given a credential service with an external ID for one role", t, func() {
+		fake := &countingSTS{clock: &fakeClock{now: time.Now()}}
+		service := server.NewDirectSessionTokenService("123456789012", fake, nil)
+		service.UseExternalIDs(map[string]string{"partner": "s3cr3t-id"})
+		user := &server.User{Username: "alice"}
+
+		Convey("Assuming that role should pass its external ID", func() {
+			_, err := service.AssumeRole(user, "arn:aws:iam::123456789012:role/partner", false)
+			So(err, ShouldBeNil)
+			So(fake.externalID, ShouldNotBeNil)
+			So(*fake.externalID, ShouldEqual, "s3cr3t-id")
+		})
+
+		Convey("Other roles should be assumed without one", func() {
+			_, err := service.AssumeRole(user, "developer", false)
+			So(err, ShouldBeNil)
+			So(fake.externalID, ShouldBeNil)
+		})
+
+		Convey("An access denied error for a role without one should say how to fix it", func() {
+			fake.err = awserr.New("AccessDenied", "not authorized to perform sts:AssumeRole", nil)
+			_, err := service.AssumeRole(user, "developer", false)
+			So(err.Error(), ShouldContainSubstring, "requires an external ID")
+			So(err.Error(), ShouldContainSubstring, "arn:aws:iam::123456789012:role/developer")
+		})
+
+		Convey("Other errors should be passed on as they are", func() {
+			fake.err = awserr.New("Throttling", "rate exceeded", nil)
+			_, err := service.AssumeRole(user, "developer", false)
+			So(err, ShouldEqual, fake.err)
+		})
+	})
+}
+
+func TestCredentialAuthorization(t *testing.T) {
+	Convey("Given a user granted a path of roles but one, and a default role", t, func() {
+		fake := &countingSTS{clock: &fakeClock{now: time.Now()}}
+		service := server.NewDirectSessionTokenService("123456789012", fake, nil)
+		user := &server.User{
+			Username:    "alice",
+			ARNs:        []string{"arn:aws:iam::123456789012:role/team/*", "!arn:aws:iam::123456789012:role/team/admin"},
+			DefaultRole: "readonly",
+		}
+
+		Convey("Roles matching a wildcard should be issued", func() {
+			_, err := service.AssumeRole(user, "arn:aws:iam::123456789012:role/team/deployer", true)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("The default role should be issued", func() {
+			_, err := service.AssumeRole(user, "readonly", true)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Denied and ungranted roles should be refused before calling STS", func() {
+			for _, role := range []string{"team/admin", "developer"} {
+				_, err := service.AssumeRole(user, role, true)
+				So(err, ShouldHaveSameTypeAs, &server.RoleNotPermittedError{})
+				So(errors.Is(err, server.ErrRoleNotAuthorized), ShouldBeTrue)
+			}
+			So(fake.callCount(), ShouldEqual, 0)
+		})
+
+		Convey("An authorizer should be asked with the qualified roles", func() {
+			authorizer := &recordingAuthorizer{err: server.ErrRoleNotAuthorized}
+			service.AuthorizeRolesWith(authorizer)
+			_, err := service.AssumeRole(user, "team/deployer", true)
+			So(err, ShouldHaveSameTypeAs, &server.RoleNotPermittedError{})
+			So(authorizer.arn, ShouldEqual, "arn:aws:iam::123456789012:role/team/deployer")
+			So(authorizer.user.DefaultRole, ShouldEqual, "arn:aws:iam::123456789012:role/readonly")
+			So(fake.callCount(), ShouldEqual, 0)
+		})
+
+		Convey("Without LDAP roles the decision should be left to IAM", func() {
+			_, err := service.AssumeRole(user, "developer", false)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+type recordingAuthorizer struct {
+	user *server.User
+	arn  string
+	err  error
+}
+
+func (a *recordingAuthorizer) AuthorizeRole(user *server.User, requestedARN string) error {
+	a.user, a.arn = user, requestedARN
+	return a.err
 }
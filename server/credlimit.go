@@ -0,0 +1,80 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+ErrCredentialRateLimited is returned when a user has requested credentials
+too often.
+*/
+var ErrCredentialRateLimited = errors.New("too many credential requests; try again later")
+
+/*
+CredentialRateLimiter caps how many credentials each user may be issued
+within a sliding window, independently of how often they authenticate, to
+bound the STS calls a single user can cause.
+*/
+type CredentialRateLimiter struct {
+	sync.Mutex
+	limit    int
+	window   time.Duration
+	clock    Clock
+	requests map[string][]time.Time
+}
+
+/*
+NewCredentialRateLimiter allows each user limit credential requests per
+window. A nil clock uses the system clock.
+*/
+func NewCredentialRateLimiter(limit int, window time.Duration, clock Clock) *CredentialRateLimiter {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &CredentialRateLimiter{
+		limit:    limit,
+		window:   window,
+		clock:    clock,
+		requests: map[string][]time.Time{},
+	}
+}
+
+/*
+Allow records a credential request by username, returning
+ErrCredentialRateLimited instead if it would exceed the limit.
+*/
+func (crl *CredentialRateLimiter) Allow(username string) error {
+	crl.Lock()
+	defer crl.Unlock()
+
+	now := crl.clock.Now()
+	recent := crl.requests[username][:0]
+	for _, at := range crl.requests[username] {
+		if now.Sub(at) < crl.window {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= crl.limit {
+		crl.requests[username] = recent
+		return ErrCredentialRateLimited
+	}
+	crl.requests[username] = append(recent, now)
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCredentialRateLimiter(t *testing.T) {
+	Convey("Given a limiter allowing two credential requests a minute", t, func() {
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		limiter := server.NewCredentialRateLimiter(2, time.Minute, clock)
+
+		Convey("A third request within the minute should be refused", func() {
+			So(limiter.Allow("alice"), ShouldBeNil)
+			So(limiter.Allow("alice"), ShouldBeNil)
+			So(limiter.Allow("alice"), ShouldEqual, server.ErrCredentialRateLimited)
+
+			Convey("Without affecting other users", func() {
+				So(limiter.Allow("bob"), ShouldBeNil)
+			})
+
+			Convey("And requests should be allowed again once the minute has passed", func() {
+				clock.Advance(time.Minute)
+				So(limiter.Allow("alice"), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestServerCredentialRateLimit(t *testing.T) {
+	Convey("Given a server that issues one set of credentials per user a minute", t, func() {
+		authenticator := &DummyAuthenticator{&server.User{Username: "words"}}
+		testServer := server.New(authenticator, &dummyCredentials{}, "default", g2s.Noop(), &DummyLDAP{}, "cn", "sshPublicKey", "dc=testdn,dc=com", false, "")
+		testServer.LimitCredentialRequests(server.NewCredentialRateLimiter(1, time.Minute, nil))
+
+		requestCredentials := func() *protocol.Message {
+			r, w := io.Pipe()
+			testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
+			go testServer.HandleConnection(testConnection)
+
+			role := "testrole"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{AssumeRole: &protocol.AssumeRole{Role: &role}},
+			})
+			_, err := testConnection.Read()
+			So(err, ShouldBeNil)
+
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{Format: &format, Signature: []byte("ssss")},
+				},
+			})
+			msg, err := testConnection.Read()
+			So(err, ShouldBeNil)
+			return msg
+		}
+
+		Convey("A second request should be refused although the user authenticates", func() {
+			So(requestCredentials().GetServerResponse().GetCredentials(), ShouldNotBeNil)
+
+			msg := requestCredentials()
+			So(msg.GetServerResponse().GetCredentials(), ShouldBeNil)
+			So(msg.GetError(), ShouldEqual, server.ErrCredentialRateLimited.Error())
+		})
+	})
+}
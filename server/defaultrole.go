@@ -0,0 +1,86 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/AdRoll/hologram/log"
+)
+
+/*
+Sources of a user's default role, for Options.DefaultRolePrecedence.
+DefaultRoleFromUser is the user's DefaultRoleAttr, DefaultRoleFromGroup
+the role of the first group in Options.DefaultRoleGroups the user belongs
+to, and DefaultRoleFromGlobal the configured DefaultRole.
+*/
+const (
+	DefaultRoleFromUser   = "user"
+	DefaultRoleFromGroup  = "group"
+	DefaultRoleFromGlobal = "global"
+)
+
+/*
+chooseDefaultRole walks the configured precedence and returns the first
+candidate that the user's ARNs grant, memberOf being the user's groups. Without a configured precedence the
+per-user attribute wins over the global default, unvalidated, as it always
+has.
+*/
+func (luc *ldapUserCache) chooseDefaultRole(attrs entryAttributes, username string, arns []string, memberOf []string, groups map[string][]string) string {
+	if len(luc.opts.DefaultRolePrecedence) == 0 {
+		if role := attrs.value(luc.opts.DefaultRoleAttr); role != "" {
+			return luc.rewriteARN(role)
+		}
+		return luc.rewriteARN(luc.opts.DefaultRole)
+	}
+
+	for _, source := range luc.opts.DefaultRolePrecedence {
+		candidate := ""
+		switch source {
+		case DefaultRoleFromUser:
+			candidate = attrs.value(luc.opts.DefaultRoleAttr)
+		case DefaultRoleFromGroup:
+			candidate = luc.groupDefaultRole(memberOf, groups)
+		case DefaultRoleFromGlobal:
+			candidate = luc.opts.DefaultRole
+		default:
+			log.Warning("Unknown default role source %q; skipping it.", source)
+		}
+		if candidate == "" {
+			continue
+		}
+		candidate = luc.rewriteARN(candidate)
+		if !roleAuthorized(&User{ARNs: arns}, candidate, luc.opts.CaseInsensitiveRoleNames) {
+			log.Debug("Not using %s as the default role of %s, who has not been granted it.", candidate, username)
+			continue
+		}
+		return candidate
+	}
+	return ""
+}
+
+/*
+groupDefaultRole returns the first role of the highest-priority group in
+Options.DefaultRoleGroups that memberOf lists.
+*/
+func (luc *ldapUserCache) groupDefaultRole(memberOf []string, groups map[string][]string) string {
+	for _, groupDN := range luc.opts.DefaultRoleGroups {
+		if !containsString(memberOf, groupDN) {
+			continue
+		}
+		if roles := groups[groupDN]; len(roles) > 0 {
+			return roles[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDefaultRolePrecedence(t *testing.T) {
+	Convey("Given users in role groups and a user > group > global precedence", t, func() {
+		const (
+			developer = "arn:aws:iam::123456789012:role/developer"
+			reader    = "arn:aws:iam::123456789012:role/reader"
+			global    = "arn:aws:iam::123456789012:role/global"
+		)
+		_, key := newECDSASigner(elliptic.P256())
+		user := func(name string, attributes map[string][]string) *ldap.Entry {
+			attributes["cn"] = []string{name}
+			attributes["sshPublicKey"] = []string{key}
+			return fixtureEntry("cn="+name, attributes)
+		}
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				user("own", map[string][]string{
+					"memberOf": {"cn=readers", "cn=developers"}, "defaultRole": {reader},
+				}),
+				user("ungranted", map[string][]string{
+					"memberOf": {"cn=readers", "cn=developers"}, "defaultRole": {"arn:aws:iam::123456789012:role/admin"},
+				}),
+				user("reader", map[string][]string{"memberOf": {"cn=readers"}}),
+				user("global", map[string][]string{"memberOf": {"cn=everyone"}}),
+				user("nothing", map[string][]string{"memberOf": {"cn=others"}}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{"businessCategory": {developer}}),
+				fixtureEntry("cn=readers", map[string][]string{"businessCategory": {reader}}),
+				fixtureEntry("cn=everyone", map[string][]string{"businessCategory": {global}}),
+				fixtureEntry("cn=others", map[string][]string{"businessCategory": {"arn:aws:iam::123456789012:role/other"}}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			DefaultRole:     global,
+			DefaultRoleAttr: "defaultRole",
+
+			DefaultRolePrecedence: []string{server.DefaultRoleFromUser, server.DefaultRoleFromGroup, server.DefaultRoleFromGlobal},
+			DefaultRoleGroups:     []string{"cn=developers", "cn=readers"},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+		So(err, ShouldBeNil)
+		users := lc.Users()
+
+		Convey("A granted per-user attribute should win", func() {
+			So(users["own"].DefaultRole, ShouldEqual, reader)
+		})
+
+		Convey("An ungranted per-user attribute should fall through to the highest-priority group", func() {
+			So(users["ungranted"].DefaultRole, ShouldEqual, developer)
+		})
+
+		Convey("Without the attribute a lower-priority group should be used", func() {
+			So(users["reader"].DefaultRole, ShouldEqual, reader)
+		})
+
+		Convey("Without a listed group the granted global default should be used", func() {
+			So(users["global"].DefaultRole, ShouldEqual, global)
+		})
+
+		Convey("If no candidate is granted there should be no default role", func() {
+			So(users["nothing"].DefaultRole, ShouldEqual, "")
+		})
+
+		Convey("Without a precedence the old unvalidated behaviour should remain", func() {
+			opts.DefaultRolePrecedence = nil
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["ungranted"].DefaultRole, ShouldEqual, "arn:aws:iam::123456789012:role/admin")
+			So(lc.Users()["nothing"].DefaultRole, ShouldEqual, global)
+		})
+	})
+}
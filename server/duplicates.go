@@ -0,0 +1,64 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+/*
+Policies for two entries of one search that resolve to the same username.
+DuplicateLastWins keeps the entry returned last, DuplicateFirstWins the
+one returned first. DuplicateUnion merges their keys and ARNs, as
+MergeUsers does. DuplicateError fails the update.
+*/
+const (
+	DuplicateLastWins  = "lastWins"
+	DuplicateFirstWins = "firstWins"
+	DuplicateUnion     = "union"
+	DuplicateError     = "error"
+)
+
+/*
+ErrDuplicateUser fails an update under DuplicateError when two entries
+share a username.
+*/
+var ErrDuplicateUser = errors.New("several directory entries have the same username")
+
+/*
+resolveDuplicate decides, according to Options.DuplicateUserPolicy, which
+user to keep when user has the same name as existing, loaded earlier in
+the same search.
+*/
+func (luc *ldapUserCache) resolveDuplicate(existing *User, user *User) (*User, error) {
+	luc.stats.Counter(1.0, "duplicateUser", 1)
+
+	switch luc.opts.DuplicateUserPolicy {
+	case DuplicateFirstWins:
+		log.Warning("Several entries have the username %s; keeping the first.", user.Username)
+		return existing, nil
+	case DuplicateUnion:
+		log.Warning("Several entries have the username %s; merging them.", user.Username)
+		return MergeUsers(existing, user), nil
+	case DuplicateError:
+		log.Errorf("Several entries have the username %s; refusing to update the user cache.", user.Username)
+		return nil, ErrDuplicateUser
+	default:
+		log.Warning("Several entries have the username %s; keeping the last.", user.Username)
+		return user, nil
+	}
+}
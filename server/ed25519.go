@@ -0,0 +1,134 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Errors returned by the strict ed25519 checks.
+var (
+	ErrEd25519SignatureEncoding = errors.New("ed25519 signature is not canonically encoded")
+	ErrEd25519KeyEncoding       = errors.New("ed25519 public key is not canonically encoded or has small order")
+)
+
+// The order of the ed25519 base point, little-endian.
+var ed25519GroupOrder = [32]byte{
+	0xed, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58,
+	0xd6, 0x9c, 0xf7, 0xa2, 0xde, 0xf9, 0xde, 0x14,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10,
+}
+
+/*
+Encodings of the points of small order, with the sign bit cleared. Keys or
+signature R values equal to one of these prove nothing about knowledge of
+a private key.
+*/
+var ed25519SmallOrderPoints = [][32]byte{
+	// 0 (order 4)
+	{},
+	// 1 (order 1)
+	{0x01},
+	// order 8
+	{
+		0x26, 0xe8, 0x95, 0x8f, 0xc2, 0xb2, 0x27, 0xb0,
+		0x45, 0xc3, 0xf4, 0x89, 0xf2, 0xef, 0x98, 0xf0,
+		0xd5, 0xdf, 0xac, 0x05, 0xd3, 0xc6, 0x33, 0x39,
+		0xb1, 0x38, 0x02, 0x88, 0x6d, 0x53, 0xfc, 0x05,
+	},
+	// order 8
+	{
+		0xc7, 0x17, 0x6a, 0x70, 0x3d, 0x4d, 0xd8, 0x4f,
+		0xba, 0x3c, 0x0b, 0x76, 0x0d, 0x10, 0x67, 0x0f,
+		0x2a, 0x20, 0x53, 0xfa, 0x2c, 0x39, 0xcc, 0xc6,
+		0x4e, 0xc7, 0xfd, 0x77, 0x92, 0xac, 0x03, 0x7a,
+	},
+	// p-1 (order 2)
+	{
+		0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f,
+	},
+}
+
+/*
+checkStrictEd25519 applies the checks that the ed25519 library skips: the
+public key and the signature's R must be canonical encodings of points that
+are not of small order, and S must be fully reduced. Keys of other types
+pass through untouched.
+*/
+func checkStrictEd25519(key ssh.PublicKey, sig *ssh.Signature) error {
+	if key.Type() != ssh.KeyAlgoED25519 {
+		return nil
+	}
+
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return ErrEd25519KeyEncoding
+	}
+	publicKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok || len(publicKey) != ed25519.PublicKeySize || !ed25519PointAcceptable(publicKey) {
+		return ErrEd25519KeyEncoding
+	}
+
+	if sig.Format != ssh.KeyAlgoED25519 || len(sig.Blob) != ed25519.SignatureSize {
+		return ErrEd25519SignatureEncoding
+	}
+	if !ed25519PointAcceptable(sig.Blob[:32]) || !ed25519ScalarReduced(sig.Blob[32:]) {
+		return ErrEd25519SignatureEncoding
+	}
+	return nil
+}
+
+/*
+ed25519PointAcceptable reports whether a 32-byte point encoding has a
+canonical y coordinate (below the field prime) and is not of small order.
+*/
+func ed25519PointAcceptable(encoded []byte) bool {
+	var point [32]byte
+	copy(point[:], encoded)
+	point[31] &= 0x7f
+
+	// y is non-canonical when it is at least p = 2^255 - 19.
+	if point[0] >= 0xed && point[31] == 0x7f && bytes.Count(point[1:31], []byte{0xff}) == 30 {
+		return false
+	}
+
+	for _, smallOrder := range ed25519SmallOrderPoints {
+		if point == smallOrder {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ed25519ScalarReduced reports whether a little-endian scalar is below the
+group order, so that no other encoding of it would verify.
+*/
+func ed25519ScalarReduced(scalar []byte) bool {
+	for i := 31; i >= 0; i-- {
+		if scalar[i] != ed25519GroupOrder[i] {
+			return scalar[i] < ed25519GroupOrder[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	cryptrand "crypto/rand"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+malleate returns a copy of an ed25519 signature whose S has the group order
+added to it. The result is a non-canonical encoding that lenient verifiers
+still accept.
+*/
+func malleate(sig *ssh.Signature) *ssh.Signature {
+	reverse := func(b []byte) []byte {
+		r := make([]byte, len(b))
+		for i := range b {
+			r[len(b)-1-i] = b[i]
+		}
+		return r
+	}
+
+	order, _ := new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+	s := new(big.Int).SetBytes(reverse(sig.Blob[32:]))
+	s.Add(s, order)
+
+	encoded := make([]byte, 32)
+	sBytes := s.Bytes()
+	copy(encoded[32-len(sBytes):], sBytes)
+
+	blob := append(append([]byte{}, sig.Blob[:32]...), reverse(encoded)...)
+	return &ssh.Signature{Format: sig.Format, Blob: blob}
+}
+
+func TestLDAPUserCacheStrictEd25519(t *testing.T) {
+	Convey("Given a user with an ed25519 key", t, func() {
+		_, privateKey, err := ed25519.GenerateKey(cryptrand.Reader)
+		So(err, ShouldBeNil)
+		signer, err := ssh.NewSignerFromKey(privateKey)
+		So(err, ShouldBeNil)
+		s := &StubLDAPServer{
+			Keys: []string{base64.StdEncoding.EncodeToString(signer.PublicKey().Marshal())},
+		}
+
+		challenge := randomBytes(64)
+		sig, err := signer.Sign(cryptrand.Reader, challenge)
+		So(err, ShouldBeNil)
+		malleated := malleate(sig)
+
+		opts := server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"}
+
+		Convey("By default the library accepts a non-canonical signature", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			user, _ := lc.Authenticate("testuser", challenge, malleated)
+			So(user, ShouldNotBeNil)
+		})
+
+		Convey("In strict mode", func() {
+			opts.StrictEd25519 = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+
+			Convey("The canonical signature should verify", func() {
+				user, _ := lc.Authenticate("testuser", challenge, sig)
+				So(user, ShouldNotBeNil)
+			})
+
+			Convey("The non-canonical signature should be rejected", func() {
+				user, _ := lc.Authenticate("testuser", challenge, malleated)
+				So(user, ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Results of an AuthEvent.
+const (
+	AuthSucceeded = "success"
+	AuthFailed    = "failure"
+)
+
+/*
+AuthEvent records the outcome of one authentication attempt. Username is
+the name the client gave, or the authenticated user's name on success;
+Fingerprint is that of the key that verified the signature, if any did.
+*/
+type AuthEvent struct {
+	Time        time.Time
+	Username    string
+	Fingerprint string
+	Result      string
+	Reason      string
+}
+
+/*
+eventRing keeps the most recent authentication events, overwriting the
+oldest once full.
+*/
+type eventRing struct {
+	sync.Mutex
+	events []AuthEvent
+	next   int
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	if size <= 0 {
+		return nil
+	}
+	return &eventRing{events: make([]AuthEvent, size)}
+}
+
+func (er *eventRing) add(event AuthEvent) {
+	er.Lock()
+	defer er.Unlock()
+
+	er.events[er.next] = event
+	er.next = (er.next + 1) % len(er.events)
+	if er.next == 0 {
+		er.full = true
+	}
+}
+
+/*
+snapshot returns the retained events, oldest first.
+*/
+func (er *eventRing) snapshot() []AuthEvent {
+	er.Lock()
+	defer er.Unlock()
+
+	if !er.full {
+		return append([]AuthEvent{}, er.events[:er.next]...)
+	}
+	return append(append([]AuthEvent{}, er.events[er.next:]...), er.events[:er.next]...)
+}
+
+/*
+recordEvent remembers the outcome of an authentication attempt.
+*/
+func (luc *ldapUserCache) recordEvent(username string, user *User, key ssh.PublicKey, err error) {
+	if luc.events == nil {
+		return
+	}
+
+	event := AuthEvent{
+		Time:     luc.options().Clock.Now(),
+		Username: username,
+		Result:   AuthSucceeded,
+	}
+	if key != nil {
+		event.Fingerprint = fingerprintSHA256(key)
+	}
+	switch {
+	case err != nil:
+		event.Result = AuthFailed
+		event.Reason = err.Error()
+	case user == nil:
+		event.Result = AuthFailed
+		event.Reason = "no matching key"
+	default:
+		event.Username = user.Username
+	}
+	luc.events.add(event)
+}
+
+/*
+RecentEvents returns the most recent authentication outcomes, oldest
+first, up to Options.RecentEventsSize of them.
+*/
+func (luc *ldapUserCache) RecentEvents() []AuthEvent {
+	if luc.events == nil {
+		return nil
+	}
+	return luc.events.snapshot()
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRecentEvents(t *testing.T) {
+	Convey("Given an LDAP cache remembering the last three authentications", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		stranger, _ := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:         "cn",
+			SSHAttr:          "sshPublicKey",
+			RecentEventsSize: 3,
+			Clock:            clock,
+		})
+		So(err, ShouldBeNil)
+		So(lc.RecentEvents(), ShouldBeEmpty)
+
+		Convey("A success and a failure should both be recorded", func() {
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+			clock.Advance(time.Second)
+			So(authenticatesWith(lc, stranger), ShouldBeFalse)
+
+			events := lc.RecentEvents()
+			So(events, ShouldHaveLength, 2)
+			So(events[0].Result, ShouldEqual, server.AuthSucceeded)
+			So(events[0].Username, ShouldEqual, "testuser")
+			So(events[0].Fingerprint, ShouldStartWith, "SHA256:")
+			So(events[1].Result, ShouldEqual, server.AuthFailed)
+			So(events[1].Reason, ShouldEqual, "no matching key")
+			So(events[1].Fingerprint, ShouldBeEmpty)
+			So(events[1].Time, ShouldResemble, events[0].Time.Add(time.Second))
+		})
+
+		Convey("Only the last three events should be kept", func() {
+			So(authenticatesWith(lc, stranger), ShouldBeFalse)
+			for i := 0; i < 3; i++ {
+				clock.Advance(time.Second)
+				So(authenticatesWith(lc, signer), ShouldBeTrue)
+			}
+			clock.Advance(time.Second)
+			_, err := lc.Authenticate("testuser", randomBytes(64), nil)
+			So(err, ShouldEqual, server.ErrMalformedRequest)
+
+			events := lc.RecentEvents()
+			So(events, ShouldHaveLength, 3)
+			So(events[0].Result, ShouldEqual, server.AuthSucceeded)
+			So(events[1].Result, ShouldEqual, server.AuthSucceeded)
+			So(events[2].Result, ShouldEqual, server.AuthFailed)
+			So(events[2].Reason, ShouldEqual, server.ErrMalformedRequest.Error())
+			So(events[2].Time.Sub(events[0].Time), ShouldEqual, 2*time.Second)
+		})
+	})
+}
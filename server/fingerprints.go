@@ -0,0 +1,210 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ErrFingerprintCollision fails an update, under
+Options.StrictFingerprintCollisions, when two different keys have the same
+fingerprint.
+*/
+var ErrFingerprintCollision = errors.New("two different keys have the same fingerprint")
+
+/*
+FingerprintSHA256 returns the OpenSSH-style SHA256 fingerprint of a key.
+It is what the key index uses unless Options.Fingerprint says otherwise.
+*/
+func FingerprintSHA256(key ssh.PublicKey) string {
+	return fingerprintSHA256(key)
+}
+
+/*
+FingerprintLegacyMD5 returns the colon-separated MD5 fingerprint older
+OpenSSH versions print, e.g. "c1:b1:30:29:d7:b8:de:6c:97:77:10:d7:46:41:63:87".
+*/
+func FingerprintLegacyMD5(key ssh.PublicKey) string {
+	sum := md5.Sum(key.Marshal())
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
+
+/*
+Policies for a key that is held by several users whose roles differ.
+ConflictFirst keeps the user that was loaded first. ConflictMostPermissive
+and ConflictLeastPermissive keep the user granted the most or the fewest
+ARNs. ConflictReject maps the key to nobody, so it cannot authenticate.
+*/
+const (
+	ConflictFirst           = "first"
+	ConflictMostPermissive  = "mostPermissive"
+	ConflictLeastPermissive = "leastPermissive"
+	ConflictReject          = "reject"
+)
+
+/*
+fingerprintIndex maps key fingerprints to the user each key authenticates
+as. It remembers the key behind each fingerprint, so that a different key
+with the same fingerprint is caught rather than taking its place.
+*/
+type fingerprintIndex struct {
+	policy      string
+	fingerprint func(ssh.PublicKey) string
+	strict      bool
+	stats       g2s.Statter
+	users       map[string]*User
+	keys        map[string][]byte
+	rejected    map[string]bool
+}
+
+func newFingerprintIndex(policy string, fingerprint func(ssh.PublicKey) string, strict bool, stats g2s.Statter) *fingerprintIndex {
+	if fingerprint == nil {
+		fingerprint = fingerprintSHA256
+	}
+	return &fingerprintIndex{
+		policy:      policy,
+		fingerprint: fingerprint,
+		strict:      strict,
+		stats:       stats,
+		users:       map[string]*User{},
+		keys:        map[string][]byte{},
+		rejected:    map[string]bool{},
+	}
+}
+
+/*
+add indexes every key of user, resolving conflicts with users added
+before it according to the index's policy. A key whose fingerprint is
+already taken by a different key is left out of the index, or, when the
+index is strict, fails the whole build.
+*/
+func (fi *fingerprintIndex) add(user *User) error {
+	for _, key := range user.SSHKeys {
+		fingerprint := fi.fingerprint(key)
+		if indexed, ok := fi.keys[fingerprint]; ok && !bytes.Equal(indexed, key.Marshal()) {
+			fi.stats.Counter(1.0, "fingerprintCollision", 1)
+			if fi.strict {
+				log.Errorf("A key of user %s has the fingerprint %s of a different key; refusing to build the key index.", user.Username, fingerprint)
+				return ErrFingerprintCollision
+			}
+			log.Warning("A key of user %s has the fingerprint %s of a different key; keeping the first.", user.Username, fingerprint)
+			continue
+		}
+		fi.keys[fingerprint] = key.Marshal()
+
+		if fi.rejected[fingerprint] {
+			continue
+		}
+
+		existing, ok := fi.users[fingerprint]
+		if !ok || existing == user {
+			fi.users[fingerprint] = user
+			continue
+		}
+		if sameGrants(existing, user) {
+			continue
+		}
+
+		log.Warning("Key %s is held by both %s and %s with different roles; resolving with the %s policy.",
+			fingerprint, existing.Username, user.Username, fi.policy)
+		fi.stats.Counter(1.0, "fingerprintConflict", 1)
+
+		switch fi.policy {
+		case ConflictMostPermissive:
+			if len(user.ARNs) > len(existing.ARNs) {
+				fi.users[fingerprint] = user
+			}
+		case ConflictLeastPermissive:
+			if len(user.ARNs) < len(existing.ARNs) {
+				fi.users[fingerprint] = user
+			}
+		case ConflictReject:
+			log.Errorf("Key %s is shared by users with different roles; it will not authenticate anyone.", fingerprint)
+			delete(fi.users, fingerprint)
+			fi.rejected[fingerprint] = true
+		}
+	}
+	return nil
+}
+
+/*
+lookup returns the user a key authenticates as, and whether the key was
+rejected as ambiguous. A key that was left out after colliding with
+another one is not found.
+*/
+func (fi *fingerprintIndex) lookup(key ssh.PublicKey) (user *User, rejected bool) {
+	fingerprint := fi.fingerprint(key)
+	if !bytes.Equal(fi.keys[fingerprint], key.Marshal()) {
+		return nil, false
+	}
+	return fi.users[fingerprint], fi.rejected[fingerprint]
+}
+
+func sameGrants(a *User, b *User) bool {
+	if a.DefaultRole != b.DefaultRole || len(a.ARNs) != len(b.ARNs) {
+		return false
+	}
+	for _, arn := range a.ARNs {
+		if !containsString(b.ARNs, arn) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+verifyHintedKey verifies the signature against the one key the client
+says it used. The last result is false when the index does not hold that
+key, in which case the caller should try the other keys.
+*/
+func (luc *ldapUserCache) verifyHintedKey(hint ssh.PublicKey, challenge []byte, sshSig *ssh.Signature, now time.Time) (*User, ssh.PublicKey, bool) {
+	if luc.keysByFingerprint == nil {
+		return nil, nil, false
+	}
+	owner, rejected := luc.keysByFingerprint.lookup(hint)
+	if rejected {
+		log.Warning("Refusing to authenticate with a key shared by users with different roles.")
+		return nil, nil, true
+	}
+	if owner == nil {
+		return nil, nil, false
+	}
+
+	hintBytes := hint.Marshal()
+	for _, key := range owner.SSHKeys {
+		if !bytes.Equal(key.Marshal(), hintBytes) {
+			continue
+		}
+		if luc.verifyKey(owner, key, challenge, sshSig, now) {
+			return owner, key, true
+		}
+		return nil, nil, true
+	}
+	return nil, nil, false
+}
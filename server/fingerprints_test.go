@@ -0,0 +1,245 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	cryptrand "crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+// authenticatedAs returns the name of the user signer authenticates as.
+func authenticatedAs(lc server.UserCache, signer ssh.Signer) string {
+	challenge := randomBytes(64)
+	sig, err := signer.Sign(cryptrand.Reader, challenge)
+	if err != nil {
+		panic(err)
+	}
+	user, _ := lc.Authenticate("", challenge, sig)
+	if user == nil {
+		return ""
+	}
+	return user.Username
+}
+
+func TestFingerprintConflictPolicy(t *testing.T) {
+	Convey("Given a key held by a reader and by an admin", t, func() {
+		shared, sharedKey := newECDSASigner(elliptic.P256())
+		own, ownKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=reader", map[string][]string{
+					"cn": {"reader"}, "sshPublicKey": {sharedKey}, "memberOf": {"cn=readers"},
+				}),
+				fixtureEntry("cn=admin", map[string][]string{
+					"cn": {"admin"}, "sshPublicKey": {sharedKey, ownKey}, "memberOf": {"cn=readers", "cn=admins"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=readers", map[string][]string{"businessCategory": {"arn:aws:iam::123456789012:role/reader"}}),
+				fixtureEntry("cn=admins", map[string][]string{"businessCategory": {"arn:aws:iam::123456789012:role/admin"}}),
+			},
+		}
+		cacheWith := func(policy string) server.UserCache {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttr:        "cn",
+				SSHAttr:         "sshPublicKey",
+				EnableLDAPRoles: true,
+				RoleAttribute:   "businessCategory",
+
+				FingerprintConflictPolicy: policy,
+			})
+			So(err, ShouldBeNil)
+			return lc
+		}
+
+		Convey("The first policy should keep the user loaded first", func() {
+			So(authenticatedAs(cacheWith(server.ConflictFirst), shared), ShouldEqual, "reader")
+		})
+
+		Convey("The default policy should be first", func() {
+			So(authenticatedAs(cacheWith(""), shared), ShouldEqual, "reader")
+		})
+
+		Convey("The mostPermissive policy should keep the admin", func() {
+			So(authenticatedAs(cacheWith(server.ConflictMostPermissive), shared), ShouldEqual, "admin")
+		})
+
+		Convey("The leastPermissive policy should keep the reader", func() {
+			So(authenticatedAs(cacheWith(server.ConflictLeastPermissive), shared), ShouldEqual, "reader")
+		})
+
+		Convey("The reject policy should let the key authenticate nobody", func() {
+			lc := cacheWith(server.ConflictReject)
+			So(authenticatedAs(lc, shared), ShouldEqual, "")
+			So(authenticatedAs(lc, own), ShouldEqual, "admin")
+		})
+	})
+}
+
+func TestFingerprintCollisions(t *testing.T) {
+	Convey("Given two users with different keys and a fingerprint that collides", t, func() {
+		first, firstKey := newECDSASigner(elliptic.P256())
+		second, secondKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=first", map[string][]string{"cn": {"first"}, "sshPublicKey": {firstKey}}),
+				fixtureEntry("cn=second", map[string][]string{"cn": {"second"}, "sshPublicKey": {secondKey}}),
+			},
+		}
+		// Legacy MD5 fingerprints cut down to their first byte would collide
+		// eventually; cutting them down to nothing forces it.
+		truncatedMD5 := func(key ssh.PublicKey) string {
+			return server.FingerprintLegacyMD5(key)[:0]
+		}
+		opts := server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey", Fingerprint: truncatedMD5}
+
+		Convey("By default the collision should be counted and both keys should still work", func() {
+			stats := newRecordingStatter()
+			lc, err := server.NewLDAPUserCacheWithOptions(s, stats, opts)
+			So(err, ShouldBeNil)
+			So(stats.Count("fingerprintCollision"), ShouldEqual, 1)
+			So(authenticatedAs(lc, first), ShouldEqual, "first")
+			So(authenticatedAs(lc, second), ShouldEqual, "second")
+		})
+
+		Convey("In strict mode the update should fail", func() {
+			opts.StrictFingerprintCollisions = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldEqual, server.ErrFingerprintCollision)
+			So(lc.Users(), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Legacy MD5 fingerprints should be formatted as OpenSSH prints them", t, func() {
+		signer, _ := newECDSASigner(elliptic.P256())
+		fingerprint := server.FingerprintLegacyMD5(signer.PublicKey())
+		So(fingerprint, ShouldHaveLength, 47)
+		So(strings.Count(fingerprint, ":"), ShouldEqual, 15)
+	})
+}
+
+func TestCanaryFingerprints(t *testing.T) {
+	Convey("Given an LDAP cache watching the on-call responder's key", t, func() {
+		oncall, oncallKey := newECDSASigner(elliptic.P256())
+		_, otherKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=oncall", map[string][]string{"cn": {"oncall"}, "sshPublicKey": {oncallKey}}),
+				fixtureEntry("cn=other", map[string][]string{"cn": {"other"}, "sshPublicKey": {otherKey}}),
+			},
+		}
+		stats := newRecordingStatter()
+		lc, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{
+			UserAttr:           "cn",
+			SSHAttr:            "sshPublicKey",
+			CanaryFingerprints: []string{server.FingerprintSHA256(oncall.PublicKey())},
+		})
+		So(err, ShouldBeNil)
+		So(stats.Count("canaryMissing"), ShouldEqual, 0)
+
+		Convey("Removing the canary should raise the alert", func() {
+			s.Users = s.Users[1:]
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "other")
+			So(stats.Count("canaryMissing"), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestAuthenticateKey(t *testing.T) {
+	Convey("Given an LDAP cache holding two users", t, func() {
+		first, firstKey := newECDSASigner(elliptic.P256())
+		second, secondKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=first", map[string][]string{"cn": {"first"}, "sshPublicKey": {firstKey}}),
+				fixtureEntry("cn=second", map[string][]string{"cn": {"second"}, "sshPublicKey": {secondKey}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+		challenge := randomBytes(64)
+		sig, err := second.Sign(cryptrand.Reader, challenge)
+		So(err, ShouldBeNil)
+
+		Convey("The key the client names should find its user", func() {
+			user, err := lc.AuthenticateKey("", challenge, sig, second.PublicKey())
+			So(err, ShouldBeNil)
+			So(user, ShouldNotBeNil)
+			So(user.Username, ShouldEqual, "second")
+		})
+
+		Convey("Naming a different known key than the one that signed should fail", func() {
+			searches := s.Searches
+			user, err := lc.AuthenticateKey("", challenge, sig, first.PublicKey())
+			So(err, ShouldBeNil)
+			So(user, ShouldBeNil)
+			So(s.Searches-searches, ShouldEqual, 1)
+		})
+
+		Convey("An unknown key should fall back to trying every key", func() {
+			stranger, _ := newECDSASigner(elliptic.P256())
+			user, err := lc.AuthenticateKey("", challenge, sig, stranger.PublicKey())
+			So(err, ShouldBeNil)
+			So(user, ShouldNotBeNil)
+			So(user.Username, ShouldEqual, "second")
+		})
+	})
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	const userCount = 5000
+	s := &FixtureLDAPServer{}
+	var last ssh.Signer
+	for i := 0; i < userCount; i++ {
+		signer, key := newECDSASigner(elliptic.P256())
+		name := fmt.Sprintf("user%d", i)
+		s.Users = append(s.Users, fixtureEntry("cn="+name, map[string][]string{"cn": {name}, "sshPublicKey": {key}}))
+		last = signer
+	}
+	lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	challenge := randomBytes(64)
+	sig, err := last.Sign(cryptrand.Reader, challenge)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("every key", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if user, _ := lc.Authenticate("", challenge, sig); user == nil {
+				b.Fatal("authentication failed")
+			}
+		}
+	})
+	b.Run("by fingerprint", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if user, _ := lc.AuthenticateKey("", challenge, sig, last.PublicKey()); user == nil {
+				b.Fatal("authentication failed")
+			}
+		}
+	})
+}
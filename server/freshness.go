@@ -0,0 +1,62 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+/*
+claimRefresh reports whether a refresh may start at now, given that none
+should start within Options.MinRefreshInterval of the previous attempt.
+If so it records the attempt, so that concurrent callers do not pile on.
+*/
+func (luc *ldapUserCache) claimRefresh(now time.Time) bool {
+	luc.mu.Lock()
+	defer luc.mu.Unlock()
+
+	if interval := luc.opts.MinRefreshInterval; interval > 0 && now.Sub(luc.lastRefreshAttempt) < interval {
+		return false
+	}
+	luc.lastRefreshAttempt = now
+	return true
+}
+
+/*
+refreshIfStale updates the cache when the last successful Update() is
+older than Options.MaxAge, so that revoked keys stop working even if
+nobody ever misses the cache.
+*/
+func (luc *ldapUserCache) refreshIfStale() {
+	luc.mu.RLock()
+	maxAge, clock, lastUpdate := luc.opts.MaxAge, luc.opts.Clock, luc.lastUpdate
+	luc.mu.RUnlock()
+	if maxAge <= 0 {
+		return
+	}
+
+	now := clock.Now()
+	age := now.Sub(lastUpdate)
+	if age <= maxAge || !luc.claimRefresh(now) {
+		return
+	}
+
+	log.Debug("The user cache is %s old; refreshing it before authenticating.", age)
+	if err := luc.updateWithTimeout(); err != nil {
+		log.Warning("Could not refresh the stale LDAP cache; using it anyway: %s", err.Error())
+	}
+}
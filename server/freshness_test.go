@@ -0,0 +1,130 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPUserCacheMaxAge(t *testing.T) {
+	Convey("Given an LDAP cache that may be at most an hour old", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop(), server.WithMaxAge(time.Hour), server.WithClock(clock))
+		So(err, ShouldBeNil)
+		searches := s.Searches
+
+		Convey("A fresh cache should not be refreshed", func() {
+			clock.Advance(30 * time.Minute)
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+			So(s.Searches, ShouldEqual, searches)
+		})
+
+		Convey("A revoked key should stop working once the cache is stale", func() {
+			s.Users = []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}}),
+			}
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+
+			clock.Advance(time.Hour + time.Second)
+			So(authenticatesWith(lc, signer), ShouldBeFalse)
+			So(lc.Users(), ShouldNotContainKey, "testuser")
+		})
+	})
+}
+
+func TestLDAPUserCacheMinRefreshInterval(t *testing.T) {
+	Convey("Given an LDAP cache refreshing at most once a minute", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		stranger, _ := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:           "cn",
+			SSHAttr:            "sshPublicKey",
+			MinRefreshInterval: time.Minute,
+			Clock:              clock,
+		})
+		So(err, ShouldBeNil)
+		searches := s.Searches
+
+		Convey("A storm of unknown keys should not query LDAP right after a refresh", func() {
+			for i := 0; i < 5; i++ {
+				So(authenticatesWith(lc, stranger), ShouldBeFalse)
+			}
+			So(s.Searches, ShouldEqual, searches)
+
+			Convey("But a miss after the interval should refresh once", func() {
+				clock.Advance(time.Minute)
+				for i := 0; i < 5; i++ {
+					So(authenticatesWith(lc, stranger), ShouldBeFalse)
+				}
+				So(s.Searches, ShouldEqual, searches+1)
+			})
+		})
+	})
+}
+
+func TestLDAPUserCacheMissRefreshRate(t *testing.T) {
+	Convey("Given an LDAP cache allowing two miss refreshes and one more a minute", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		stranger, _ := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		stats := newRecordingStatter()
+		lc, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{
+			UserAttr:         "cn",
+			SSHAttr:          "sshPublicKey",
+			MissRefreshRate:  1.0 / 60,
+			MissRefreshBurst: 2,
+			Clock:            clock,
+		})
+		So(err, ShouldBeNil)
+		searches := s.Searches
+
+		Convey("A storm of unknown keys should only refresh as often as the bucket allows", func() {
+			for i := 0; i < 5; i++ {
+				So(authenticatesWith(lc, stranger), ShouldBeFalse)
+			}
+			So(s.Searches, ShouldEqual, searches+2)
+			So(stats.Count("ldapCacheMissRefreshThrottled"), ShouldEqual, 3)
+
+			clock.Advance(time.Minute)
+			So(authenticatesWith(lc, stranger), ShouldBeFalse)
+			So(authenticatesWith(lc, stranger), ShouldBeFalse)
+			So(s.Searches, ShouldEqual, searches+3)
+		})
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+removedKey is a key that has disappeared from the directory but keeps
+authenticating its user until the grace window has passed.
+*/
+type removedKey struct {
+	user      *User
+	key       ssh.PublicKey
+	removedAt time.Time
+}
+
+func removedKeyID(username string, key ssh.PublicKey) string {
+	return username + "\x00" + fingerprintSHA256(key)
+}
+
+/*
+carryRemovedKeys diffs the users being replaced against the freshly loaded
+ones and returns the removed keys that are still within the grace window,
+including those that have just disappeared. Keys that came back are
+forgotten.
+*/
+func (luc *ldapUserCache) carryRemovedKeys(users map[string]*User, now time.Time) map[string]*removedKey {
+	if luc.opts.RemovedKeyGrace <= 0 {
+		return nil
+	}
+
+	present := map[string]bool{}
+	for username, user := range users {
+		for _, key := range user.SSHKeys {
+			present[removedKeyID(username, key)] = true
+		}
+	}
+
+	removed := map[string]*removedKey{}
+	for id, rk := range luc.removedKeys {
+		if !present[id] && now.Sub(rk.removedAt) < luc.opts.RemovedKeyGrace {
+			removed[id] = rk
+		}
+	}
+	for username, user := range luc.users {
+		for _, key := range user.SSHKeys {
+			id := removedKeyID(username, key)
+			if present[id] || removed[id] != nil {
+				continue
+			}
+			log.Info("SSH key %s was removed from %s; it will keep working for %s.",
+				fingerprintSHA256(key), username, luc.opts.RemovedKeyGrace)
+			removed[id] = &removedKey{user: user, key: key, removedAt: now}
+		}
+	}
+	return removed
+}
+
+/*
+verifyRemovedKey checks the signature against removed keys still within
+their grace window. A match authenticates as the user's current entry if
+it still has one.
+*/
+func (luc *ldapUserCache) verifyRemovedKey(challenge []byte, sshSig *ssh.Signature, now time.Time) (*User, ssh.PublicKey) {
+	for _, rk := range luc.removedKeys {
+		if now.Sub(rk.removedAt) >= luc.opts.RemovedKeyGrace {
+			continue
+		}
+		candidate := &User{Username: rk.user.Username, SSHKeys: []ssh.PublicKey{rk.key}}
+		if luc.verifyUserKey(candidate, challenge, sshSig, now) == nil {
+			continue
+		}
+
+		log.Warning("User %s authenticated with a key removed at %s.", rk.user.Username, rk.removedAt)
+		luc.stats.Counter(1.0, "graceWindowAuth", 1)
+		if current, ok := luc.users[rk.user.Username]; ok {
+			return current, rk.key
+		}
+		return rk.user, rk.key
+	}
+	return nil, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrCacheNotLoaded is reported as unreadiness until the user cache first loads.
+var ErrCacheNotLoaded = errors.New("the user cache has not loaded yet")
+
+// ErrShuttingDown is reported as unreadiness while the server drains.
+var ErrShuttingDown = errors.New("the server is shutting down")
+
+/*
+ReadinessChecker is implemented by user caches that know whether they are
+fit to serve: loaded, and able to reach their backend on the last try.
+*/
+type ReadinessChecker interface {
+	Ready() error
+}
+
+func readiness(loaded bool, lastErr error) error {
+	if !loaded {
+		return ErrCacheNotLoaded
+	}
+	if lastErr != nil {
+		return fmt.Errorf("the last refresh failed: %s", lastErr.Error())
+	}
+	return nil
+}
+
+/*
+Ready reports why the server should not be sent traffic, if it should
+not: it is shutting down, or its user cache is not ready.
+*/
+func (sm *server) Ready() error {
+	sm.drain.Lock()
+	draining := sm.drain.draining
+	sm.drain.Unlock()
+	if draining {
+		return ErrShuttingDown
+	}
+
+	if checker, ok := sm.userCache.(ReadinessChecker); ok {
+		return checker.Ready()
+	}
+	return nil
+}
+
+/*
+HealthHandler serves probes for load balancers and orchestrators:
+/healthz answers 200 while the process is up, and /readyz answers 200
+only while Ready() finds nothing wrong, and 503 otherwise.
+*/
+func (sm *server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := sm.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"context"
+	"crypto/elliptic"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealthHandler(t *testing.T) {
+	Convey("Given a server backed by an LDAP cache", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop())
+		So(err, ShouldBeNil)
+		testServer := server.New(lc, &dummyCredentials{}, "default", g2s.Noop(), nil, "cn", "sshPublicKey", "dc=testdn,dc=com", false, "")
+		handler := testServer.HealthHandler()
+
+		get := func(path string) int {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+			return recorder.Code
+		}
+
+		Convey("It should be healthy and ready once loaded", func() {
+			So(get("/healthz"), ShouldEqual, http.StatusOK)
+			So(get("/readyz"), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("When LDAP cannot be reached", func() {
+			s.Err = errors.New("connection refused")
+			So(lc.Update(), ShouldNotBeNil)
+
+			Convey("It should be healthy but not ready", func() {
+				So(get("/healthz"), ShouldEqual, http.StatusOK)
+				So(get("/readyz"), ShouldEqual, http.StatusServiceUnavailable)
+			})
+
+			Convey("It should keep authenticating from the cache", func() {
+				So(authenticatesWith(lc, signer), ShouldBeTrue)
+			})
+
+			Convey("It should become ready again once LDAP recovers", func() {
+				s.Err = nil
+				So(lc.Update(), ShouldBeNil)
+				So(get("/readyz"), ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("It should not be ready while shutting down", func() {
+			So(testServer.Shutdown(context.Background()), ShouldBeNil)
+			So(get("/healthz"), ShouldEqual, http.StatusOK)
+			So(get("/readyz"), ShouldEqual, http.StatusServiceUnavailable)
+		})
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ErrOutsideAllowedHours is returned by Authenticate when a user whose
+account is restricted to certain hours authenticates outside of them.
+*/
+var ErrOutsideAllowedHours = errors.New("user may not authenticate at this time of day")
+
+/*
+HourWindow is the daily window during which a user may authenticate,
+expressed as offsets from midnight in Location. A window whose End is
+before its Start runs past midnight; one whose Start equals its End never
+opens.
+*/
+type HourWindow struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+/*
+Contains reports whether t falls inside the window.
+*/
+func (hw *HourWindow) Contains(t time.Time) bool {
+	local := t.In(hw.Location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour +
+		time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second
+
+	if hw.Start <= hw.End {
+		return sinceMidnight >= hw.Start && sinceMidnight < hw.End
+	}
+	return sinceMidnight >= hw.Start || sinceMidnight < hw.End
+}
+
+/*
+parseHourWindow reads a window such as "09:00-17:30" or "22-06" in the
+named timezone, which defaults to UTC.
+*/
+func parseHourWindow(hours string, timezone string) (*HourWindow, error) {
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	bounds := strings.Split(hours, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("allowed hours %q are not of the form HH:MM-HH:MM", hours)
+	}
+	start, err := parseTimeOfDay(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+	return &HourWindow{Start: start, End: end, Location: location}, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	var hour, minute int
+	value = strings.TrimSpace(value)
+	if _, err := fmt.Sscanf(value, "%d:%d", &hour, &minute); err != nil {
+		minute = 0
+		if _, err := fmt.Sscanf(value, "%d", &hour); err != nil {
+			return 0, fmt.Errorf("%q is not a time of day", value)
+		}
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("%q is not a time of day", value)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
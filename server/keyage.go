@@ -0,0 +1,95 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+)
+
+/*
+DefaultKeyAgeBuckets are the upper bounds used for the key age histogram
+when Options.KeyAgeBuckets is left empty.
+*/
+var DefaultKeyAgeBuckets = []time.Duration{
+	30 * 24 * time.Hour,
+	90 * 24 * time.Hour,
+	180 * 24 * time.Hour,
+	365 * 24 * time.Hour,
+}
+
+// Formats we accept for key creation timestamps, LDAP GeneralizedTime first.
+var keyCreatedFormats = []string{
+	"20060102150405Z0700",
+	"20060102150405Z",
+	time.RFC3339,
+}
+
+/*
+KeyAgeBucket counts the keys whose age is below UpTo and at or above the
+previous bucket's bound. The last bucket has a zero UpTo and holds every
+key older than the largest configured bound.
+*/
+type KeyAgeBucket struct {
+	UpTo  time.Duration
+	Count int
+}
+
+/*
+KeyAgeDistribution is a histogram of SSH key ages across every user in
+the cache. Keys whose entries carry no usable creation timestamp are
+counted in Unknown instead of a bucket.
+*/
+type KeyAgeDistribution struct {
+	Buckets []KeyAgeBucket
+	Unknown int
+}
+
+func newKeyAgeDistribution(bounds []time.Duration) *KeyAgeDistribution {
+	if len(bounds) == 0 {
+		bounds = DefaultKeyAgeBuckets
+	}
+
+	buckets := make([]KeyAgeBucket, 0, len(bounds)+1)
+	for _, bound := range bounds {
+		buckets = append(buckets, KeyAgeBucket{UpTo: bound})
+	}
+	buckets = append(buckets, KeyAgeBucket{})
+
+	return &KeyAgeDistribution{Buckets: buckets}
+}
+
+/*
+add records count keys of the given age.
+*/
+func (kad *KeyAgeDistribution) add(age time.Duration, count int) {
+	for i := range kad.Buckets {
+		if kad.Buckets[i].UpTo == 0 || age < kad.Buckets[i].UpTo {
+			kad.Buckets[i].Count += count
+			return
+		}
+	}
+}
+
+/*
+parseKeyCreated interprets a creation timestamp stored in LDAP.
+*/
+func parseKeyCreated(value string) (time.Time, bool) {
+	for _, format := range keyCreatedFormats {
+		if created, err := time.Parse(format, value); err == nil {
+			return created, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"path"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Signature algorithms on ssh-rsa keys, accepted in Options.AllowedKeyTypes.
+var rsaSignatureAlgorithms = []string{"rsa-sha2-256", "rsa-sha2-512"}
+
+/*
+checkKeyPolicy holds a key loaded from LDAP to Options.AllowedKeyTypes and
+Options.MinRSABits, returning why it falls short, or nil. Certificates are
+judged by the key they certify.
+*/
+func (luc *ldapUserCache) checkKeyPolicy(key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	if len(luc.opts.AllowedKeyTypes) > 0 && !keyTypeAllowed(key.Type(), luc.opts.AllowedKeyTypes) {
+		return fmt.Errorf("key type %s is not allowed", key.Type())
+	}
+
+	if luc.opts.MinRSABits > 0 {
+		if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+			if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < luc.opts.MinRSABits {
+				return fmt.Errorf("%d-bit RSA keys are below the minimum of %d bits", rsaKey.N.BitLen(), luc.opts.MinRSABits)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+keyTypeAllowed matches keyType against patterns such as "ssh-ed25519" or
+"ecdsa-sha2-*". An RSA signature algorithm such as "rsa-sha2-*" allows
+ssh-rsa keys, which is what those signatures are made with.
+*/
+func keyTypeAllowed(keyType string, patterns []string) bool {
+	candidates := []string{keyType}
+	if keyType == ssh.KeyAlgoRSA {
+		candidates = append(candidates, rsaSignatureAlgorithms...)
+	}
+
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	cryptrand "crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func newRSAKey(bits int) string {
+	privateKey, err := rsa.GenerateKey(cryptrand.Reader, bits)
+	if err != nil {
+		panic(err)
+	}
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey.Marshal())
+}
+
+func TestLDAPUserCacheKeyPolicy(t *testing.T) {
+	Convey("Given a user with a weak RSA key, a strong one and an ECDSA key", t, func() {
+		_, ecdsaKey := newECDSASigner(elliptic.P256())
+		s := &StubLDAPServer{
+			Keys: []string{newRSAKey(1024), newRSAKey(2048), ecdsaKey},
+		}
+		stats := newRecordingStatter()
+		opts := server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"}
+
+		Convey("A minimum of 2048 RSA bits should drop the weak key", func() {
+			opts.MinRSABits = 2048
+			lc, err := server.NewLDAPUserCacheWithOptions(s, stats, opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].SSHKeys, ShouldHaveLength, 2)
+			So(stats.Count("keyPolicyRejected"), ShouldEqual, 1)
+		})
+
+		Convey("Allowing only ed25519 and SHA-2 RSA should drop the ECDSA key", func() {
+			opts.AllowedKeyTypes = []string{"ssh-ed25519", "rsa-sha2-*"}
+			lc, err := server.NewLDAPUserCacheWithOptions(s, stats, opts)
+			So(err, ShouldBeNil)
+			keys := lc.Users()["testuser"].SSHKeys
+			So(keys, ShouldHaveLength, 2)
+			So(keys[0].Type(), ShouldEqual, ssh.KeyAlgoRSA)
+			So(keys[1].Type(), ShouldEqual, ssh.KeyAlgoRSA)
+			So(stats.Count("keyPolicyRejected"), ShouldEqual, 1)
+		})
+
+		Convey("Without a policy every key should be loaded", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, stats, opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].SSHKeys, ShouldHaveLength, 3)
+			So(stats.Count("keyPolicyRejected"), ShouldEqual, 0)
+		})
+	})
+}
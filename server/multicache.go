@@ -0,0 +1,176 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+UserSource names one of the caches behind a MultiUserCache. The name
+labels its metrics and errors.
+*/
+type UserSource struct {
+	Name  string
+	Cache UserCache
+}
+
+/*
+MultiUserCache serves users from several caches at once, such as LDAP and
+a database while migrating from one to the other. A user found in any of
+them authenticates. Sources are tried in order, so on a username collision
+the first source's record is the one returned by Users().
+*/
+type MultiUserCache struct {
+	sources []UserSource
+	stats   g2s.Statter
+}
+
+/*
+NewMultiUserCache combines sources, which should already have loaded
+their users. Per-source metrics are sent to stats as
+multiUserCache.<name>.<metric>.
+*/
+func NewMultiUserCache(stats g2s.Statter, sources ...UserSource) *MultiUserCache {
+	return &MultiUserCache{sources: sources, stats: stats}
+}
+
+func (muc *MultiUserCache) bucket(source UserSource, metric string) string {
+	return "multiUserCache." + source.Name + "." + metric
+}
+
+/*
+Update() refreshes every source, even when some of them fail, so that a
+backend outage does not keep the others stale.
+*/
+func (muc *MultiUserCache) Update() error {
+	return muc.UpdateContext(context.Background())
+}
+
+/*
+UpdateContext is Update() with ctx passed on to the sources that can be
+cut short.
+*/
+func (muc *MultiUserCache) UpdateContext(ctx context.Context) error {
+	var failures []string
+	for _, source := range muc.sources {
+		start := time.Now()
+		var err error
+		if updater, ok := source.Cache.(ContextUpdater); ok {
+			err = updater.UpdateContext(ctx)
+		} else {
+			err = source.Cache.Update()
+		}
+		muc.stats.Timing(1.0, muc.bucket(source, "update"), time.Since(start))
+		if err != nil {
+			log.Warning("Could not update the %s user source: %s", source.Name, err.Error())
+			muc.stats.Counter(1.0, muc.bucket(source, "updateFailed"), 1)
+			failures = append(failures, source.Name+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d user sources failed to update: %s", len(failures), len(muc.sources), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+/*
+Authenticate tries each source in turn and returns the first user found.
+If none has the user, the first error any source reported is returned.
+*/
+func (muc *MultiUserCache) Authenticate(username string, challenge []byte, sshSig *ssh.Signature) (*User, error) {
+	return muc.AuthenticateKey(username, challenge, sshSig, nil)
+}
+
+/*
+AuthenticateKey is Authenticate with the key the client signed with passed
+on to the sources that can use it.
+*/
+func (muc *MultiUserCache) AuthenticateKey(username string, challenge []byte, sshSig *ssh.Signature, key ssh.PublicKey) (*User, error) {
+	var firstErr error
+	for _, source := range muc.sources {
+		var user *User
+		var err error
+		if keyAuthenticator, ok := source.Cache.(KeyAuthenticator); ok && key != nil {
+			user, err = keyAuthenticator.AuthenticateKey(username, challenge, sshSig, key)
+		} else {
+			user, err = source.Cache.Authenticate(username, challenge, sshSig)
+		}
+		if user != nil {
+			muc.stats.Counter(1.0, muc.bucket(source, "authenticated"), 1)
+			return user, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+/*
+Users merges the users of every source that can list them. When two
+sources know the same username, the earlier source wins and the later
+record is ignored.
+*/
+func (muc *MultiUserCache) Users() map[string]*User {
+	merged := map[string]*User{}
+	for _, source := range muc.sources {
+		lister, ok := source.Cache.(interface {
+			Users() map[string]*User
+		})
+		if !ok {
+			continue
+		}
+		for username, user := range lister.Users() {
+			if _, exists := merged[username]; !exists {
+				merged[username] = user
+			}
+		}
+	}
+	return merged
+}
+
+/*
+Lookup returns the user from the first source that knows username.
+*/
+func (muc *MultiUserCache) Lookup(username string) (*User, bool) {
+	for _, source := range muc.sources {
+		if user, ok := source.Cache.Lookup(username); ok {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+/*
+Ready reports the first source that is not ready, if any.
+*/
+func (muc *MultiUserCache) Ready() error {
+	for _, source := range muc.sources {
+		if checker, ok := source.Cache.(ReadinessChecker); ok {
+			if err := checker.Ready(); err != nil {
+				return fmt.Errorf("user source %s: %s", source.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMultiUserCache(t *testing.T) {
+	Convey("Given users split between LDAP and SQL", t, func() {
+		ldapSigner, ldapKey := newECDSASigner(elliptic.P256())
+		sqlSigner, sqlKey := newECDSASigner(elliptic.P256())
+		stranger, _ := newECDSASigner(elliptic.P256())
+
+		ldapServer := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=alice", map[string][]string{"cn": {"alice"}, "sshPublicKey": {ldapKey}}),
+			},
+		}
+		ldapCache, err := server.NewLDAPUserCacheWithOptions(ldapServer, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		fixtureTables["multi"] = [][]driver.Value{
+			{"alice", sqlKey, nil, nil},
+			{"bob", sqlKey, nil, nil},
+		}
+		db, err := sql.Open("hologramfixture", "multi")
+		So(err, ShouldBeNil)
+		sqlCache, err := server.NewSQLUserCache(db, "SELECT * FROM multi", 0, g2s.Noop())
+		So(err, ShouldBeNil)
+
+		stats := newRecordingStatter()
+		multi := server.NewMultiUserCache(stats,
+			server.UserSource{Name: "ldap", Cache: ldapCache},
+			server.UserSource{Name: "sql", Cache: sqlCache},
+		)
+
+		Convey("A key from either source should authenticate", func() {
+			So(authenticatesWith(multi, ldapSigner), ShouldBeTrue)
+			So(authenticatesWith(multi, sqlSigner), ShouldBeTrue)
+			So(authenticatesWith(multi, stranger), ShouldBeFalse)
+			So(stats.Count("multiUserCache.ldap.authenticated"), ShouldEqual, 1)
+			So(stats.Count("multiUserCache.sql.authenticated"), ShouldEqual, 1)
+		})
+
+		Convey("The first source should win on a username collision", func() {
+			users := multi.Users()
+			So(users, ShouldHaveLength, 2)
+			So(users["alice"].Source, ShouldEqual, "ldap")
+			So(users["bob"].Source, ShouldEqual, "sql")
+		})
+
+		Convey("Lookup should follow the same precedence", func() {
+			alice, ok := multi.Lookup("alice")
+			So(ok, ShouldBeTrue)
+			So(alice.Source, ShouldEqual, "ldap")
+			bob, ok := multi.Lookup("bob")
+			So(ok, ShouldBeTrue)
+			So(bob.Source, ShouldEqual, "sql")
+			_, ok = multi.Lookup("carol")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("When one source fails to update", func() {
+			ldapServer.Err = errors.New("connection refused")
+			fixtureTables["multi"] = append(fixtureTables["multi"], []driver.Value{"carol", sqlKey, nil, nil})
+			err := multi.Update()
+
+			Convey("The others should still be updated", func() {
+				So(err, ShouldNotBeNil)
+				So(multi.Users(), ShouldContainKey, "carol")
+				So(stats.Count("multiUserCache.ldap.updateFailed"), ShouldEqual, 1)
+				So(stats.Count("multiUserCache.sql.updateFailed"), ShouldEqual, 0)
+			})
+
+			Convey("The cache should not be ready", func() {
+				So(multi.Ready(), ShouldNotBeNil)
+			})
+		})
+	})
+}
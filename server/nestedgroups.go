@@ -0,0 +1,62 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+/*
+expandNestedGroups gives every group the ARNs of the groups it is nested
+in, following parents (group DN to the DNs its memberOf lists) at most
+depth levels up. Cycles are cut by never visiting a group twice, and each
+group's ARNs are de-duplicated in first-seen order.
+*/
+func expandNestedGroups(groups map[string][]string, parents map[string][]string, depth int) map[string][]string {
+	expanded := make(map[string][]string, len(groups))
+	for dn, arns := range groups {
+		seen := map[string]bool{dn: true}
+		inherited := append([]string(nil), arns...)
+		frontier := []string{dn}
+		for level := 0; level < depth && len(frontier) > 0; level++ {
+			var next []string
+			for _, groupDN := range frontier {
+				for _, parentDN := range parents[groupDN] {
+					if seen[parentDN] {
+						continue
+					}
+					seen[parentDN] = true
+					inherited = append(inherited, groups[parentDN]...)
+					next = append(next, parentDN)
+				}
+			}
+			frontier = next
+		}
+		expanded[dn] = dedupeStrings(inherited)
+	}
+	return expanded
+}
+
+/*
+dedupeStrings drops repeated values, keeping the first occurrence of each.
+*/
+func dedupeStrings(values []string) []string {
+	seen := map[string]bool{}
+	deduped := make([]string, 0, len(values))
+	for _, value := range values {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		deduped = append(deduped, value)
+	}
+	return deduped
+}
@@ -0,0 +1,128 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/peterbourgon/g2s"
+)
+
+// Attributes NewLDAPUserCacheWith reads users from unless told otherwise.
+const (
+	DefaultUserAttr = "cn"
+	DefaultSSHAttr  = "sshPublicKey"
+)
+
+// How many users an LDAP cache asks for at a time unless told otherwise.
+const DefaultPageSize = 1000
+
+/*
+Option sets one or more fields of the Options an LDAP cache is built
+with. The With functions below cover the common settings; any other field
+can be set with an Option literal of your own.
+*/
+type Option func(*Options)
+
+/*
+WithUserAttr names the attribute holding usernames.
+*/
+func WithUserAttr(attr string) Option {
+	return func(opts *Options) { opts.UserAttr = attr }
+}
+
+/*
+WithUserAttrs takes usernames from the first of attrs an entry has.
+*/
+func WithUserAttrs(attrs ...string) Option {
+	return func(opts *Options) { opts.UserAttrs = attrs }
+}
+
+/*
+WithSSHAttr names the attribute holding SSH public keys.
+*/
+func WithSSHAttr(attr string) Option {
+	return func(opts *Options) { opts.SSHAttr = attr }
+}
+
+/*
+WithBaseDN sets where the user search starts.
+*/
+func WithBaseDN(baseDN string) Option {
+	return func(opts *Options) { opts.BaseDN = baseDN }
+}
+
+/*
+WithLDAPRoles grants users the ARNs that roleAttribute lists on the
+groups they are members of.
+*/
+func WithLDAPRoles(roleAttribute string) Option {
+	return func(opts *Options) {
+		opts.EnableLDAPRoles = true
+		opts.RoleAttribute = roleAttribute
+	}
+}
+
+/*
+WithDefaultRole sets the role users get when they do not ask for one.
+*/
+func WithDefaultRole(role string) Option {
+	return func(opts *Options) { opts.DefaultRole = role }
+}
+
+/*
+WithDefaultRoleAttr names the attribute holding a user's own default role.
+*/
+func WithDefaultRoleAttr(attr string) Option {
+	return func(opts *Options) { opts.DefaultRoleAttr = attr }
+}
+
+/*
+WithPageSize sets how many users each page of the user search holds.
+*/
+func WithPageSize(size uint32) Option {
+	return func(opts *Options) { opts.PageSize = size }
+}
+
+/*
+WithMaxAge refreshes the cache before authenticating once it is older
+than maxAge.
+*/
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(opts *Options) { opts.MaxAge = maxAge }
+}
+
+/*
+WithClock replaces the system clock, for tests.
+*/
+func WithClock(clock Clock) Option {
+	return func(opts *Options) { opts.Clock = clock }
+}
+
+/*
+NewLDAPUserCacheWith returns an LDAP cache configured by options, applied
+in order over defaults that read keys from DefaultSSHAttr of entries named
+by DefaultUserAttr.
+*/
+func NewLDAPUserCacheWith(server LDAPImplementation, stats g2s.Statter, options ...Option) (*ldapUserCache, error) {
+	opts := Options{
+		UserAttr: DefaultUserAttr,
+		SSHAttr:  DefaultSSHAttr,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	return NewLDAPUserCacheWithOptions(server, stats, opts)
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewLDAPUserCacheWith(t *testing.T) {
+	Convey("Given a directory with a user in a role group", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "uid": {"tuser"}, "sshPublicKey": {key}, "memberOf": {"cn=developers"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer"},
+				}),
+			},
+		}
+
+		Convey("With no options the defaults should find the user by cn and sshPublicKey", func() {
+			lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop())
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "testuser")
+			So(lc.Users()["testuser"].ARNs, ShouldBeEmpty)
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+		})
+
+		Convey("Options should override the defaults", func() {
+			lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop(),
+				server.WithUserAttr("uid"),
+				server.WithLDAPRoles("businessCategory"),
+				server.WithDefaultRole("arn:aws:iam::123456789012:role/developer"),
+			)
+			So(err, ShouldBeNil)
+			user := lc.Users()["tuser"]
+			So(user, ShouldNotBeNil)
+			So(user.ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+			So(user.DefaultRole, ShouldEqual, "arn:aws:iam::123456789012:role/developer")
+		})
+
+		Convey("An option literal should be able to set any field", func() {
+			clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+			lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop(),
+				server.WithClock(clock),
+				func(opts *server.Options) { opts.SourceLabel = "primary" },
+			)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].Source, ShouldEqual, "primary")
+		})
+
+		Convey("Later options should win over earlier ones", func() {
+			lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop(), server.WithUserAttr("uid"), server.WithUserAttr("cn"))
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "testuser")
+		})
+	})
+}
+
+func TestLDAPUserCacheUserAttrs(t *testing.T) {
+	Convey("Given a directory whose entries name users by uid or sAMAccountName", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=Posix User", map[string][]string{"uid": {"puser"}, "sshPublicKey": {key}}),
+				fixtureEntry("cn=AD User", map[string][]string{"sAMAccountName": {"aduser"}, "sshPublicKey": {key}}),
+				fixtureEntry("cn=Both", map[string][]string{"uid": {"both"}, "sAMAccountName": {"BOTH"}, "sshPublicKey": {key}}),
+				fixtureEntry("cn=Nameless", map[string][]string{"sshPublicKey": {key}}),
+			},
+		}
+
+		Convey("Each entry should be named by the first attribute it has", func() {
+			lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop(), server.WithUserAttrs("uid", "sAMAccountName"))
+			So(err, ShouldBeNil)
+			users := lc.Users()
+			So(users, ShouldHaveLength, 3)
+			So(users, ShouldContainKey, "puser")
+			So(users, ShouldContainKey, "aduser")
+			So(users, ShouldContainKey, "both")
+		})
+
+		Convey("A default role attribute among them should be refused", func() {
+			_, err := server.NewLDAPUserCacheWith(s, g2s.Noop(),
+				server.WithUserAttrs("uid", "sAMAccountName"),
+				server.WithDefaultRoleAttr("samaccountname"),
+			)
+			So(err, ShouldEqual, server.ErrDefaultRoleAttrIsUserAttr)
+		})
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+
+	"github.com/nmcclain/ldap"
+)
+
+/*
+searchPages runs a search a page of pageSize entries at a time with the
+simple paged results control, handing each page to handle before fetching
+the next, so that only one page of raw entries is held at once. Servers
+that ignore the control return everything as a single page. It returns
+how many pages were fetched. It stops with ctx's error once ctx is done.
+*/
+func searchPages(ctx context.Context, server LDAPImplementation, searchRequest *ldap.SearchRequest, pageSize uint32, handle func([]*ldap.Entry) error) (int, error) {
+	paging := ldap.NewControlPaging(pageSize)
+	pagedRequest := *searchRequest
+	pagedRequest.Controls = append(append([]ldap.Control(nil), searchRequest.Controls...), paging)
+
+	for pages := 1; ; pages++ {
+		result, err := limitedSearchContext(ctx, server, &pagedRequest)
+		if err != nil {
+			return pages, err
+		}
+		if err := handle(result.Entries); err != nil {
+			// Tell the server we are done with the remaining pages.
+			if cookie := pagingCookie(result); len(cookie) > 0 {
+				paging.PagingSize = 0
+				paging.SetCookie(cookie)
+				limitedSearch(server, &pagedRequest)
+			}
+			return pages, err
+		}
+
+		// The last page comes back with an empty cookie.
+		cookie := pagingCookie(result)
+		if len(cookie) == 0 {
+			return pages, nil
+		}
+		paging.SetCookie(cookie)
+	}
+}
+
+func pagingCookie(result *ldap.SearchResult) []byte {
+	control, ok := ldap.FindControl(result.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	if !ok {
+		return nil
+	}
+	return control.Cookie
+}
@@ -0,0 +1,203 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+pagingLDAPServer generates Count user entries on demand and honours the
+simple paged results control, keeping track of the pages it served.
+*/
+type pagingLDAPServer struct {
+	Count int
+	Entry func(i int) *ldap.Entry
+	Pages []uint32
+}
+
+func (pls *pagingLDAPServer) Search(s *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if strings.Contains(s.Filter, "groupOfNames") {
+		return &ldap.SearchResult{}, nil
+	}
+
+	paging, ok := ldap.FindControl(s.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	if !ok {
+		return &ldap.SearchResult{Entries: pls.entries(0, pls.Count)}, nil
+	}
+	pls.Pages = append(pls.Pages, paging.PagingSize)
+	if paging.PagingSize == 0 {
+		return &ldap.SearchResult{}, nil
+	}
+
+	offset, _ := strconv.Atoi(string(paging.Cookie))
+	end := offset + int(paging.PagingSize)
+	if end > pls.Count {
+		end = pls.Count
+	}
+	result := &ldap.SearchResult{Entries: pls.entries(offset, end)}
+	next := ldap.NewControlPaging(paging.PagingSize)
+	if end < pls.Count {
+		next.SetCookie([]byte(strconv.Itoa(end)))
+	}
+	result.Controls = []ldap.Control{next}
+	return result, nil
+}
+
+func (pls *pagingLDAPServer) entries(from int, to int) []*ldap.Entry {
+	entries := make([]*ldap.Entry, 0, to-from)
+	for i := from; i < to; i++ {
+		entries = append(entries, pls.Entry(i))
+	}
+	return entries
+}
+
+func (*pagingLDAPServer) Modify(*ldap.ModifyRequest) error {
+	return nil
+}
+
+func TestLDAPUserCachePaging(t *testing.T) {
+	Convey("Given a directory of 25 users that pages its results", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &pagingLDAPServer{
+			Count: 25,
+			Entry: func(i int) *ldap.Entry {
+				name := fmt.Sprintf("user%d", i)
+				return fixtureEntry("cn="+name, map[string][]string{"cn": {name}, "sshPublicKey": {key}})
+			},
+		}
+
+		Convey("A page size of 10 should load every user over three pages", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttr: "cn",
+				SSHAttr:  "sshPublicKey",
+				PageSize: 10,
+			})
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldHaveLength, 25)
+			So(s.Pages, ShouldResemble, []uint32{10, 10, 10})
+		})
+
+		Convey("A failure part way through should abandon the remaining pages", func() {
+			s.Entry = func(i int) *ldap.Entry {
+				return fixtureEntry(fmt.Sprintf("cn=user%d", i), map[string][]string{"cn": {"same"}, "sshPublicKey": {key}})
+			}
+			_, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttr:            "cn",
+				SSHAttr:             "sshPublicKey",
+				PageSize:            10,
+				DuplicateUserPolicy: server.DuplicateError,
+			})
+			So(err, ShouldEqual, server.ErrDuplicateUser)
+			So(s.Pages, ShouldResemble, []uint32{10, 0})
+		})
+
+		Convey("Without a page size pages of the default size should be asked for", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldHaveLength, 25)
+			So(s.Pages, ShouldResemble, []uint32{server.DefaultPageSize})
+		})
+
+		Convey("A directory capped below its size should still be read in full", func() {
+			s.Count = 2500
+			lc, err := server.NewLDAPUserCacheWith(s, g2s.Noop(), server.WithPageSize(1000))
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldHaveLength, 2500)
+			So(s.Pages, ShouldResemble, []uint32{1000, 1000, 1000})
+		})
+	})
+}
+
+/*
+heapSampler is a g2s.Statter that measures the live heap every so many
+key age timings, which Update() emits once per entry it loads.
+*/
+type heapSampler struct {
+	sync.Mutex
+	every   int
+	timings int
+	peak    uint64
+}
+
+func (hs *heapSampler) Counter(sampleRate float32, bucket string, n ...int) {}
+
+func (hs *heapSampler) Timing(sampleRate float32, bucket string, d ...time.Duration) {
+	if bucket != "ldapKeyAge" {
+		return
+	}
+	hs.Lock()
+	defer hs.Unlock()
+	hs.timings++
+	if hs.timings%hs.every != 0 {
+		return
+	}
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > hs.peak {
+		hs.peak = stats.HeapAlloc
+	}
+}
+
+func (hs *heapSampler) Gauge(sampleRate float32, bucket string, value ...string) {}
+
+func BenchmarkUpdatePeakHeap(b *testing.B) {
+	_, key := newECDSASigner(elliptic.P256())
+	s := &pagingLDAPServer{
+		Count: 2000,
+		Entry: func(i int) *ldap.Entry {
+			name := fmt.Sprintf("user%d", i)
+			return fixtureEntry("cn="+name, map[string][]string{
+				"cn":           {name},
+				"sshPublicKey": {key},
+				"createTime":   {"20160101000000Z"},
+				// Directories often return bulky attributes alongside.
+				"jpegPhoto": {strings.Repeat("x", 16*1024)},
+			})
+		},
+	}
+
+	for _, pageSize := range []uint32{2000, 100} {
+		b.Run(fmt.Sprintf("page size %d", pageSize), func(b *testing.B) {
+			stats := &heapSampler{every: 100}
+			for i := 0; i < b.N; i++ {
+				_, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{
+					UserAttr:       "cn",
+					SSHAttr:        "sshPublicKey",
+					KeyCreatedAttr: "createTime",
+					PageSize:       pageSize,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(stats.peak)/(1<<20), "peak-MiB")
+		})
+	}
+}
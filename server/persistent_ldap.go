@@ -15,52 +15,126 @@
 package server
 
 import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/AdRoll/hologram/log"
 	"github.com/nmcclain/ldap"
 )
 
-type persistentLDAP struct {
-	open func() (LDAPImplementation, error)
+/*
+reconnectingLDAP holds a connection made by dial, and dials a new one
+when a request fails because the old one went away.
+*/
+type reconnectingLDAP struct {
+	sync.Mutex
+	dial func() (LDAPImplementation, error)
 	conn LDAPImplementation
 }
 
-func (pl *persistentLDAP) Refresh() error {
-	conn, err := pl.open()
+/*
+Refresh replaces the connection with a freshly dialled one.
+*/
+func (rl *reconnectingLDAP) Refresh() error {
+	conn, err := rl.dial()
 	if err != nil {
 		return err
 	}
 
-	pl.conn = conn
+	rl.Lock()
+	old := rl.conn
+	rl.conn = conn
+	rl.Unlock()
+
+	if closer, ok := old.(interface {
+		Close()
+	}); ok {
+		closer.Close()
+	}
 	return nil
 }
 
-func (pl *persistentLDAP) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
-	if conn, err := pl.conn.Search(searchRequest); err != nil && err.(*ldap.Error).ResultCode == ldap.ErrorNetwork {
-		pl.Refresh()
-		return pl.conn.Search(searchRequest)
-	} else {
-		return conn, err
+func (rl *reconnectingLDAP) current() LDAPImplementation {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.conn
+}
+
+/*
+reconnect is called after a request on conn failed with err. It reports
+whether the request should be retried on a new connection.
+*/
+func (rl *reconnectingLDAP) reconnect(conn LDAPImplementation, err error) bool {
+	if !connectionLost(err) {
+		return false
 	}
+
+	// Another request may have reconnected while this one was failing.
+	if rl.current() != conn {
+		return true
+	}
+	log.Warning("Lost the LDAP connection (%s); reconnecting.", err.Error())
+	if err := rl.Refresh(); err != nil {
+		log.Warning("Could not reconnect to LDAP: %s", err.Error())
+		return false
+	}
+	return true
 }
 
-func (pl *persistentLDAP) Modify(modifyRequest *ldap.ModifyRequest) error {
-	if err := pl.conn.Modify(modifyRequest); err != nil && err.(*ldap.Error).ResultCode == ldap.ErrorNetwork {
-		pl.Refresh()
-		return pl.conn.Modify(modifyRequest)
-	} else {
-		return err
+func (rl *reconnectingLDAP) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	conn := rl.current()
+	result, err := conn.Search(searchRequest)
+	if err != nil && rl.reconnect(conn, err) {
+		return rl.current().Search(searchRequest)
 	}
+	return result, err
 }
 
-func NewPersistentLDAP(open func() (LDAPImplementation, error)) (LDAPImplementation, error) {
-	conn, err := open()
+func (rl *reconnectingLDAP) Modify(modifyRequest *ldap.ModifyRequest) error {
+	conn := rl.current()
+	err := conn.Modify(modifyRequest)
+	if err != nil && rl.reconnect(conn, err) {
+		return rl.current().Modify(modifyRequest)
+	}
+	return err
+}
+
+/*
+connectionLost reports whether err means the connection is unusable, as
+opposed to the server turning down the request.
+*/
+func connectionLost(err error) bool {
+	switch e := err.(type) {
+	case *ldap.Error:
+		return e.ResultCode == ldap.ErrorNetwork || e.ResultCode == ldap.LDAPResultUnavailable
+	case net.Error:
+		return true
+	}
+	return err == io.EOF
+}
+
+/*
+NewReconnectingLDAP dials a connection and returns an LDAPImplementation
+that, when a search or modification fails because the connection was
+dropped, dials again (dial is expected to bind as well) and retries the
+request once.
+*/
+func NewReconnectingLDAP(dial func() (LDAPImplementation, error)) (LDAPImplementation, error) {
+	conn, err := dial()
 	if err != nil {
 		return nil, err
 	}
 
-	ret := &persistentLDAP{
-		open: open,
+	return &reconnectingLDAP{
+		dial: dial,
 		conn: conn,
-	}
+	}, nil
+}
 
-	return ret, nil
+/*
+NewPersistentLDAP is the old name of NewReconnectingLDAP.
+*/
+func NewPersistentLDAP(open func() (LDAPImplementation, error)) (LDAPImplementation, error) {
+	return NewReconnectingLDAP(open)
 }
@@ -16,6 +16,7 @@ package server_test
 
 import (
 	"errors"
+	"net"
 	"testing"
 
 	"github.com/AdRoll/hologram/server"
@@ -98,3 +99,65 @@ func TestPersistentLDAP(t *testing.T) {
 		So(ldapServer, ShouldBeNil)
 	})
 }
+
+// A server that answers every request with a fixed error.
+type failingLDAPServer struct {
+	err error
+}
+
+func (fls *failingLDAPServer) Search(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return nil, fls.err
+}
+
+func (fls *failingLDAPServer) Modify(*ldap.ModifyRequest) error {
+	return fls.err
+}
+
+func TestReconnectingLDAP(t *testing.T) {
+	Convey("Given a reconnecting LDAP connection", t, func() {
+		dials := 0
+		var failWith error
+		s := &StubLDAPServer{Keys: []string{}}
+		dial := func() (server.LDAPImplementation, error) {
+			dials++
+			if dials == 1 {
+				return &failingLDAPServer{err: failWith}, nil
+			}
+			return s, nil
+		}
+
+		Convey("A dropped TCP connection should be redialled", func() {
+			failWith = &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+			ldapServer, err := server.NewReconnectingLDAP(dial)
+			So(err, ShouldBeNil)
+			_, err = ldapServer.Search(nil)
+			So(err, ShouldBeNil)
+			So(dials, ShouldEqual, 2)
+		})
+
+		Convey("An unavailable server should be redialled", func() {
+			failWith = ldap.NewError(ldap.LDAPResultUnavailable, errors.New("server down"))
+			ldapServer, err := server.NewReconnectingLDAP(dial)
+			So(err, ShouldBeNil)
+			So(ldapServer.Modify(nil), ShouldBeNil)
+			So(dials, ShouldEqual, 2)
+		})
+
+		Convey("A request the server turned down should not be retried", func() {
+			failWith = ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("no"))
+			ldapServer, err := server.NewReconnectingLDAP(dial)
+			So(err, ShouldBeNil)
+			_, err = ldapServer.Search(nil)
+			So(err, ShouldEqual, failWith)
+			So(dials, ShouldEqual, 1)
+		})
+
+		Convey("Errors from outside the LDAP library should be passed on", func() {
+			failWith = errors.New("something else")
+			ldapServer, err := server.NewReconnectingLDAP(dial)
+			So(err, ShouldBeNil)
+			So(ldapServer.Modify(nil), ShouldEqual, failWith)
+			So(dials, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,174 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+DefaultPrometheusBuckets are the histogram bounds, in seconds, used for
+timings when NewPrometheusStatter is given none.
+*/
+var DefaultPrometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/*
+PrometheusStatter is a g2s.Statter backed by prometheus/client_golang, for
+pull-based monitoring instead of statsd. Counters become the counter
+<namespace>_<bucket>_total, gauges the gauge <namespace>_<bucket> and
+timings the histogram <namespace>_<bucket>_seconds, each created on first
+use in a registry of its own. It is an http.Handler meant to be mounted
+at /metrics.
+*/
+type PrometheusStatter struct {
+	sync.Mutex
+	namespace  string
+	buckets    []float64
+	registry   *prometheus.Registry
+	handler    http.Handler
+	counters   map[string]prometheus.Counter
+	gauges     map[string]prometheus.Gauge
+	histograms map[string]prometheus.Histogram
+}
+
+func NewPrometheusStatter(namespace string, buckets []float64) *PrometheusStatter {
+	if len(buckets) == 0 {
+		buckets = DefaultPrometheusBuckets
+	}
+	registry := prometheus.NewRegistry()
+	return &PrometheusStatter{
+		namespace:  namespace,
+		buckets:    buckets,
+		registry:   registry,
+		handler:    promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		counters:   map[string]prometheus.Counter{},
+		gauges:     map[string]prometheus.Gauge{},
+		histograms: map[string]prometheus.Histogram{},
+	}
+}
+
+func (ps *PrometheusStatter) Counter(sampleRate float32, bucket string, n ...int) {
+	counter := ps.counter(bucket)
+	for _, count := range n {
+		counter.Add(float64(count))
+	}
+}
+
+func (ps *PrometheusStatter) Timing(sampleRate float32, bucket string, d ...time.Duration) {
+	histogram := ps.histogram(bucket)
+	for _, duration := range d {
+		histogram.Observe(duration.Seconds())
+	}
+}
+
+func (ps *PrometheusStatter) Gauge(sampleRate float32, bucket string, value ...string) {
+	for _, v := range value {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Debug("Not exporting non-numeric gauge %s=%q.", bucket, v)
+			continue
+		}
+		ps.gauge(bucket).Set(parsed)
+	}
+}
+
+/*
+ServeHTTP serves every metric in whichever exposition format the scraper
+asks for.
+*/
+func (ps *PrometheusStatter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.handler.ServeHTTP(w, r)
+}
+
+func (ps *PrometheusStatter) counter(bucket string) prometheus.Counter {
+	ps.Lock()
+	defer ps.Unlock()
+	counter, ok := ps.counters[bucket]
+	if !ok {
+		counter = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ps.namespace,
+			Name:      metricName(bucket) + "_total",
+			Help:      "The " + bucket + " counter.",
+		})
+		ps.register(bucket, counter)
+		ps.counters[bucket] = counter
+	}
+	return counter
+}
+
+func (ps *PrometheusStatter) gauge(bucket string) prometheus.Gauge {
+	ps.Lock()
+	defer ps.Unlock()
+	gauge, ok := ps.gauges[bucket]
+	if !ok {
+		gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ps.namespace,
+			Name:      metricName(bucket),
+			Help:      "The " + bucket + " gauge.",
+		})
+		ps.register(bucket, gauge)
+		ps.gauges[bucket] = gauge
+	}
+	return gauge
+}
+
+func (ps *PrometheusStatter) histogram(bucket string) prometheus.Histogram {
+	ps.Lock()
+	defer ps.Unlock()
+	histogram, ok := ps.histograms[bucket]
+	if !ok {
+		histogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: ps.namespace,
+			Name:      metricName(bucket) + "_seconds",
+			Help:      "The " + bucket + " timing, in seconds.",
+			Buckets:   ps.buckets,
+		})
+		ps.register(bucket, histogram)
+		ps.histograms[bucket] = histogram
+	}
+	return histogram
+}
+
+/*
+register adds a new metric to the registry. One whose name clashes with
+another's is still kept, so that callers need not check, but is not
+exported.
+*/
+func (ps *PrometheusStatter) register(bucket string, collector prometheus.Collector) {
+	if err := ps.registry.Register(collector); err != nil {
+		log.Warning("Not exporting metric %s: %s", bucket, err.Error())
+	}
+}
+
+/*
+metricName turns a statsd bucket into a valid Prometheus metric name,
+replacing anything other than letters, digits and underscores.
+*/
+func metricName(bucket string) string {
+	name := []byte(bucket)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusStatter(t *testing.T) {
+	Convey("Given a Prometheus statter", t, func() {
+		ps := server.NewPrometheusStatter("hologram", []float64{0.1, 1})
+		scrape := func() string {
+			recorder := httptest.NewRecorder()
+			ps.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			body, _ := ioutil.ReadAll(recorder.Body)
+			return string(body)
+		}
+
+		Convey("Counters should be summed", func() {
+			ps.Counter(1.0, "ldapCacheMiss", 1)
+			ps.Counter(1.0, "ldapCacheMiss", 2)
+			So(scrape(), ShouldContainSubstring, "# TYPE hologram_ldapCacheMiss_total counter\nhologram_ldapCacheMiss_total 3\n")
+		})
+
+		Convey("Gauges should keep their last value", func() {
+			ps.Gauge(1.0, "ldapUserCount", "10")
+			ps.Gauge(1.0, "ldapUserCount", "7")
+			ps.Gauge(1.0, "ldapUserCount", "not a number")
+			So(scrape(), ShouldContainSubstring, "hologram_ldapUserCount 7\n")
+		})
+
+		Convey("Timings should fill a cumulative histogram", func() {
+			ps.Timing(1.0, "authLatency", 50*time.Millisecond, 500*time.Millisecond, 2*time.Second)
+			body := scrape()
+			So(body, ShouldContainSubstring, "# TYPE hologram_authLatency_seconds histogram\n")
+			So(body, ShouldContainSubstring, "hologram_authLatency_seconds_bucket{le=\"0.1\"} 1\n")
+			So(body, ShouldContainSubstring, "hologram_authLatency_seconds_bucket{le=\"1\"} 2\n")
+			So(body, ShouldContainSubstring, "hologram_authLatency_seconds_bucket{le=\"+Inf\"} 3\n")
+			So(body, ShouldContainSubstring, "hologram_authLatency_seconds_sum 2.55\n")
+			So(body, ShouldContainSubstring, "hologram_authLatency_seconds_count 3\n")
+		})
+
+		Convey("Bucket names should be made valid metric names", func() {
+			ps.Counter(1.0, "authByKeyType.ecdsa-sha2-nistp256", 1)
+			So(scrape(), ShouldContainSubstring, "hologram_authByKeyType_ecdsa_sha2_nistp256_total 1\n")
+		})
+
+		Convey("A bucket whose name clashes with another's should not be exported", func() {
+			ps.Counter(1.0, "requests", 1)
+			ps.Gauge(1.0, "requests_total", "5")
+			body := scrape()
+			So(body, ShouldContainSubstring, "hologram_requests_total 1\n")
+			So(body, ShouldNotContainSubstring, "hologram_requests_total 5\n")
+		})
+
+		Convey("An LDAP cache should report misses and authentication latency", func() {
+			signer, key := newECDSASigner(elliptic.P256())
+			s := &FixtureLDAPServer{}
+			lc, err := server.NewLDAPUserCacheWith(s, ps)
+			So(err, ShouldBeNil)
+			s.Users = []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			}
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+
+			body := scrape()
+			So(body, ShouldContainSubstring, "hologram_ldapCacheMiss_total 1\n")
+			So(body, ShouldContainSubstring, "hologram_authLatency_seconds_count 1\n")
+		})
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+/*
+BackgroundRefresher is implemented by user caches that can keep
+themselves fresh on a timer, rather than waiting for a cache miss.
+*/
+type BackgroundRefresher interface {
+	StartBackgroundRefresh(interval time.Duration) (stop func())
+}
+
+/*
+StartBackgroundRefresh calls Update() every interval until the returned
+function is called. A failed refresh is logged and leaves the last good
+user set in place. Calling stop waits for the goroutine to exit, and is
+safe to do more than once.
+*/
+func (luc *ldapUserCache) StartBackgroundRefresh(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		if interval <= 0 {
+			<-done
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := luc.updateWithTimeout(); err != nil {
+					log.Warning("Background refresh of the user cache failed, keeping the previous users: %s", err.Error())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"context"
+	"crypto/elliptic"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+lockedLDAPServer guards a FixtureLDAPServer so that tests can change it
+while a background refresh is searching it.
+*/
+type lockedLDAPServer struct {
+	sync.Mutex
+	fixture FixtureLDAPServer
+}
+
+func (lls *lockedLDAPServer) Search(s *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	lls.Lock()
+	defer lls.Unlock()
+	return lls.fixture.Search(s)
+}
+
+func (lls *lockedLDAPServer) Modify(m *ldap.ModifyRequest) error {
+	lls.Lock()
+	defer lls.Unlock()
+	return lls.fixture.Modify(m)
+}
+
+func (lls *lockedLDAPServer) searches() int {
+	lls.Lock()
+	defer lls.Unlock()
+	return lls.fixture.Searches
+}
+
+// eventually polls condition until it holds or a second has passed.
+func eventually(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return condition()
+}
+
+func TestLDAPUserCacheBackgroundRefresh(t *testing.T) {
+	Convey("Given an LDAP cache refreshing itself in the background", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &lockedLDAPServer{}
+		s.fixture.Users = []*ldap.Entry{
+			fixtureEntry("cn=first", map[string][]string{"cn": {"first"}, "sshPublicKey": {key}}),
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		stop := lc.StartBackgroundRefresh(5 * time.Millisecond)
+		defer stop()
+
+		Convey("Users added to LDAP should show up without a cache miss", func() {
+			s.Lock()
+			s.fixture.Users = append(s.fixture.Users,
+				fixtureEntry("cn=second", map[string][]string{"cn": {"second"}, "sshPublicKey": {key}}))
+			s.Unlock()
+
+			So(eventually(func() bool { return lc.Users()["second"] != nil }), ShouldBeTrue)
+		})
+
+		Convey("A failing refresh should keep the last good users", func() {
+			s.Lock()
+			s.fixture.Err = errors.New("LDAP is down")
+			s.Unlock()
+
+			before := s.searches()
+			So(eventually(func() bool { return s.searches() > before+2 }), ShouldBeTrue)
+			So(lc.Users(), ShouldContainKey, "first")
+		})
+
+		Convey("Stopping should end the refreshes", func() {
+			stop()
+			stop()
+			after := s.searches()
+			time.Sleep(20 * time.Millisecond)
+			So(s.searches(), ShouldEqual, after)
+		})
+	})
+}
+
+func TestLDAPUserCacheUpdateContext(t *testing.T) {
+	Convey("Given an LDAP cache whose directory stops answering", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &lockedLDAPServer{}
+		s.fixture.Users = []*ldap.Entry{
+			fixtureEntry("cn=first", map[string][]string{"cn": {"first"}, "sshPublicKey": {key}}),
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		s.Lock()
+		s.fixture.Users = nil
+		defer s.Unlock()
+
+		Convey("UpdateContext should give up at the deadline and keep the users", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			So(lc.UpdateContext(ctx), ShouldResemble, context.DeadlineExceeded)
+			So(lc.Users(), ShouldContainKey, "first")
+		})
+
+		Convey("UpdateWithTimeout should do the same for any cache that supports it", func() {
+			So(server.UpdateWithTimeout(lc, 20*time.Millisecond), ShouldResemble, context.DeadlineExceeded)
+			So(lc.Users(), ShouldContainKey, "first")
+		})
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+RefreshRecord describes one Update(): when it started, how long it took,
+how many users it loaded and, if it failed, why.
+*/
+type RefreshRecord struct {
+	Time     time.Time
+	Duration time.Duration
+	Users    int
+	Error    string
+}
+
+/*
+refreshHistory keeps the most recent refresh records, dropping the oldest
+once full.
+*/
+type refreshHistory struct {
+	sync.Mutex
+	size    int
+	records []RefreshRecord
+}
+
+func newRefreshHistory(size int) *refreshHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &refreshHistory{size: size}
+}
+
+func (rh *refreshHistory) add(record RefreshRecord) {
+	rh.Lock()
+	defer rh.Unlock()
+
+	rh.records = append(rh.records, record)
+	if len(rh.records) > rh.size {
+		rh.records = append([]RefreshRecord{}, rh.records[len(rh.records)-rh.size:]...)
+	}
+}
+
+/*
+snapshot returns the retained records, oldest first.
+*/
+func (rh *refreshHistory) snapshot() []RefreshRecord {
+	rh.Lock()
+	defer rh.Unlock()
+	return append([]RefreshRecord{}, rh.records...)
+}
+
+/*
+recordRefresh remembers the outcome of an Update() that began at start.
+*/
+func (luc *ldapUserCache) recordRefresh(start time.Time, users int, err error) {
+	if luc.refreshes == nil {
+		return
+	}
+
+	record := RefreshRecord{
+		Time:     start,
+		Duration: luc.opts.Clock.Now().Sub(start),
+		Users:    users,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	luc.refreshes.add(record)
+}
+
+/*
+RefreshHistory returns the outcomes of the most recent Update() calls,
+oldest first, up to Options.RefreshHistorySize of them.
+*/
+func (luc *ldapUserCache) RefreshHistory() []RefreshRecord {
+	if luc.refreshes == nil {
+		return nil
+	}
+	return luc.refreshes.snapshot()
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRefreshHistory(t *testing.T) {
+	Convey("Given an LDAP cache remembering the last three refreshes", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:           "cn",
+			SSHAttr:            "sshPublicKey",
+			RefreshHistorySize: 3,
+			Clock:              clock,
+		})
+		So(err, ShouldBeNil)
+
+		history := lc.RefreshHistory()
+		So(history, ShouldHaveLength, 1)
+		So(history[0].Users, ShouldEqual, 1)
+		So(history[0].Error, ShouldBeEmpty)
+
+		Convey("Successes and failures should be recorded in order", func() {
+			clock.Advance(time.Minute)
+			s.Err = errors.New("directory is down")
+			So(lc.Update(), ShouldNotBeNil)
+
+			clock.Advance(time.Minute)
+			s.Err = nil
+			s.Users = append(s.Users, fixtureEntry("cn=other", map[string][]string{"cn": {"other"}, "sshPublicKey": {key}}))
+			So(lc.Update(), ShouldBeNil)
+
+			history := lc.RefreshHistory()
+			So(history, ShouldHaveLength, 3)
+			So(history[1].Error, ShouldEqual, "directory is down")
+			So(history[1].Users, ShouldEqual, 0)
+			So(history[2].Error, ShouldBeEmpty)
+			So(history[2].Users, ShouldEqual, 2)
+			So(history[2].Time, ShouldResemble, history[1].Time.Add(time.Minute))
+
+			Convey("And only the most recent three should be kept", func() {
+				clock.Advance(time.Minute)
+				s.Err = errors.New("still down")
+				So(lc.Update(), ShouldNotBeNil)
+
+				history := lc.RefreshHistory()
+				So(history, ShouldHaveLength, 3)
+				So(history[0].Error, ShouldEqual, "directory is down")
+				So(history[2].Error, ShouldEqual, "still down")
+			})
+		})
+	})
+
+	Convey("Without a history size nothing should be recorded", t, func() {
+		lc, err := server.NewLDAPUserCacheWithOptions(&FixtureLDAPServer{}, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+		So(lc.RefreshHistory(), ShouldBeEmpty)
+	})
+}
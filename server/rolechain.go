@@ -0,0 +1,115 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/peterbourgon/g2s"
+)
+
+// The most intermediate roles a chain may go through.
+const MaxRoleChainLength = 5
+
+/*
+AWS caps sessions of roles assumed with credentials from another role at
+an hour, whatever the role's MaxSessionDuration.
+*/
+const chainedSessionDuration = time.Hour
+
+// Errors returned for role chains that cannot be used.
+var (
+	ErrEmptyRoleChain   = errors.New("a role chain needs at least one intermediate role")
+	ErrRoleChainTooLong = fmt.Errorf("a role chain may have at most %d intermediate roles", MaxRoleChainLength)
+)
+
+/*
+roleChain describes the intermediate roles assumed, in order, before the
+role a user asked for, each with the credentials the previous one got.
+*/
+type roleChain struct {
+	hops   []string
+	newSTS func(*sts.Credentials) STSImplementation
+	stats  g2s.Statter
+}
+
+/*
+NewChainedSTS returns an STS client acting with creds, for the hops of a
+role chain.
+*/
+func NewChainedSTS(creds *sts.Credentials) STSImplementation {
+	static := credentials.NewStaticCredentials(*creds.AccessKeyId, *creds.SecretAccessKey, *creds.SessionToken)
+	return sts.New(session.New(&aws.Config{Credentials: static}))
+}
+
+/*
+ChainThrough makes AssumeRole go through the given intermediate roles, in
+order, before assuming the requested role with the last one's
+credentials. Every hop uses the requesting user's session name, and its
+time is reported to stats as roleChainHop<n>, the requested role being
+the last hop. Chained sessions last an hour at most. A nil newSTS uses
+NewChainedSTS.
+*/
+func (s *directSessionTokenService) ChainThrough(hops []string, newSTS func(*sts.Credentials) STSImplementation, stats g2s.Statter) error {
+	if len(hops) == 0 {
+		return ErrEmptyRoleChain
+	}
+	if len(hops) > MaxRoleChainLength {
+		return ErrRoleChainTooLong
+	}
+	if newSTS == nil {
+		newSTS = NewChainedSTS
+	}
+
+	arns := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		arns = append(arns, s.buildARN(hop))
+	}
+	s.chain = &roleChain{hops: arns, newSTS: newSTS, stats: stats}
+	return nil
+}
+
+/*
+assume walks the chain and assumes the role options asks for with the
+credentials of its last hop.
+*/
+func (rc *roleChain) assume(base STSImplementation, options *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	client := base
+	for i, hop := range rc.hops {
+		duration := int64(chainedSessionDuration / time.Second)
+		start := time.Now()
+		r, err := client.AssumeRole(&sts.AssumeRoleInput{
+			DurationSeconds: &duration,
+			RoleArn:         &hop,
+			RoleSessionName: options.RoleSessionName,
+		})
+		rc.stats.Timing(1.0, fmt.Sprintf("roleChainHop%d", i), time.Since(start))
+		if err != nil {
+			return nil, fmt.Errorf("could not assume %s, hop %d of the role chain: %s", hop, i+1, err.Error())
+		}
+		client = rc.newSTS(r.Credentials)
+	}
+
+	start := time.Now()
+	r, err := client.AssumeRole(options)
+	rc.stats.Timing(1.0, fmt.Sprintf("roleChainHop%d", len(rc.hops)), time.Since(start))
+	return r, err
+}
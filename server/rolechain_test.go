@@ -0,0 +1,111 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+chainLog records, for each AssumeRole call made through a hopSTS, who made
+it and what it asked for.
+*/
+type chainLog struct {
+	calls     []string
+	durations []int64
+	fail      string
+}
+
+/*
+hopSTS acts as the identity named by its credentials, issuing credentials
+named after the role assumed.
+*/
+type hopSTS struct {
+	as  string
+	log *chainLog
+}
+
+func (hs *hopSTS) AssumeRole(options *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	hs.log.calls = append(hs.log.calls, hs.as+" -> "+*options.RoleArn+" as "+*options.RoleSessionName)
+	hs.log.durations = append(hs.log.durations, *options.DurationSeconds)
+	if *options.RoleArn == hs.log.fail {
+		return nil, errors.New("AccessDenied")
+	}
+	expiration := time.Now().Add(time.Hour)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String(*options.RoleArn),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      &expiration,
+	}}, nil
+}
+
+func (hs *hopSTS) GetSessionToken(*sts.GetSessionTokenInput) (*sts.GetSessionTokenOutput, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestRoleChain(t *testing.T) {
+	Convey("Given a credential service chaining through two hub roles", t, func() {
+		calls := &chainLog{}
+		service := server.NewDirectSessionTokenService("123456789012", &hopSTS{as: "hologram", log: calls}, nil)
+		service.LimitSessionDuration(12 * time.Hour)
+		stats := newRecordingStatter()
+		newSTS := func(creds *sts.Credentials) server.STSImplementation {
+			return &hopSTS{as: *creds.AccessKeyId, log: calls}
+		}
+		err := service.ChainThrough([]string{"hub", "arn:aws:iam::210987654321:role/member-hub"}, newSTS, stats)
+		So(err, ShouldBeNil)
+		user := &server.User{Username: "alice"}
+
+		Convey("Each hop should use the previous hop's credentials and the user's session name", func() {
+			creds, err := service.AssumeRole(user, "arn:aws:iam::210987654321:role/developer", false)
+			So(err, ShouldBeNil)
+			So(*creds.AccessKeyId, ShouldEqual, "arn:aws:iam::210987654321:role/developer")
+			So(calls.calls, ShouldResemble, []string{
+				"hologram -> arn:aws:iam::123456789012:role/hub as alice",
+				"arn:aws:iam::123456789012:role/hub -> arn:aws:iam::210987654321:role/member-hub as alice",
+				"arn:aws:iam::210987654321:role/member-hub -> arn:aws:iam::210987654321:role/developer as alice",
+			})
+		})
+
+		Convey("Chained sessions should last an hour at most", func() {
+			_, err := service.AssumeRoleFor(user, "developer", false, 8*time.Hour)
+			So(err, ShouldBeNil)
+			So(calls.durations, ShouldResemble, []int64{3600, 3600, 3600})
+		})
+
+		Convey("A failing hop should be named in the error", func() {
+			calls.fail = "arn:aws:iam::210987654321:role/member-hub"
+			_, err := service.AssumeRole(user, "developer", false)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "hop 2 of the role chain")
+			So(calls.calls, ShouldHaveLength, 2)
+		})
+	})
+
+	Convey("Chains should be refused when empty or too long", t, func() {
+		service := server.NewDirectSessionTokenService("123456789012", &hopSTS{log: &chainLog{}}, nil)
+		So(service.ChainThrough(nil, nil, nil), ShouldEqual, server.ErrEmptyRoleChain)
+		tooLong := make([]string, server.MaxRoleChainLength+1)
+		So(service.ChainThrough(tooLong, nil, nil), ShouldEqual, server.ErrRoleChainTooLong)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// How long a role's MaxSessionDuration is reused when no TTL is given.
+const defaultRoleDurationTTL = time.Hour
+
+var errNoMaxSessionDuration = errors.New("GetRole did not return a MaxSessionDuration")
+
+/*
+RoleDurationSource looks up the MaxSessionDuration of a role in the
+account Hologram runs in.
+*/
+type RoleDurationSource interface {
+	MaxSessionDuration(roleName string) (time.Duration, error)
+}
+
+type iamRoleDurations struct {
+	client *iam.IAM
+}
+
+/*
+NewIAMRoleDurations reads roles' MaxSessionDuration with iam:GetRole.
+*/
+func NewIAMRoleDurations(client *iam.IAM) RoleDurationSource {
+	return &iamRoleDurations{client: client}
+}
+
+/*
+getRoleDurationOutput decodes the MaxSessionDuration of a GetRole
+response, which the vendored SDK's iam.Role predates.
+*/
+type getRoleDurationOutput struct {
+	_    struct{}          `type:"structure"`
+	Role *roleDurationData `type:"structure"`
+}
+
+type roleDurationData struct {
+	_                  struct{} `type:"structure"`
+	MaxSessionDuration *int64   `type:"integer"`
+}
+
+func (ird *iamRoleDurations) MaxSessionDuration(roleName string) (time.Duration, error) {
+	req, _ := ird.client.GetRoleRequest(&iam.GetRoleInput{RoleName: &roleName})
+	output := &getRoleDurationOutput{}
+	req.Data = output
+	if err := req.Send(); err != nil {
+		return 0, err
+	}
+	if output.Role == nil || output.Role.MaxSessionDuration == nil {
+		return 0, errNoMaxSessionDuration
+	}
+	return time.Duration(*output.Role.MaxSessionDuration) * time.Second, nil
+}
+
+type roleDuration struct {
+	max     time.Duration
+	checked time.Time
+}
+
+/*
+roleDurations caches the MaxSessionDuration of the roles in one account,
+so that only the first session for a role in each ttl costs a GetRole
+call.
+*/
+type roleDurations struct {
+	sync.Mutex
+	source  RoleDurationSource
+	account string
+	ttl     time.Duration
+	clock   Clock
+	entries map[string]roleDuration
+}
+
+func newRoleDurations(source RoleDurationSource, account string, ttl time.Duration, clock Clock) *roleDurations {
+	if ttl <= 0 {
+		ttl = defaultRoleDurationTTL
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &roleDurations{
+		source:  source,
+		account: account,
+		ttl:     ttl,
+		clock:   clock,
+		entries: map[string]roleDuration{},
+	}
+}
+
+/*
+lookup returns roleARN's MaxSessionDuration. Roles in other accounts
+cannot be read with our IAM client and are not looked up; neither are
+lookups that fail cached.
+*/
+func (rd *roleDurations) lookup(roleARN string) (time.Duration, bool) {
+	if parts := strings.Split(roleARN, ":"); len(parts) < 6 || parts[4] != rd.account {
+		return 0, false
+	}
+
+	rd.Lock()
+	entry, ok := rd.entries[roleARN]
+	rd.Unlock()
+	if ok && rd.clock.Now().Sub(entry.checked) < rd.ttl {
+		return entry.max, true
+	}
+
+	roleName := roleARN[strings.LastIndex(roleARN, "/")+1:]
+	max, err := rd.source.MaxSessionDuration(roleName)
+	if err != nil {
+		log.Warning("Could not look up the MaxSessionDuration of %s: %s", roleARN, err.Error())
+		return 0, false
+	}
+
+	rd.Lock()
+	rd.entries[roleARN] = roleDuration{max: max, checked: rd.clock.Now()}
+	rd.Unlock()
+	return max, true
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+stubRoleDurations serves canned MaxSessionDurations keyed by role name,
+counting the lookups it receives.
+*/
+type stubRoleDurations struct {
+	durations map[string]time.Duration
+	calls     int
+}
+
+func (srd *stubRoleDurations) MaxSessionDuration(roleName string) (time.Duration, error) {
+	srd.calls++
+	if d, ok := srd.durations[roleName]; ok {
+		return d, nil
+	}
+	return 0, errors.New("NoSuchEntity")
+}
+
+func TestRoleDurations(t *testing.T) {
+	Convey("Given a credential service that looks up role durations", t, func() {
+		fake := &countingSTS{clock: &fakeClock{now: time.Now()}}
+		clock := &fakeClock{now: time.Now()}
+		source := &stubRoleDurations{durations: map[string]time.Duration{
+			"long":  8 * time.Hour,
+			"short": time.Hour,
+		}}
+		service := server.NewDirectSessionTokenService("123456789012", fake, nil)
+		service.LookupRoleDurations(source, time.Hour, clock)
+		user := &server.User{Username: "alice"}
+
+		Convey("Sessions should be limited by the role's own MaxSessionDuration", func() {
+			service.AssumeRoleFor(user, "long", false, 12*time.Hour)
+			So(fake.duration, ShouldEqual, 8*3600)
+			service.AssumeRoleFor(user, "short", false, 12*time.Hour)
+			So(fake.duration, ShouldEqual, 3600)
+		})
+
+		Convey("The configured limit should stay an upper bound", func() {
+			service.LimitSessionDuration(4 * time.Hour)
+			service.AssumeRoleFor(user, "long", false, 12*time.Hour)
+			So(fake.duration, ShouldEqual, 4*3600)
+		})
+
+		Convey("Lookups should be cached until they expire", func() {
+			service.AssumeRoleFor(user, "long", false, 2*time.Hour)
+			service.AssumeRoleFor(user, "long", false, 2*time.Hour)
+			So(source.calls, ShouldEqual, 1)
+			clock.now = clock.now.Add(2 * time.Hour)
+			service.AssumeRoleFor(user, "long", false, 2*time.Hour)
+			So(source.calls, ShouldEqual, 2)
+		})
+
+		Convey("Roles that cannot be looked up should keep the old limit", func() {
+			service.AssumeRoleFor(user, "missing", false, 12*time.Hour)
+			So(fake.duration, ShouldEqual, 3600)
+		})
+
+		Convey("Roles in other accounts should not be looked up", func() {
+			service.AssumeRoleFor(user, "arn:aws:iam::210987654321:role/long", false, 12*time.Hour)
+			So(fake.duration, ShouldEqual, 3600)
+			So(source.calls, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestIAMRoleDurations(t *testing.T) {
+	Convey("Given an IAM endpoint describing a role", t, func() {
+		var roleName string
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			roleName = r.Form.Get("RoleName")
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(`<GetRoleResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/">
+  <GetRoleResult>
+    <Role>
+      <Path>/</Path>
+      <RoleName>developer</RoleName>
+      <RoleId>AROADBQP57FF2AEXAMPLE</RoleId>
+      <Arn>arn:aws:iam::123456789012:role/developer</Arn>
+      <CreateDate>2019-11-13T16:45:56Z</CreateDate>
+      <MaxSessionDuration>14400</MaxSessionDuration>
+    </Role>
+  </GetRoleResult>
+  <ResponseMetadata><RequestId>df37e965-9967-11e1-a4c3-270EXAMPLE04</RequestId></ResponseMetadata>
+</GetRoleResponse>`))
+		}))
+		defer endpoint.Close()
+
+		client := iam.New(session.New(&aws.Config{
+			Endpoint:    aws.String(endpoint.URL),
+			Region:      aws.String("us-east-1"),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		}))
+
+		Convey("Its MaxSessionDuration should be read from GetRole", func() {
+			max, err := server.NewIAMRoleDurations(client).MaxSessionDuration("developer")
+			So(err, ShouldBeNil)
+			So(max, ShouldEqual, 4*time.Hour)
+			So(roleName, ShouldEqual, "developer")
+		})
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/peterbourgon/g2s"
+)
+
+// How many distinct roles are counted when Options.RoleUsageLimit is unset.
+const defaultRoleUsageLimit = 1024
+
+/*
+RoleUsageOther collects the uses of roles seen after the usage counters
+reached their limit.
+*/
+const RoleUsageOther = "other"
+
+/*
+roleUsage counts authorized credential requests per role. Only the first
+limit roles get a counter of their own, so a stream of bogus role names
+cannot grow the map without bound.
+*/
+type roleUsage struct {
+	sync.Mutex
+	limit  int
+	stats  g2s.Statter
+	counts map[string]int
+}
+
+func newRoleUsage(limit int, stats g2s.Statter) *roleUsage {
+	if limit <= 0 {
+		limit = defaultRoleUsageLimit
+	}
+	return &roleUsage{
+		limit:  limit,
+		stats:  stats,
+		counts: map[string]int{},
+	}
+}
+
+/*
+record counts one use of role.
+*/
+func (ru *roleUsage) record(role string) {
+	if role == "" {
+		return
+	}
+
+	ru.Lock()
+	if _, ok := ru.counts[role]; !ok && len(ru.counts) >= ru.limit {
+		role = RoleUsageOther
+	}
+	ru.counts[role]++
+	ru.Unlock()
+
+	ru.stats.Counter(1.0, "roleUsage."+statName(role), 1)
+}
+
+/*
+snapshot returns a copy of the counters.
+*/
+func (ru *roleUsage) snapshot() map[string]int {
+	ru.Lock()
+	defer ru.Unlock()
+
+	counts := make(map[string]int, len(ru.counts))
+	for role, count := range ru.counts {
+		counts[role] = count
+	}
+	return counts
+}
+
+// statName makes an ARN safe to use as part of a statsd bucket name.
+func statName(arn string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '/', '.', '|', '@':
+			return '_'
+		}
+		return r
+	}, arn)
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRoleUsage(t *testing.T) {
+	Convey("Given an LDAP cache that tracks at most two roles", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:       "cn",
+			SSHAttr:        "sshPublicKey",
+			DefaultRole:    "arn:aws:iam::123456789012:role/default",
+			RoleUsageLimit: 2,
+		})
+		So(err, ShouldBeNil)
+
+		authorize := func(role string) {
+			user, ok := lc.Lookup("testuser")
+			So(ok, ShouldBeTrue)
+			So(lc.AuthorizeRole(user, role), ShouldBeNil)
+		}
+
+		Convey("Roles issued by a credential service should be counted", func() {
+			service := server.NewDirectSessionTokenService("123456789012", &countingSTS{clock: &fakeClock{now: time.Now()}}, nil)
+			service.AuthorizeRolesWith(lc)
+			user, _ := lc.Lookup("testuser")
+			_, err := service.AssumeRole(user, "developer", false)
+			So(err, ShouldBeNil)
+			So(lc.RoleUsage(), ShouldResemble, map[string]int{
+				"arn:aws:iam::123456789012:role/developer": 1,
+			})
+		})
+
+		Convey("Authenticating alone should not count any role", func() {
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+			So(lc.RoleUsage(), ShouldBeEmpty)
+		})
+
+		Convey("Authorizing a role should count that role", func() {
+			authorize("arn:aws:iam::123456789012:role/developer")
+			So(lc.RoleUsage()["arn:aws:iam::123456789012:role/developer"], ShouldEqual, 1)
+
+			Convey("And roles beyond the limit should be counted together", func() {
+				authorize("arn:aws:iam::123456789012:role/default")
+				authorize("arn:aws:iam::123456789012:role/reader")
+				authorize("arn:aws:iam::123456789012:role/writer")
+				So(lc.RoleUsage(), ShouldResemble, map[string]int{
+					"arn:aws:iam::123456789012:role/developer": 1,
+					"arn:aws:iam::123456789012:role/default":   1,
+					server.RoleUsageOther:                      2,
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nmcclain/ldap"
+)
+
+/*
+searchSlots bounds the LDAP searches in flight across every cache and
+handler in this process, so that we stay under the directory's connection
+limit. A nil channel means no bound.
+*/
+var searchSlots struct {
+	sync.Mutex
+	slots chan struct{}
+}
+
+/*
+SetMaxConcurrentSearches limits the number of LDAP searches Hologram runs
+at once; searches beyond the limit wait for a free slot. Zero or less
+removes the limit. Searches already waiting keep the limit they started
+under.
+*/
+func SetMaxConcurrentSearches(n int) {
+	searchSlots.Lock()
+	defer searchSlots.Unlock()
+
+	if n <= 0 {
+		searchSlots.slots = nil
+		return
+	}
+	searchSlots.slots = make(chan struct{}, n)
+}
+
+/*
+limitedSearch runs a search against server once a slot is free.
+*/
+func limitedSearch(server LDAPImplementation, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return limitedSearchContext(context.Background(), server, searchRequest)
+}
+
+type searchOutcome struct {
+	result *ldap.SearchResult
+	err    error
+}
+
+/*
+limitedSearchContext is limitedSearch giving up, with ctx's error, once
+ctx is done. The LDAP client cannot abandon a search, so one that is
+already running is left to finish in the background, holding its slot
+until it does, and its result is discarded.
+*/
+func limitedSearchContext(ctx context.Context, server LDAPImplementation, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	searchSlots.Lock()
+	slots := searchSlots.slots
+	searchSlots.Unlock()
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+
+	if ctx.Done() == nil {
+		defer release()
+		return server.Search(searchRequest)
+	}
+
+	outcome := make(chan searchOutcome, 1)
+	go func() {
+		defer release()
+		result, err := server.Search(searchRequest)
+		outcome <- searchOutcome{result, err}
+	}()
+	select {
+	case o := <-outcome:
+		return o.result, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+slowLDAPServer answers every search after a pause, keeping track of the
+most searches it ever had in flight at once.
+*/
+type slowLDAPServer struct {
+	sync.Mutex
+	entries     []*ldap.Entry
+	inFlight    int
+	maxInFlight int
+}
+
+func (sls *slowLDAPServer) Search(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+	sls.Lock()
+	sls.inFlight++
+	if sls.inFlight > sls.maxInFlight {
+		sls.maxInFlight = sls.inFlight
+	}
+	sls.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	sls.Lock()
+	sls.inFlight--
+	sls.Unlock()
+	return &ldap.SearchResult{Entries: sls.entries}, nil
+}
+
+func (*slowLDAPServer) Modify(*ldap.ModifyRequest) error {
+	return nil
+}
+
+func TestMaxConcurrentSearches(t *testing.T) {
+	Convey("Given several caches sharing a slow directory", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &slowLDAPServer{entries: []*ldap.Entry{
+			fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+		}}
+		caches := make([]server.UserCache, 8)
+		for i := range caches {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+			So(err, ShouldBeNil)
+			caches[i] = lc
+		}
+		updateAll := func() []error {
+			var wg sync.WaitGroup
+			errs := make([]error, len(caches))
+			for i, lc := range caches {
+				wg.Add(1)
+				go func(i int, lc server.UserCache) {
+					defer wg.Done()
+					errs[i] = lc.Update()
+				}(i, lc)
+			}
+			wg.Wait()
+			return errs
+		}
+		Reset(func() { server.SetMaxConcurrentSearches(0) })
+
+		Convey("Concurrent updates should never exceed the configured ceiling", func() {
+			server.SetMaxConcurrentSearches(2)
+			for _, err := range updateAll() {
+				So(err, ShouldBeNil)
+			}
+			So(s.maxInFlight, ShouldEqual, 2)
+		})
+
+		Convey("Without a ceiling the updates should overlap freely", func() {
+			s.maxInFlight = 0
+			updateAll()
+			So(s.maxInFlight, ShouldBeGreaterThan, 2)
+		})
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Errors returned by the verification self-test.
+var (
+	ErrSelfTestRejected = errors.New("self-test: a valid signature was rejected")
+	ErrSelfTestAccepted = errors.New("self-test: a signature over the wrong challenge was accepted")
+)
+
+/*
+KeyVerifier checks that sig is key's signature over challenge.
+*/
+type KeyVerifier func(key ssh.PublicKey, challenge []byte, sig *ssh.Signature) error
+
+/*
+RunSelfTest signs a challenge with an ephemeral key and checks that verify
+accepts the signature and rejects it for a different challenge, catching a
+broken crypto build that would otherwise turn every user away (or let
+everybody in).
+*/
+func RunSelfTest(verify KeyVerifier) error {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("self-test: could not generate a key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("self-test: could not create a signer: %s", err)
+	}
+
+	challenge := make([]byte, 64)
+	if _, err := rand.Read(challenge); err != nil {
+		return fmt.Errorf("self-test: could not create a challenge: %s", err)
+	}
+	sig, err := signer.Sign(rand.Reader, challenge)
+	if err != nil {
+		return fmt.Errorf("self-test: could not sign the challenge: %s", err)
+	}
+
+	if verify(signer.PublicKey(), challenge, sig) != nil {
+		return ErrSelfTestRejected
+	}
+	challenge[0] ^= 0xff
+	if verify(signer.PublicKey(), challenge, sig) == nil {
+		return ErrSelfTestAccepted
+	}
+	return nil
+}
+
+/*
+SelfTest runs RunSelfTest against the checks the cache applies to its
+users' keys.
+*/
+func (luc *ldapUserCache) SelfTest() error {
+	return RunSelfTest(func(key ssh.PublicKey, challenge []byte, sig *ssh.Signature) error {
+		user := &User{Username: "self-test", SSHKeys: []ssh.PublicKey{key}}
+		if luc.verifyUserKey(user, challenge, sig, luc.opts.Clock.Now()) == nil {
+			return errors.New("signature did not verify")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,55 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSelfTest(t *testing.T) {
+	Convey("The self-test should pass with the real verifier", t, func() {
+		So(server.RunSelfTest(func(key ssh.PublicKey, challenge []byte, sig *ssh.Signature) error {
+			return key.Verify(challenge, sig)
+		}), ShouldBeNil)
+	})
+
+	Convey("The self-test should fail with a verifier that rejects everything", t, func() {
+		So(server.RunSelfTest(func(key ssh.PublicKey, challenge []byte, sig *ssh.Signature) error {
+			return errors.New("broken")
+		}), ShouldEqual, server.ErrSelfTestRejected)
+	})
+
+	Convey("The self-test should fail with a verifier that accepts everything", t, func() {
+		So(server.RunSelfTest(func(key ssh.PublicKey, challenge []byte, sig *ssh.Signature) error {
+			return nil
+		}), ShouldEqual, server.ErrSelfTestAccepted)
+	})
+
+	Convey("An LDAP cache built with the self-test enabled should start", t, func() {
+		lc, err := server.NewLDAPUserCacheWithOptions(&FixtureLDAPServer{}, g2s.Noop(), server.Options{
+			UserAttr: "cn",
+			SSHAttr:  "sshPublicKey",
+			SelfTest: true,
+		})
+		So(err, ShouldBeNil)
+		So(lc, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The wire representation of a User.
+type wireUser struct {
+	Username     string            `json:"username"`
+	SSHKeys      [][]byte          `json:"sshKeys"`
+	ARNs         []string          `json:"arns,omitempty"`
+	DefaultRole  string            `json:"defaultRole,omitempty"`
+	AllowedHours *wireHourWindow   `json:"allowedHours,omitempty"`
+	Source       string            `json:"source,omitempty"`
+	SessionTags  map[string]string `json:"sessionTags,omitempty"`
+}
+
+type wireHourWindow struct {
+	Start    time.Duration `json:"start"`
+	End      time.Duration `json:"end"`
+	Location string        `json:"location"`
+}
+
+/*
+MarshalUser encodes a user, including its keys in SSH wire format, for
+snapshots and RPC.
+*/
+func MarshalUser(user *User) ([]byte, error) {
+	wire := wireUser{
+		Username:    user.Username,
+		SSHKeys:     make([][]byte, 0, len(user.SSHKeys)),
+		ARNs:        user.ARNs,
+		DefaultRole: user.DefaultRole,
+		Source:      user.Source,
+		SessionTags: user.SessionTags,
+	}
+	for _, key := range user.SSHKeys {
+		wire.SSHKeys = append(wire.SSHKeys, key.Marshal())
+	}
+	if user.AllowedHours != nil {
+		wire.AllowedHours = &wireHourWindow{
+			Start:    user.AllowedHours.Start,
+			End:      user.AllowedHours.End,
+			Location: user.AllowedHours.Location.String(),
+		}
+	}
+	return json.Marshal(wire)
+}
+
+/*
+UnmarshalUser decodes a user encoded by MarshalUser.
+*/
+func UnmarshalUser(data []byte) (*User, error) {
+	var wire wireUser
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Username:    wire.Username,
+		SSHKeys:     make([]ssh.PublicKey, 0, len(wire.SSHKeys)),
+		ARNs:        wire.ARNs,
+		DefaultRole: wire.DefaultRole,
+		Source:      wire.Source,
+		SessionTags: wire.SessionTags,
+	}
+	for _, keyBytes := range wire.SSHKeys {
+		key, err := ssh.ParsePublicKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		user.SSHKeys = append(user.SSHKeys, key)
+	}
+	user.KeyFingerprints = keyFingerprints(user.SSHKeys)
+	if wire.AllowedHours != nil {
+		location, err := time.LoadLocation(wire.AllowedHours.Location)
+		if err != nil {
+			return nil, err
+		}
+		user.AllowedHours = &HourWindow{
+			Start:    wire.AllowedHours.Start,
+			End:      wire.AllowedHours.End,
+			Location: location,
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUserSerialization(t *testing.T) {
+	Convey("Given a user with several keys, roles and allowed hours", t, func() {
+		first, _ := newECDSASigner(elliptic.P256())
+		second, _ := newECDSASigner(elliptic.P384())
+		privateKey, err := ssh.ParsePrivateKey(testKey)
+		So(err, ShouldBeNil)
+		tokyo, err := time.LoadLocation("Asia/Tokyo")
+		So(err, ShouldBeNil)
+
+		user := &server.User{
+			Username:     "testuser",
+			SSHKeys:      []ssh.PublicKey{first.PublicKey(), second.PublicKey(), privateKey.PublicKey()},
+			ARNs:         []string{"arn:aws:iam::123456789012:role/developer", "arn:aws:iam::123456789012:role/reader"},
+			DefaultRole:  "arn:aws:iam::123456789012:role/default",
+			AllowedHours: &server.HourWindow{Start: 9 * time.Hour, End: 17 * time.Hour, Location: tokyo},
+			Source:       "ldap,sql",
+		}
+
+		Convey("It should survive a round trip", func() {
+			data, err := server.MarshalUser(user)
+			So(err, ShouldBeNil)
+
+			decoded, err := server.UnmarshalUser(data)
+			So(err, ShouldBeNil)
+			So(decoded.Username, ShouldEqual, user.Username)
+			So(decoded.ARNs, ShouldResemble, user.ARNs)
+			So(decoded.DefaultRole, ShouldEqual, user.DefaultRole)
+			So(decoded.Source, ShouldEqual, "ldap,sql")
+			So(decoded.AllowedHours.Start, ShouldEqual, user.AllowedHours.Start)
+			So(decoded.AllowedHours.End, ShouldEqual, user.AllowedHours.End)
+			So(decoded.AllowedHours.Location.String(), ShouldEqual, "Asia/Tokyo")
+
+			So(decoded.SSHKeys, ShouldHaveLength, 3)
+			for i, key := range decoded.SSHKeys {
+				So(key.Marshal(), ShouldResemble, user.SSHKeys[i].Marshal())
+			}
+		})
+
+		Convey("A user without optional fields should round trip too", func() {
+			data, err := server.MarshalUser(&server.User{Username: "bare"})
+			So(err, ShouldBeNil)
+
+			decoded, err := server.UnmarshalUser(data)
+			So(err, ShouldBeNil)
+			So(decoded.Username, ShouldEqual, "bare")
+			So(decoded.SSHKeys, ShouldBeEmpty)
+			So(decoded.AllowedHours, ShouldBeNil)
+		})
+
+		Convey("Corrupt key data should be an error", func() {
+			_, err := server.UnmarshalUser([]byte(`{"username":"testuser","sshKeys":["AAAA"]}`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -18,7 +18,7 @@ package server
 import (
 	"errors"
 	"fmt"
-	"math/rand"
+	"time"
 
 	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
@@ -32,6 +32,14 @@ type Authenticator interface {
 	Authenticate(username string, challenge []byte, sig *ssh.Signature) (user *User, err error)
 }
 
+/*
+KeyAuthenticator is implemented by authenticators that can use the public
+key a client signed with to find its user without trying every key.
+*/
+type KeyAuthenticator interface {
+	AuthenticateKey(username string, challenge []byte, sig *ssh.Signature, key ssh.PublicKey) (user *User, err error)
+}
+
 /*
 server is a wrapper for all of the connection and message
 handlers that this server implements.
@@ -48,6 +56,12 @@ type server struct {
 	baseDN          string
 	enableLDAPRoles bool
 	defaultRoleAttr string
+
+	credentialLimiter *CredentialRateLimiter
+	challenges        *ChallengeGuard
+	audit             AuditSink
+	authLimiter       *TokenBucketLimiter
+	drain             drainState
 }
 
 /*
@@ -55,6 +69,22 @@ ConnectionHandler is the root of the state machine created for
 each socket that is opened.
 */
 func (sm *server) HandleConnection(m protocol.MessageReadWriteCloser) {
+	if !sm.openConnection(m) {
+		log.Debug("Refusing a connection while shutting down.")
+		m.Close()
+		return
+	}
+	defer sm.closeConnection(m)
+
+	// A connection that negotiated a Hello is about to send the request it
+	// opened for, so it stays in flight until that request is handled.
+	inflight := false
+	defer func() {
+		if inflight {
+			sm.endRequest()
+		}
+	}()
+
 	// Loop as long as we have this connection alive.
 	log.Debug("Opening new connection handler.")
 	for {
@@ -70,11 +100,23 @@ func (sm *server) HandleConnection(m protocol.MessageReadWriteCloser) {
 			break
 		}
 
-		if pingMsg := recvMsg.GetPing(); pingMsg != nil {
+		if !inflight {
+			sm.beginRequest()
+			inflight = true
+		}
+		if hello := recvMsg.GetHello(); hello != nil && recvMsg.GetPing() != nil {
+			sm.HandleHello(m, hello)
+			continue
+		} else if pingMsg := recvMsg.GetPing(); pingMsg != nil {
 			sm.HandlePing(m, pingMsg)
 		} else if reqMsg := recvMsg.GetServerRequest(); reqMsg != nil {
 			sm.HandleServerRequest(m, reqMsg)
 		}
+		inflight = false
+		if sm.endRequest() {
+			m.Close()
+			break
+		}
 	}
 }
 
@@ -94,6 +136,25 @@ func (sm *server) HandlePing(m protocol.MessageReadWriteCloser, p *protocol.Ping
 	m.Write(pingMsg)
 }
 
+/*
+HandleHello answers a Ping carrying the peer's Hello with a Ping carrying
+ours, so that both ends know what the other speaks.
+*/
+func (sm *server) HandleHello(m protocol.MessageReadWriteCloser, hello *protocol.Hello) {
+	sm.stats.Counter(1.0, "messages.hello", 1)
+	negotiated := protocol.Negotiate(hello)
+	log.Debug("Negotiated protocol version %d with %s (peer speaks %d).", negotiated.Version, remoteAddr(m), hello.GetVersion())
+
+	pingType := protocol.Ping_RESPONSE
+	m.Write(&protocol.Message{
+		Hello: protocol.NewHello(),
+		Ping: &protocol.Ping{
+			Type: &pingType,
+		},
+	})
+	protocol.EnableCompression(m, negotiated)
+}
+
 func (sm *server) WriteError(m protocol.MessageReadWriteCloser, errStr string) {
 	errMsg := &protocol.Message{
 		Error: &errStr,
@@ -110,6 +171,7 @@ func (sm *server) HandleServerRequest(m protocol.MessageReadWriteCloser, r *prot
 		sm.stats.Counter(1.0, "messages.assumeRole", 1)
 
 		role := assumeRoleMsg.GetRole()
+		duration := time.Duration(assumeRoleMsg.GetDurationSeconds()) * time.Second
 
 		user, err := sm.SSHChallenge(m)
 
@@ -119,26 +181,37 @@ func (sm *server) HandleServerRequest(m protocol.MessageReadWriteCloser, r *prot
 		}
 
 		if user != nil {
-			creds, err := sm.credentials.AssumeRole(user, role, sm.enableLDAPRoles)
+			if !sm.allowCredentialRequest(m, user, role) {
+				return
+			}
+			creds, err := sm.assumeRole(user, role, duration)
 			if err != nil {
 				// Update user cache and try again
-				sm.userCache.Update()
-				creds, err := sm.credentials.AssumeRole(user, role, sm.enableLDAPRoles)
+				UpdateWithTimeout(sm.userCache, DefaultUpdateTimeout)
+				creds, err = sm.assumeRole(user, role, duration)
 
 				if err != nil {
 					// error message from Amazon, so forward that on to the client
-					log.Errorf("Error from AWS for AssumeRole: %s", err.Error())
+					if _, ok := err.(*RoleNotPermittedError); ok {
+						log.Warning("Refusing role %s to %s: %s", role, user.Username, err.Error())
+						sm.stats.Counter(1.0, "errors.roleNotPermitted", 1)
+					} else {
+						log.Errorf("Error from AWS for AssumeRole: %s", err.Error())
+					}
 					sm.WriteError(m, err.Error())
 					sm.stats.Counter(1.0, "errors.assumeRole", 1)
 
 					// Attempt to use the default role to fall back
-					creds, err = sm.credentials.AssumeRole(user, user.DefaultRole, sm.enableLDAPRoles)
-					if err == nil {
-						m.Write(makeCredsResponse(creds))
+					granted := ""
+					if fallback, fallbackErr := sm.credentials.AssumeRole(user, user.DefaultRole, sm.enableLDAPRoles); fallbackErr == nil {
+						m.Write(makeCredsResponse(fallback))
+						granted = user.DefaultRole
 					}
+					sm.auditCredentials(m, user, role, granted, err)
 					return
 				}
 			}
+			sm.auditCredentials(m, user, role, role, nil)
 			m.Write(makeCredsResponse(creds))
 			return
 		}
@@ -152,25 +225,49 @@ func (sm *server) HandleServerRequest(m protocol.MessageReadWriteCloser, r *prot
 		}
 
 		if user != nil {
+			if !sm.allowCredentialRequest(m, user, "") {
+				return
+			}
 			creds, err := sm.credentials.AssumeRole(user, user.DefaultRole, sm.enableLDAPRoles)
 			if err != nil {
 				log.Errorf("Error trying to handle GetUserCredentials: %s", err.Error())
 				// Update user cache and try again
-				sm.userCache.Update()
+				UpdateWithTimeout(sm.userCache, DefaultUpdateTimeout)
 				creds, err = sm.credentials.AssumeRole(user, user.DefaultRole, sm.enableLDAPRoles)
 				if err != nil {
 					errStr := fmt.Sprintf("Could not get user credentials. %s may not have been given Hologram access yet.", user.Username)
 					sm.WriteError(m, errStr)
 				}
+				sm.auditCredentials(m, user, "", "", err)
 				m.Close()
 				return
 			}
+			sm.auditCredentials(m, user, "", user.DefaultRole, nil)
 			m.Write(makeCredsResponse(creds))
 			return
 		}
+	} else if listRolesMsg := r.GetListRoles(); listRolesMsg != nil {
+		sm.stats.Counter(1.0, "messages.listRoles", 1)
+		user, err := sm.SSHChallenge(m)
+		if err != nil {
+			log.Errorf("Error trying to handle ListRoles: %s", err.Error())
+			m.Close()
+			return
+		}
+
+		if user != nil {
+			m.Write(makeRolesResponse(user))
+			return
+		}
 	} else if addSSHKeyMsg := r.GetAddSSHkey(); addSSHKeyMsg != nil {
 		sm.stats.Counter(1.0, "messages.addSSHKeyMsg", 1)
 
+		// Keys can only be added to an LDAP directory.
+		if sm.ldapServer == nil {
+			sm.WriteError(m, "This server does not support adding SSH keys.")
+			return
+		}
+
 		// Search for the user specified in this request.
 		sr := ldap.NewSearchRequest(
 			sm.baseDN,
@@ -179,7 +276,7 @@ func (sm *server) HandleServerRequest(m protocol.MessageReadWriteCloser, r *prot
 			[]string{sm.sshAttr, sm.userAttr, "userPassword"},
 			nil)
 
-		user, err := sm.ldapServer.Search(sr)
+		user, err := limitedSearch(sm.ldapServer, sr)
 		if err != nil {
 			log.Errorf("Error trying to handle addSSHKeyMsg: %s", err.Error())
 			sm.WriteError(m, "There was an error connecting to the data source.")
@@ -230,9 +327,9 @@ SSHChallenge performs the challenge-response process to authenticate a connectin
 */
 func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error) {
 	for {
-		challenge := make([]byte, 64)
-		for i := 0; i < len(challenge); i++ {
-			challenge[i] = byte(rand.Int() % 256)
+		challenge, err := sm.challenges.Issue()
+		if err != nil {
+			return nil, err
 		}
 
 		response := &protocol.Message{
@@ -243,7 +340,7 @@ func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error)
 			},
 		}
 
-		err := m.Write(response)
+		err = m.Write(response)
 		if err != nil {
 			return nil, err
 		}
@@ -262,12 +359,28 @@ func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error)
 			return nil, errors.New("not a server request")
 		}
 
+		if err := sm.challenges.Consume(challenge); err != nil {
+			log.Warning("Rejecting a challenge response: %s", err.Error())
+			sm.stats.Counter(1.0, "errors.challengeRejected", 1)
+			sm.auditAuthentication(m, nil, cr.GetPublicKey(), err)
+			return nil, err
+		}
+
+		if sm.authLimiter != nil && !sm.authLimiter.Allow(remoteHost(remoteAddr(m))) {
+			log.Warning("Throttling authentication attempts from %s.", remoteAddr(m))
+			sm.stats.Counter(1.0, "errors.authRateLimited", 1)
+			sm.auditAuthentication(m, nil, cr.GetPublicKey(), ErrAuthRateLimited)
+			sm.WriteError(m, ErrAuthRateLimited.Error())
+			return nil, ErrAuthRateLimited
+		}
+
 		// Compose this into the proper format for Authenticate.
 		sig := &ssh.Signature{
 			Format: cr.GetFormat(),
 			Blob:   cr.GetSignature(),
 		}
-		verifiedUser, err := sm.authenticator.Authenticate("derp", challenge, sig)
+		verifiedUser, err := sm.authenticate(challenge, sig, cr.GetPublicKey())
+		sm.auditAuthentication(m, verifiedUser, cr.GetPublicKey(), err)
 		if err != nil {
 			return nil, err
 		}
@@ -289,6 +402,93 @@ func (sm *server) SSHChallenge(m protocol.MessageReadWriteCloser) (*User, error)
 	}
 }
 
+/*
+authenticate checks a challenge response, going straight to the key the
+client says it used when both sides support that.
+*/
+func (sm *server) authenticate(challenge []byte, sig *ssh.Signature, publicKey []byte) (*User, error) {
+	keyAuthenticator, ok := sm.authenticator.(KeyAuthenticator)
+	if !ok || len(publicKey) == 0 {
+		return sm.authenticator.Authenticate("derp", challenge, sig)
+	}
+
+	key, err := ssh.ParsePublicKey(publicKey)
+	if err != nil {
+		log.Debug("Ignoring unparseable public key in challenge response: %s", err.Error())
+		return sm.authenticator.Authenticate("derp", challenge, sig)
+	}
+	return keyAuthenticator.AuthenticateKey("derp", challenge, sig, key)
+}
+
+/*
+LimitCredentialRequests makes the server check every credential request
+against limiter once the user has authenticated.
+*/
+func (sm *server) LimitCredentialRequests(limiter *CredentialRateLimiter) {
+	sm.credentialLimiter = limiter
+}
+
+/*
+assumeRole gets credentials for user in role lasting duration, or the
+default if the credential service cannot issue sessions of other lengths.
+*/
+func (sm *server) assumeRole(user *User, role string, duration time.Duration) (*sts.Credentials, error) {
+	if service, ok := sm.credentials.(DurationCredentialService); ok && duration > 0 {
+		return service.AssumeRoleFor(user, role, sm.enableLDAPRoles, duration)
+	}
+	return sm.credentials.AssumeRole(user, role, sm.enableLDAPRoles)
+}
+
+/*
+LimitAuthentications makes the server check every challenge response
+against limiter, keyed by the client's address, before verifying it.
+*/
+func (sm *server) LimitAuthentications(limiter *TokenBucketLimiter) {
+	sm.authLimiter = limiter
+}
+
+/*
+GuardChallenges replaces the guard that issues SSH challenges and refuses
+stale or replayed ones.
+*/
+func (sm *server) GuardChallenges(guard *ChallengeGuard) {
+	sm.challenges = guard
+}
+
+/*
+allowCredentialRequest tells the client off and returns false if user may
+not be issued credentials for requested right now.
+*/
+func (sm *server) allowCredentialRequest(m protocol.MessageReadWriteCloser, user *User, requested string) bool {
+	if sm.credentialLimiter == nil {
+		return true
+	}
+	if err := sm.credentialLimiter.Allow(user.Username); err != nil {
+		log.Warning("Refusing credentials to %s: %s", user.Username, err.Error())
+		sm.stats.Counter(1.0, "errors.credentialRateLimited", 1)
+		sm.auditCredentials(m, user, requested, "", err)
+		sm.WriteError(m, err.Error())
+		return false
+	}
+	return true
+}
+
+/*
+makeRolesResponse lists the roles user may ask for, along with the one
+they get by default.
+*/
+func makeRolesResponse(user *User) *protocol.Message {
+	defaultRole := user.DefaultRole
+	return &protocol.Message{
+		ServerResponse: &protocol.ServerResponse{
+			Roles: &protocol.RoleList{
+				Roles:       append([]string(nil), user.ARNs...),
+				DefaultRole: &defaultRole,
+			},
+		},
+	}
+}
+
 func makeCredsResponse(creds *sts.Credentials) *protocol.Message {
 	expiration := creds.Expiration.Unix()
 	credsResponse := &protocol.Message{
@@ -330,5 +530,6 @@ func New(userCache UserCache,
 		baseDN:          baseDN,
 		enableLDAPRoles: enableLDAPRoles,
 		defaultRoleAttr: defaultRoleAttr,
+		challenges:      NewChallengeGuard(0, 0, nil),
 	}
 }
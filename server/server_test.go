@@ -61,6 +61,10 @@ func (d *DummyAuthenticator) Authenticate(username string, challenge []byte, sig
 
 func (d *DummyAuthenticator) Update() error { return nil }
 
+func (d *DummyAuthenticator) Lookup(username string) (*server.User, bool) {
+	return d.user, d.user != nil
+}
+
 type dummyCredentials struct{}
 
 func (*dummyCredentials) GetSessionToken() (*sts.Credentials, error) {
@@ -139,7 +143,7 @@ func TestServerStateMachine(t *testing.T) {
 			sshKeys:  []string{},
 			req:      neededModifyRequest,
 		}
-		testServer := server.New(authenticator, &dummyCredentials{}, "default", g2s.Noop(), ldap, "cn", "dc=testdn,dc=com", false, "")
+		testServer := server.New(authenticator, &dummyCredentials{}, "default", g2s.Noop(), ldap, "cn", "sshPublicKey", "dc=testdn,dc=com", false, "")
 		r, w := io.Pipe()
 
 		testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
@@ -151,6 +155,18 @@ func TestServerStateMachine(t *testing.T) {
 				recvMsg, recvErr := testConnection.Read()
 				So(recvErr, ShouldBeNil)
 				So(recvMsg.GetPing(), ShouldNotBeNil)
+				So(recvMsg.GetHello(), ShouldBeNil)
+			})
+		})
+
+		Convey("When a ping carrying a Hello comes in", func() {
+			testConnection.Write(&protocol.Message{Hello: protocol.NewHello(), Ping: &protocol.Ping{}})
+			Convey("Then the server should answer with its own Hello.", func() {
+				recvMsg, recvErr := testConnection.Read()
+				So(recvErr, ShouldBeNil)
+				So(recvMsg.GetPing().GetType(), ShouldEqual, protocol.Ping_RESPONSE)
+				So(recvMsg.GetHello().GetVersion(), ShouldEqual, protocol.Version)
+				So(protocol.Negotiate(recvMsg.GetHello()).Supports(protocol.CapabilityListRoles), ShouldBeTrue)
 			})
 		})
 
@@ -239,6 +255,36 @@ func TestServerStateMachine(t *testing.T) {
 			})
 		})
 
+		Convey("After a ListRoles request", func() {
+			authenticator.user = &server.User{
+				Username:    "words",
+				ARNs:        []string{"arn:aws:iam::123456789012:role/dev", "arn:aws:iam::123456789012:role/prod"},
+				DefaultRole: "arn:aws:iam::123456789012:role/dev",
+			}
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{ListRoles: &protocol.ListRoles{}},
+			})
+
+			_, err := testConnection.Read()
+			So(err, ShouldBeNil)
+
+			Convey("it should list the user's roles once they authenticate", func() {
+				format := "test"
+				testConnection.Write(&protocol.Message{
+					ServerRequest: &protocol.ServerRequest{
+						ChallengeResponse: &protocol.SSHChallengeResponse{Format: &format, Signature: []byte("ssss")},
+					},
+				})
+
+				rolesMsg, err := testConnection.Read()
+				So(err, ShouldBeNil)
+				roles := rolesMsg.GetServerResponse().GetRoles()
+				So(roles, ShouldNotBeNil)
+				So(roles.GetRoles(), ShouldResemble, []string{"arn:aws:iam::123456789012:role/dev", "arn:aws:iam::123456789012:role/prod"})
+				So(roles.GetDefaultRole(), ShouldEqual, "arn:aws:iam::123456789012:role/dev")
+			})
+		})
+
 		Convey("When a request to add an SSH key comes in", func() {
 			user := "ari.adair"
 			password := "098f6bcd4621d373cade4e832627b4f6"
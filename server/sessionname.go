@@ -0,0 +1,62 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// The longest RoleSessionName STS accepts.
+const maxSessionNameLength = 64
+
+// How many hex digits of the username's hash mark an altered session name.
+const sessionNameHashLength = 8
+
+/*
+SessionName turns a username into an STS RoleSessionName, which CloudTrail
+records against everything done with the session. Usernames STS accepts
+as they are are used unchanged. Otherwise characters outside [\w+=,.@-]
+become underscores, the result is cut short to fit in 64 characters, and
+a hash of the full username is appended, so that different usernames
+never share a session name.
+*/
+func SessionName(username string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if sessionNameRune(r) {
+			return r
+		}
+		return '_'
+	}, username)
+	if sanitized == username && len(username) >= 2 && len(username) <= maxSessionNameLength {
+		return username
+	}
+
+	sum := sha256.Sum256([]byte(username))
+	suffix := "-" + hex.EncodeToString(sum[:])[:sessionNameHashLength]
+	if limit := maxSessionNameLength - len(suffix); len(sanitized) > limit {
+		sanitized = sanitized[:limit]
+	}
+	return sanitized + suffix
+}
+
+func sessionNameRune(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("_+=,.@-", r)
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var validSessionName = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+func TestSessionName(t *testing.T) {
+	Convey("Usernames STS accepts should be used unchanged", t, func() {
+		So(server.SessionName("alice"), ShouldEqual, "alice")
+		So(server.SessionName("a.lice+ops@example.com"), ShouldEqual, "a.lice+ops@example.com")
+	})
+
+	Convey("Other usernames should become valid session names", t, func() {
+		for _, username := range []string{
+			"CORP\\alice", "alice smith", "josé", "a", "", strings.Repeat("x", 100),
+		} {
+			name := server.SessionName(username)
+			So(validSessionName.MatchString(name), ShouldBeTrue)
+			So(name, ShouldNotEqual, username)
+		}
+		So(server.SessionName("CORP\\alice"), ShouldStartWith, "CORP_alice-")
+	})
+
+	Convey("Usernames that sanitize alike should get different session names", t, func() {
+		So(server.SessionName("alice smith"), ShouldNotEqual, server.SessionName("alice/smith"))
+		So(server.SessionName("alice smith"), ShouldNotEqual, "alice_smith")
+		long := strings.Repeat("x", 70)
+		So(server.SessionName(long+"1"), ShouldNotEqual, server.SessionName(long+"2"))
+	})
+
+	Convey("Assumed roles should use the session name", t, func() {
+		fake := &countingSTS{clock: &fakeClock{}}
+		service := server.NewDirectSessionTokenService("123456789012", fake, nil)
+		creds, err := service.AssumeRole(&server.User{Username: "CORP\\alice"}, "developer", false)
+		So(err, ShouldBeNil)
+		So(*creds.AccessKeyId, ShouldEqual, "arn:aws:iam::123456789012:role/developer/"+server.SessionName("CORP\\alice"))
+	})
+}
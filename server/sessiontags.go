@@ -0,0 +1,99 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/AdRoll/hologram/log"
+)
+
+// AWS's limits on session tags passed to AssumeRole.
+const (
+	maxSessionTags           = 50
+	maxSessionTagKeyLength   = 128
+	maxSessionTagValueLength = 256
+)
+
+// Errors describing why a session tag is unacceptable to AWS.
+var (
+	ErrSessionTagKeyLength   = errors.New("session tag key must be 1 to 128 characters")
+	ErrSessionTagValueLength = errors.New("session tag value must be at most 256 characters")
+	ErrSessionTagCharacters  = errors.New("session tag may only contain letters, digits, spaces and _.:/=+-@")
+	ErrSessionTagReserved    = errors.New("session tag keys may not start with aws:")
+)
+
+/*
+validateSessionTag checks a tag against the constraints STS puts on
+session tags.
+*/
+func validateSessionTag(key string, value string) error {
+	if length := utf8.RuneCountInString(key); length < 1 || length > maxSessionTagKeyLength {
+		return ErrSessionTagKeyLength
+	}
+	if utf8.RuneCountInString(value) > maxSessionTagValueLength {
+		return ErrSessionTagValueLength
+	}
+	if !sessionTagCharactersAllowed(key) || !sessionTagCharactersAllowed(value) {
+		return ErrSessionTagCharacters
+	}
+	if strings.HasPrefix(strings.ToLower(key), "aws:") {
+		return ErrSessionTagReserved
+	}
+	return nil
+}
+
+func sessionTagCharactersAllowed(s string) bool {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune(" _.:/=+-@", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+/*
+sessionTags reads the attributes in Options.SessionTagAttrs into tags
+named after them. Missing attributes are skipped; tags AWS would refuse are
+dropped with a warning so that they cannot fail the user's AssumeRole.
+*/
+func (luc *ldapUserCache) sessionTags(attrs entryAttributes, username string) map[string]string {
+	if len(luc.opts.SessionTagAttrs) == 0 {
+		return nil
+	}
+
+	tags := map[string]string{}
+	for _, attr := range luc.opts.SessionTagAttrs {
+		value := attrs.value(attr)
+		if value == "" {
+			continue
+		}
+		if err := validateSessionTag(attr, value); err != nil {
+			log.Warning("Dropping session tag %s of user %s: %s", attr, username, err.Error())
+			continue
+		}
+		if len(tags) == maxSessionTags {
+			log.Warning("User %s has more than %d session tags; dropping %s.", username, maxSessionTags, attr)
+			continue
+		}
+		tags[attr] = value
+	}
+	return tags
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLDAPUserCacheSessionTags(t *testing.T) {
+	Convey("Given a user with attributes configured as session tags", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn":             {"testuser"},
+					"sshPublicKey":   {key},
+					"team":           {"platform"},
+					"costCenter":     {"cc-42/eng"},
+					"department":     {"R&D; ops"},
+					"employeeNumber": {strings.Repeat("7", 257)},
+				}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			SessionTagAttrs: []string{"team", "costCenter", "department", "employeeNumber", "title"},
+		})
+		So(err, ShouldBeNil)
+		tags := lc.Users()["testuser"].SessionTags
+
+		Convey("Valid values should become tags named after their attributes", func() {
+			So(tags, ShouldContainKey, "team")
+			So(tags["team"], ShouldEqual, "platform")
+			So(tags["costCenter"], ShouldEqual, "cc-42/eng")
+		})
+
+		Convey("Values with disallowed characters should be dropped", func() {
+			So(tags, ShouldNotContainKey, "department")
+		})
+
+		Convey("Values that are too long should be dropped", func() {
+			So(tags, ShouldNotContainKey, "employeeNumber")
+		})
+
+		Convey("Missing attributes should be skipped", func() {
+			So(tags, ShouldHaveLength, 2)
+		})
+	})
+
+	Convey("Given a tag attribute in the reserved aws: namespace", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "aws:team": {"platform"},
+				}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			SessionTagAttrs: []string{"aws:team"},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("It should be dropped", func() {
+			So(lc.Users()["testuser"].SessionTags, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/AdRoll/hologram/protocol"
+)
+
+// DefaultShutdownTimeout is how long requests are given to finish on shutdown by default.
+const DefaultShutdownTimeout = 30 * time.Second
+
+/*
+drainState tracks the connections and requests a server is handling, so
+that Shutdown can wait for the requests and then close the connections.
+A connection counts as one request from the message that opens it,
+through any Hello, until the request it came for has been answered.
+*/
+type drainState struct {
+	sync.Mutex
+	draining bool
+	inflight int
+	drained  chan struct{}
+	conns    map[protocol.MessageReadWriteCloser]struct{}
+}
+
+/*
+Shutdown stops the server taking new connections and waits for the
+requests it is handling to finish, or for ctx to be done, before closing
+every connection. Stop the listener first so that new clients go to
+other servers. It returns ctx's error if requests were cut off.
+*/
+func (sm *server) Shutdown(ctx context.Context) error {
+	sm.drain.Lock()
+	sm.drain.draining = true
+	drained := make(chan struct{})
+	if sm.drain.inflight == 0 {
+		close(drained)
+	} else {
+		sm.drain.drained = drained
+	}
+	log.Info("Draining %d requests before shutting down.", sm.drain.inflight)
+	sm.drain.Unlock()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Warning("Gave up draining requests: %s", err.Error())
+	}
+
+	sm.drain.Lock()
+	defer sm.drain.Unlock()
+	for conn := range sm.drain.conns {
+		conn.Close()
+	}
+	return err
+}
+
+/*
+openConnection registers a new connection, refusing it if the server is
+shutting down.
+*/
+func (sm *server) openConnection(m protocol.MessageReadWriteCloser) bool {
+	sm.drain.Lock()
+	defer sm.drain.Unlock()
+	if sm.drain.draining {
+		return false
+	}
+	if sm.drain.conns == nil {
+		sm.drain.conns = map[protocol.MessageReadWriteCloser]struct{}{}
+	}
+	sm.drain.conns[m] = struct{}{}
+	return true
+}
+
+func (sm *server) closeConnection(m protocol.MessageReadWriteCloser) {
+	sm.drain.Lock()
+	defer sm.drain.Unlock()
+	delete(sm.drain.conns, m)
+}
+
+func (sm *server) beginRequest() {
+	sm.drain.Lock()
+	defer sm.drain.Unlock()
+	sm.drain.inflight++
+}
+
+/*
+endRequest marks a request done, reporting whether the server is shutting
+down and the connection should be closed rather than wait for another.
+*/
+func (sm *server) endRequest() bool {
+	sm.drain.Lock()
+	defer sm.drain.Unlock()
+	sm.drain.inflight--
+	if sm.drain.inflight == 0 && sm.drain.drained != nil {
+		close(sm.drain.drained)
+		sm.drain.drained = nil
+	}
+	return sm.drain.draining
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+	"github.com/AdRoll/hologram/server"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServerShutdown(t *testing.T) {
+	Convey("Given a server with a request waiting on its challenge", t, func() {
+		authenticator := &DummyAuthenticator{&server.User{Username: "words"}}
+		testServer := server.New(authenticator, &dummyCredentials{}, "default", g2s.Noop(), nil, "cn", "sshPublicKey", "dc=testdn,dc=com", false, "")
+
+		r, w := io.Pipe()
+		testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
+		go testServer.HandleConnection(testConnection)
+
+		role := "testrole"
+		testConnection.Write(&protocol.Message{
+			ServerRequest: &protocol.ServerRequest{AssumeRole: &protocol.AssumeRole{Role: &role}},
+		})
+		_, err := testConnection.Read()
+		So(err, ShouldBeNil)
+
+		shutdown := func(timeout time.Duration) chan error {
+			result := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				result <- testServer.Shutdown(ctx)
+			}()
+			return result
+		}
+
+		Convey("Shutdown should wait for the request to finish", func() {
+			result := shutdown(time.Minute)
+			select {
+			case <-result:
+				t.Fatal("Shutdown returned with a request in flight")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{Format: &format, Signature: []byte("ssss")},
+				},
+			})
+			credsMsg, err := testConnection.Read()
+			So(err, ShouldBeNil)
+			So(credsMsg.GetServerResponse().GetCredentials(), ShouldNotBeNil)
+			So(<-result, ShouldBeNil)
+
+			Convey("And refuse new connections afterwards", func() {
+				r, w := io.Pipe()
+				late := protocol.NewMessageConnection(ReadWriter(r, w))
+				go testServer.HandleConnection(late)
+				_, err := late.Read()
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("Shutdown should give up when its context is done", func() {
+			So(<-shutdown(10*time.Millisecond), ShouldResemble, context.DeadlineExceeded)
+		})
+	})
+}
+
+func TestServerShutdownAfterHello(t *testing.T) {
+	Convey("Given a connection that has negotiated a Hello", t, func() {
+		authenticator := &DummyAuthenticator{&server.User{Username: "words"}}
+		testServer := server.New(authenticator, &dummyCredentials{}, "default", g2s.Noop(), nil, "cn", "sshPublicKey", "dc=testdn,dc=com", false, "")
+
+		r, w := io.Pipe()
+		testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
+		go testServer.HandleConnection(testConnection)
+
+		// Both ends of the pipe share one connection, so leave compression
+		// out of the Hello.
+		pingType := protocol.Ping_REQUEST
+		version := protocol.Version
+		testConnection.Write(&protocol.Message{Hello: &protocol.Hello{Version: &version}, Ping: &protocol.Ping{Type: &pingType}})
+		reply, err := testConnection.Read()
+		So(err, ShouldBeNil)
+		So(reply.GetHello(), ShouldNotBeNil)
+
+		Convey("Shutdown should let it make the request it opened for", func() {
+			result := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				result <- testServer.Shutdown(ctx)
+			}()
+			select {
+			case <-result:
+				t.Fatal("Shutdown returned before the connection made its request")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			role := "testrole"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{AssumeRole: &protocol.AssumeRole{Role: &role}},
+			})
+			_, err := testConnection.Read()
+			So(err, ShouldBeNil)
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{Format: &format, Signature: []byte("ssss")},
+				},
+			})
+			credsMsg, err := testConnection.Read()
+			So(err, ShouldBeNil)
+			So(credsMsg.GetServerResponse().GetCredentials(), ShouldNotBeNil)
+			So(<-result, ShouldBeNil)
+		})
+	})
+}
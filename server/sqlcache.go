@@ -0,0 +1,294 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/peterbourgon/g2s"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long the user query may run when no timeout is configured.
+const defaultSQLQueryTimeout = 10 * time.Second
+
+/*
+sqlUserCache loads users from a SQL database instead of LDAP. Its query
+must return rows of (username, ssh_key, arn, default_role); a user may
+span several rows, and arn and default_role may be NULL.
+*/
+type sqlUserCache struct {
+	// Guards users and hash, which Update() replaces, and verifier and
+	// usernameCase, which can be changed while the cache is in use.
+	mu       sync.RWMutex
+	users    map[string]*User
+	db       *sql.DB
+	query    string
+	timeout  time.Duration
+	stats    g2s.Statter
+	hash     string
+	verifier Verifier
+
+	// The case usernames are stored and looked up in.
+	usernameCase string
+
+	// Whether an Update() has succeeded, and how the last one went.
+	status  sync.Mutex
+	loaded  bool
+	lastErr error
+}
+
+/*
+Update() runs the user query and rebuilds the cache from its rows.
+*/
+func (suc *sqlUserCache) Update() error {
+	return suc.UpdateContext(context.Background())
+}
+
+/*
+UpdateContext is Update() with the query also cancelled once ctx is done.
+*/
+func (suc *sqlUserCache) UpdateContext(ctx context.Context) error {
+	err := suc.load(ctx)
+
+	suc.status.Lock()
+	defer suc.status.Unlock()
+	suc.loaded = suc.loaded || err == nil
+	suc.lastErr = err
+	return err
+}
+
+/*
+Ready reports an error unless the last Update() succeeded.
+*/
+func (suc *sqlUserCache) Ready() error {
+	suc.status.Lock()
+	defer suc.status.Unlock()
+	return readiness(suc.loaded, suc.lastErr)
+}
+
+func (suc *sqlUserCache) load(ctx context.Context) error {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, suc.timeout)
+	defer cancel()
+
+	suc.mu.RLock()
+	usernameCase := suc.usernameCase
+	suc.mu.RUnlock()
+
+	rows, err := suc.db.QueryContext(ctx, suc.query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := map[string]*User{}
+	for rows.Next() {
+		var username, sshKey string
+		var arn, defaultRole sql.NullString
+		if err := rows.Scan(&username, &sshKey, &arn, &defaultRole); err != nil {
+			return err
+		}
+		username = canonicalUsername(username, usernameCase)
+
+		user, ok := users[username]
+		if !ok {
+			user = &User{Username: username, Source: "sql"}
+			users[username] = user
+		}
+
+		if sshKey != "" {
+			key, err := parseSSHKeyValue(sshKey)
+			if err != nil {
+				log.Warning("SSH key parsing for user %s failed (key fingerprint %s)! This key will not be added into the cache.", username, rawKeyFingerprint(sshKey))
+			} else if !containsKey(user.SSHKeys, key) {
+				user.SSHKeys = append(user.SSHKeys, key)
+				user.KeyFingerprints = append(user.KeyFingerprints, fingerprintSHA256(key))
+			}
+		}
+		if arn.Valid && arn.String != "" && !containsString(user.ARNs, arn.String) {
+			user.ARNs = append(user.ARNs, arn.String)
+		}
+		if defaultRole.Valid && user.DefaultRole == "" {
+			user.DefaultRole = defaultRole.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	suc.mu.Lock()
+	suc.users = users
+	suc.hash = contentHash(users)
+	suc.mu.Unlock()
+	reportCacheSize(suc.stats, "sql", users)
+	suc.stats.Timing(1.0, "sqlCacheUpdate", time.Since(start))
+	return nil
+}
+
+/*
+Users returns a copy of the users loaded by the last successful Update().
+Changing it or the users in it does not change the cache.
+*/
+func (suc *sqlUserCache) Users() map[string]*User {
+	return copyUsers(suc.cachedUsers())
+}
+
+/*
+cachedUsers returns the map of users itself. Update() replaces it rather
+than changing it, so it may be read without holding the lock.
+*/
+func (suc *sqlUserCache) cachedUsers() map[string]*User {
+	suc.mu.RLock()
+	defer suc.mu.RUnlock()
+	return suc.users
+}
+
+/*
+Lookup returns a copy of the user loaded under username.
+*/
+func (suc *sqlUserCache) Lookup(username string) (*User, bool) {
+	user, ok := suc.cachedUsers()[suc.canonicalUsername(username)]
+	if !ok {
+		return nil, false
+	}
+	return copyUser(user), true
+}
+
+/*
+ContentHash returns a digest of the users loaded by the last successful
+Update(), for comparing caches across servers.
+*/
+func (suc *sqlUserCache) ContentHash() string {
+	suc.mu.RLock()
+	defer suc.mu.RUnlock()
+	return suc.hash
+}
+
+func (suc *sqlUserCache) verify(username string, challenge []byte, sshSig *ssh.Signature) *User {
+	suc.mu.RLock()
+	users, verifier := suc.users, suc.verifier
+	suc.mu.RUnlock()
+
+	// Try the named user's keys first, before falling back to every key.
+	if user, ok := users[suc.canonicalUsername(username)]; ok {
+		for _, key := range user.SSHKeys {
+			if err := verifier.Verify(key, challenge, sshSig); err == nil {
+				return user
+			}
+		}
+	}
+
+	for _, user := range users {
+		for _, key := range user.SSHKeys {
+			if err := verifier.Verify(key, challenge, sshSig); err == nil {
+				return user
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Authenticate finds the user holding the key that made sshSig, refreshing
+from the database once if no cached key matches.
+*/
+func (suc *sqlUserCache) Authenticate(username string, challenge []byte, sshSig *ssh.Signature) (*User, error) {
+	if err := validateAuthenticateInput(challenge, sshSig); err != nil {
+		return nil, err
+	}
+
+	if user := suc.verify(username, challenge, sshSig); user != nil {
+		return user, nil
+	}
+
+	log.Debug("Could not find %s in the SQL cache; updating from the database.", username)
+	suc.stats.Counter(1.0, "sqlCacheMiss", 1)
+	if err := suc.Update(); err != nil {
+		return nil, err
+	}
+	return suc.verify(username, challenge, sshSig), nil
+}
+
+/*
+NewSQLUserCache returns a cache filled by running query against db. The
+query is cancelled if it runs longer than timeout, which defaults to ten
+seconds.
+*/
+func NewSQLUserCache(db *sql.DB, query string, timeout time.Duration, stats g2s.Statter) (*sqlUserCache, error) {
+	if timeout <= 0 {
+		timeout = defaultSQLQueryTimeout
+	}
+	retCache := &sqlUserCache{
+		users:    map[string]*User{},
+		db:       db,
+		query:    query,
+		timeout:  timeout,
+		stats:    stats,
+		verifier: SoftwareVerifier{},
+	}
+	return retCache, retCache.Update()
+}
+
+/*
+NormalizeUsernames makes the cache store and look up usernames in
+usernameCase, one of UsernameAsIs, UsernameLower or UsernameUpper. The
+cache is reloaded so that the users already in it are renamed.
+*/
+func (suc *sqlUserCache) NormalizeUsernames(usernameCase string) error {
+	suc.mu.Lock()
+	suc.usernameCase = usernameCase
+	suc.mu.Unlock()
+	return suc.Update()
+}
+
+func (suc *sqlUserCache) canonicalUsername(username string) string {
+	suc.mu.RLock()
+	defer suc.mu.RUnlock()
+	return canonicalUsername(username, suc.usernameCase)
+}
+
+/*
+UseVerifier replaces the SoftwareVerifier that checks signatures.
+*/
+func (suc *sqlUserCache) UseVerifier(verifier Verifier) {
+	suc.mu.Lock()
+	defer suc.mu.Unlock()
+	suc.verifier = verifier
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	marshaled := string(key.Marshal())
+	for _, existing := range keys {
+		if string(existing.Marshal()) == marshaled {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	cryptrand "crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+fixtureDriver is a database/sql driver that answers every query with the
+rows of the DSN it was opened with, registered in fixtureTables.
+*/
+type fixtureDriver struct{}
+
+var fixtureTables = map[string][][]driver.Value{}
+
+func init() {
+	sql.Register("hologramfixture", fixtureDriver{})
+}
+
+func (fixtureDriver) Open(dsn string) (driver.Conn, error) {
+	if _, ok := fixtureTables[dsn]; !ok {
+		return nil, errors.New("no such fixture table")
+	}
+	return &fixtureConn{table: dsn}, nil
+}
+
+type fixtureConn struct {
+	table string
+}
+
+func (fc *fixtureConn) Prepare(query string) (driver.Stmt, error) { return &fixtureStmt{fc}, nil }
+func (fc *fixtureConn) Close() error                              { return nil }
+func (fc *fixtureConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fixtureStmt struct {
+	conn *fixtureConn
+}
+
+func (fs *fixtureStmt) Close() error  { return nil }
+func (fs *fixtureStmt) NumInput() int { return 0 }
+func (fs *fixtureStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (fs *fixtureStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fixtureRows{rows: fixtureTables[fs.conn.table]}, nil
+}
+
+type fixtureRows struct {
+	rows [][]driver.Value
+}
+
+func (fr *fixtureRows) Columns() []string {
+	return []string{"username", "ssh_key", "arn", "default_role"}
+}
+func (fr *fixtureRows) Close() error { return nil }
+func (fr *fixtureRows) Next(dest []driver.Value) error {
+	if len(fr.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, fr.rows[0])
+	fr.rows = fr.rows[1:]
+	return nil
+}
+
+func TestSQLUserCache(t *testing.T) {
+	Convey("Given a SQL cache over a table of users", t, func() {
+		aliceSigner, aliceKey := newECDSASigner(elliptic.P256())
+		bobSigner, bobKey := newECDSASigner(elliptic.P256())
+		_, aliceOtherKey := newECDSASigner(elliptic.P384())
+
+		fixtureTables["users"] = [][]driver.Value{
+			{"alice", aliceKey, "arn:aws:iam::123456789012:role/developer", "arn:aws:iam::123456789012:role/default"},
+			{"alice", aliceOtherKey, "arn:aws:iam::123456789012:role/reader", nil},
+			{"alice", aliceKey, "arn:aws:iam::123456789012:role/developer", nil},
+			{"bob", bobKey, nil, nil},
+		}
+		db, err := sql.Open("hologramfixture", "users")
+		So(err, ShouldBeNil)
+
+		stats := newRecordingStatter()
+		lc, err := server.NewSQLUserCache(db, "SELECT username, ssh_key, arn, default_role FROM users", 0, stats)
+		So(err, ShouldBeNil)
+
+		Convey("The user and key counts should be reported", func() {
+			So(stats.GaugeValue("sqlUserCount"), ShouldEqual, "2")
+			So(stats.GaugeValue("sqlKeyCount"), ShouldEqual, "3")
+		})
+
+		Convey("Rows should be aggregated into one user each", func() {
+			alice := lc.Users()["alice"]
+			So(alice.SSHKeys, ShouldHaveLength, 2)
+			So(alice.ARNs, ShouldResemble, []string{
+				"arn:aws:iam::123456789012:role/developer",
+				"arn:aws:iam::123456789012:role/reader",
+			})
+			So(alice.DefaultRole, ShouldEqual, "arn:aws:iam::123456789012:role/default")
+			So(alice.Source, ShouldEqual, "sql")
+
+			bob := lc.Users()["bob"]
+			So(bob.SSHKeys, ShouldHaveLength, 1)
+			So(bob.ARNs, ShouldBeEmpty)
+		})
+
+		Convey("Users should authenticate with their keys", func() {
+			So(authenticatesWith(lc, aliceSigner), ShouldBeTrue)
+			So(authenticatesWith(lc, bobSigner), ShouldBeTrue)
+		})
+
+		Convey("A user added to the table should be picked up on a miss", func() {
+			carolSigner, carolKey := newECDSASigner(elliptic.P256())
+			fixtureTables["users"] = append(fixtureTables["users"], []driver.Value{"carol", carolKey, nil, nil})
+			So(authenticatesWith(lc, carolSigner), ShouldBeTrue)
+		})
+	})
+}
+
+func TestSQLUserCacheUsernameCase(t *testing.T) {
+	Convey("Given a database listing one user in mixed case", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		fixtureTables["mixedcase"] = [][]driver.Value{
+			{"Jdoe", key, nil, nil},
+			{"jdoe", key, "arn:aws:iam::123456789012:role/developer", nil},
+		}
+		db, err := sql.Open("hologramfixture", "mixedcase")
+		So(err, ShouldBeNil)
+		lc, err := server.NewSQLUserCache(db, "SELECT * FROM mixedcase", 0, g2s.Noop())
+		So(err, ShouldBeNil)
+
+		Convey("Normalizing to upper case should merge its rows", func() {
+			So(lc.NormalizeUsernames(server.UsernameUpper), ShouldBeNil)
+			So(lc.Users(), ShouldHaveLength, 1)
+			So(lc.Users()["JDOE"].ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+
+			Convey("And Lookup should find the user in any case", func() {
+				user, ok := lc.Lookup("jdoe")
+				So(ok, ShouldBeTrue)
+				So(user.Username, ShouldEqual, "JDOE")
+				user.ARNs[0] = "changed"
+				So(lc.Users()["JDOE"].ARNs[0], ShouldEqual, "arn:aws:iam::123456789012:role/developer")
+			})
+
+			Convey("And a mixed-case request should find the user", func() {
+				challenge := randomBytes(64)
+				sig, err := signer.Sign(cryptrand.Reader, challenge)
+				So(err, ShouldBeNil)
+				user, err := lc.Authenticate("jDoe", challenge, sig)
+				So(err, ShouldBeNil)
+				So(user.Username, ShouldEqual, "JDOE")
+			})
+		})
+
+		Convey("Changing settings while users authenticate should be safe", func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 20; i++ {
+					challenge := randomBytes(64)
+					sig, _ := signer.Sign(cryptrand.Reader, challenge)
+					lc.Authenticate("jdoe", challenge, sig)
+					lc.Lookup("jdoe")
+				}
+			}()
+			So(lc.NormalizeUsernames(server.UsernameLower), ShouldBeNil)
+			lc.UseVerifier(server.SoftwareVerifier{})
+			<-done
+			_, ok := lc.Lookup("JDoe")
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func TestUserSources(t *testing.T) {
+	Convey("Given the same user loaded from LDAP and from SQL", t, func() {
+		ldapSigner, ldapKey := newECDSASigner(elliptic.P256())
+		sqlSigner, sqlKey := newECDSASigner(elliptic.P256())
+
+		ldapCache, err := server.NewLDAPUserCacheWithOptions(&FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=alice", map[string][]string{"cn": {"alice"}, "sshPublicKey": {ldapKey}}),
+			},
+		}, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		fixtureTables["sources"] = [][]driver.Value{
+			{"alice", sqlKey, "arn:aws:iam::123456789012:role/developer", nil},
+			{"bob", sqlKey, nil, nil},
+		}
+		db, err := sql.Open("hologramfixture", "sources")
+		So(err, ShouldBeNil)
+		sqlCache, err := server.NewSQLUserCache(db, "SELECT * FROM sources", 0, g2s.Noop())
+		So(err, ShouldBeNil)
+
+		Convey("Each backend should label its users", func() {
+			So(ldapCache.Users()["alice"].Source, ShouldEqual, "ldap")
+			So(sqlCache.Users()["alice"].Source, ShouldEqual, "sql")
+		})
+
+		Convey("Merging should union the records and concatenate their sources", func() {
+			merged := server.MergeUsers(ldapCache.Users()["alice"], sqlCache.Users()["alice"])
+			So(merged.Source, ShouldEqual, "ldap,sql")
+			So(merged.SSHKeys, ShouldHaveLength, 2)
+			So(merged.SSHKeys[0].Marshal(), ShouldResemble, ldapSigner.PublicKey().Marshal())
+			So(merged.SSHKeys[1].Marshal(), ShouldResemble, sqlSigner.PublicKey().Marshal())
+			So(merged.ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+
+			Convey("And merged users should be found by either source", func() {
+				users := map[string]*server.User{"alice": merged, "bob": sqlCache.Users()["bob"]}
+				So(server.FilterUsersBySource(users, "ldap"), ShouldContainKey, "alice")
+				So(server.FilterUsersBySource(users, "ldap"), ShouldNotContainKey, "bob")
+				So(server.FilterUsersBySource(users, "sql"), ShouldHaveLength, 2)
+			})
+		})
+	})
+}
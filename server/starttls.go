@@ -0,0 +1,200 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+)
+
+// The OID of the StartTLS extended operation (RFC 4511, section 4.14).
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// How long DialStartTLS waits for the server before giving up.
+const startTLSTimeout = 30 * time.Second
+
+// ErrStartTLSRefused is returned when the server will not start TLS.
+var ErrStartTLSRefused = errors.New("LDAP server refused StartTLS")
+
+/*
+LDAPTLSConfig builds the TLS configuration for an LDAP connection. caFile,
+if set, is a PEM bundle that replaces the system roots; certFile and
+keyFile, if set, are a client certificate to present; serverName, if set,
+is the name the server's certificate must carry instead of the host
+dialled.
+*/
+func LDAPTLSConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+/*
+DialStartTLS connects to addr in plaintext, upgrades the connection with
+StartTLS, and binds as bindDN. It fails closed: if the server does not
+support StartTLS, refuses it, or presents a certificate config does not
+accept, it returns an error rather than carrying on in plaintext, and the
+credentials are never sent. When config has no ServerName, the host part
+of addr is used.
+*/
+func DialStartTLS(addr string, config *tls.Config, bindDN string, password string) (LDAPImplementation, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	raw, err := net.DialTimeout("tcp", addr, startTLSTimeout)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	raw.SetDeadline(time.Now().Add(startTLSTimeout))
+	if err := startTLS(raw); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	secure := tls.Client(raw, config)
+	if err := secure.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+
+	conn, err := relayConn(secure)
+	if err != nil {
+		secure.Close()
+		return nil, err
+	}
+	if err := conn.Bind(bindDN, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+relayConn returns an LDAP connection that talks over secure. The ldap
+package only starts reading from connections it dials itself, and its own
+StartTLS races with that reader, so the connection is dialled to a
+private unix socket whose other end is relayed to secure.
+*/
+func relayConn(secure net.Conn) (*ldap.Conn, error) {
+	dir, err := ioutil.TempDir("", "hologram-ldap")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ldap.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		local, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- local
+	}()
+
+	conn, err := ldap.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	local, ok := <-accepted
+	if !ok {
+		conn.Close()
+		return nil, errors.New("could not relay the LDAP connection")
+	}
+	go relay(local, secure)
+	go relay(secure, local)
+	return conn, nil
+}
+
+// relay copies src to dst until either fails, then closes both.
+func relay(dst net.Conn, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+}
+
+/*
+startTLS sends the StartTLS extended request on a fresh connection and
+waits for the server to accept it.
+*/
+func startTLS(conn net.Conn) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "MessageID"))
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, startTLSOID, "TLS Extended Command"))
+	packet.AppendChild(request)
+
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		return ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	response, err := ber.ReadPacket(conn)
+	if err != nil {
+		return ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	if len(response.Children) < 2 || response.Children[1].Tag != ldap.ApplicationExtendedResponse ||
+		len(response.Children[1].Children) == 0 {
+		return ErrStartTLSRefused
+	}
+	if code, ok := response.Children[1].Children[0].Value.(uint64); !ok || code != 0 {
+		log.Warning("LDAP server at %s answered StartTLS with result code %v.", conn.RemoteAddr(), response.Children[1].Children[0].Value)
+		return ErrStartTLSRefused
+	}
+	return nil
+}
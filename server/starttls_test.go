@@ -0,0 +1,180 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptrand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/server"
+	ber "github.com/nmcclain/asn1-ber"
+	"github.com/nmcclain/ldap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTestCertificate makes a self-signed certificate for host.
+func newTestCertificate(host string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptrand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(cryptrand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func ldapResponse(messageID uint64, tag uint8, code uint64) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	packet.AppendChild(response)
+	return packet.Bytes()
+}
+
+/*
+serveStartTLS answers one connection as a directory that answers StartTLS
+with code, then, once TLS is up, accepts any bind. It reports the DN that
+bound, or "" if the client went away first.
+*/
+func serveStartTLS(listener net.Listener, cert tls.Certificate, code uint64) <-chan string {
+	bound := make(chan string, 1)
+	go func() {
+		defer close(bound)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		request, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(ldapResponse(request.Children[0].Value.(uint64), ldap.ApplicationExtendedResponse, code))
+
+		var secure net.Conn = conn
+		if code == 0 {
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			secure = tlsConn
+		}
+
+		bind, err := ber.ReadPacket(secure)
+		if err != nil {
+			return
+		}
+		secure.Write(ldapResponse(bind.Children[0].Value.(uint64), ldap.ApplicationBindResponse, 0))
+		bound <- bind.Children[1].Children[1].Value.(string)
+	}()
+	return bound
+}
+
+func TestDialStartTLS(t *testing.T) {
+	Convey("Given a directory that requires StartTLS", t, func() {
+		cert, parsed := newTestCertificate("ldap.example.com")
+		roots := x509.NewCertPool()
+		roots.AddCert(parsed)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		Convey("A trusted server should be upgraded to TLS before binding", func() {
+			bound := serveStartTLS(listener, cert, 0)
+			conn, err := server.DialStartTLS(listener.Addr().String(),
+				&tls.Config{RootCAs: roots, ServerName: "ldap.example.com"}, "cn=hologram", "secret")
+			So(err, ShouldBeNil)
+			So(<-bound, ShouldEqual, "cn=hologram")
+			conn.(*ldap.Conn).Close()
+		})
+
+		Convey("A refusal should fail closed without binding in plaintext", func() {
+			bound := serveStartTLS(listener, cert, ldap.LDAPResultUnavailable)
+			_, err := server.DialStartTLS(listener.Addr().String(),
+				&tls.Config{RootCAs: roots, ServerName: "ldap.example.com"}, "cn=hologram", "secret")
+			So(err, ShouldEqual, server.ErrStartTLSRefused)
+			So(<-bound, ShouldBeEmpty)
+		})
+
+		Convey("A certificate for another name should be rejected", func() {
+			bound := serveStartTLS(listener, cert, 0)
+			_, err := server.DialStartTLS(listener.Addr().String(),
+				&tls.Config{RootCAs: roots, ServerName: "other.example.com"}, "cn=hologram", "secret")
+			So(err, ShouldNotBeNil)
+			So(<-bound, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestLDAPTLSConfig(t *testing.T) {
+	Convey("Given a CA bundle on disk", t, func() {
+		_, parsed := newTestCertificate("ldap.example.com")
+		bundle, err := ioutil.TempFile("", "hologram-ca")
+		So(err, ShouldBeNil)
+		defer os.Remove(bundle.Name())
+		pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: parsed.Raw})
+		bundle.Close()
+
+		Convey("It should become the only trusted root", func() {
+			config, err := server.LDAPTLSConfig(bundle.Name(), "", "", "ldap.example.com")
+			So(err, ShouldBeNil)
+			So(config.ServerName, ShouldEqual, "ldap.example.com")
+			_, err = parsed.Verify(x509.VerifyOptions{Roots: config.RootCAs, DNSName: "ldap.example.com"})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A file without certificates should be an error", func() {
+			empty, err := ioutil.TempFile("", "hologram-ca")
+			So(err, ShouldBeNil)
+			defer os.Remove(empty.Name())
+			empty.Close()
+
+			_, err = server.LDAPTLSConfig(empty.Name(), "", "", "")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrAuthRateLimited is returned when a client has tried to authenticate too often.
+var ErrAuthRateLimited = errors.New("too many authentication attempts; try again later")
+
+// How many keys a TokenBucketLimiter tracks before forgetting idle ones.
+const maxTokenBuckets = 10000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+TokenBucketLimiter allows each key bursts of up to burst events, refilled
+at rate events per second.
+*/
+type TokenBucketLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	clock   Clock
+	buckets map[string]*tokenBucket
+}
+
+/*
+NewTokenBucketLimiter allows burst events at once per key, and rate per
+second after that. A nil clock uses the system clock.
+*/
+func NewTokenBucketLimiter(rate float64, burst int, clock Clock) *TokenBucketLimiter {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &TokenBucketLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clock:   clock,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+/*
+Allow takes a token from key's bucket, reporting false if it is empty.
+*/
+func (tbl *TokenBucketLimiter) Allow(key string) bool {
+	tbl.Lock()
+	defer tbl.Unlock()
+
+	now := tbl.clock.Now()
+	bucket, ok := tbl.buckets[key]
+	if !ok {
+		if len(tbl.buckets) >= maxTokenBuckets {
+			tbl.forgetIdle(now)
+		}
+		bucket = &tokenBucket{tokens: tbl.burst, last: now}
+		tbl.buckets[key] = bucket
+	}
+
+	bucket.tokens = tbl.refilled(bucket, now)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (tbl *TokenBucketLimiter) refilled(bucket *tokenBucket, now time.Time) float64 {
+	tokens := bucket.tokens + now.Sub(bucket.last).Seconds()*tbl.rate
+	if tokens > tbl.burst {
+		return tbl.burst
+	}
+	return tokens
+}
+
+/*
+forgetIdle drops the buckets that have filled up again, which behave just
+like new ones. The lock must be held.
+*/
+func (tbl *TokenBucketLimiter) forgetIdle(now time.Time) {
+	for key, bucket := range tbl.buckets {
+		if tbl.refilled(bucket, now) >= tbl.burst {
+			delete(tbl.buckets, key)
+		}
+	}
+}
+
+/*
+remoteHost strips the port from a remote address, so that a client is
+limited however many connections it opens.
+*/
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
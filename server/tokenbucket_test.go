@@ -0,0 +1,98 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+	"github.com/AdRoll/hologram/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	Convey("Given a limiter allowing bursts of two and one event per second", t, func() {
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		limiter := server.NewTokenBucketLimiter(1, 2, clock)
+
+		Convey("A key should be allowed its burst and then refused", func() {
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.1"), ShouldBeFalse)
+		})
+
+		Convey("Keys should have buckets of their own", func() {
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.2"), ShouldBeTrue)
+		})
+
+		Convey("Buckets should refill over time, but no further than the burst", func() {
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			clock.Advance(time.Second)
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.1"), ShouldBeFalse)
+
+			clock.Advance(time.Hour)
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.1"), ShouldBeTrue)
+			So(limiter.Allow("10.0.0.1"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a server allowing one authentication attempt", t, func() {
+		authenticator := &DummyAuthenticator{&server.User{Username: "words"}}
+		stats := newRecordingStatter()
+		testServer := server.New(authenticator, &dummyCredentials{}, "default", stats, nil, "cn", "sshPublicKey", "dc=testdn,dc=com", false, "")
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		testServer.LimitAuthentications(server.NewTokenBucketLimiter(0.1, 1, clock))
+
+		authenticate := func() *protocol.Message {
+			r, w := io.Pipe()
+			testConnection := protocol.NewMessageConnection(ReadWriter(r, w))
+			go testServer.HandleConnection(testConnection)
+
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{GetUserCredentials: &protocol.GetUserCredentials{}},
+			})
+			_, err := testConnection.Read()
+			So(err, ShouldBeNil)
+
+			format := "test"
+			testConnection.Write(&protocol.Message{
+				ServerRequest: &protocol.ServerRequest{
+					ChallengeResponse: &protocol.SSHChallengeResponse{Format: &format, Signature: []byte("ssss")},
+				},
+			})
+			response, err := testConnection.Read()
+			So(err, ShouldBeNil)
+			return response
+		}
+
+		Convey("A second attempt should be throttled until the bucket refills", func() {
+			So(authenticate().GetServerResponse().GetCredentials(), ShouldNotBeNil)
+
+			throttled := authenticate()
+			So(throttled.GetError(), ShouldEqual, server.ErrAuthRateLimited.Error())
+			So(stats.Count("errors.authRateLimited"), ShouldEqual, 1)
+
+			clock.Advance(10 * time.Second)
+			So(authenticate().GetServerResponse().GetCredentials(), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,251 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/hologram/log"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+/*
+IAMImplementation exists to enable dependency injection of an
+implementation of IAM.
+*/
+type IAMImplementation interface {
+	GetRole(options *iam.GetRoleInput) (*iam.GetRoleOutput, error)
+}
+
+// How long a role's trust verdict is reused when Options.TrustCacheTTL is unset.
+const defaultTrustCacheTTL = time.Hour
+
+type trustVerdict struct {
+	trusted bool
+	checked time.Time
+}
+
+/*
+trustChecker fetches role trust policies from IAM and decides whether they
+let Hologram's principal assume the role. Verdicts are cached so that a
+refresh does not issue one GetRole call per role every time.
+*/
+type trustChecker struct {
+	iam       IAMImplementation
+	account   string
+	principal string
+	ttl       time.Duration
+	clock     Clock
+	verdicts  map[string]trustVerdict
+	skipped   map[string]bool
+}
+
+/*
+newTrustChecker returns a trustChecker for the roles in account, the one
+iamClient reads from. Without an account, the principal's is assumed.
+*/
+func newTrustChecker(iamClient IAMImplementation, account string, principal string, ttl time.Duration, clock Clock) *trustChecker {
+	if ttl <= 0 {
+		ttl = defaultTrustCacheTTL
+	}
+	if account == "" {
+		account = arnAccount(principal)
+	}
+	return &trustChecker{
+		iam:       iamClient,
+		account:   account,
+		principal: principal,
+		ttl:       ttl,
+		clock:     clock,
+		verdicts:  map[string]trustVerdict{},
+		skipped:   map[string]bool{},
+	}
+}
+
+/*
+trusts reports whether the role's trust policy permits our principal. If
+IAM cannot be asked, the role is given the benefit of the doubt and the
+answer is not cached; STS remains the final authority either way. Roles
+in other accounts cannot be read with our IAM client, so they are not
+checked at all.
+*/
+func (tc *trustChecker) trusts(roleARN string) bool {
+	if arnAccount(roleARN) != tc.account {
+		if !tc.skipped[roleARN] {
+			log.Debug("Not checking the trust policy of %s: it is outside account %s.", roleARN, tc.account)
+			tc.skipped[roleARN] = true
+		}
+		return true
+	}
+	if verdict, ok := tc.verdicts[roleARN]; ok && tc.clock.Now().Sub(verdict.checked) < tc.ttl {
+		return verdict.trusted
+	}
+
+	roleName := roleARN[strings.LastIndex(roleARN, "/")+1:]
+	output, err := tc.iam.GetRole(&iam.GetRoleInput{RoleName: &roleName})
+	if err != nil {
+		log.Warning("Could not fetch the trust policy for %s: %s", roleARN, err.Error())
+		return true
+	}
+
+	trusted := false
+	if output.Role != nil && output.Role.AssumeRolePolicyDocument != nil {
+		trusted = trustPolicyAllows(roleARN, *output.Role.AssumeRolePolicyDocument, tc.principal)
+	}
+	tc.verdicts[roleARN] = trustVerdict{trusted: trusted, checked: tc.clock.Now()}
+	return trusted
+}
+
+// A role trust policy, as far as we need to understand it.
+type trustPolicy struct {
+	Statement []struct {
+		Effect       string
+		Action       stringOrList
+		Principal    *policyPrincipal
+		NotPrincipal *policyPrincipal
+		Condition    map[string]json.RawMessage
+	}
+}
+
+/*
+policyPrincipal decodes a Principal or NotPrincipal, which is either an
+object keyed by principal type or the bare string "*" for everyone.
+*/
+type policyPrincipal struct {
+	AWS stringOrList
+}
+
+func (pp *policyPrincipal) UnmarshalJSON(data []byte) error {
+	var everyone string
+	if err := json.Unmarshal(data, &everyone); err == nil {
+		pp.AWS = stringOrList{everyone}
+		return nil
+	}
+
+	var principal struct {
+		AWS stringOrList
+	}
+	if err := json.Unmarshal(data, &principal); err != nil {
+		return err
+	}
+	pp.AWS = principal.AWS
+	return nil
+}
+
+/*
+stringOrList decodes IAM policy fields that may be either a single string
+or a list of strings.
+*/
+type stringOrList []string
+
+func (sl *stringOrList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*sl = []string{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*sl = list
+	return nil
+}
+
+/*
+trustPolicyAllows evaluates roleARN's (possibly URL-encoded) trust policy
+document for an sts:AssumeRole by principal. A principal is matched
+directly, by a wildcard, or by its account's root, and a NotPrincipal
+applies to every principal it does not match. Explicit denies win over
+allows.
+
+Conditions cannot be evaluated here, so they are assumed to hold: a
+conditional deny excludes the role, while a conditional allow, such as
+one requiring an external ID, is left for STS to check. Both are logged.
+An allow with a NotPrincipal is not something IAM accepts in a trust
+policy and grants nothing.
+*/
+func trustPolicyAllows(roleARN string, document string, principal string) bool {
+	if decoded, err := url.QueryUnescape(document); err == nil {
+		document = decoded
+	}
+
+	var policy trustPolicy
+	if err := json.Unmarshal([]byte(document), &policy); err != nil {
+		log.Warning("Could not parse the trust policy for %s: %s", roleARN, err.Error())
+		return false
+	}
+
+	allowed := false
+	for _, statement := range policy.Statement {
+		if !matchesAny(statement.Action, "sts:AssumeRole", "sts:*", "*") {
+			continue
+		}
+		if statement.NotPrincipal != nil {
+			if principalMatches(statement.NotPrincipal.AWS, principal) {
+				continue
+			}
+		} else if statement.Principal == nil || !principalMatches(statement.Principal.AWS, principal) {
+			continue
+		}
+
+		if len(statement.Condition) > 0 {
+			log.Info("The trust policy for %s has a conditional %s for %s; assuming its conditions hold.", roleARN, statement.Effect, principal)
+		}
+		if statement.Effect == "Deny" {
+			return false
+		}
+		if statement.Effect == "Allow" {
+			if statement.NotPrincipal != nil {
+				log.Warning("Ignoring an Allow with a NotPrincipal in the trust policy for %s.", roleARN)
+				continue
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func matchesAny(values []string, candidates ...string) bool {
+	for _, value := range values {
+		for _, candidate := range candidates {
+			if value == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func principalMatches(principals []string, principal string) bool {
+	account := ""
+	if parts := strings.Split(principal, ":"); len(parts) > 4 {
+		account = parts[4]
+	}
+
+	for _, p := range principals {
+		if p == "*" || p == principal {
+			return true
+		}
+		if account != "" && (p == account || strings.HasSuffix(p, ":"+account+":root")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"net/url"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const hologramPrincipal = "arn:aws:iam::123456789012:role/hologram"
+
+/*
+StubIAM serves canned trust policies keyed by role name and counts the
+GetRole calls it receives.
+*/
+type StubIAM struct {
+	Policies map[string]string
+	Calls    int
+}
+
+func (si *StubIAM) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	si.Calls++
+	document := url.QueryEscape(si.Policies[*input.RoleName])
+	return &iam.GetRoleOutput{
+		Role: &iam.Role{AssumeRolePolicyDocument: &document},
+	}, nil
+}
+
+func TestLDAPUserCacheRoleTrust(t *testing.T) {
+	Convey("Given a user granted one role that trusts Hologram and one that does not", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=roles"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=roles", map[string][]string{
+					"businessCategory": {
+						"arn:aws:iam::123456789012:role/trusting",
+						"arn:aws:iam::123456789012:role/untrusting",
+						"arn:aws:iam::210987654321:role/untrusting",
+					},
+				}),
+			},
+		}
+		stubIAM := &StubIAM{
+			Policies: map[string]string{
+				"trusting":   `{"Statement":[{"Effect":"Allow","Principal":{"AWS":"` + hologramPrincipal + `"},"Action":"sts:AssumeRole"}]}`,
+				"untrusting": `{"Statement":[{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole"}]}`,
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			TrustIAM:        stubIAM,
+			TrustPrincipal:  hologramPrincipal,
+		}
+
+		Convey("By default the untrusting role should be excluded", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{
+				"arn:aws:iam::123456789012:role/trusting",
+				"arn:aws:iam::210987654321:role/untrusting",
+			})
+			So(stubIAM.Calls, ShouldEqual, 2)
+
+			Convey("And the verdicts should be cached across refreshes", func() {
+				So(lc.Update(), ShouldBeNil)
+				So(stubIAM.Calls, ShouldEqual, 2)
+			})
+		})
+
+		Convey("Only roles in the configured account should be checked", func() {
+			opts.TrustAccount = "210987654321"
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{
+				"arn:aws:iam::123456789012:role/trusting",
+				"arn:aws:iam::123456789012:role/untrusting",
+			})
+			So(stubIAM.Calls, ShouldEqual, 1)
+		})
+
+		Convey("In warn-only mode the untrusting role should be kept", func() {
+			opts.TrustWarnOnly = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldHaveLength, 3)
+		})
+	})
+}
+
+func TestLDAPUserCacheTrustPolicyForms(t *testing.T) {
+	Convey("Given a user granted roles whose trust policies use less common forms", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		policies := map[string]string{
+			"everyone": `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"sts:AssumeRole"}]}`,
+			"onlyhologram": `{"Statement":[` +
+				`{"Effect":"Allow","Principal":"*","Action":"sts:AssumeRole"},` +
+				`{"Effect":"Deny","NotPrincipal":{"AWS":"` + hologramPrincipal + `"},"Action":"sts:AssumeRole"}]}`,
+			"onlyothers": `{"Statement":[` +
+				`{"Effect":"Allow","Principal":"*","Action":"sts:AssumeRole"},` +
+				`{"Effect":"Deny","NotPrincipal":{"AWS":"arn:aws:iam::210987654321:root"},"Action":"sts:AssumeRole"}]}`,
+			"conditionaldeny": `{"Statement":[` +
+				`{"Effect":"Allow","Principal":{"AWS":"` + hologramPrincipal + `"},"Action":"sts:AssumeRole"},` +
+				`{"Effect":"Deny","Principal":"*","Action":"sts:AssumeRole","Condition":{"IpAddress":{"aws:SourceIp":"10.0.0.0/8"}}}]}`,
+			"externalid": `{"Statement":[{"Effect":"Allow","Principal":{"AWS":"` + hologramPrincipal + `"},"Action":"sts:AssumeRole",` +
+				`"Condition":{"StringEquals":{"sts:ExternalId":"s3cr3t"}}}]}`,
+			"notprincipalallow": `{"Statement":[{"Effect":"Allow","NotPrincipal":{"AWS":"arn:aws:iam::210987654321:root"},"Action":"sts:AssumeRole"}]}`,
+		}
+		roles := []string{}
+		for _, name := range []string{"everyone", "onlyhologram", "onlyothers", "conditionaldeny", "externalid", "notprincipalallow"} {
+			roles = append(roles, "arn:aws:iam::123456789012:role/"+name)
+		}
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=roles"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=roles", map[string][]string{"businessCategory": roles}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			TrustIAM:        &StubIAM{Policies: policies},
+			TrustPrincipal:  hologramPrincipal,
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Wildcards, NotPrincipal denies and conditions should be understood", func() {
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{
+				"arn:aws:iam::123456789012:role/everyone",
+				"arn:aws:iam::123456789012:role/onlyhologram",
+				"arn:aws:iam::123456789012:role/externalid",
+			})
+		})
+	})
+}
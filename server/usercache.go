@@ -15,7 +15,14 @@
 package server
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/AdRoll/hologram/log"
@@ -32,6 +39,114 @@ type User struct {
 	SSHKeys     []ssh.PublicKey
 	ARNs        []string
 	DefaultRole string
+
+	// KeyFingerprints holds the SHA256 fingerprint of each of SSHKeys,
+	// in the same order, for auditing which keys were loaded.
+	KeyFingerprints []string
+
+	// AllowedHours restricts when the user may authenticate; nil means
+	// at any time.
+	AllowedHours *HourWindow
+
+	// Source names the backend the user was loaded from, or several of
+	// them, comma-separated, for a user merged from more than one.
+	Source string
+
+	// SessionTags are the user's tags for attribute-based access control,
+	// checked against STS's limits on session tags. They are only loaded
+	// for now: AssumeRole does not pass them to STS yet.
+	SessionTags map[string]string
+}
+
+/*
+MergeUsers combines two records of the same user from different backends:
+keys and ARNs are unioned, the first record's default role and allowed
+hours win unless it has none, and the sources are concatenated.
+*/
+func MergeUsers(first *User, second *User) *User {
+	merged := &User{
+		Username:     first.Username,
+		SSHKeys:      append([]ssh.PublicKey{}, first.SSHKeys...),
+		ARNs:         append([]string{}, first.ARNs...),
+		DefaultRole:  first.DefaultRole,
+		AllowedHours: first.AllowedHours,
+		Source:       first.Source,
+		SessionTags:  first.SessionTags,
+	}
+	for _, key := range second.SSHKeys {
+		if !containsKey(merged.SSHKeys, key) {
+			merged.SSHKeys = append(merged.SSHKeys, key)
+		}
+	}
+	for _, arn := range second.ARNs {
+		if !containsString(merged.ARNs, arn) {
+			merged.ARNs = append(merged.ARNs, arn)
+		}
+	}
+	merged.KeyFingerprints = keyFingerprints(merged.SSHKeys)
+	if merged.DefaultRole == "" {
+		merged.DefaultRole = second.DefaultRole
+	}
+	if merged.AllowedHours == nil {
+		merged.AllowedHours = second.AllowedHours
+	}
+	if len(merged.SessionTags) == 0 {
+		merged.SessionTags = second.SessionTags
+	}
+	if second.Source != "" && !containsString(strings.Split(merged.Source, ","), second.Source) {
+		if merged.Source != "" {
+			merged.Source += ","
+		}
+		merged.Source += second.Source
+	}
+	return merged
+}
+
+/*
+copyUser returns a copy of user whose slices and maps can be changed
+without touching the cached original.
+*/
+func copyUser(user *User) *User {
+	copied := *user
+	copied.SSHKeys = append([]ssh.PublicKey(nil), user.SSHKeys...)
+	copied.ARNs = append([]string(nil), user.ARNs...)
+	copied.KeyFingerprints = append([]string(nil), user.KeyFingerprints...)
+	if user.AllowedHours != nil {
+		hours := *user.AllowedHours
+		copied.AllowedHours = &hours
+	}
+	if user.SessionTags != nil {
+		copied.SessionTags = make(map[string]string, len(user.SessionTags))
+		for key, value := range user.SessionTags {
+			copied.SessionTags[key] = value
+		}
+	}
+	return &copied
+}
+
+/*
+copyUsers copies users and every user in it with copyUser.
+*/
+func copyUsers(users map[string]*User) map[string]*User {
+	copied := make(map[string]*User, len(users))
+	for username, user := range users {
+		copied[username] = copyUser(user)
+	}
+	return copied
+}
+
+/*
+FilterUsersBySource returns the users that were loaded from source, alone
+or merged with other backends.
+*/
+func FilterUsersBySource(users map[string]*User, source string) map[string]*User {
+	filtered := map[string]*User{}
+	for username, user := range users {
+		if containsString(strings.Split(user.Source, ","), source) {
+			filtered[username] = user
+		}
+	}
+	return filtered
 }
 
 /*
@@ -41,6 +156,35 @@ type UserCache interface {
 	// They also need to implement the SSH key verification interface.
 	Authenticator
 	Update() error
+
+	// Lookup returns a copy of the named user, for tools that want to
+	// see a user's keys and roles without verifying a signature.
+	Lookup(username string) (*User, bool)
+}
+
+/*
+ContextUpdater is implemented by user caches whose Update() can be cut
+short by a context, so that a wedged backend cannot wedge its callers.
+*/
+type ContextUpdater interface {
+	UpdateContext(ctx context.Context) error
+}
+
+// How long refreshes may run when no other timeout is configured.
+const DefaultUpdateTimeout = 30 * time.Second
+
+/*
+UpdateWithTimeout refreshes cache, giving up after timeout if the cache
+supports it. Other caches are simply updated.
+*/
+func UpdateWithTimeout(cache UserCache, timeout time.Duration) error {
+	updater, ok := cache.(ContextUpdater)
+	if !ok {
+		return cache.Update()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return updater.UpdateContext(ctx)
 }
 
 /*
@@ -53,166 +197,1485 @@ type LDAPImplementation interface {
 	Modify(*ldap.ModifyRequest) error
 }
 
+// Key types that mark a value as an authorized_keys line.
+var authorizedKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:          true,
+	ssh.KeyAlgoDSA:          true,
+	ssh.KeyAlgoECDSA256:     true,
+	ssh.KeyAlgoECDSA384:     true,
+	ssh.KeyAlgoECDSA521:     true,
+	ssh.KeyAlgoED25519:      true,
+	ssh.CertAlgoRSAv01:      true,
+	ssh.CertAlgoDSAv01:      true,
+	ssh.CertAlgoECDSA256v01: true,
+	ssh.CertAlgoECDSA384v01: true,
+	ssh.CertAlgoECDSA521v01: true,
+	ssh.CertAlgoED25519v01:  true,
+}
+
+/*
+ErrMalformedRequest is returned by Authenticate when the challenge or the
+signature could not have come from a well-behaved client.
+*/
+var ErrMalformedRequest = errors.New("malformed authentication request")
+
+/*
+ErrDefaultRoleAttrIsUserAttr refuses a configuration that would read each
+user's default role from their username.
+*/
+var ErrDefaultRoleAttrIsUserAttr = errors.New("the default role attribute is the same as the user attribute")
+
+/*
+validateOptions rejects configurations that cannot be what was meant.
+*/
+func validateOptions(opts Options) error {
+	for _, userAttr := range opts.userAttrs() {
+		if opts.DefaultRoleAttr != "" && strings.EqualFold(opts.DefaultRoleAttr, userAttr) {
+			return ErrDefaultRoleAttrIsUserAttr
+		}
+	}
+	return nil
+}
+
+// Signature formats a client can produce with a key we are able to load.
+var knownSignatureFormats = map[string]bool{
+	ssh.KeyAlgoRSA:      true,
+	ssh.KeyAlgoDSA:      true,
+	ssh.KeyAlgoECDSA256: true,
+	ssh.KeyAlgoECDSA384: true,
+	ssh.KeyAlgoECDSA521: true,
+	ssh.KeyAlgoED25519:  true,
+}
+
+/*
+Options configures how an LDAP user cache queries the directory and
+interprets the entries it finds there.
+*/
+type Options struct {
+	UserAttr        string
+	SSHAttr         string
+	BaseDN          string
+	EnableLDAPRoles bool
+	RoleAttribute   string
+	DefaultRole     string
+	DefaultRoleAttr string
+
+	// MemberUidGroups resolves role group membership from the memberUid
+	// values of posixGroup (and groupOfNames) entries, matched against
+	// usernames, rather than from the memberOf attribute of users, which
+	// OpenLDAP does not maintain for posixGroups.
+	MemberUidGroups bool
+
+	// UserAttrs, if set, replaces UserAttr with a list of attributes to
+	// take usernames from, in order of preference, for directories where
+	// entries name their users differently. Entries with none of them
+	// are skipped.
+	UserAttrs []string
+
+	// ApprovedCurves restricts ECDSA keys to the named curves, e.g.
+	// "P-256" or "P-384". Keys on any other curve are skipped. Leaving
+	// this empty accepts ECDSA keys on every curve.
+	ApprovedCurves []string
+
+	// AllowedKeyTypes, if set, restricts users' keys to the listed types,
+	// e.g. "ssh-ed25519" or "ecdsa-sha2-*". The RSA signature algorithms
+	// "rsa-sha2-256" and "rsa-sha2-512" stand for ssh-rsa keys. MinRSABits,
+	// if set, rejects smaller RSA keys. Keys failing either are skipped.
+	AllowedKeyTypes []string
+	MinRSABits      int
+
+	// KeyCreatedAttr names a user attribute holding the time the user's
+	// SSH keys were created. When set, Update() records key ages into a
+	// histogram; KeyAgeBuckets overrides its upper bounds, which must be
+	// in ascending order.
+	KeyCreatedAttr string
+	KeyAgeBuckets  []time.Duration
+
+	// ReportRoleOnlyMembers makes Update() cross-reference the members of
+	// role groups against the users it loaded, reporting members that
+	// have no keyed user entry. Only used with EnableLDAPRoles.
+	ReportRoleOnlyMembers bool
+
+	// MaxCertLifetime caps how long after its ValidAfter time an SSH
+	// certificate stored as a user key is trusted, regardless of its
+	// ValidBefore. Zero leaves certificates bounded by their own window.
+	MaxCertLifetime time.Duration
+
+	// TrustedUserCAs are SSH certificate authorities whose user
+	// certificates authenticate the users named by their principals, with
+	// no key of the user's own enrolled. Setting them makes Update() load
+	// every entry with a username, not only those with sshPublicKey.
+	// MaxCertLifetime applies to them.
+	TrustedUserCAs []ssh.PublicKey
+
+	// TrustIAM, when set, makes Update() fetch the trust policy of every
+	// role it grants and check that TrustPrincipal may assume it. Roles
+	// that do not trust Hologram are dropped from users' ARNs, or only
+	// warned about if TrustWarnOnly is set. Verdicts are cached for
+	// TrustCacheTTL, which defaults to an hour. Only roles in
+	// TrustAccount, the account TrustIAM reads from, are checked; it
+	// defaults to TrustPrincipal's account.
+	TrustIAM       IAMImplementation
+	TrustAccount   string
+	TrustPrincipal string
+	TrustWarnOnly  bool
+	TrustCacheTTL  time.Duration
+
+	// StrictEd25519 rejects ed25519 keys and signatures that are not
+	// canonically encoded or that use small-order points, before they
+	// reach the library's more lenient verification.
+	StrictEd25519 bool
+
+	// FoldAttributeNames matches attribute names case-insensitively, for
+	// directories that return e.g. sshpublickey instead of sshPublicKey.
+	FoldAttributeNames bool
+
+	// DecodeBinaryAttributes reads values returned with the ;binary option,
+	// e.g. cn;binary, as if they had come under the bare attribute name,
+	// decoding UTF-16 text and stripping NUL padding.
+	DecodeBinaryAttributes bool
+
+	// ExclusiveRoles lists role ARNs meant for a single identity. Update()
+	// raises an alarm when more than one user holds one of them, either
+	// as their default role or in their ARNs.
+	ExclusiveRoles []string
+
+	// RefreshBreakerThreshold, when positive, stops cache misses from
+	// refreshing after that many consecutive Update() failures. Misses
+	// are then served from the stale cache until RefreshBreakerCooldown
+	// has passed and a probe refresh succeeds.
+	RefreshBreakerThreshold int
+	RefreshBreakerCooldown  time.Duration
+
+	// RealmSuffixes are stripped from the username given to Authenticate
+	// before looking the user up, e.g. "@CORP.EXAMPLE.COM".
+	RealmSuffixes []string
+
+	// UsernameCase is the case usernames are stored and looked up in: one
+	// of UsernameAsIs (the default), UsernameLower or UsernameUpper.
+	UsernameCase string
+
+	// RoleUsageLimit caps how many distinct roles RoleUsage() tracks;
+	// further roles are counted under RoleUsageOther. Defaults to 1024.
+	RoleUsageLimit int
+
+	// AllowedAccounts, if set, limits the roles Update() hands out to
+	// these AWS account IDs. Other ARNs are dropped with a warning or, with
+	// StrictAccounts, cause the user holding them not to be loaded.
+	AllowedAccounts []string
+	StrictAccounts  bool
+
+	// CaseInsensitiveRoleNames ignores case in the path and name of roles
+	// when checking a requested role against a user's ARNs. The stored
+	// ARNs are left as they are.
+	CaseInsensitiveRoleNames bool
+
+	// DedupeARNsIgnoringCase collapses a user's ARNs that differ only in
+	// case into the first one seen, so overlapping groups don't leave
+	// near-duplicates in User.ARNs.
+	DedupeARNsIgnoringCase bool
+
+	// ARNRewriter, if set, is applied to every ARN a user is granted,
+	// default roles included, before the ARNs are checked and stored. It
+	// lets deployments in other partitions adapt the directory's ARNs.
+	ARNRewriter func(string) string
+
+	// SessionTagAttrs lists the LDAP attributes copied into each user's
+	// SessionTags, keyed by attribute name.
+	SessionTagAttrs []string
+
+	// DefaultRolePrecedence, with LDAP roles, lists where a user's default
+	// role comes from in order of preference: DefaultRoleFromUser,
+	// DefaultRoleFromGroup and DefaultRoleFromGlobal. The first candidate
+	// that the user's ARNs grant is used. DefaultRoleGroups orders the
+	// group DNs consulted by DefaultRoleFromGroup. Leaving the precedence
+	// empty keeps the per-user attribute, then the global default,
+	// without validation.
+	DefaultRolePrecedence []string
+	DefaultRoleGroups     []string
+
+	// AllowedHoursAttr names a user attribute holding the daily window
+	// during which the user may authenticate, e.g. "09:00-17:00", in the
+	// timezone named by TimezoneAttr (UTC if absent). Users without the
+	// attribute are unrestricted.
+	AllowedHoursAttr string
+	TimezoneAttr     string
+
+	// GroupRefreshInterval lets Update() reuse the group to ARN mapping for
+	// this long instead of searching for groups every time, as groups
+	// tend to change far less often than keys. Zero searches every time.
+	GroupRefreshInterval time.Duration
+
+	// GroupNestingDepth, if positive, lets groups inherit the roles of the
+	// groups their memberOf lists, up to this many levels up, so that a
+	// member of a group nested in a role group gets that role too.
+	GroupNestingDepth int
+
+	// MaxAge, if set, makes authentications refresh the cache first when
+	// the last successful Update() is older than this, so that a revoked
+	// key cannot keep working for as long as nobody misses the cache.
+	MaxAge time.Duration
+
+	// MinRefreshInterval keeps cache misses and MaxAge from starting a
+	// refresh within this long of the previous attempt, so that a storm
+	// of unknown keys cannot query LDAP back to back.
+	MinRefreshInterval time.Duration
+
+	// UpdateTimeout bounds the refreshes the cache starts on its own, on
+	// a miss, for MaxAge or in the background. It defaults to
+	// DefaultUpdateTimeout.
+	UpdateTimeout time.Duration
+
+	// MissRefreshRate and MissRefreshBurst, if set, bound the refreshes
+	// that cache misses start across all clients with a token bucket, so
+	// that a flood of unknown keys cannot flood LDAP.
+	MissRefreshRate  float64
+	MissRefreshBurst int
+
+	// RemovedKeyGrace keeps keys that disappear from the directory working
+	// for this long after the Update() that noticed, so that automation
+	// using them is not cut off mid-flight. Zero drops them immediately.
+	RemovedKeyGrace time.Duration
+
+	// FingerprintConflictPolicy decides which user a key authenticates as
+	// when it is held by several users with different roles: one of
+	// ConflictFirst (the default), ConflictMostPermissive,
+	// ConflictLeastPermissive or ConflictReject.
+	FingerprintConflictPolicy string
+
+	// Fingerprint computes the fingerprints keys are indexed by, by default
+	// FingerprintSHA256. Two different keys that fingerprint the same are
+	// logged and the later one left out of the index, unless
+	// StrictFingerprintCollisions makes the update fail instead.
+	Fingerprint                 func(ssh.PublicKey) string
+	StrictFingerprintCollisions bool
+
+	// PageSize is how many users Update() asks for at a time, with the
+	// paged results control, so that servers capping the size of a
+	// search (Active Directory stops at 1000) still return everyone. Each
+	// page is loaded before the next is fetched, which also bounds the
+	// memory a refresh needs. Zero means DefaultPageSize.
+	PageSize uint32
+
+	// Verifier checks every signature. It defaults to a SoftwareVerifier;
+	// a KeyTypeVerifier hands chosen key types to an HSM or KMS.
+	Verifier Verifier
+
+	// DropKeylessUsers leaves out users none of whose keys could be
+	// loaded, as they can never authenticate. By default they are kept
+	// so they still show up in the cache.
+	DropKeylessUsers bool
+
+	// DuplicateUserPolicy decides what happens when two entries of the
+	// user search have the same username: one of DuplicateLastWins (the
+	// default), DuplicateFirstWins, DuplicateUnion or DuplicateError.
+	DuplicateUserPolicy string
+
+	// CanaryFingerprints are fingerprints, in the format Fingerprint
+	// produces, of keys that must never go missing. Update() raises a
+	// critical alert for each one it cannot find.
+	CanaryFingerprints []string
+
+	// SourceLabel is recorded as the Source of every user this cache
+	// loads. It defaults to "ldap".
+	SourceLabel string
+
+	// RecentEventsSize is how many authentication outcomes RecentEvents()
+	// remembers. Zero remembers none.
+	RecentEventsSize int
+
+	// RefreshHistorySize is how many Update() outcomes RefreshHistory()
+	// remembers. Zero remembers none.
+	RefreshHistorySize int
+
+	// SelfTest makes the constructor check, with an ephemeral key, that
+	// signatures verify before loading any users, and fail if not.
+	SelfTest bool
+
+	// Clock is used for every time-dependent check. It defaults to the
+	// system clock.
+	Clock Clock
+}
+
+/*
+userAttrs returns the attributes usernames are taken from, in order.
+*/
+func (opts Options) userAttrs() []string {
+	if len(opts.UserAttrs) > 0 {
+		return opts.UserAttrs
+	}
+	return []string{opts.UserAttr}
+}
+
+/*
+userFilter selects the entries Update() loads. Normally only users with
+an enrolled key can authenticate, but with TrustedUserCAs a certificate
+vouches for users who have none, so every entry with a username is
+loaded.
+*/
+func (luc *ldapUserCache) userFilter() string {
+	if len(luc.opts.TrustedUserCAs) == 0 {
+		return "(sshPublicKey=*)"
+	}
+	attrs := luc.opts.userAttrs()
+	if len(attrs) == 1 {
+		return "(" + attrs[0] + "=*)"
+	}
+	filter := "(|"
+	for _, attr := range attrs {
+		filter += "(" + attr + "=*)"
+	}
+	return filter + ")"
+}
+
 /*
 ldapUserCache connects to LDAP and pulls user settings from it.
+
+Update() builds each refresh on the side and swaps it in under mu, so
+authentications running meanwhile see either the old users or the new
+ones, never a mix. Updates themselves take turns on updating.
 */
 type ldapUserCache struct {
+	mu       sync.RWMutex
+	updating sync.Mutex
+
 	users           map[string]*User
 	groups          map[string][]string
 	server          LDAPImplementation
 	stats           g2s.Statter
-	userAttr        string
-	sshAttr         string
-	baseDN          string
-	enableLDAPRoles bool
-	roleAttribute   string
-	defaultRole     string
-	defaultRoleAttr string
+	opts            Options
+	keyAges         *KeyAgeDistribution
+	roleOnlyMembers []string
+	sharedExclusive map[string][]string
+	trust           *trustChecker
+	breaker         *refreshBreaker
+	missRefreshes   *TokenBucketLimiter
+	roleUsage       *roleUsage
+	contentHash     string
+
+	keysByFingerprint *fingerprintIndex
+	removedKeys       map[string]*removedKey
+	events            *eventRing
+	refreshes         *refreshHistory
+	groupMembers      map[string][]string
+	groupsByUid       map[string][]string
+	groupsFetchedAt   time.Time
+
+	// When Update() last succeeded and was last tried, and how the last
+	// one to finish went, guarded by mu.
+	lastUpdate         time.Time
+	lastRefreshAttempt time.Time
+	lastRefreshErr     error
 }
 
 /*
 Update() searches LDAP for the current user set that supports
-the necessary properties for Hologram.
-
-TODO: call this at some point during verification failure so that keys that have
-been recently added to LDAP work, instead of requiring a server restart.
+the necessary properties for Hologram. It runs on a cache miss
+and, via StartBackgroundRefresh, on a timer.
 */
 func (luc *ldapUserCache) Update() error {
-	start := time.Now()
-	if luc.enableLDAPRoles {
-		groupSearchRequest := ldap.NewSearchRequest(
-			luc.baseDN,
-			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
-			0, 0, false,
-			"(objectClass=groupOfNames)",
-			[]string{luc.roleAttribute},
-			nil,
-		)
-
-		groupSearchResult, err := luc.server.Search(groupSearchRequest)
-		if err != nil {
-			return err
-		}
+	return luc.UpdateContext(context.Background())
+}
+
+/*
+UpdateContext is Update() giving up with ctx's error once ctx is done,
+leaving the cache as it was. Waiting for an Update() already in progress
+is not cut short.
+*/
+func (luc *ldapUserCache) UpdateContext(ctx context.Context) error {
+	luc.updating.Lock()
+	defer luc.updating.Unlock()
 
-		for _, entry := range groupSearchResult.Entries {
-			dn := entry.DN
-			arns := entry.GetAttributeValues(luc.roleAttribute)
-			log.Debug("Adding %s to %s", arns, dn)
-			luc.groups[dn] = arns
+	start := luc.opts.Clock.Now()
+	luc.mu.Lock()
+	luc.lastRefreshAttempt = start
+	luc.mu.Unlock()
+
+	loaded, err := luc.update(ctx, start)
+	luc.recordRefresh(start, loaded, err)
+	luc.mu.Lock()
+	luc.lastRefreshErr = err
+	luc.mu.Unlock()
+	return err
+}
+
+/*
+Ready reports an error unless the last Update() succeeded. Users are
+still served from the last good refresh either way.
+*/
+func (luc *ldapUserCache) Ready() error {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	return readiness(!luc.lastUpdate.IsZero(), luc.lastRefreshErr)
+}
+
+/*
+updateWithTimeout runs one of the refreshes the cache starts on its own,
+bounded by Options.UpdateTimeout.
+*/
+func (luc *ldapUserCache) updateWithTimeout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), luc.options().UpdateTimeout)
+	defer cancel()
+	return luc.UpdateContext(ctx)
+}
+
+/*
+update does the work of UpdateContext(), returning how many users it
+loaded.
+*/
+func (luc *ldapUserCache) update(ctx context.Context, start time.Time) (int, error) {
+	reportRoleOnly := luc.opts.EnableLDAPRoles && luc.opts.ReportRoleOnlyMembers
+
+	// Build into fresh maps and swap them in at the end, so that users
+	// are re-resolved as a whole and removed entries disappear.
+	users := map[string]*User{}
+	groups := map[string][]string{}
+	groupMembers := map[string][]string{}
+	groupsByUid := map[string][]string{}
+	groupsFetchedAt := luc.groupsFetchedAt
+	if luc.opts.EnableLDAPRoles {
+		if luc.groupsFresh(start) {
+			log.Debug("Group mapping is still fresh; skipping the group search.")
+			groups, groupMembers, groupsByUid = luc.groups, luc.groupMembers, luc.groupsByUid
+		} else {
+			var err error
+			if groups, groupMembers, groupsByUid, err = luc.fetchGroups(ctx, reportRoleOnly); err != nil {
+				return 0, err
+			}
+			groupsFetchedAt = start
 		}
 	}
 
-	filter := "(sshPublicKey=*)"
+	attributes := []string{luc.opts.SSHAttr, "memberOf", luc.opts.DefaultRoleAttr}
+	attributes = append(attributes, luc.opts.userAttrs()...)
+	if luc.opts.KeyCreatedAttr != "" {
+		attributes = append(attributes, luc.opts.KeyCreatedAttr)
+	}
+	if luc.opts.AllowedHoursAttr != "" {
+		attributes = append(attributes, luc.opts.AllowedHoursAttr)
+	}
+	if luc.opts.TimezoneAttr != "" {
+		attributes = append(attributes, luc.opts.TimezoneAttr)
+	}
+	attributes = append(attributes, luc.opts.SessionTagAttrs...)
+
+	filter := luc.userFilter()
 	searchRequest := ldap.NewSearchRequest(
-		luc.baseDN,
+		luc.opts.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
 		0, 0, false,
-		filter, []string{luc.sshAttr, luc.userAttr, "memberOf", luc.defaultRoleAttr},
+		filter, attributes,
 		nil,
 	)
 
-	searchResult, err := luc.server.Search(searchRequest)
-	if err != nil {
-		return err
+	var keyAges *KeyAgeDistribution
+	if luc.opts.KeyCreatedAttr != "" {
+		keyAges = newKeyAgeDistribution(luc.opts.KeyAgeBuckets)
 	}
-	for _, entry := range searchResult.Entries {
-		username := entry.GetAttributeValue(luc.userAttr)
-		userKeys := []ssh.PublicKey{}
-		for _, eachKey := range entry.GetAttributeValues(luc.sshAttr) {
-			sshKeyBytes, _ := base64.StdEncoding.DecodeString(eachKey)
-			userSSHKey, err := ssh.ParsePublicKey(sshKeyBytes)
-			if err != nil {
-				userSSHKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(eachKey))
-				if err != nil {
-					log.Warning("SSH key parsing for user %s failed (key was '%s')! This key will not be added into LDAP.", username, eachKey)
+
+	loadedDNs := map[string]bool{}
+	loadOrder := []*User{}
+	keyless := 0
+	load := func(entries []*ldap.Entry) error {
+		for _, entry := range entries {
+			loadedDNs[strings.ToLower(entry.DN)] = true
+			user := luc.userFromEntry(entry, groups, groupsByUid, keyAges)
+			if user == nil {
+				continue
+			}
+			if luc.opts.DropKeylessUsers && len(user.SSHKeys) == 0 {
+				keyless++
+				continue
+			}
+			if existing, ok := users[user.Username]; ok {
+				var err error
+				if user, err = luc.resolveDuplicate(existing, user); err != nil {
+					return err
+				}
+				if user == existing {
 					continue
 				}
 			}
+			users[user.Username] = user
+			loadOrder = append(loadOrder, user)
+
+			log.Debug("Information on %s (re-)generated.", user.Username)
+		}
+		return nil
+	}
+
+	pages, err := searchPages(ctx, luc.server, searchRequest, luc.opts.PageSize, load)
+	if err != nil {
+		return 0, err
+	}
+	log.Debug("Loaded %d LDAP entries over %d pages.", len(loadedDNs), pages)
+
+	if keyless > 0 {
+		log.Warning("Left out %d users with no usable SSH keys.", keyless)
+		luc.stats.Counter(1.0, "ldapKeylessUsersDropped", keyless)
+	}
 
-			userKeys = append(userKeys, userSSHKey)
+	keysByFingerprint := newFingerprintIndex(luc.opts.FingerprintConflictPolicy,
+		luc.opts.Fingerprint, luc.opts.StrictFingerprintCollisions, luc.stats)
+	for _, user := range loadOrder {
+		// Skip users replaced by a later entry with the same name.
+		if users[user.Username] != user {
+			continue
+		}
+		if err := keysByFingerprint.add(user); err != nil {
+			return 0, err
 		}
+	}
+
+	if len(users) == 0 {
+		// Nobody can get credentials from an empty cache; page someone.
+		log.Critical("LDAP returned no usable users; the user cache is now empty.")
+		luc.stats.Counter(1.0, "ldapCacheEmpty", 1)
+	}
 
-		userDefaultRole := luc.defaultRole
-		arns := []string{}
-		if luc.enableLDAPRoles {
-			userDefaultRole = entry.GetAttributeValue(luc.defaultRoleAttr)
-			if userDefaultRole == "" {
-				userDefaultRole = luc.defaultRole
+	// Only Update() writes these fields, so reading them here needs no lock.
+	removedKeys := luc.carryRemovedKeys(users, luc.opts.Clock.Now())
+	hash := contentHash(users)
+	roleOnlyMembers := luc.roleOnlyMembers
+	if reportRoleOnly {
+		roleOnlyMembers = luc.findRoleOnlyMembers(groupMembers, loadedDNs)
+	}
+	sharedExclusive := luc.sharedExclusive
+	if len(luc.opts.ExclusiveRoles) > 0 {
+		sharedExclusive = luc.findSharedExclusiveRoles(users)
+	}
+
+	luc.mu.Lock()
+	luc.removedKeys = removedKeys
+	luc.users = users
+	luc.groups = groups
+	luc.groupMembers = groupMembers
+	luc.groupsByUid = groupsByUid
+	luc.groupsFetchedAt = groupsFetchedAt
+	luc.keysByFingerprint = keysByFingerprint
+	luc.contentHash = hash
+	if keyAges != nil {
+		luc.keyAges = keyAges
+	}
+	luc.roleOnlyMembers = roleOnlyMembers
+	luc.sharedExclusive = sharedExclusive
+	luc.lastUpdate = start
+	luc.mu.Unlock()
+
+	luc.checkCanaries(keysByFingerprint)
+	reportCacheSize(luc.stats, "ldap", users)
+	luc.stats.Gauge(1.0, "ldapGroupCount", strconv.Itoa(len(groups)))
+
+	log.Debug("LDAP information re-cached.")
+	luc.stats.Timing(1.0, "ldapCacheUpdate", luc.opts.Clock.Now().Sub(start))
+	return len(users), nil
+}
+
+/*
+reportCacheSize sends gauges of how many users and SSH keys a cache holds,
+prefixed with the cache's name, so that a sudden drop can be alerted on.
+*/
+func reportCacheSize(stats g2s.Statter, prefix string, users map[string]*User) {
+	keys := 0
+	for _, user := range users {
+		keys += len(user.SSHKeys)
+	}
+	stats.Gauge(1.0, prefix+"UserCount", strconv.Itoa(len(users)))
+	stats.Gauge(1.0, prefix+"KeyCount", strconv.Itoa(keys))
+}
+
+/*
+userFromEntry builds the user described by one entry of the user search,
+or returns nil if the entry must not be loaded. groupsByUid maps usernames
+to the groups listing them by memberUid.
+*/
+func (luc *ldapUserCache) userFromEntry(entry *ldap.Entry, groups map[string][]string, groupsByUid map[string][]string, keyAges *KeyAgeDistribution) *User {
+	attrs := luc.attributesOf(entry)
+	username := ""
+	for _, userAttr := range luc.opts.userAttrs() {
+		if username = attrs.value(userAttr); username != "" {
+			break
+		}
+	}
+	if username == "" {
+		log.Warning("Skipping %s: it has none of the username attributes %v.", entry.DN, luc.opts.userAttrs())
+		return nil
+	}
+	userKeys := []ssh.PublicKey{}
+	fingerprints := []string{}
+	for _, eachKey := range attrs.values(luc.opts.SSHAttr) {
+		userSSHKey, err := parseSSHKeyValue(eachKey)
+		if err != nil {
+			log.Warning("SSH key parsing for user %s failed (key fingerprint %s)! This key will not be added into LDAP.", username, rawKeyFingerprint(eachKey))
+			continue
+		}
+
+		if curve, ok := luc.curveApproved(userSSHKey); !ok {
+			log.Warning("SSH key for user %s uses ECDSA curve %s, which is not approved. This key will not be added into LDAP.", username, curve)
+			continue
+		}
+
+		if err := luc.checkKeyPolicy(userSSHKey); err != nil {
+			log.Warning("SSH key %s for user %s does not meet the key policy: %s. This key will not be added into LDAP.", fingerprintSHA256(userSSHKey), username, err.Error())
+			luc.stats.Counter(1.0, "keyPolicyRejected", 1)
+			continue
+		}
+
+		fingerprint := fingerprintSHA256(userSSHKey)
+		log.Debug("Loaded SSH key %s for user %s.", fingerprint, username)
+		userKeys = append(userKeys, userSSHKey)
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	if keyAges != nil {
+		luc.recordKeyAge(keyAges, attrs, username, len(userKeys))
+	}
+
+	userDefaultRole := luc.opts.DefaultRole
+	arns := []string{}
+	if luc.opts.EnableLDAPRoles {
+		memberOf := attrs.values("memberOf")
+		if luc.opts.MemberUidGroups {
+			memberOf = groupsByUid[username]
+		}
+		for _, groupDN := range memberOf {
+			log.Debug(groupDN)
+			arns = append(arns, groups[groupDN]...)
+		}
+		arns = dedupeStrings(luc.rewriteARNs(arns))
+		if luc.opts.DedupeARNsIgnoringCase {
+			arns = dedupeARNsIgnoringCase(arns)
+		}
+		if luc.trust != nil {
+			arns = luc.trustedARNs(username, arns)
+		}
+		var ok bool
+		if arns, ok = luc.allowedAccountARNs(username, arns); !ok {
+			return nil
+		}
+		userDefaultRole = luc.chooseDefaultRole(attrs, username, arns, memberOf, groups)
+	}
+	if !luc.opts.EnableLDAPRoles {
+		userDefaultRole = luc.rewriteARN(userDefaultRole)
+	}
+	if userDefaultRole != "" && len(luc.opts.AllowedAccounts) > 0 && !luc.accountAllowed(userDefaultRole) {
+		log.Warning("Not giving user %s the default role %s: its account is not allowed.", username, userDefaultRole)
+		userDefaultRole = ""
+	}
+
+	return &User{
+		SSHKeys:         userKeys,
+		KeyFingerprints: fingerprints,
+		Username:        canonicalUsername(username, luc.opts.UsernameCase),
+		ARNs:            arns,
+		DefaultRole:     userDefaultRole,
+		AllowedHours:    luc.allowedHours(attrs, username),
+		Source:          luc.opts.SourceLabel,
+		SessionTags:     luc.sessionTags(attrs, username),
+	}
+}
+
+/*
+trustedARNs removes the roles whose trust policy does not let Hologram
+assume them, so users get a clear authorization error instead of an STS
+AccessDenied later on.
+*/
+func (luc *ldapUserCache) trustedARNs(username string, arns []string) []string {
+	trusted := make([]string, 0, len(arns))
+	for _, arn := range arns {
+		if !luc.trust.trusts(arn) {
+			luc.stats.Counter(1.0, "ldapUntrustedRole", 1)
+			if !luc.opts.TrustWarnOnly {
+				log.Warning("Role %s does not trust %s; removing it from user %s.", arn, luc.opts.TrustPrincipal, username)
+				continue
 			}
-			for _, groupDN := range entry.GetAttributeValues("memberOf") {
-				log.Debug(groupDN)
-				arns = append(arns, luc.groups[groupDN]...)
+			log.Warning("Role %s granted to user %s does not trust %s.", arn, username, luc.opts.TrustPrincipal)
+		}
+		trusted = append(trusted, arn)
+	}
+	return trusted
+}
+
+/*
+findRoleOnlyMembers lists the group members that have no corresponding
+keyed user entry. Such members are granted roles but cannot authenticate,
+which usually points at a misconfigured access grant.
+*/
+func (luc *ldapUserCache) findRoleOnlyMembers(groupMembers map[string][]string, loadedDNs map[string]bool) []string {
+	seen := map[string]bool{}
+	roleOnly := []string{}
+	for groupDN, members := range groupMembers {
+		for _, member := range members {
+			if loadedDNs[strings.ToLower(member)] {
+				continue
+			}
+			log.Warning("%s is a member of %s but has no user entry with an SSH key.", member, groupDN)
+			if !seen[member] {
+				seen[member] = true
+				roleOnly = append(roleOnly, member)
 			}
 		}
+	}
 
-		luc.users[username] = &User{
-			SSHKeys:     userKeys,
-			Username:    username,
-			ARNs:        arns,
-			DefaultRole: userDefaultRole,
+	sort.Strings(roleOnly)
+	luc.stats.Gauge(1.0, "ldapRoleOnlyMembers", strconv.Itoa(len(roleOnly)))
+	return roleOnly
+}
+
+/*
+fetchGroups searches for role groups, returning the ARNs of each (with
+those of enclosing groups under Options.GroupNestingDepth), their
+members if asked to, and, under Options.MemberUidGroups, the groups that
+list each username by memberUid.
+*/
+func (luc *ldapUserCache) fetchGroups(ctx context.Context, withMembers bool) (map[string][]string, map[string][]string, map[string][]string, error) {
+	filter := "(objectClass=groupOfNames)"
+	groupAttributes := []string{luc.opts.RoleAttribute}
+	if withMembers {
+		groupAttributes = append(groupAttributes, "member")
+	}
+	if luc.opts.MemberUidGroups {
+		filter = "(|(objectClass=groupOfNames)(objectClass=posixGroup))"
+		groupAttributes = append(groupAttributes, "memberUid")
+	}
+	if luc.opts.GroupNestingDepth > 0 {
+		groupAttributes = append(groupAttributes, "memberOf")
+	}
+
+	groupSearchRequest := ldap.NewSearchRequest(
+		luc.opts.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false,
+		filter,
+		groupAttributes,
+		nil,
+	)
+
+	groupSearchResult, err := limitedSearchContext(ctx, luc.server, groupSearchRequest)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	groups := map[string][]string{}
+	groupMembers := map[string][]string{}
+	groupsByUid := map[string][]string{}
+	parents := map[string][]string{}
+	for _, entry := range groupSearchResult.Entries {
+		dn := entry.DN
+		attrs := luc.attributesOf(entry)
+		arns := attrs.values(luc.opts.RoleAttribute)
+		log.Debug("Adding %s to %s", arns, dn)
+		groups[dn] = arns
+		if withMembers {
+			groupMembers[dn] = attrs.values("member")
+		}
+		if luc.opts.MemberUidGroups {
+			for _, uid := range attrs.values("memberUid") {
+				groupsByUid[uid] = append(groupsByUid[uid], dn)
+			}
+		}
+		if luc.opts.GroupNestingDepth > 0 {
+			parents[dn] = attrs.values("memberOf")
+		}
+	}
+	if luc.opts.GroupNestingDepth > 0 {
+		groups = expandNestedGroups(groups, parents, luc.opts.GroupNestingDepth)
+	}
+	return groups, groupMembers, groupsByUid, nil
+}
+
+/*
+groupsFresh reports whether the group mapping was fetched recently enough
+to be reused under Options.GroupRefreshInterval.
+*/
+func (luc *ldapUserCache) groupsFresh(now time.Time) bool {
+	return luc.opts.GroupRefreshInterval > 0 && !luc.groupsFetchedAt.IsZero() &&
+		now.Sub(luc.groupsFetchedAt) < luc.opts.GroupRefreshInterval
+}
+
+/*
+RoleOnlyMembers returns the group members found by the most recent Update()
+that have no keyed user entry. It is only populated when
+Options.ReportRoleOnlyMembers is set.
+*/
+func (luc *ldapUserCache) RoleOnlyMembers() []string {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	return append([]string(nil), luc.roleOnlyMembers...)
+}
+
+/*
+findSharedExclusiveRoles maps each exclusive role held by more than one
+user to the (sorted) usernames holding it, alarming for every such role.
+*/
+func (luc *ldapUserCache) findSharedExclusiveRoles(users map[string]*User) map[string][]string {
+	holders := map[string][]string{}
+	for _, role := range luc.opts.ExclusiveRoles {
+		holders[role] = nil
+	}
+
+	for username, user := range users {
+		held := map[string]bool{}
+		if _, ok := holders[user.DefaultRole]; ok {
+			held[user.DefaultRole] = true
+		}
+		for _, arn := range user.ARNs {
+			if _, ok := holders[arn]; ok {
+				held[arn] = true
+			}
 		}
+		for role := range held {
+			holders[role] = append(holders[role], username)
+		}
+	}
 
-		log.Debug("Information on %s (re-)generated.", username)
+	shared := map[string][]string{}
+	for role, usernames := range holders {
+		if len(usernames) < 2 {
+			continue
+		}
+		sort.Strings(usernames)
+		log.Errorf("Exclusive role %s is held by %d users: %s", role, len(usernames), strings.Join(usernames, ", "))
+		luc.stats.Counter(1.0, "ldapExclusiveRoleShared", 1)
+		shared[role] = usernames
 	}
+	return shared
+}
 
-	log.Debug("LDAP information re-cached.")
-	luc.stats.Timing(1.0, "ldapCacheUpdate", time.Since(start))
+/*
+SharedExclusiveRoles returns the exclusive roles that the most recent
+Update() found held by more than one user, with the users holding them.
+*/
+func (luc *ldapUserCache) SharedExclusiveRoles() map[string][]string {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	shared := make(map[string][]string, len(luc.sharedExclusive))
+	for role, usernames := range luc.sharedExclusive {
+		shared[role] = append([]string(nil), usernames...)
+	}
+	return shared
+}
+
+/*
+Reconfigure replaces the cache's options and rebuilds every user under
+them, for example to switch LDAP roles on or off without a restart. The
+users are rebuilt into a separate cache, as DryRunUpdate does, and the new
+options and users are swapped in together only if that succeeds; otherwise
+the live cache is left as it was and the error is returned.
+*/
+func (luc *ldapUserCache) Reconfigure(opts Options) error {
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	luc.updating.Lock()
+	defer luc.updating.Unlock()
+
+	// Only Update() writes users and removedKeys, and we hold it off, so
+	// the candidate can start from them without a lock. It needs them to
+	// keep removed keys in their grace period.
+	candidate := &ldapUserCache{
+		users:       luc.users,
+		groups:      map[string][]string{},
+		removedKeys: luc.removedKeys,
+		server:      luc.server,
+		stats:       luc.stats,
+	}
+	candidate.applyOptions(opts)
+	start := candidate.opts.Clock.Now()
+	loaded, err := candidate.update(context.Background(), start)
+	luc.recordRefresh(start, loaded, err)
+	if err != nil {
+		log.Warning("Could not apply the new LDAP cache configuration: %s", err.Error())
+		return err
+	}
+
+	luc.mu.Lock()
+	luc.opts = candidate.opts
+	luc.trust = candidate.trust
+	luc.breaker = candidate.breaker
+	luc.missRefreshes = candidate.missRefreshes
+	luc.removedKeys = candidate.removedKeys
+	luc.users = candidate.users
+	luc.groups = candidate.groups
+	luc.groupMembers = candidate.groupMembers
+	luc.groupsByUid = candidate.groupsByUid
+	luc.groupsFetchedAt = candidate.groupsFetchedAt
+	luc.keysByFingerprint = candidate.keysByFingerprint
+	luc.contentHash = candidate.contentHash
+	luc.keyAges = candidate.keyAges
+	luc.roleOnlyMembers = candidate.roleOnlyMembers
+	luc.sharedExclusive = candidate.sharedExclusive
+	luc.lastRefreshAttempt = start
+	luc.lastUpdate = start
+	luc.lastRefreshErr = nil
+	luc.mu.Unlock()
+
+	log.Info("LDAP cache reconfigured (LDAP roles enabled: %t).", opts.EnableLDAPRoles)
 	return nil
 }
 
+/*
+DryRunUpdate loads users the way Update() would under opts and returns
+them sorted by username, leaving the live cache and its options alone.
+*/
+func (luc *ldapUserCache) DryRunUpdate(opts Options) ([]*User, error) {
+	if opts.Clock == nil {
+		opts.Clock = luc.opts.Clock
+	}
+	candidate := &ldapUserCache{
+		users:  map[string]*User{},
+		groups: map[string][]string{},
+		server: luc.server,
+		stats:  g2s.Noop(),
+	}
+	candidate.applyOptions(opts)
+	if err := candidate.Update(); err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(candidate.users))
+	for _, user := range candidate.users {
+		users = append(users, user)
+	}
+	sort.Sort(usersByName(users))
+	return users, nil
+}
+
+type usersByName []*User
+
+func (u usersByName) Len() int           { return len(u) }
+func (u usersByName) Less(i, j int) bool { return u[i].Username < u[j].Username }
+func (u usersByName) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+/*
+applyOptions installs opts along with the helpers they call for.
+*/
+func (luc *ldapUserCache) applyOptions(opts Options) {
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	if opts.SourceLabel == "" {
+		opts.SourceLabel = "ldap"
+	}
+	if opts.PageSize == 0 {
+		opts.PageSize = DefaultPageSize
+	}
+	if opts.Verifier == nil {
+		opts.Verifier = SoftwareVerifier{}
+	}
+	if opts.UpdateTimeout <= 0 {
+		opts.UpdateTimeout = DefaultUpdateTimeout
+	}
+	switch opts.FingerprintConflictPolicy {
+	case ConflictFirst, ConflictMostPermissive, ConflictLeastPermissive, ConflictReject:
+	default:
+		if opts.FingerprintConflictPolicy != "" {
+			log.Warning("Unknown fingerprint conflict policy %q; using %q.", opts.FingerprintConflictPolicy, ConflictFirst)
+		}
+		opts.FingerprintConflictPolicy = ConflictFirst
+	}
+	luc.opts = opts
+	luc.groupsFetchedAt = time.Time{}
+
+	luc.trust = nil
+	if opts.TrustIAM != nil {
+		luc.trust = newTrustChecker(opts.TrustIAM, opts.TrustAccount, opts.TrustPrincipal, opts.TrustCacheTTL, opts.Clock)
+	}
+	luc.breaker = nil
+	if opts.RefreshBreakerThreshold > 0 {
+		luc.breaker = newRefreshBreaker(opts.RefreshBreakerThreshold, opts.RefreshBreakerCooldown, opts.Clock, luc.stats)
+	}
+	luc.missRefreshes = nil
+	if opts.MissRefreshRate > 0 {
+		burst := opts.MissRefreshBurst
+		if burst < 1 {
+			burst = 1
+		}
+		luc.missRefreshes = NewTokenBucketLimiter(opts.MissRefreshRate, burst, opts.Clock)
+	}
+}
+
+/*
+RefreshBreakerState returns the state of the cache-miss refresh breaker,
+one of BreakerClosed, BreakerOpen or BreakerHalfOpen. Without a breaker
+configured it is always BreakerClosed.
+*/
+func (luc *ldapUserCache) RefreshBreakerState() string {
+	_, breaker, _ := luc.refreshSettings()
+	if breaker == nil {
+		return BreakerClosed
+	}
+	return breaker.currentState()
+}
+
+/*
+refreshSettings returns the options and the helpers built from them,
+which Reconfigure() may swap out, for code that does not hold mu.
+*/
+func (luc *ldapUserCache) refreshSettings() (Options, *refreshBreaker, *TokenBucketLimiter) {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	return luc.opts, luc.breaker, luc.missRefreshes
+}
+
+/*
+options returns the options, for code that does not hold mu.
+*/
+func (luc *ldapUserCache) options() Options {
+	opts, _, _ := luc.refreshSettings()
+	return opts
+}
+
+/*
+allowedHours reads the window during which the user may authenticate. A
+value that cannot be understood locks the user out rather than leaving
+them unrestricted.
+*/
+func (luc *ldapUserCache) allowedHours(attrs entryAttributes, username string) *HourWindow {
+	if luc.opts.AllowedHoursAttr == "" {
+		return nil
+	}
+	hours := attrs.value(luc.opts.AllowedHoursAttr)
+	if hours == "" {
+		return nil
+	}
+
+	window, err := parseHourWindow(hours, attrs.value(luc.opts.TimezoneAttr))
+	if err != nil {
+		log.Warning("Could not read the allowed hours of user %s, who will not be able to authenticate: %s", username, err.Error())
+		return &HourWindow{Location: time.UTC}
+	}
+	return window
+}
+
+/*
+curveApproved checks an ECDSA key against the configured curve list and
+returns the key's curve name alongside the verdict. Keys that are not ECDSA
+are always approved here.
+*/
+func (luc *ldapUserCache) curveApproved(key ssh.PublicKey) (string, bool) {
+	if len(luc.opts.ApprovedCurves) == 0 {
+		return "", true
+	}
+
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return "", true
+	}
+	ecdsaKey, ok := cryptoKey.CryptoPublicKey().(*ecdsa.PublicKey)
+	if !ok {
+		return "", true
+	}
+
+	curve := ecdsaKey.Curve.Params().Name
+	for _, approved := range luc.opts.ApprovedCurves {
+		if approved == curve {
+			return curve, true
+		}
+	}
+	return curve, false
+}
+
+/*
+recordKeyAge adds an entry's keys to the key age histogram and emits their
+age as a timing stat, so that statsd can build the fleet-wide distribution.
+*/
+func (luc *ldapUserCache) recordKeyAge(keyAges *KeyAgeDistribution, attrs entryAttributes, username string, keyCount int) {
+	created, ok := parseKeyCreated(attrs.value(luc.opts.KeyCreatedAttr))
+	if !ok {
+		log.Debug("No usable key creation time for user %s.", username)
+		keyAges.Unknown += keyCount
+		luc.stats.Counter(1.0, "ldapKeyAgeUnknown", keyCount)
+		return
+	}
+
+	age := luc.opts.Clock.Now().Sub(created)
+	keyAges.add(age, keyCount)
+	for i := 0; i < keyCount; i++ {
+		luc.stats.Timing(1.0, "ldapKeyAge", age)
+	}
+}
+
+/*
+KeyAgeDistribution returns the key age histogram built by the most recent
+Update(), or nil if no key creation attribute is configured.
+*/
+func (luc *ldapUserCache) KeyAgeDistribution() *KeyAgeDistribution {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	if luc.keyAges == nil {
+		return nil
+	}
+
+	distribution := *luc.keyAges
+	distribution.Buckets = append([]KeyAgeBucket(nil), luc.keyAges.Buckets...)
+	return &distribution
+}
+
+/*
+Groups returns a copy of the group DN to role ARN mapping resolved by the
+most recent Update(). It is only populated with LDAP roles enabled.
+*/
+func (luc *ldapUserCache) Groups() map[string][]string {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	groups := make(map[string][]string, len(luc.groups))
+	for dn, arns := range luc.groups {
+		groups[dn] = append([]string(nil), arns...)
+	}
+	return groups
+}
+
+/*
+Users returns a copy of the users loaded by the most recent Update().
+Changing it or the users in it does not change the cache.
+*/
 func (luc *ldapUserCache) Users() map[string]*User {
-	return luc.users
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	return copyUsers(luc.users)
 }
 
-func (luc *ldapUserCache) _verify(username string, challenge []byte, sshSig *ssh.Signature) (
-	*User, error) {
+/*
+Lookup returns a copy of the user loaded under username, after the same
+realm and case normalization as Authenticate.
+*/
+func (luc *ldapUserCache) Lookup(username string) (*User, bool) {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	user, ok := luc.users[luc.normalizeUsername(username)]
+	if !ok {
+		return nil, false
+	}
+	return copyUser(user), true
+}
+
+/*
+_verify finds the user whose key made the signature. It holds the read
+lock throughout, so it must not call Update().
+*/
+func (luc *ldapUserCache) _verify(username string, challenge []byte, sshSig *ssh.Signature, hint ssh.PublicKey) (
+	*User, ssh.PublicKey) {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	now := luc.opts.Clock.Now()
+
+	// A certificate from a trusted CA names its user as a principal.
+	if cert, ok := hint.(*ssh.Certificate); ok && len(luc.opts.TrustedUserCAs) > 0 {
+		if user := luc.verifyAuthorityCert(cert, challenge, sshSig, now); user != nil {
+			return user, cert
+		}
+	}
+
+	// A client that says which key it signed with needs a single Verify.
+	if hint != nil {
+		if user, key, indexed := luc.verifyHintedKey(hint, challenge, sshSig, now); indexed {
+			return user, key
+		}
+	}
+
+	// Try the named user's keys first, before falling back to every key.
+	if user, ok := luc.users[luc.normalizeUsername(username)]; ok {
+		if key := luc.verifyUserKey(user, challenge, sshSig, now); key != nil {
+			return luc.keyOwner(user, key), key
+		}
+	}
+
 	for _, user := range luc.users {
-		for _, key := range user.SSHKeys {
-			verifyErr := key.Verify(challenge, sshSig)
-			if verifyErr == nil {
-				return user, nil
-			}
+		if key := luc.verifyUserKey(user, challenge, sshSig, now); key != nil {
+			return luc.keyOwner(user, key), key
 		}
 	}
 
-	return nil, nil
+	return luc.verifyRemovedKey(challenge, sshSig, now)
 }
 
 /*
+verifyUserKey returns the first of user's keys that verifies the
+signature, or nil if none does.
+*/
+func (luc *ldapUserCache) verifyUserKey(user *User, challenge []byte, sshSig *ssh.Signature, now time.Time) ssh.PublicKey {
+	for _, key := range user.SSHKeys {
+		if luc.verifyKey(user, key, challenge, sshSig, now) {
+			return key
+		}
+	}
+	return nil
+}
 
+/*
+verifyKey checks the signature against one of user's keys.
+*/
+func (luc *ldapUserCache) verifyKey(user *User, key ssh.PublicKey, challenge []byte, sshSig *ssh.Signature, now time.Time) bool {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if err := checkCertValidity(cert, now, luc.opts.MaxCertLifetime); err != nil {
+			log.Debug("Skipping certificate for user %s: %s", user.Username, err.Error())
+			return false
+		}
+	}
+
+	if luc.opts.StrictEd25519 {
+		if err := checkStrictEd25519(key, sshSig); err != nil {
+			return false
+		}
+	}
+
+	return luc.opts.Verifier.Verify(key, challenge, sshSig) == nil
+}
+
+/*
+keyOwner returns the user that a key verified under user authenticates
+as, which differs from user when several users hold the key. It returns
+nil for keys rejected as ambiguous.
+*/
+func (luc *ldapUserCache) keyOwner(user *User, key ssh.PublicKey) *User {
+	if luc.keysByFingerprint == nil {
+		return user
+	}
+	owner, rejected := luc.keysByFingerprint.lookup(key)
+	if rejected {
+		log.Warning("Refusing to authenticate %s with a key shared by users with different roles.", user.Username)
+		return nil
+	}
+	if owner == nil {
+		return user
+	}
+	return owner
+}
+
+/*
+normalizeUsername strips the first configured realm suffix that matches
+the end of username, ignoring case, so that a principal such as
+jdoe@CORP.EXAMPLE.COM finds the user stored as jdoe. The rest is put in
+Options.UsernameCase.
+*/
+func (luc *ldapUserCache) normalizeUsername(username string) string {
+	for _, suffix := range luc.opts.RealmSuffixes {
+		if len(username) > len(suffix) && strings.EqualFold(username[len(username)-len(suffix):], suffix) {
+			username = username[:len(username)-len(suffix)]
+			break
+		}
+	}
+	return canonicalUsername(username, luc.opts.UsernameCase)
+}
+
+/*
  */
 func (luc *ldapUserCache) Authenticate(username string, challenge []byte, sshSig *ssh.Signature) (
 	*User, error) {
+	return luc.AuthenticateKey(username, challenge, sshSig, nil)
+}
+
+/*
+AuthenticateKey authenticates like Authenticate, given the public key the
+client says it signed with. The key is looked up by fingerprint so that
+only it is tried; keys the cache does not know fall back to trying every
+key.
+*/
+func (luc *ldapUserCache) AuthenticateKey(username string, challenge []byte, sshSig *ssh.Signature, hint ssh.PublicKey) (
+	*User, error) {
+	user, key, err := luc.authenticate(username, challenge, sshSig, hint)
+	luc.recordEvent(username, user, key, err)
+	if user != nil && err == nil {
+		luc.countKeyType(key)
+	}
+	return user, err
+}
+
+/*
+countKeyType counts a successful authentication against the algorithm of
+the key that made it, to show how much traffic still uses weak key types.
+*/
+func (luc *ldapUserCache) countKeyType(key ssh.PublicKey) {
+	if key != nil {
+		luc.stats.Counter(1.0, "authByKeyType."+statName(key.Type()), 1)
+	}
+}
+
+/*
+ContentHash returns a digest of the users loaded by the last successful
+Update(), for comparing caches across servers.
+*/
+func (luc *ldapUserCache) ContentHash() string {
+	luc.mu.RLock()
+	defer luc.mu.RUnlock()
+	return luc.contentHash
+}
+
+/*
+RoleUsage returns how many times each role has been authorized for a
+credential request, keyed by the requested ARN.
+*/
+func (luc *ldapUserCache) RoleUsage() map[string]int {
+	return luc.roleUsage.snapshot()
+}
+
+/*
+authenticate verifies the signature without counting role usage, which
+is left to AuthorizeRole, where the requested role is known.
+*/
+func (luc *ldapUserCache) authenticate(username string, challenge []byte, sshSig *ssh.Signature, hint ssh.PublicKey) (
+	*User, ssh.PublicKey, error) {
+	clock := luc.options().Clock
+	start := clock.Now()
+	defer func() {
+		luc.stats.Timing(1.0, "authLatency", clock.Now().Sub(start))
+	}()
+
+	if err := validateAuthenticateInput(challenge, sshSig); err != nil {
+		luc.stats.Counter(1.0, "malformedRequest", 1)
+		return nil, nil, err
+	}
+
+	luc.refreshIfStale()
+	user, key := luc.verifyOrRefresh(username, challenge, sshSig, hint)
+	if user != nil && user.AllowedHours != nil && !user.AllowedHours.Contains(clock.Now()) {
+		log.Warning("User %s tried to authenticate outside of their allowed hours.", user.Username)
+		luc.stats.Counter(1.0, "outsideAllowedHours", 1)
+		return nil, key, ErrOutsideAllowedHours
+	}
+	return user, key, nil
+}
+
+func (luc *ldapUserCache) verifyOrRefresh(username string, challenge []byte, sshSig *ssh.Signature, hint ssh.PublicKey) (
+	*User, ssh.PublicKey) {
 	// Loop through all of the keys and attempt verification.
-	retUser, _ := luc._verify(username, challenge, sshSig)
+	retUser, retKey := luc._verify(username, challenge, sshSig, hint)
 
 	if retUser == nil {
 		log.Debug("Could not find %s in the LDAP cache; updating from the server.", username)
 		luc.stats.Counter(1.0, "ldapCacheMiss", 1)
 
-		// We should update LDAP cache again to retry keys.
-		luc.Update()
-		return luc._verify(username, challenge, sshSig)
+		// We should update LDAP cache again to retry keys, unless the
+		// directory has been failing and the breaker is holding off.
+		opts, breaker, missRefreshes := luc.refreshSettings()
+		if !luc.claimRefresh(opts.Clock.Now()) {
+			log.Debug("The cache was refreshed moments ago; not refreshing it again for %s.", username)
+			return nil, nil
+		}
+		if missRefreshes != nil && !missRefreshes.Allow("") {
+			log.Debug("Too many refreshes on cache misses; not refreshing for %s.", username)
+			luc.stats.Counter(1.0, "ldapCacheMissRefreshThrottled", 1)
+			return nil, nil
+		}
+		if breaker != nil && !breaker.allow() {
+			log.Debug("Refresh breaker is open; serving %s from the stale cache.", username)
+			return nil, nil
+		}
+		err := luc.updateWithTimeout()
+		if breaker != nil {
+			breaker.record(err)
+		}
+		if err != nil {
+			// The cache is untouched by a failed Update(), so keep going
+			// with it rather than failing everyone while LDAP is away.
+			log.Warning("Could not refresh the LDAP cache; verifying %s against the cached users: %s", username, err.Error())
+			luc.stats.Counter(1.0, "ldapCacheMissRefreshFailed", 1)
+		}
+		return luc._verify(username, challenge, sshSig, hint)
 	}
-	return retUser, nil
+	return retUser, retKey
 }
 
 /*
-	NewLDAPUserCache returns a properly-configured LDAP cache.
+parseSSHKeyValue parses one value of the SSH key attribute. Values holding
+an authorized_keys line, recognised by a key type among their fields (after
+any options), go to the authorized_keys parser. A base64 key followed by a
+comment but no key type has the comment dropped. Anything else is taken to
+be a base64-encoded wire-format key.
+*/
+func parseSSHKeyValue(value string) (ssh.PublicKey, error) {
+	raw := value
+	value = strings.TrimSpace(value)
+	fields := strings.Fields(value)
+	for _, field := range fields {
+		if authorizedKeyTypes[field] {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+			return key, err
+		}
+	}
+	if len(fields) > 1 {
+		if keyBytes, err := base64.StdEncoding.DecodeString(fields[0]); err == nil {
+			if key, err := ssh.ParsePublicKey(keyBytes); err == nil {
+				return key, nil
+			}
+		}
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		// Binary-tagged attributes may hold the wire format unencoded.
+		if key, rawErr := ssh.ParsePublicKey([]byte(raw)); rawErr == nil {
+			return key, nil
+		}
+		return nil, err
+	}
+	return ssh.ParsePublicKey(keyBytes)
+}
+
+/*
+validateAuthenticateInput rejects requests that no key could verify, so
+that they are not checked against every key in the cache.
+*/
+func validateAuthenticateInput(challenge []byte, sshSig *ssh.Signature) error {
+	if len(challenge) == 0 {
+		log.Warning("Rejecting authentication request with an empty challenge.")
+		return ErrMalformedRequest
+	}
+	if sshSig == nil || len(sshSig.Blob) == 0 {
+		log.Warning("Rejecting authentication request without a signature.")
+		return ErrMalformedRequest
+	}
+	if !knownSignatureFormats[sshSig.Format] {
+		log.Warning("Rejecting authentication request with unknown signature format %q.", sshSig.Format)
+		return ErrMalformedRequest
+	}
+	return nil
+}
+
+/*
+NewLDAPUserCache returns a properly-configured LDAP cache. It is kept for
+existing callers; NewLDAPUserCacheWith is easier to get right.
 */
 func NewLDAPUserCache(server LDAPImplementation, stats g2s.Statter, userAttr string, sshAttr string, baseDN string, enableLDAPRoles bool, roleAttribute string, defaultRole string, defaultRoleAttr string) (*ldapUserCache, error) {
+	return NewLDAPUserCacheWith(server, stats,
+		WithUserAttr(userAttr),
+		WithSSHAttr(sshAttr),
+		WithBaseDN(baseDN),
+		func(opts *Options) {
+			opts.EnableLDAPRoles = enableLDAPRoles
+			opts.RoleAttribute = roleAttribute
+		},
+		WithDefaultRole(defaultRole),
+		WithDefaultRoleAttr(defaultRoleAttr),
+	)
+}
+
+/*
+NewLDAPUserCacheWithOptions returns an LDAP cache configured from opts.
+*/
+func NewLDAPUserCacheWithOptions(server LDAPImplementation, stats g2s.Statter, opts Options) (*ldapUserCache, error) {
+	if err := validateOptions(opts); err != nil {
+		log.Errorf("Invalid LDAP cache configuration: %s", err.Error())
+		return nil, err
+	}
 	retCache := &ldapUserCache{
-		users:           map[string]*User{},
-		groups:          map[string][]string{},
-		server:          server,
-		stats:           stats,
-		userAttr:        userAttr,
-		sshAttr:         sshAttr,
-		baseDN:          baseDN,
-		enableLDAPRoles: enableLDAPRoles,
-		roleAttribute:   roleAttribute,
-		defaultRole:     defaultRole,
-		defaultRoleAttr: defaultRoleAttr,
+		users:  map[string]*User{},
+		groups: map[string][]string{},
+		server: server,
+		stats:  stats,
+	}
+	retCache.applyOptions(opts)
+	retCache.roleUsage = newRoleUsage(opts.RoleUsageLimit, stats)
+	retCache.events = newEventRing(opts.RecentEventsSize)
+	retCache.refreshes = newRefreshHistory(opts.RefreshHistorySize)
+
+	if opts.SelfTest {
+		if err := retCache.SelfTest(); err != nil {
+			log.Errorf("Verification self-test failed: %s", err.Error())
+			return nil, err
+		}
+		log.Debug("Verification self-test passed.")
 	}
 
 	updateError := retCache.Update()
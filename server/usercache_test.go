@@ -15,12 +15,19 @@
 package server_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	cryptrand "crypto/rand"
 	"encoding/base64"
+	"errors"
 	"math/rand"
 	"net"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/hologram/server"
 	"github.com/nmcclain/ldap"
@@ -90,6 +97,132 @@ func (*StubLDAPServer) Modify(*ldap.ModifyRequest) error {
 	return nil
 }
 
+/*
+FixtureLDAPServer serves a fixed directory, answering group searches with
+Groups and every other search with Users.
+*/
+type FixtureLDAPServer struct {
+	Users    []*ldap.Entry
+	Groups   []*ldap.Entry
+	Err      error
+	Searches int
+}
+
+func (fls *FixtureLDAPServer) Search(s *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	fls.Searches++
+	if fls.Err != nil {
+		return nil, fls.Err
+	}
+	if strings.Contains(s.Filter, "groupOfNames") {
+		return &ldap.SearchResult{Entries: fls.Groups}, nil
+	}
+	return &ldap.SearchResult{Entries: presentEntries(fls.Users, s.Filter)}, nil
+}
+
+var presenceTerm = regexp.MustCompile(`\(([^()=|&!]+)=\*\)`)
+
+/*
+presentEntries applies a filter made only of presence terms, such as
+"(sshPublicKey=*)" or "(|(uid=*)(cn=*))", keeping the entries that have any
+of the attributes. Other filters match every entry.
+*/
+func presentEntries(entries []*ldap.Entry, filter string) []*ldap.Entry {
+	terms := presenceTerm.FindAllStringSubmatch(filter, -1)
+	if len(terms) == 0 || strings.Trim(presenceTerm.ReplaceAllString(filter, ""), "(|)") != "" {
+		return entries
+	}
+	present := []*ldap.Entry{}
+	for _, entry := range entries {
+		for _, term := range terms {
+			if hasAttribute(entry, term[1]) {
+				present = append(present, entry)
+				break
+			}
+		}
+	}
+	return present
+}
+
+// hasAttribute matches attribute names as LDAP does, ignoring case and options.
+func hasAttribute(entry *ldap.Entry, name string) bool {
+	for _, attribute := range entry.Attributes {
+		if strings.EqualFold(strings.SplitN(attribute.Name, ";", 2)[0], name) && len(attribute.Values) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (*FixtureLDAPServer) Modify(*ldap.ModifyRequest) error {
+	return nil
+}
+
+func fixtureEntry(dn string, attributes map[string][]string) *ldap.Entry {
+	entry := &ldap.Entry{DN: dn}
+	for name, values := range attributes {
+		entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{
+			Name:   name,
+			Values: values,
+		})
+	}
+	return entry
+}
+
+// fakeClock is a server.Clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+// recordingStatter is a g2s.Statter that counts what it is sent.
+type recordingStatter struct {
+	sync.Mutex
+	counters map[string]int
+	gauges   map[string]string
+}
+
+func newRecordingStatter() *recordingStatter {
+	return &recordingStatter{counters: map[string]int{}, gauges: map[string]string{}}
+}
+
+func (rs *recordingStatter) Counter(sampleRate float32, bucket string, n ...int) {
+	rs.Lock()
+	defer rs.Unlock()
+	for _, count := range n {
+		rs.counters[bucket] += count
+	}
+}
+
+func (rs *recordingStatter) Timing(sampleRate float32, bucket string, d ...time.Duration) {}
+
+func (rs *recordingStatter) Gauge(sampleRate float32, bucket string, value ...string) {
+	rs.Lock()
+	defer rs.Unlock()
+	for _, v := range value {
+		rs.gauges[bucket] = v
+	}
+}
+
+func (rs *recordingStatter) Count(bucket string) int {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.counters[bucket]
+}
+
+// GaugeValue returns the last value sent to a gauge, or "" if none was.
+func (rs *recordingStatter) GaugeValue(bucket string) string {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.gauges[bucket]
+}
+
 func randomBytes(length int) []byte {
 	buf := make([]byte, length)
 
@@ -218,3 +351,1471 @@ func TestLDAPUserCache(t *testing.T) {
 		})
 	})
 }
+
+/*
+newECDSASigner generates a throwaway ECDSA key on the given curve and
+returns a signer for it along with its base64 wire encoding, the way it
+would be stored in LDAP.
+*/
+func newECDSASigner(curve elliptic.Curve) (ssh.Signer, string) {
+	privateKey, err := ecdsa.GenerateKey(curve, cryptrand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		panic(err)
+	}
+	return signer, base64.StdEncoding.EncodeToString(signer.PublicKey().Marshal())
+}
+
+func TestLDAPUserCacheApprovedCurves(t *testing.T) {
+	Convey("Given an LDAP user cache that only approves P-256 and P-384", t, func() {
+		approvedSigner, approvedKey := newECDSASigner(elliptic.P256())
+		rejectedSigner, rejectedKey := newECDSASigner(elliptic.P521())
+
+		s := &StubLDAPServer{
+			Keys: []string{approvedKey, rejectedKey},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:       "cn",
+			SSHAttr:        "sshPublicKey",
+			BaseDN:         "dc=testdn,dc=com",
+			ApprovedCurves: []string{"P-256", "P-384"},
+		})
+		So(err, ShouldBeNil)
+		So(lc, ShouldNotBeNil)
+
+		Convey("It should only load the key on an approved curve", func() {
+			So(lc.Users()["testuser"].SSHKeys, ShouldHaveLength, 1)
+		})
+
+		Convey("It should authenticate with the approved key", func() {
+			challenge := randomBytes(64)
+			sig, err := approvedSigner.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			verifiedUser, err := lc.Authenticate("testuser", challenge, sig)
+			So(err, ShouldBeNil)
+			So(verifiedUser, ShouldNotBeNil)
+		})
+
+		Convey("It should not authenticate with the disallowed-curve key", func() {
+			challenge := randomBytes(64)
+			sig, err := rejectedSigner.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			verifiedUser, _ := lc.Authenticate("testuser", challenge, sig)
+			So(verifiedUser, ShouldBeNil)
+		})
+	})
+}
+
+func TestLDAPUserCacheKeyAges(t *testing.T) {
+	Convey("Given LDAP users whose keys were created at different times", t, func() {
+		created := func(age time.Duration) []string {
+			return []string{time.Now().Add(-age).UTC().Format("20060102150405Z")}
+		}
+		day := 24 * time.Hour
+
+		_, fresh := newECDSASigner(elliptic.P256())
+		_, older := newECDSASigner(elliptic.P256())
+		_, ancient := newECDSASigner(elliptic.P256())
+		_, secondAncient := newECDSASigner(elliptic.P256())
+		_, undated := newECDSASigner(elliptic.P256())
+
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=fresh", map[string][]string{
+					"cn": {"fresh"}, "sshPublicKey": {fresh}, "sshKeyCreated": created(10 * day),
+				}),
+				fixtureEntry("cn=older", map[string][]string{
+					"cn": {"older"}, "sshPublicKey": {older}, "sshKeyCreated": created(100 * day),
+				}),
+				fixtureEntry("cn=ancient", map[string][]string{
+					"cn": {"ancient"}, "sshPublicKey": {ancient, secondAncient}, "sshKeyCreated": created(400 * day),
+				}),
+				fixtureEntry("cn=undated", map[string][]string{
+					"cn": {"undated"}, "sshPublicKey": {undated},
+				}),
+			},
+		}
+
+		Convey("When a key creation attribute is configured", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttr:       "cn",
+				SSHAttr:        "sshPublicKey",
+				KeyCreatedAttr: "sshKeyCreated",
+			})
+			So(err, ShouldBeNil)
+
+			Convey("It should bucket every dated key by age", func() {
+				distribution := lc.KeyAgeDistribution()
+				So(distribution, ShouldNotBeNil)
+				So(distribution.Buckets, ShouldHaveLength, 5)
+				So(distribution.Buckets[0].Count, ShouldEqual, 1)
+				So(distribution.Buckets[1].Count, ShouldEqual, 0)
+				So(distribution.Buckets[2].Count, ShouldEqual, 1)
+				So(distribution.Buckets[3].Count, ShouldEqual, 0)
+				So(distribution.Buckets[4].Count, ShouldEqual, 2)
+			})
+
+			Convey("It should count undated keys separately", func() {
+				So(lc.KeyAgeDistribution().Unknown, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When no key creation attribute is configured", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttr: "cn",
+				SSHAttr:  "sshPublicKey",
+			})
+			So(err, ShouldBeNil)
+
+			Convey("There should be no distribution", func() {
+				So(lc.KeyAgeDistribution(), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestLDAPUserCacheRoleOnlyMembers(t *testing.T) {
+	Convey("Given a role group with a member who has no keyed user entry", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=keyed,dc=testdn,dc=com", map[string][]string{
+					"cn": {"keyed"}, "sshPublicKey": {key}, "memberOf": {"cn=admins,dc=testdn,dc=com"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=admins,dc=testdn,dc=com", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/admin"},
+					"member":           {"cn=keyed,dc=testdn,dc=com", "cn=keyless,dc=testdn,dc=com"},
+				}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+		}
+
+		Convey("When the cross-reference is enabled", func() {
+			opts.ReportRoleOnlyMembers = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+
+			Convey("It should report only the keyless member", func() {
+				So(lc.RoleOnlyMembers(), ShouldResemble, []string{"cn=keyless,dc=testdn,dc=com"})
+			})
+		})
+
+		Convey("When the cross-reference is disabled", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+
+			Convey("It should report nothing", func() {
+				So(lc.RoleOnlyMembers(), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestLDAPUserCacheFoldAttributeNames(t *testing.T) {
+	Convey("Given a directory that returns attribute names in inconsistent case", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"CN": {"testuser"}, "sshpublickey": {key},
+				}),
+			},
+		}
+		opts := server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"}
+
+		Convey("Without folding the user's values are missed", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"], ShouldBeNil)
+		})
+
+		Convey("With folding the user and key are loaded", func() {
+			opts.FoldAttributeNames = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"], ShouldNotBeNil)
+			So(lc.Users()["testuser"].SSHKeys, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestLDAPUserCacheExclusiveRoles(t *testing.T) {
+	Convey("Given two users who share a role marked exclusive", t, func() {
+		_, firstKey := newECDSASigner(elliptic.P256())
+		_, secondKey := newECDSASigner(elliptic.P256())
+		exclusive := "arn:aws:iam::123456789012:role/deployer"
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=first", map[string][]string{
+					"cn": {"first"}, "sshPublicKey": {firstKey}, "employeeType": {exclusive},
+				}),
+				fixtureEntry("cn=second", map[string][]string{
+					"cn": {"second"}, "sshPublicKey": {secondKey}, "memberOf": {"cn=deployers"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=deployers", map[string][]string{
+					"businessCategory": {exclusive},
+				}),
+			},
+		}
+
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			DefaultRoleAttr: "employeeType",
+			ExclusiveRoles:  []string{exclusive, "arn:aws:iam::123456789012:role/unused"},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("It should report the shared role and both holders", func() {
+			So(lc.SharedExclusiveRoles(), ShouldResemble, map[string][]string{
+				exclusive: {"first", "second"},
+			})
+		})
+	})
+}
+
+func TestLDAPUserCacheRealmSuffixes(t *testing.T) {
+	Convey("Given two users who share a key", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=jdoe", map[string][]string{"cn": {"jdoe"}, "sshPublicKey": {key}}),
+				fixtureEntry("cn=jdoe-admin", map[string][]string{"cn": {"jdoe-admin"}, "sshPublicKey": {key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:      "cn",
+			SSHAttr:       "sshPublicKey",
+			RealmSuffixes: []string{"@CORP.EXAMPLE.COM"},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("A principal with a configured realm should resolve to the short name", func() {
+			for i := 0; i < 20; i++ {
+				challenge := randomBytes(64)
+				sig, err := signer.Sign(cryptrand.Reader, challenge)
+				So(err, ShouldBeNil)
+				user, err := lc.Authenticate("jdoe@corp.example.com", challenge, sig)
+				So(err, ShouldBeNil)
+				So(user.Username, ShouldEqual, "jdoe")
+			}
+		})
+	})
+}
+
+func TestLDAPUserCacheUsernameCase(t *testing.T) {
+	Convey("Given users stored in mixed case who share a key", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=Jdoe", map[string][]string{"cn": {"Jdoe"}, "sshPublicKey": {key}}),
+				fixtureEntry("cn=jdoe-admin", map[string][]string{"cn": {"jdoe-admin"}, "sshPublicKey": {key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:     "cn",
+			SSHAttr:      "sshPublicKey",
+			UsernameCase: server.UsernameLower,
+		})
+		So(err, ShouldBeNil)
+		searches := s.Searches
+
+		Convey("Usernames should be stored in lower case", func() {
+			So(lc.Users(), ShouldContainKey, "jdoe")
+			So(lc.Users(), ShouldNotContainKey, "Jdoe")
+			So(lc.Users()["jdoe"].Username, ShouldEqual, "jdoe")
+		})
+
+		Convey("A mixed-case request should hit the cache", func() {
+			for i := 0; i < 20; i++ {
+				challenge := randomBytes(64)
+				sig, err := signer.Sign(cryptrand.Reader, challenge)
+				So(err, ShouldBeNil)
+				user, err := lc.Authenticate("JDoe", challenge, sig)
+				So(err, ShouldBeNil)
+				So(user.Username, ShouldEqual, "jdoe")
+			}
+			So(s.Searches, ShouldEqual, searches)
+		})
+	})
+}
+
+func TestLDAPUserCacheLookup(t *testing.T) {
+	Convey("Given an LDAP cache with one user", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=jdoe", map[string][]string{
+					"cn": {"jdoe"}, "sshPublicKey": {key}, "memberOf": {"cn=developers"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer"},
+				}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			RealmSuffixes:   []string{"@CORP.EXAMPLE.COM"},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Lookup should find the user by name or principal", func() {
+			user, ok := lc.Lookup("jdoe")
+			So(ok, ShouldBeTrue)
+			So(user.SSHKeys, ShouldHaveLength, 1)
+			So(user.ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+
+			_, ok = lc.Lookup("jdoe@CORP.EXAMPLE.COM")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Lookup should not find unknown users", func() {
+			user, ok := lc.Lookup("nobody")
+			So(ok, ShouldBeFalse)
+			So(user, ShouldBeNil)
+		})
+
+		Convey("Changing what Lookup returns should leave the cache alone", func() {
+			user, _ := lc.Lookup("jdoe")
+			user.ARNs[0] = "arn:aws:iam::123456789012:role/admin"
+			user.SSHKeys = nil
+
+			cached := lc.Users()["jdoe"]
+			So(cached.ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+			So(cached.SSHKeys, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestLDAPUserCacheUsersCopy(t *testing.T) {
+	Convey("Given an LDAP cache with one user", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+		searches := s.Searches
+
+		Convey("Mutating what Users() returns should not affect authentication", func() {
+			users := lc.Users()
+			users["testuser"].SSHKeys[0] = nil
+			users["testuser"].Username = "mallory"
+			delete(users, "testuser")
+			users["mallory"] = &server.User{Username: "mallory"}
+
+			challenge := randomBytes(64)
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			user, err := lc.Authenticate("testuser", challenge, sig)
+			So(err, ShouldBeNil)
+			So(user.Username, ShouldEqual, "testuser")
+			So(s.Searches, ShouldEqual, searches)
+			So(lc.Users(), ShouldNotContainKey, "mallory")
+		})
+	})
+}
+
+func TestLDAPUserCacheGroups(t *testing.T) {
+	Convey("Given an LDAP cache with role groups", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=alice", map[string][]string{
+					"cn": {"alice"}, "sshPublicKey": {key}, "memberOf": {"cn=developers", "cn=admins"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer"},
+				}),
+				fixtureEntry("cn=admins", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/admin", "arn:aws:iam::123456789012:role/developer"},
+				}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Groups() should match the fixture groups", func() {
+			So(lc.Groups(), ShouldResemble, map[string][]string{
+				"cn=developers": {"arn:aws:iam::123456789012:role/developer"},
+				"cn=admins":     {"arn:aws:iam::123456789012:role/admin", "arn:aws:iam::123456789012:role/developer"},
+			})
+		})
+
+		Convey("A role granted by two groups should be listed once, in first-seen order", func() {
+			So(lc.Users()["alice"].ARNs, ShouldResemble, []string{
+				"arn:aws:iam::123456789012:role/developer",
+				"arn:aws:iam::123456789012:role/admin",
+			})
+		})
+
+		Convey("Changing the returned map should not change the cache", func() {
+			groups := lc.Groups()
+			groups["cn=developers"][0] = "changed"
+			delete(groups, "cn=admins")
+			So(lc.Groups()["cn=developers"][0], ShouldEqual, "arn:aws:iam::123456789012:role/developer")
+			So(lc.Groups(), ShouldContainKey, "cn=admins")
+		})
+	})
+}
+
+func TestLDAPUserCacheMemberUidGroups(t *testing.T) {
+	Convey("Given a directory whose posixGroups list members by memberUid", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		developer := "arn:aws:iam::123456789012:role/developer"
+		admin := "arn:aws:iam::123456789012:role/admin"
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=alice", map[string][]string{"cn": {"alice"}, "sshPublicKey": {key}}),
+				fixtureEntry("cn=bob", map[string][]string{"cn": {"bob"}, "sshPublicKey": {key}}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {developer}, "memberUid": {"alice", "bob"},
+				}),
+				fixtureEntry("cn=admins", map[string][]string{
+					"businessCategory": {admin}, "memberUid": {"alice"},
+				}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			MemberUidGroups: true,
+		}
+
+		Convey("Users should be granted the roles of the groups listing them", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			users := lc.Users()
+			So(users["alice"].ARNs, ShouldResemble, []string{developer, admin})
+			So(users["bob"].ARNs, ShouldResemble, []string{developer})
+		})
+
+		Convey("Without the option memberUid should be ignored", func() {
+			opts.MemberUidGroups = false
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["alice"].ARNs, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestLDAPUserCacheNestedGroups(t *testing.T) {
+	Convey("Given a user in a group nested two levels deep in role groups", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		readOnly := "arn:aws:iam::123456789012:role/prod-ro"
+		admin := "arn:aws:iam::123456789012:role/prod-admin"
+		developer := "arn:aws:iam::123456789012:role/developer"
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=alice", map[string][]string{
+					"cn": {"alice"}, "sshPublicKey": {key}, "memberOf": {"cn=engineers", "cn=aws-prod-ro"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=engineers", map[string][]string{
+					"businessCategory": {developer}, "memberOf": {"cn=aws-prod-ro"},
+				}),
+				fixtureEntry("cn=aws-prod-ro", map[string][]string{
+					"businessCategory": {readOnly}, "memberOf": {"cn=aws-prod-admin"},
+				}),
+				fixtureEntry("cn=aws-prod-admin", map[string][]string{
+					"businessCategory": {admin}, "memberOf": {"cn=engineers"},
+				}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+		}
+
+		Convey("Without nesting only direct groups should count", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["alice"].ARNs, ShouldResemble, []string{developer, readOnly})
+		})
+
+		Convey("With a depth of one only the parents should be added", func() {
+			opts.GroupNestingDepth = 1
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["alice"].ARNs, ShouldResemble, []string{developer, readOnly, admin})
+		})
+
+		Convey("A cycle should neither loop nor duplicate roles", func() {
+			opts.GroupNestingDepth = 10
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["alice"].ARNs, ShouldResemble, []string{developer, readOnly, admin})
+			So(lc.Groups()["cn=aws-prod-admin"], ShouldResemble, []string{admin, developer, readOnly})
+		})
+	})
+}
+
+func TestLDAPUserCacheReconfigure(t *testing.T) {
+	Convey("Given an LDAP cache without LDAP roles and a user in a role group", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=developers"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer"},
+				}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:      "cn",
+			SSHAttr:       "sshPublicKey",
+			RoleAttribute: "businessCategory",
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+		So(err, ShouldBeNil)
+		So(lc.Users()["testuser"].ARNs, ShouldBeEmpty)
+
+		Convey("Enabling LDAP roles should give the user the group's ARNs", func() {
+			searches := s.Searches
+			opts.EnableLDAPRoles = true
+			So(lc.Reconfigure(opts), ShouldBeNil)
+			So(s.Searches-searches, ShouldEqual, 2)
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+
+			Convey("And disabling them again should take the ARNs away", func() {
+				searches := s.Searches
+				opts.EnableLDAPRoles = false
+				So(lc.Reconfigure(opts), ShouldBeNil)
+				So(s.Searches-searches, ShouldEqual, 1)
+				So(lc.Users()["testuser"].ARNs, ShouldBeEmpty)
+				So(lc.Groups(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("A reconfiguration whose refresh fails should change nothing", func() {
+			s.Err = errors.New("directory is down")
+			opts.EnableLDAPRoles = true
+			So(lc.Reconfigure(opts), ShouldNotBeNil)
+
+			s.Err = nil
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldBeEmpty)
+		})
+
+		Convey("Users should keep authenticating while the cache is reconfigured", func() {
+			done := make(chan bool)
+			go func() {
+				for i := 0; i < 20; i++ {
+					if !authenticatesWith(lc, signer) {
+						done <- false
+						return
+					}
+				}
+				done <- true
+			}()
+			for i := 0; i < 5; i++ {
+				opts.EnableLDAPRoles = !opts.EnableLDAPRoles
+				So(lc.Reconfigure(opts), ShouldBeNil)
+			}
+			So(<-done, ShouldBeTrue)
+		})
+	})
+}
+
+func TestLDAPUserCacheMalformedRequests(t *testing.T) {
+	Convey("Given an LDAP cache holding a user", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr: "cn",
+			SSHAttr:  "sshPublicKey",
+		})
+		So(err, ShouldBeNil)
+		searches := s.Searches
+
+		Convey("An empty challenge should be rejected without a refresh", func() {
+			sig, err := signer.Sign(cryptrand.Reader, []byte{})
+			So(err, ShouldBeNil)
+
+			user, err := lc.Authenticate("testuser", []byte{}, sig)
+			So(user, ShouldBeNil)
+			So(err, ShouldEqual, server.ErrMalformedRequest)
+			So(s.Searches, ShouldEqual, searches)
+		})
+
+		Convey("A nil signature should be rejected without a refresh", func() {
+			user, err := lc.Authenticate("testuser", randomBytes(64), nil)
+			So(user, ShouldBeNil)
+			So(err, ShouldEqual, server.ErrMalformedRequest)
+			So(s.Searches, ShouldEqual, searches)
+		})
+
+		Convey("A signature in an unknown format should be rejected", func() {
+			challenge := randomBytes(64)
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			sig.Format = "ssh-unknown"
+
+			user, err := lc.Authenticate("testuser", challenge, sig)
+			So(user, ShouldBeNil)
+			So(err, ShouldEqual, server.ErrMalformedRequest)
+		})
+
+		Convey("A well-formed request should still authenticate", func() {
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+		})
+	})
+}
+
+func TestLDAPUserCacheMixedKeyEncodings(t *testing.T) {
+	Convey("Given a user with one wire-format key and one authorized_keys line", t, func() {
+		wireSigner, wireKey := newECDSASigner(elliptic.P256())
+		lineSigner, _ := newECDSASigner(elliptic.P384())
+		line := `from="10.0.0.0/8" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(lineSigner.PublicKey()))) + " user@laptop"
+
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn":           {"testuser"},
+					"sshPublicKey": {wireKey, line, "not a key"},
+				}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr: "cn",
+			SSHAttr:  "sshPublicKey",
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Both keys should load and the garbage value should be skipped", func() {
+			So(lc.Users()["testuser"].SSHKeys, ShouldHaveLength, 2)
+			So(authenticatesWith(lc, wireSigner), ShouldBeTrue)
+			So(authenticatesWith(lc, lineSigner), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a user whose base64 key is followed by a comment", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn":           {"testuser"},
+					"sshPublicKey": {key + " user@host", "bm90IGEga2V5 user@host"},
+				}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr: "cn",
+			SSHAttr:  "sshPublicKey",
+		})
+		So(err, ShouldBeNil)
+
+		Convey("The key should load without its comment", func() {
+			So(lc.Users()["testuser"].SSHKeys, ShouldHaveLength, 1)
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+		})
+	})
+}
+
+func TestLDAPUserCacheContentHash(t *testing.T) {
+	Convey("Given an LDAP cache holding two users", t, func() {
+		_, aliceKey := newECDSASigner(elliptic.P256())
+		_, bobKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=alice", map[string][]string{"cn": {"alice"}, "sshPublicKey": {aliceKey}}),
+				fixtureEntry("cn=bob", map[string][]string{"cn": {"bob"}, "sshPublicKey": {bobKey}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr: "cn",
+			SSHAttr:  "sshPublicKey",
+		})
+		So(err, ShouldBeNil)
+		hash := lc.ContentHash()
+		So(hash, ShouldNotBeEmpty)
+
+		Convey("The hash should not change when the same data is reloaded", func() {
+			So(lc.Update(), ShouldBeNil)
+			So(lc.ContentHash(), ShouldEqual, hash)
+		})
+
+		Convey("The hash should not depend on the order entries arrive in", func() {
+			s.Users[0], s.Users[1] = s.Users[1], s.Users[0]
+			So(lc.Update(), ShouldBeNil)
+			So(lc.ContentHash(), ShouldEqual, hash)
+		})
+
+		Convey("The hash should change when a key changes", func() {
+			_, newKey := newECDSASigner(elliptic.P256())
+			s.Users[1] = fixtureEntry("cn=bob", map[string][]string{"cn": {"bob"}, "sshPublicKey": {newKey}})
+			So(lc.Update(), ShouldBeNil)
+			So(lc.ContentHash(), ShouldNotEqual, hash)
+		})
+	})
+}
+
+func TestLDAPUserCacheDryRunUpdate(t *testing.T) {
+	Convey("Given an LDAP cache without LDAP roles", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=developers"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer"},
+				}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:      "cn",
+			SSHAttr:       "sshPublicKey",
+			RoleAttribute: "businessCategory",
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+		So(err, ShouldBeNil)
+		hash := lc.ContentHash()
+
+		Convey("A dry run with LDAP roles should preview the users' ARNs", func() {
+			opts.EnableLDAPRoles = true
+			users, err := lc.DryRunUpdate(opts)
+			So(err, ShouldBeNil)
+			So(users, ShouldHaveLength, 1)
+			So(users[0].ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+
+			Convey("And leave the live cache untouched", func() {
+				So(lc.Users()["testuser"].ARNs, ShouldBeEmpty)
+				So(lc.Groups(), ShouldBeEmpty)
+				So(lc.ContentHash(), ShouldEqual, hash)
+			})
+		})
+
+		Convey("A failing dry run should return the error", func() {
+			s.Err = errors.New("directory is down")
+			_, err := lc.DryRunUpdate(opts)
+			So(err, ShouldNotBeNil)
+			So(lc.Users(), ShouldContainKey, "testuser")
+		})
+	})
+}
+
+func TestLDAPUserCacheRemovedKeyGrace(t *testing.T) {
+	Convey("Given an LDAP cache with a one hour grace window for removed keys", t, func() {
+		oldSigner, oldKey := newECDSASigner(elliptic.P256())
+		_, newKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {oldKey}}),
+			},
+		}
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			RemovedKeyGrace: time.Hour,
+			Clock:           clock,
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When the user's key is replaced", func() {
+			s.Users[0] = fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {newKey}})
+			So(lc.Update(), ShouldBeNil)
+
+			Convey("The removed key should still work within the window", func() {
+				clock.Advance(59 * time.Minute)
+				So(authenticatesWith(lc, oldSigner), ShouldBeTrue)
+			})
+
+			Convey("The removed key should stop working after the window", func() {
+				clock.Advance(61 * time.Minute)
+				So(authenticatesWith(lc, oldSigner), ShouldBeFalse)
+			})
+
+			Convey("The removed key should be dropped by later updates once the window is over", func() {
+				clock.Advance(2 * time.Hour)
+				So(lc.Update(), ShouldBeNil)
+				clock.now = clock.now.Add(-2 * time.Hour)
+				So(authenticatesWith(lc, oldSigner), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the user is removed entirely, their key should still work within the window", func() {
+			s.Users = nil
+			So(lc.Update(), ShouldBeNil)
+			clock.Advance(30 * time.Minute)
+			So(authenticatesWith(lc, oldSigner), ShouldBeTrue)
+		})
+	})
+}
+
+func TestLDAPUserCacheAllowedHours(t *testing.T) {
+	Convey("Given users restricted to office hours in different timezones", t, func() {
+		nySigner, nyKey := newECDSASigner(elliptic.P256())
+		tokyoSigner, tokyoKey := newECDSASigner(elliptic.P256())
+		nightSigner, nightKey := newECDSASigner(elliptic.P256())
+		freeSigner, freeKey := newECDSASigner(elliptic.P256())
+		brokenSigner, brokenKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=ny", map[string][]string{
+					"cn": {"ny"}, "sshPublicKey": {nyKey}, "allowedHours": {"09:00-17:00"}, "timezone": {"America/New_York"},
+				}),
+				fixtureEntry("cn=tokyo", map[string][]string{
+					"cn": {"tokyo"}, "sshPublicKey": {tokyoKey}, "allowedHours": {"09:00-17:00"}, "timezone": {"Asia/Tokyo"},
+				}),
+				fixtureEntry("cn=night", map[string][]string{
+					"cn": {"night"}, "sshPublicKey": {nightKey}, "allowedHours": {"22-06"},
+				}),
+				fixtureEntry("cn=free", map[string][]string{"cn": {"free"}, "sshPublicKey": {freeKey}}),
+				fixtureEntry("cn=broken", map[string][]string{
+					"cn": {"broken"}, "sshPublicKey": {brokenKey}, "allowedHours": {"whenever"},
+				}),
+			},
+		}
+		// 15:00 UTC is 10:00 in New York, midnight in Tokyo.
+		clock := &fakeClock{now: time.Date(2016, 1, 4, 15, 0, 0, 0, time.UTC)}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:         "cn",
+			SSHAttr:          "sshPublicKey",
+			AllowedHoursAttr: "allowedHours",
+			TimezoneAttr:     "timezone",
+			Clock:            clock,
+		})
+		So(err, ShouldBeNil)
+
+		authenticate := func(signer ssh.Signer) error {
+			challenge := randomBytes(64)
+			sig, err := signer.Sign(cryptrand.Reader, challenge)
+			So(err, ShouldBeNil)
+			_, err = lc.Authenticate("", challenge, sig)
+			return err
+		}
+
+		Convey("A user inside their window should authenticate", func() {
+			So(authenticate(nySigner), ShouldBeNil)
+			So(authenticatesWith(lc, nySigner), ShouldBeTrue)
+		})
+
+		Convey("A user outside their window should be refused", func() {
+			So(authenticate(tokyoSigner), ShouldEqual, server.ErrOutsideAllowedHours)
+			So(authenticate(nightSigner), ShouldEqual, server.ErrOutsideAllowedHours)
+		})
+
+		Convey("Windows should follow the clock across timezones and midnight", func() {
+			// 02:00 UTC is 21:00 in New York and 11:00 in Tokyo.
+			clock.now = time.Date(2016, 1, 5, 2, 0, 0, 0, time.UTC)
+			So(authenticate(nySigner), ShouldEqual, server.ErrOutsideAllowedHours)
+			So(authenticate(tokyoSigner), ShouldBeNil)
+			So(authenticate(nightSigner), ShouldBeNil)
+		})
+
+		Convey("A user without the attribute should be unrestricted", func() {
+			So(authenticate(freeSigner), ShouldBeNil)
+		})
+
+		Convey("A user whose window cannot be read should be locked out", func() {
+			So(authenticate(brokenSigner), ShouldEqual, server.ErrOutsideAllowedHours)
+		})
+	})
+}
+
+func TestLDAPUserCacheDecodeBinaryAttributes(t *testing.T) {
+	Convey("Given a directory that returns binary-tagged usernames and keys", t, func() {
+		adSigner, adKey := newECDSASigner(elliptic.P256())
+		rawSigner, _ := newECDSASigner(elliptic.P256())
+
+		// "aduser" in UTF-16LE, as Active Directory writes it.
+		utf16Name := ""
+		for _, c := range "aduser" {
+			utf16Name += string([]byte{byte(c), 0})
+		}
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=aduser", map[string][]string{
+					"cn;binary": {utf16Name}, "sshPublicKey": {adKey},
+				}),
+				fixtureEntry("cn=rawuser", map[string][]string{
+					"cn;binary": {"rawuser\x00"}, "sshPublicKey;binary": {string(rawSigner.PublicKey().Marshal())},
+				}),
+			},
+		}
+		opts := server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"}
+
+		Convey("Without decoding the users are missed", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "aduser")
+			So(lc.Users(), ShouldNotContainKey, "rawuser")
+		})
+
+		Convey("With decoding the users are loaded under their text names", func() {
+			opts.DecodeBinaryAttributes = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "aduser")
+			So(lc.Users(), ShouldContainKey, "rawuser")
+			So(authenticatesWith(lc, adSigner), ShouldBeTrue)
+			So(authenticatesWith(lc, rawSigner), ShouldBeTrue)
+		})
+	})
+}
+
+func TestLDAPUserCacheGroupRefreshInterval(t *testing.T) {
+	Convey("Given an LDAP cache that refreshes groups hourly", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=developers"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer"},
+				}),
+			},
+		}
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:             "cn",
+			SSHAttr:              "sshPublicKey",
+			EnableLDAPRoles:      true,
+			RoleAttribute:        "businessCategory",
+			GroupRefreshInterval: time.Hour,
+			Clock:                clock,
+		})
+		So(err, ShouldBeNil)
+		So(s.Searches, ShouldEqual, 2)
+
+		Convey("A refresh within the hour should only search for users", func() {
+			clock.Advance(30 * time.Minute)
+			So(lc.Update(), ShouldBeNil)
+			So(s.Searches, ShouldEqual, 3)
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+		})
+
+		Convey("A refresh after the hour should search for groups again", func() {
+			s.Groups[0] = fixtureEntry("cn=developers", map[string][]string{
+				"businessCategory": {"arn:aws:iam::123456789012:role/senior"},
+			})
+			clock.Advance(time.Hour)
+			So(lc.Update(), ShouldBeNil)
+			So(s.Searches, ShouldEqual, 4)
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/senior"})
+		})
+	})
+}
+
+func TestLDAPUserCacheKeyTypeCounters(t *testing.T) {
+	Convey("Given an LDAP cache holding an ECDSA key and an RSA key", t, func() {
+		ecdsaSigner, ecdsaKey := newECDSASigner(elliptic.P256())
+		rsaSigner, err := ssh.ParsePrivateKey(testKey)
+		So(err, ShouldBeNil)
+		rsaKey := base64.StdEncoding.EncodeToString(rsaSigner.PublicKey().Marshal())
+
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {ecdsaKey, rsaKey}}),
+			},
+		}
+		stats := newRecordingStatter()
+		lc, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		Convey("Each successful authentication should be counted under its key type", func() {
+			So(authenticatesWith(lc, ecdsaSigner), ShouldBeTrue)
+			So(authenticatesWith(lc, ecdsaSigner), ShouldBeTrue)
+			So(authenticatesWith(lc, rsaSigner), ShouldBeTrue)
+
+			So(stats.Count("authByKeyType.ecdsa-sha2-nistp256"), ShouldEqual, 2)
+			So(stats.Count("authByKeyType.ssh-rsa"), ShouldEqual, 1)
+		})
+
+		Convey("Failed authentications should not be counted", func() {
+			stranger, _ := newECDSASigner(elliptic.P256())
+			So(authenticatesWith(lc, stranger), ShouldBeFalse)
+			So(stats.Count("authByKeyType.ecdsa-sha2-nistp256"), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestLDAPUserCacheAllowedAccounts(t *testing.T) {
+	Convey("Given a user whose groups grant roles in two AWS accounts", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=developers", "cn=contractors"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer"},
+				}),
+				fixtureEntry("cn=contractors", map[string][]string{
+					"businessCategory": {"arn:aws:iam::999999999999:role/contractor"},
+				}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			AllowedAccounts: []string{"123456789012"},
+		}
+
+		Convey("Roles in other accounts should be dropped", func() {
+			stats := newRecordingStatter()
+			lc, err := server.NewLDAPUserCacheWithOptions(s, stats, opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{"arn:aws:iam::123456789012:role/developer"})
+			So(stats.Count("foreignAccountARN"), ShouldEqual, 1)
+		})
+
+		Convey("In strict mode the user should not be loaded at all", func() {
+			opts.StrictAccounts = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "testuser")
+		})
+
+		Convey("Without an allowlist every account should be kept", func() {
+			opts.AllowedAccounts = nil
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldHaveLength, 2)
+		})
+	})
+}
+
+func TestLDAPUserCacheDedupeARNs(t *testing.T) {
+	Convey("Given a user in two groups granting the same role in different case", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=developers", "cn=oncall"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/Developer"},
+				}),
+				fixtureEntry("cn=oncall", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer", "arn:aws:iam::123456789012:role/oncall"},
+				}),
+			},
+		}
+		opts := server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+		}
+
+		Convey("With deduplication the copies should collapse to the first one seen", func() {
+			opts.DedupeARNsIgnoringCase = true
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldResemble, []string{
+				"arn:aws:iam::123456789012:role/Developer",
+				"arn:aws:iam::123456789012:role/oncall",
+			})
+		})
+
+		Convey("Without deduplication both copies should be kept", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+			So(lc.Users()["testuser"].ARNs, ShouldHaveLength, 3)
+		})
+	})
+}
+
+func TestLDAPUserCacheARNRewriter(t *testing.T) {
+	Convey("Given a directory holding commercial ARNs and a rewriter to the gov partition", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{
+					"cn": {"testuser"}, "sshPublicKey": {key}, "memberOf": {"cn=developers"},
+				}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{
+					"businessCategory": {"arn:aws:iam::123456789012:role/developer", "!arn:aws:iam::123456789012:role/admin"},
+				}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr:        "cn",
+			SSHAttr:         "sshPublicKey",
+			EnableLDAPRoles: true,
+			RoleAttribute:   "businessCategory",
+			DefaultRole:     "arn:aws:iam::123456789012:role/developer",
+			ARNRewriter: func(arn string) string {
+				return strings.Replace(arn, "arn:aws:", "arn:aws-us-gov:", 1)
+			},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("The stored ARNs should be in the gov partition", func() {
+			user := lc.Users()["testuser"]
+			So(user.ARNs, ShouldResemble, []string{
+				"arn:aws-us-gov:iam::123456789012:role/developer",
+				"!arn:aws-us-gov:iam::123456789012:role/admin",
+			})
+			So(user.DefaultRole, ShouldEqual, "arn:aws-us-gov:iam::123456789012:role/developer")
+		})
+
+		Convey("Roles should be authorized by their rewritten ARNs", func() {
+			So(authenticatesWith(lc, signer), ShouldBeTrue)
+			user, ok := lc.Lookup("testuser")
+			So(ok, ShouldBeTrue)
+			So(lc.AuthorizeRole(user, "arn:aws-us-gov:iam::123456789012:role/developer"), ShouldBeNil)
+			So(lc.AuthorizeRole(user, "arn:aws-us-gov:iam::123456789012:role/admin"), ShouldEqual, server.ErrRoleNotAuthorized)
+		})
+
+		Convey("A credential service in the gov partition should assume the rewritten roles", func() {
+			service := server.NewDirectSessionTokenService("123456789012", &countingSTS{clock: &fakeClock{now: time.Now()}}, nil)
+			service.UsePartition("aws-us-gov")
+			service.AuthorizeRolesWith(lc)
+			user, _ := lc.Lookup("testuser")
+
+			creds, err := service.AssumeRole(user, "developer", true)
+			So(err, ShouldBeNil)
+			So(*creds.AccessKeyId, ShouldStartWith, "arn:aws-us-gov:iam::123456789012:role/developer/")
+
+			creds, err = service.AssumeRole(user, "arn:aws-us-gov:iam::123456789012:role/developer", true)
+			So(err, ShouldBeNil)
+			So(*creds.AccessKeyId, ShouldStartWith, "arn:aws-us-gov:iam::123456789012:role/developer/")
+
+			_, err = service.AssumeRole(user, "admin", true)
+			So(err, ShouldHaveSameTypeAs, &server.RoleNotPermittedError{})
+		})
+	})
+}
+
+func TestLDAPUserCacheEmptyResult(t *testing.T) {
+	Convey("Given an LDAP cache holding a user", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		stats := newRecordingStatter()
+		lc, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+		So(stats.Count("ldapCacheEmpty"), ShouldEqual, 0)
+
+		Convey("A refresh that finds nobody should raise the empty cache event", func() {
+			s.Users = nil
+			So(lc.Update(), ShouldBeNil)
+			So(lc.Users(), ShouldBeEmpty)
+			So(stats.Count("ldapCacheEmpty"), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestLDAPUserCacheDuplicateUsers(t *testing.T) {
+	Convey("Given two entries with the same username", t, func() {
+		personSigner, personKey := newECDSASigner(elliptic.P256())
+		shadowSigner, shadowKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser,ou=people", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {personKey}}),
+				fixtureEntry("cn=testuser,ou=disabled", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {shadowKey}}),
+			},
+		}
+		cacheWith := func(policy string) (server.UserCache, error) {
+			return server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+				UserAttr:            "cn",
+				SSHAttr:             "sshPublicKey",
+				DuplicateUserPolicy: policy,
+			})
+		}
+
+		Convey("By default the last entry should win", func() {
+			lc, err := cacheWith("")
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, personSigner), ShouldBeFalse)
+			So(authenticatesWith(lc, shadowSigner), ShouldBeTrue)
+		})
+
+		Convey("lastWins should keep the last entry", func() {
+			lc, err := cacheWith(server.DuplicateLastWins)
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, personSigner), ShouldBeFalse)
+			So(authenticatesWith(lc, shadowSigner), ShouldBeTrue)
+		})
+
+		Convey("firstWins should keep the first entry", func() {
+			lc, err := cacheWith(server.DuplicateFirstWins)
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, personSigner), ShouldBeTrue)
+			So(authenticatesWith(lc, shadowSigner), ShouldBeFalse)
+		})
+
+		Convey("union should keep the keys of both", func() {
+			lc, err := cacheWith(server.DuplicateUnion)
+			So(err, ShouldBeNil)
+			So(authenticatesWith(lc, personSigner), ShouldBeTrue)
+			So(authenticatesWith(lc, shadowSigner), ShouldBeTrue)
+		})
+
+		Convey("error should fail the update", func() {
+			_, err := cacheWith(server.DuplicateError)
+			So(err, ShouldEqual, server.ErrDuplicateUser)
+		})
+	})
+}
+
+func TestLDAPUserCacheDefaultRoleAttrIsUserAttr(t *testing.T) {
+	Convey("Given a configuration whose default role attribute is the user attribute", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		opts := server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey", DefaultRoleAttr: "CN"}
+
+		Convey("Construction should fail without searching the directory", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldEqual, server.ErrDefaultRoleAttrIsUserAttr)
+			So(lc, ShouldBeNil)
+			So(s.Searches, ShouldEqual, 0)
+		})
+
+		Convey("Reconfiguring into it should fail and change nothing", func() {
+			opts.DefaultRoleAttr = "defaultRole"
+			lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), opts)
+			So(err, ShouldBeNil)
+
+			opts.DefaultRoleAttr = "cn"
+			So(lc.Reconfigure(opts), ShouldEqual, server.ErrDefaultRoleAttrIsUserAttr)
+			So(lc.Users()["testuser"].DefaultRole, ShouldEqual, "")
+		})
+	})
+}
+
+func TestLDAPUserCacheConcurrentUpdates(t *testing.T) {
+	Convey("Given an LDAP cache being refreshed while users authenticate", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		Convey("Every authentication should succeed and nothing should race", func() {
+			stop := make(chan struct{})
+			refreshed := make(chan struct{})
+			go func() {
+				defer close(refreshed)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						lc.Update()
+					}
+				}
+			}()
+
+			var wg sync.WaitGroup
+			failures := make(chan string, 8*50)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						if !authenticatesWith(lc, signer) {
+							failures <- "authentication failed"
+						}
+						lc.Users()
+						lc.ContentHash()
+					}
+				}()
+			}
+			wg.Wait()
+			close(stop)
+			<-refreshed
+			close(failures)
+
+			So(len(failures), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestLDAPUserCacheDropKeylessUsers(t *testing.T) {
+	Convey("Given a user whose keys all fail to parse", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=gooduser", map[string][]string{"cn": {"gooduser"}, "sshPublicKey": {key}}),
+				fixtureEntry("cn=keyless", map[string][]string{"cn": {"keyless"}, "sshPublicKey": {"not a key", "ssh-rsa garbage"}}),
+			},
+		}
+		stats := newRecordingStatter()
+
+		Convey("By default the user should be kept without keys", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldContainKey, "keyless")
+			So(lc.Users()["keyless"].SSHKeys, ShouldBeEmpty)
+			So(stats.Count("ldapKeylessUsersDropped"), ShouldEqual, 0)
+		})
+
+		Convey("With DropKeylessUsers the user should be left out and counted", func() {
+			lc, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{
+				UserAttr:         "cn",
+				SSHAttr:          "sshPublicKey",
+				DropKeylessUsers: true,
+			})
+			So(err, ShouldBeNil)
+			So(lc.Users(), ShouldNotContainKey, "keyless")
+			So(lc.Users(), ShouldContainKey, "gooduser")
+			So(stats.Count("ldapKeylessUsersDropped"), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestLDAPUserCacheStaleOnFailure(t *testing.T) {
+	Convey("Given an LDAP cache holding a user", t, func() {
+		signer, key := newECDSASigner(elliptic.P256())
+		stranger, _ := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {key}}),
+			},
+		}
+		stats := newRecordingStatter()
+		lc, err := server.NewLDAPUserCacheWithOptions(s, stats, server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		Convey("When LDAP goes away", func() {
+			s.Err = errors.New("directory is down")
+
+			Convey("A failed Update() should keep the cached users", func() {
+				So(lc.Update(), ShouldNotBeNil)
+				So(lc.Users(), ShouldContainKey, "testuser")
+			})
+
+			Convey("A cache miss should fail without an error and leave the cache usable", func() {
+				challenge := randomBytes(64)
+				sig, err := stranger.Sign(cryptrand.Reader, challenge)
+				So(err, ShouldBeNil)
+				user, err := lc.Authenticate("testuser", challenge, sig)
+				So(user, ShouldBeNil)
+				So(err, ShouldBeNil)
+				So(stats.Count("ldapCacheMissRefreshFailed"), ShouldEqual, 1)
+				So(authenticatesWith(lc, signer), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestLDAPUserCacheSizeGauges(t *testing.T) {
+	Convey("Given an LDAP cache with two users, three keys and a group", t, func() {
+		_, key := newECDSASigner(elliptic.P256())
+		_, otherKey := newECDSASigner(elliptic.P256())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=alice", map[string][]string{"cn": {"alice"}, "sshPublicKey": {key, otherKey}}),
+				fixtureEntry("cn=bob", map[string][]string{"cn": {"bob"}, "sshPublicKey": {key}}),
+			},
+			Groups: []*ldap.Entry{
+				fixtureEntry("cn=developers", map[string][]string{"businessCategory": {"arn:aws:iam::123456789012:role/developer"}}),
+			},
+		}
+		stats := newRecordingStatter()
+		lc, err := server.NewLDAPUserCacheWith(s, stats, server.WithLDAPRoles("businessCategory"))
+		So(err, ShouldBeNil)
+
+		Convey("The counts should be reported as gauges", func() {
+			So(stats.GaugeValue("ldapUserCount"), ShouldEqual, "2")
+			So(stats.GaugeValue("ldapKeyCount"), ShouldEqual, "3")
+			So(stats.GaugeValue("ldapGroupCount"), ShouldEqual, "1")
+		})
+
+		Convey("A refresh that loses users should lower the gauges", func() {
+			s.Users = s.Users[1:]
+			So(lc.Update(), ShouldBeNil)
+			So(stats.GaugeValue("ldapUserCount"), ShouldEqual, "1")
+			So(stats.GaugeValue("ldapKeyCount"), ShouldEqual, "1")
+		})
+	})
+}
+
+func TestLDAPUserCacheKeyFingerprints(t *testing.T) {
+	Convey("Given a user with two good keys and a bad one", t, func() {
+		first, firstKey := newECDSASigner(elliptic.P256())
+		second, secondKey := newECDSASigner(elliptic.P384())
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {firstKey, "AAAAbroken", secondKey}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{UserAttr: "cn", SSHAttr: "sshPublicKey"})
+		So(err, ShouldBeNil)
+
+		Convey("The fingerprints of the loaded keys should be recorded in order", func() {
+			user := lc.Users()["testuser"]
+			So(user.KeyFingerprints, ShouldResemble, []string{
+				server.FingerprintSHA256(first.PublicKey()),
+				server.FingerprintSHA256(second.PublicKey()),
+			})
+		})
+
+		Convey("Merging records should keep the fingerprints in step with the keys", func() {
+			other := &server.User{Username: "testuser", SSHKeys: []ssh.PublicKey{first.PublicKey()}}
+			merged := server.MergeUsers(other, lc.Users()["testuser"])
+			So(merged.KeyFingerprints, ShouldResemble, lc.Users()["testuser"].KeyFingerprints)
+		})
+	})
+}
@@ -0,0 +1,45 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+)
+
+/*
+Cases usernames can be normalized to, so that Jdoe in one backend and jdoe
+in another, or in an agent's request, are the same user. UsernameAsIs, the
+default, leaves them alone.
+*/
+const (
+	UsernameAsIs  = ""
+	UsernameLower = "lower"
+	UsernameUpper = "upper"
+)
+
+/*
+canonicalUsername puts username in usernameCase, one of the constants
+above. Unknown cases leave it as it is.
+*/
+func canonicalUsername(username string, usernameCase string) string {
+	switch usernameCase {
+	case UsernameLower:
+		return strings.ToLower(username)
+	case UsernameUpper:
+		return strings.ToUpper(username)
+	default:
+		return username
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+Verifier checks that sig is a signature of data by key. The caches send
+every signature check through one, so that checks can be delegated to
+an HSM or a KMS that attests them instead of being done in process.
+*/
+type Verifier interface {
+	Verify(key ssh.PublicKey, data []byte, sig *ssh.Signature) error
+}
+
+/*
+SoftwareVerifier verifies signatures in process with the key itself. It
+is what the caches use unless told otherwise.
+*/
+type SoftwareVerifier struct{}
+
+func (SoftwareVerifier) Verify(key ssh.PublicKey, data []byte, sig *ssh.Signature) error {
+	return key.Verify(data, sig)
+}
+
+/*
+KeyTypeVerifier sends keys whose Type() is listed in ByType to that
+Verifier, and every other key to Default, or to a SoftwareVerifier when
+Default is nil. Certificates are listed under their certificate type.
+*/
+type KeyTypeVerifier struct {
+	Default Verifier
+	ByType  map[string]Verifier
+}
+
+func (ktv KeyTypeVerifier) Verify(key ssh.PublicKey, data []byte, sig *ssh.Signature) error {
+	if verifier, ok := ktv.ByType[key.Type()]; ok {
+		return verifier.Verify(key, data, sig)
+	}
+	if ktv.Default != nil {
+		return ktv.Default.Verify(key, data, sig)
+	}
+	return SoftwareVerifier{}.Verify(key, data, sig)
+}
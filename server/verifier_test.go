@@ -0,0 +1,86 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/hologram/server"
+	"github.com/nmcclain/ldap"
+	"github.com/peterbourgon/g2s"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+mockVerifier stands in for an HSM, recording the type of every key it
+is asked about and answering with err if set, or in software otherwise.
+*/
+type mockVerifier struct {
+	sync.Mutex
+	keyTypes []string
+	err      error
+}
+
+func (mv *mockVerifier) Verify(key ssh.PublicKey, data []byte, sig *ssh.Signature) error {
+	mv.Lock()
+	mv.keyTypes = append(mv.keyTypes, key.Type())
+	mv.Unlock()
+	if mv.err != nil {
+		return mv.err
+	}
+	return server.SoftwareVerifier{}.Verify(key, data, sig)
+}
+
+func TestLDAPUserCacheVerifier(t *testing.T) {
+	Convey("Given an LDAP cache sending P-384 keys to an HSM", t, func() {
+		p256, p256Key := newECDSASigner(elliptic.P256())
+		p384, p384Key := newECDSASigner(elliptic.P384())
+		hsm := &mockVerifier{}
+		s := &FixtureLDAPServer{
+			Users: []*ldap.Entry{
+				fixtureEntry("cn=testuser", map[string][]string{"cn": {"testuser"}, "sshPublicKey": {p256Key, p384Key}}),
+			},
+		}
+		lc, err := server.NewLDAPUserCacheWithOptions(s, g2s.Noop(), server.Options{
+			UserAttr: "cn",
+			SSHAttr:  "sshPublicKey",
+			Verifier: server.KeyTypeVerifier{
+				ByType: map[string]server.Verifier{"ecdsa-sha2-nistp384": hsm},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("A P-384 key should be verified by the HSM", func() {
+			So(authenticatesWith(lc, p384), ShouldBeTrue)
+			So(hsm.keyTypes, ShouldContain, "ecdsa-sha2-nistp384")
+			So(hsm.keyTypes, ShouldNotContain, "ecdsa-sha2-nistp256")
+		})
+
+		Convey("A P-256 key should be verified in software", func() {
+			So(authenticatesWith(lc, p256), ShouldBeTrue)
+			So(hsm.keyTypes, ShouldNotContain, "ecdsa-sha2-nistp256")
+		})
+
+		Convey("The HSM turning down a signature should fail the authentication", func() {
+			hsm.err = errors.New("attestation failed")
+			So(authenticatesWith(lc, p384), ShouldBeFalse)
+			So(hsm.keyTypes, ShouldNotBeEmpty)
+		})
+	})
+}
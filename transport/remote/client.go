@@ -27,6 +27,32 @@ New returns a TLS connection that, if not overriden, has various useful
 options set.
 */
 func NewClient(address string) (retClient protocol.MessageReadWriteCloser, err error) {
+	return NewClientWithTLS(address, nil)
+}
+
+/*
+NewClientWithTLS dials address with tlsConf, such as one from
+ClientTLSConfig, in place of the built-in certificate. A nil tlsConf
+behaves like NewClient.
+*/
+func NewClientWithTLS(address string, tlsConf *tls.Config) (retClient protocol.MessageReadWriteCloser, err error) {
+	if tlsConf == nil {
+		tlsConf, err = defaultClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	socket, err := tls.Dial("tcp", address, tlsConf)
+	if err != nil {
+		return
+	}
+
+	retClient = protocol.NewMessageConnection(socket)
+	return
+}
+
+func defaultClientTLSConfig() (*tls.Config, error) {
 	pool := x509.NewCertPool()
 	ca, err := Asset("self-signed-ca.cert")
 	if err != nil {
@@ -41,12 +67,5 @@ func NewClient(address string) (retClient protocol.MessageReadWriteCloser, err e
 		// ECDHE by default, we actually don't care about leaking keys or authenticating either end of the connection.
 		InsecureSkipVerify: true,
 	}
-
-	socket, err := tls.Dial("tcp", address, tlsConf)
-	if err != nil {
-		return
-	}
-
-	retClient = protocol.NewMessageConnection(socket)
-	return
+	return tlsConf, nil
 }
@@ -0,0 +1,86 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+/*
+Mutual TLS wraps the agent's connection before any Hologram message is
+exchanged: the TLS handshake, in which the server checks the agent's
+certificate and the agent checks the server's, completes first, and only
+then does the server send its SSH challenge over the encrypted channel.
+The two are independent; an agent needs both a certificate signed by the
+configured CA and a key the server knows.
+*/
+
+/*
+ServerTLSConfig builds a listener configuration that presents the server
+certificate in certFile and keyFile and only accepts clients whose
+certificates chain to the PEM bundle in caFile.
+*/
+func ServerTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+/*
+ClientTLSConfig builds a dialer configuration that presents the client
+certificate in certFile and keyFile and checks the server's certificate
+against the PEM bundle in caFile. serverName, if set, is the name the
+server's certificate must carry instead of the host dialled.
+*/
+func ClientTLSConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+	}, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 AdRoll, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/hologram/protocol"
+	"github.com/AdRoll/hologram/transport/remote"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+writeCert issues a certificate for name, signed by parent (or self-signed
+if parent is nil), and writes it and its key to dir.
+*/
+func writeCert(dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+
+	certFile := filepath.Join(dir, name+".cert")
+	keyFile := filepath.Join(dir, name+".key")
+	So(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), ShouldBeNil)
+	So(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), ShouldBeNil)
+	return cert, key, certFile, keyFile
+}
+
+func ping(client protocol.MessageReadWriteCloser) error {
+	pingReq := protocol.Ping_REQUEST
+	if err := client.Write(&protocol.Message{Ping: &protocol.Ping{Type: &pingReq}}); err != nil {
+		return err
+	}
+	_, err := client.Read()
+	return err
+}
+
+func TestMutualTLS(t *testing.T) {
+	Convey("Given a server requiring client certificates from a CA", t, func() {
+		dir, err := ioutil.TempDir("", "hologram-mtls")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		ca, caKey, caFile, _ := writeCert(dir, "ca", nil, nil)
+		_, _, serverCert, serverKey := writeCert(dir, "hologram.example.com", ca, caKey)
+		_, _, clientCert, clientKey := writeCert(dir, "agent", ca, caKey)
+
+		serverConf, err := remote.ServerTLSConfig(caFile, serverCert, serverKey)
+		So(err, ShouldBeNil)
+		tlsServer, err := remote.NewServerWithTLS("127.0.0.1:0", testHandler, serverConf)
+		So(err, ShouldBeNil)
+		Reset(func() {
+			tlsServer.Close()
+		})
+		address := tlsServer.Addr().String()
+
+		Convey("A client with a certificate from the CA should get a pong", func() {
+			clientConf, err := remote.ClientTLSConfig(caFile, clientCert, clientKey, "hologram.example.com")
+			So(err, ShouldBeNil)
+
+			client, err := remote.NewClientWithTLS(address, clientConf)
+			So(err, ShouldBeNil)
+			So(ping(client), ShouldBeNil)
+		})
+
+		Convey("A client with a certificate from another CA should be refused", func() {
+			otherCA, otherKey, _, _ := writeCert(dir, "other-ca", nil, nil)
+			_, _, strangerCert, strangerKey := writeCert(dir, "stranger", otherCA, otherKey)
+			clientConf, err := remote.ClientTLSConfig(caFile, strangerCert, strangerKey, "hologram.example.com")
+			So(err, ShouldBeNil)
+
+			client, err := remote.NewClientWithTLS(address, clientConf)
+			if err == nil {
+				err = ping(client)
+			}
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A client expecting another server name should refuse the server", func() {
+			clientConf, err := remote.ClientTLSConfig(caFile, clientCert, clientKey, "elsewhere.example.com")
+			So(err, ShouldBeNil)
+
+			_, err = remote.NewClientWithTLS(address, clientConf)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -19,13 +19,19 @@ package remote
 import (
 	"crypto/tls"
 	"net"
+	"time"
 
+	"github.com/AdRoll/hologram/log"
 	"github.com/AdRoll/hologram/protocol"
 )
 
+// How long a client has to complete the TLS handshake.
+const handshakeTimeout = 30 * time.Second
+
 type server struct {
 	s       net.Listener
 	handler protocol.ConnectionHandlerFunc
+	closed  chan struct{}
 }
 
 /*
@@ -36,18 +42,48 @@ func (us *server) listen() {
 	for {
 		conn, err := us.s.Accept()
 		if err != nil {
-			continue
+			select {
+			case <-us.closed:
+				return
+			default:
+				continue
+			}
 		}
 
-		smc := protocol.NewMessageConnection(conn)
-		go us.handler(smc)
+		go us.handle(conn)
+	}
+}
+
+/*
+handle completes the TLS handshake before passing the connection on, so
+that clients that cannot present an acceptable certificate never reach
+the handler.
+*/
+func (us *server) handle(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Warning("TLS handshake with %s failed: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
 	}
+	us.handler(protocol.NewMessageConnection(conn))
+}
+
+/*
+Addr returns the address the server is listening on.
+*/
+func (us *server) Addr() net.Addr {
+	return us.s.Addr()
 }
 
 /*
 Close closes the underlying SSL socket.
 */
 func (us *server) Close() error {
+	close(us.closed)
 	return us.s.Close()
 }
 
@@ -56,6 +92,38 @@ NewServer returns a server that listens on a TCP socket protected by
 TLS, and automatically starts that server.
 */
 func NewServer(address string, handler protocol.ConnectionHandlerFunc) (retServer *server, err error) {
+	return NewServerWithTLS(address, handler, nil)
+}
+
+/*
+NewServerWithTLS is like NewServer, but listens with serverTLSConf, such
+as one from ServerTLSConfig, in place of the built-in certificate. A nil
+serverTLSConf uses the built-in certificate.
+*/
+func NewServerWithTLS(address string, handler protocol.ConnectionHandlerFunc, serverTLSConf *tls.Config) (retServer *server, err error) {
+	if serverTLSConf == nil {
+		serverTLSConf, err = defaultServerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	socket, err := tls.Listen("tcp", address, serverTLSConf)
+	if err != nil {
+		return
+	}
+
+	retServer = &server{
+		s:       socket,
+		handler: handler,
+		closed:  make(chan struct{}),
+	}
+
+	go retServer.listen()
+	return
+}
+
+func defaultServerTLSConfig() (*tls.Config, error) {
 	cert, err := Asset("self-signed.cert")
 	if err != nil {
 		return nil, err
@@ -71,20 +139,7 @@ func NewServer(address string, handler protocol.ConnectionHandlerFunc) (retServe
 		return nil, err
 	}
 
-	serverTLSConf := &tls.Config{
+	return &tls.Config{
 		Certificates: []tls.Certificate{serverCert},
-	}
-
-	socket, err := tls.Listen("tcp", address, serverTLSConf)
-	if err != nil {
-		return
-	}
-
-	retServer = &server{
-		s:       socket,
-		handler: handler,
-	}
-
-	go retServer.listen()
-	return
+	}, nil
 }